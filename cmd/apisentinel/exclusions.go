@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/princetheprogrammer/apisentinel/internal/config"
+	"github.com/princetheprogrammer/apisentinel/internal/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// exclusionProposal is what the admin API suggests for a false positive.
+type exclusionProposal struct {
+	RequestID  string                   `json:"request_id" yaml:"-"`
+	Route      string                   `json:"route,omitempty" yaml:"-"`
+	Exclusions []config.ExclusionConfig `json:"exclusions" yaml:"exclusions"`
+}
+
+// ExclusionHandler proposes rule exclusions for a request the WAF flagged.
+// Nothing is applied: the operator reviews the proposal and adds it to the
+// config.
+//
+//	GET /exclusions?key=K&request_id=ID              proposal (JSON)
+//	GET /exclusions?key=K&request_id=ID&format=yaml  ready to paste under security
+func (g *Gateway) ExclusionHandler(w http.ResponseWriter, r *http.Request) {
+	if !g.blocklist.Authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	requestID := r.URL.Query().Get("request_id")
+	if requestID == "" {
+		http.Error(w, "Missing request_id", http.StatusBadRequest)
+		return
+	}
+
+	events, err := logger.Find(g.Config().Server.AuditLog, requestID)
+	if err != nil {
+		log.Printf("❌ Failed to read audit log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// The last WAF event: a request ID sent by the client may be reused.
+	var event *logger.AuditEvent
+	for i := range events {
+		if len(events[i].Matches) > 0 {
+			event = &events[i]
+		}
+	}
+	if event == nil {
+		http.Error(w, "No rule matches logged for this request", http.StatusNotFound)
+		return
+	}
+
+	route, _ := g.current.Load().proxy.Match(event.Path)
+	proposal := proposeExclusions(event, route)
+
+	if r.URL.Query().Get("format") == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+		yaml.NewEncoder(w).Encode(proposal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(proposal)
+}
+
+// arrayIndex matches the indexes in a JSON path.
+var arrayIndex = regexp.MustCompile(`\[\d+\]`)
+
+// proposeExclusions builds one exclusion per location the rules matched,
+// as narrow as the event allows: those rules, that field, that method, and
+// the route the request went to (or its exact path if it only matched "/").
+// Array indexes become wildcards, so the same field in the next item of
+// the array is covered too.
+func proposeExclusions(event *logger.AuditEvent, route string) exclusionProposal {
+	p := exclusionProposal{RequestID: event.RequestID, Route: route}
+
+	path := route
+	if path == "" || path == "/" {
+		path = event.Path
+	}
+
+	type location struct{ target, field string }
+	index := make(map[location]int)
+	for _, m := range event.Matches {
+		loc := location{m.Target, arrayIndex.ReplaceAllString(m.Field, "[*]")}
+		i, ok := index[loc]
+		if !ok {
+			i = len(p.Exclusions)
+			index[loc] = i
+			e := config.ExclusionConfig{Path: path, Target: loc.target, Field: loc.field}
+			if event.Method != "" {
+				e.Methods = []string{event.Method}
+			}
+			p.Exclusions = append(p.Exclusions, e)
+		}
+		if e := &p.Exclusions[i]; !slices.Contains(e.Rules, m.RuleID) {
+			e.Rules = append(e.Rules, m.RuleID)
+		}
+	}
+	return p
+}
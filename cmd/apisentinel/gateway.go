@@ -0,0 +1,553 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/princetheprogrammer/apisentinel/internal/config"
+	"github.com/princetheprogrammer/apisentinel/internal/middleware"
+	"github.com/princetheprogrammer/apisentinel/internal/proxy"
+	"github.com/princetheprogrammer/apisentinel/internal/testserver"
+)
+
+// Mock backends used when the config has no routes.
+const mockPort1, mockPort2 = "9000", "9001"
+
+var startMocks sync.Once
+
+// generation is one immutable build of the proxy pipeline from a single Config.
+// Requests hold a reference to the generation they started on, so a reload
+// never changes the rules in the middle of a request.
+type generation struct {
+	id      uint64
+	cfg     *config.Config
+	proxy   *proxy.MultiTargetProxy
+	handler http.Handler
+
+	// Rate limit per limiter key ("" is the shared global limiter).
+	limits map[string]middleware.RateLimit
+
+	mu       sync.Mutex
+	inflight int
+	retired  bool
+	drained  chan struct{}
+	stale    []*middleware.RateLimiter // Stopped once drained
+}
+
+// acquire registers an in-flight request. It fails once the generation is retired.
+func (g *generation) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return false
+	}
+	g.inflight++
+	return true
+}
+
+func (g *generation) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight--
+	if g.retired && g.inflight == 0 {
+		close(g.drained)
+	}
+}
+
+// retire stops new requests from joining, waits for in-flight ones to finish,
+// then stops the generation's health checkers.
+func (g *generation) retire() {
+	g.mu.Lock()
+	g.retired = true
+	if g.inflight == 0 {
+		close(g.drained)
+	}
+	g.mu.Unlock()
+
+	<-g.drained
+	g.proxy.Close()
+	for _, rl := range g.stale {
+		rl.Stop()
+	}
+	log.Printf("♻️  Generation %d drained and stopped", g.id)
+}
+
+// Gateway serves proxy traffic through the current generation and swaps in
+// a freshly built one whenever the configuration is reloaded.
+type Gateway struct {
+	configPath string
+	current    atomic.Pointer[generation]
+	nextID     uint64
+	reloadMu   sync.Mutex
+
+	// State that must survive reloads lives outside the generation.
+	blocklist *middleware.IPBlocklist
+	limiters  map[string]*middleware.RateLimiter // Keyed by route path ("" = global) or rate_limits rule
+	patches   *middleware.VirtualPatches
+	rateStore middleware.RateLimitStore // nil = each limiter in memory
+	failOpen  bool                      // When rateStore is unreachable
+
+	learnMu  sync.Mutex
+	learners map[string]*middleware.Learner // Keyed by route path, "" = unmatched paths
+}
+
+func NewGateway(configPath string, cfg *config.Config) (*Gateway, error) {
+	g := &Gateway{
+		configPath: configPath,
+		blocklist:  middleware.NewIPBlocklist(cfg.Server.AdminKey),
+		limiters:   make(map[string]*middleware.RateLimiter),
+		learners:   make(map[string]*middleware.Learner),
+	}
+
+	patches, err := middleware.LoadVirtualPatches(cfg.Server.VirtualPatches)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load virtual patches: %w", err)
+	}
+	g.patches = patches
+
+	if sc := cfg.Server.RateLimitStore; sc.Type == "redis" {
+		store := &middleware.RedisStore{
+			Address:    sc.Address,
+			Password:   sc.Password,
+			DB:         sc.DB,
+			Prefix:     sc.Prefix,
+			Timeout:    sc.Timeout,
+			RetryEvery: sc.RetryEvery,
+		}
+		// Not fatal: the store logs the failure, and the limiters fail open
+		// or closed until it's reachable.
+		if store.Ping() == nil {
+			log.Printf("🗄️ Rate limits shared through Redis at %s", sc.Address)
+		}
+		g.rateStore, g.failOpen = store, sc.FailOpen
+	}
+
+	gen, err := g.build(cfg)
+	if err != nil {
+		return nil, err
+	}
+	g.current.Store(gen)
+
+	return g, nil
+}
+
+// Config returns the configuration of the live generation.
+func (g *Gateway) Config() *config.Config {
+	return g.current.Load().cfg
+}
+
+// Reload re-reads the config file and atomically swaps in a new generation.
+// If the file is invalid the current generation stays live.
+func (g *Gateway) Reload() {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	cfg, err := config.LoadConfig(g.configPath)
+	if err != nil {
+		log.Printf("❌ Config reload rejected (%s): %v. Keeping current config.", g.configPath, err)
+		return
+	}
+
+	gen, err := g.build(cfg)
+	if err != nil {
+		log.Printf("❌ Config reload rejected: %v. Keeping current config.", err)
+		return
+	}
+
+	old := g.current.Load()
+	if cfg.Server.Port != old.cfg.Server.Port || cfg.Server.AuditLog != old.cfg.Server.AuditLog ||
+		cfg.Server.VirtualPatches != old.cfg.Server.VirtualPatches || cfg.Server.RateLimitStore != old.cfg.Server.RateLimitStore {
+		log.Println("⚠️ Changes to server.port, server.audit_log, server.virtual_patches and server.rate_limit_store require a restart.")
+	}
+
+	// Apply the new limits. Limiters no longer referenced are stopped once
+	// the old generation drains, so a fresh one is created if the route returns.
+	for key, rl := range g.limiters {
+		if limit, ok := gen.limits[key]; ok {
+			rl.SetLimit(limit)
+			continue
+		}
+		old.stale = append(old.stale, rl)
+		delete(g.limiters, key)
+	}
+	g.blocklist.SetAdminKey(cfg.Server.AdminKey)
+
+	g.current.Store(gen)
+	log.Printf("🔄 Config reloaded: generation %d is live", gen.id)
+
+	go old.retire()
+}
+
+// Close retires the live generation, waiting for in-flight requests, and
+// saves the virtual patches' hit counts.
+func (g *Gateway) Close() {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+	g.current.Load().retire()
+	if rs, ok := g.rateStore.(*middleware.RedisStore); ok {
+		rs.Close()
+	}
+	if len(g.patches.List()) == 0 {
+		return // Every change is saved already, and there are no hits to keep
+	}
+	if err := g.patches.Save(); err != nil {
+		log.Printf("❌ Failed to save virtual patches: %v", err)
+	}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// A request can race a reload and load a generation that was just retired;
+	// in that case simply pick up the new one.
+	gen := g.current.Load()
+	for !gen.acquire() {
+		gen = g.current.Load()
+	}
+	defer gen.release()
+
+	gen.handler.ServeHTTP(w, r)
+}
+
+// build creates a new generation: routes, load balancers and the per-route middleware chains.
+func (g *Gateway) build(cfg *config.Config) (*generation, error) {
+	routes := cfg.Routes
+	if len(routes) == 0 {
+		log.Println("📦 No routes in config. Using mock backends.")
+		startMocks.Do(func() {
+			go testserver.StartTestServer(mockPort1)
+			go testserver.StartTestServer(mockPort2)
+		})
+		routes = []config.RouteConfig{
+			{Path: "/", Target: "http://localhost:" + mockPort1},
+			{Path: "/api/v2", Target: "http://localhost:" + mockPort2},
+		}
+	}
+
+	mtProxy := proxy.NewMultiTargetProxy()
+	for _, r := range routes {
+		targets := r.Targets
+		if len(targets) == 0 && r.Target != "" {
+			targets = []string{r.Target}
+		}
+
+		log.Printf("🛣️  Adding route: %s -> %v", r.Path, targets)
+		if err := mtProxy.AddRoute(r.Path, targets); err != nil {
+			mtProxy.Close()
+			return nil, fmt.Errorf("failed to add route %s: %w", r.Path, err)
+		}
+	}
+
+	// WAF rules: built-ins plus rule files, re-read on every reload.
+	rules, err := middleware.LoadRuleSet(cfg.Security.RuleFiles)
+	if err != nil {
+		mtProxy.Close()
+		return nil, fmt.Errorf("failed to load WAF rules: %w", err)
+	}
+	if err := checkExclusions(cfg, routes, rules); err != nil {
+		mtProxy.Close()
+		return nil, err
+	}
+
+	// OpenAPI specs, also re-read on every reload.
+	specs, err := loadOpenAPISpecs(cfg, routes)
+	if err != nil {
+		mtProxy.Close()
+		return nil, fmt.Errorf("failed to load OpenAPI spec: %w", err)
+	}
+
+	// Each route gets its own chain built from its resolved policy.
+	// Unmatched paths use the global policy (and end in the proxy's 404).
+	limits := make(map[string]middleware.RateLimit)
+	chains := make(map[string]http.Handler, len(routes))
+	for _, r := range routes {
+		if chains[r.Path], err = g.routeChain(mtProxy, cfg, r, rules, specs, limits); err != nil {
+			mtProxy.Close()
+			return nil, err
+		}
+	}
+	fallback, err := g.routeChain(mtProxy, cfg, config.RouteConfig{}, rules, specs, limits)
+	if err != nil {
+		mtProxy.Close()
+		return nil, err
+	}
+
+	dispatch := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if prefix, ok := mtProxy.Match(r.URL.Path); ok {
+			chains[prefix].ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+
+	// Global middlewares run for every request before route resolution.
+	handler := middleware.Chain(dispatch,
+		middleware.Tracing,
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				middleware.IncrementTotal()
+				next.ServeHTTP(w, r)
+			})
+		},
+		g.blocklist.Middleware,
+	)
+
+	g.nextID++
+	return &generation{
+		id:      g.nextID,
+		cfg:     cfg,
+		proxy:   mtProxy,
+		handler: handler,
+		limits:  limits,
+		drained: make(chan struct{}),
+	}, nil
+}
+
+// routeChain builds the middleware chain for one route from its policy.
+func (g *Gateway) routeChain(next http.Handler, cfg *config.Config, route config.RouteConfig, rules []*middleware.Rule, specs map[string]*middleware.OpenAPISpec, limits map[string]middleware.RateLimit) (http.Handler, error) {
+	policy := cfg.Policy(route)
+
+	mws := []middleware.Middleware{
+		middleware.MethodFilter(policy.AllowedMethods),
+		middleware.BodyLimit(policy.MaxBodySize),
+		middleware.NewJSONGuard(jsonLimits(policy.JSONLimits), policy.Mode).Middleware,
+	}
+
+	if spec := specs[policy.OpenAPI.Spec]; spec != nil {
+		mws = append(mws, middleware.NewSchemaEnforcer(spec, middleware.SchemaOptions{
+			BasePath:             policy.OpenAPI.BasePath,
+			Mode:                 policy.Mode,
+			ValidateResponses:    policy.OpenAPI.ValidateResponses,
+			AllowUndeclaredQuery: policy.OpenAPI.AllowUndeclaredQuery,
+		}).Middleware)
+	}
+
+	mws = append(mws, middleware.NewUploadGuard(uploadPolicy(policy.Uploads)).Middleware)
+
+	if policy.EnableDLP {
+		mws = append(mws, middleware.NewDLPMiddleware(policy.DLPAction).Middleware)
+	}
+
+	inspector := middleware.NewSecurityInspector(middleware.InspectorOptions{
+		Rules: rules,
+		Categories: map[string]bool{
+			"xss":                 policy.EnableXSS,
+			"sqli":                policy.EnableSQLi,
+			"nosqli":              policy.EnableNoSQLi,
+			"prototype_pollution": policy.EnableProto,
+			"lfi":                 policy.EnableLFI,
+			"cmdi":                policy.EnableCmdi,
+			"ssrf":                policy.EnableSSRF,
+			"ssti":                policy.EnableSSTI,
+			"jndi":                policy.EnableJNDI,
+		},
+		Mode:             policy.Mode,
+		AnomalyThreshold: policy.Threshold,
+		ParanoiaLevel:    policy.Paranoia,
+		Targets:          policy.InspectTargets,
+		ExcludeHeaders:   policy.ExcludeHeaders,
+		ExcludeCookies:   policy.ExcludeCookies,
+		GraphQL:          graphqlLimits(policy.GraphQL),
+		InspectBodySize:  policy.InspectBody,
+		MaxInspectSize:   policy.MaxInspect,
+		Exclusions:       exclusions(policy.Exclusions),
+		Patches:          g.patches,
+	})
+	// The per-IP limit, then the global rate_limits and the route's own.
+	limiters := []*middleware.RateLimiter{g.limiterFor(route, middleware.RateLimit{
+		Rate:   policy.RateLimit,
+		Burst:  policy.RateBurst,
+		Period: policy.RatePeriod,
+	}, limits)}
+	rateRules := cfg.Server.RateLimits
+	if route.Security != nil {
+		rateRules = append(slices.Clip(rateRules), route.Security.RateLimits...)
+	}
+	for i, rule := range rateRules {
+		scope := ""
+		if i >= len(cfg.Server.RateLimits) {
+			scope = route.Path
+		}
+		rl, err := g.ruleLimiter(scope, rule, limits)
+		if err != nil {
+			return nil, err
+		}
+		limiters = append(limiters, rl)
+	}
+
+	mws = append(mws,
+		inspector.Middleware,
+		middleware.RateLimits(route.Path, limiters...),
+		middleware.NewSecurityHeaders(policy.Headers),
+	)
+
+	// Innermost, so it only learns from requests the WAF let through and
+	// sees the backend's response.
+	if policy.Learning.Enabled {
+		mws = append(mws, g.learnerFor(route.Path, policy.Learning).Middleware)
+	}
+
+	return middleware.Chain(next, mws...), nil
+}
+
+// loadOpenAPISpecs loads every spec referenced by the global or a route
+// policy, keyed by file path. Routes sharing a spec share one copy.
+func loadOpenAPISpecs(cfg *config.Config, routes []config.RouteConfig) (map[string]*middleware.OpenAPISpec, error) {
+	specs := make(map[string]*middleware.OpenAPISpec)
+	for _, r := range append([]config.RouteConfig{{}}, routes...) {
+		path := cfg.Policy(r).OpenAPI.Spec
+		if path == "" || specs[path] != nil {
+			continue
+		}
+		spec, err := middleware.LoadOpenAPI(path)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("📐 OpenAPI spec loaded: %s (%d paths)", path, len(spec.Paths))
+		specs[path] = spec
+	}
+	return specs, nil
+}
+
+// uploadPolicy converts the config's upload settings for the UploadGuard.
+func uploadPolicy(c config.UploadConfig) middleware.UploadPolicy {
+	p := middleware.UploadPolicy{
+		MaxFileSize:       c.MaxFileSize,
+		AllowedExtensions: c.AllowedExtensions,
+		VerifyContentType: c.VerifyContentType,
+		ScanFailOpen:      c.ClamAVFailOpen,
+	}
+	if c.ClamAV != "" {
+		p.Scanner = &middleware.ClamAVScanner{Address: c.ClamAV}
+	}
+	return p
+}
+
+// jsonLimits converts the config's JSON limits for the JSONGuard.
+func jsonLimits(c config.JSONLimitsConfig) middleware.JSONLimits {
+	return middleware.JSONLimits{
+		MaxDepth:           c.MaxDepth,
+		MaxKeys:            c.MaxKeys,
+		MaxArrayLength:     c.MaxArrayLength,
+		MaxStringLength:    c.MaxStringLength,
+		AllowDuplicateKeys: c.AllowDuplicateKeys,
+	}
+}
+
+// exclusions converts the config's rule exclusions for the inspector.
+func exclusions(c []config.ExclusionConfig) []middleware.Exclusion {
+	out := make([]middleware.Exclusion, len(c))
+	for i, e := range c {
+		out[i] = middleware.Exclusion{
+			Rules:   e.Rules,
+			Path:    e.Path,
+			Methods: e.Methods,
+			Target:  e.Target,
+			Field:   e.Field,
+		}
+	}
+	return out
+}
+
+// checkExclusions rejects exclusions naming rules that don't exist. A typo
+// would leave the false positive in place with nothing to show why.
+func checkExclusions(cfg *config.Config, routes []config.RouteConfig, rules []*middleware.Rule) error {
+	ids := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		ids[r.ID] = true
+	}
+	for _, r := range append([]config.RouteConfig{{}}, routes...) {
+		for _, e := range cfg.Policy(r).Exclusions {
+			for _, id := range e.Rules {
+				if !ids[id] {
+					return fmt.Errorf("exclusion refers to unknown WAF rule %q", id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// graphqlLimits returns the GraphQL limits for the inspector, or nil if GraphQL mode is off.
+func graphqlLimits(c config.GraphQLConfig) *middleware.GraphQLLimits {
+	if !c.Enabled {
+		return nil
+	}
+	return &middleware.GraphQLLimits{
+		MaxDepth:           c.MaxDepth,
+		MaxAliases:         c.MaxAliases,
+		MaxFields:          c.MaxFields,
+		MaxCost:            c.MaxCost,
+		BlockIntrospection: c.BlockIntrospection,
+	}
+}
+
+// ipLimiterID names the per-IP limiter's buckets. rate_limits names can't
+// start with "_", so no rule shares them.
+const ipLimiterID = "_global"
+
+// limiterFor returns the route's own RateLimiter if it overrides the rate
+// limit, otherwise the shared global one. Limiters are reused across reloads
+// so buckets aren't refilled by a config change.
+func (g *Gateway) limiterFor(route config.RouteConfig, limit middleware.RateLimit, limits map[string]middleware.RateLimit) *middleware.RateLimiter {
+	key := ""
+	if s := route.Security; s != nil && (s.RateLimit != nil || s.RateBurst != nil || s.RatePeriod != nil) {
+		key = route.Path
+	}
+	limits[key] = limit
+
+	rl, ok := g.limiters[key]
+	if !ok {
+		rl = middleware.NewRateLimiter(middleware.RateLimiterOptions{
+			ID:       scopedID(ipLimiterID, key),
+			Name:     "rate_limit",
+			Limit:    limit,
+			Store:    g.rateStore,
+			FailOpen: g.failOpen,
+		})
+		g.limiters[key] = rl
+	}
+	return rl
+}
+
+// ruleLimiter returns the RateLimiter for one of the rate_limits, global
+// (scope "") or declared by the route at scope. A rule whose key or
+// jwt_secret changes gets a fresh limiter, since its old buckets counted
+// something else.
+func (g *Gateway) ruleLimiter(scope string, rule config.RateLimitRule, limits map[string]middleware.RateLimit) (*middleware.RateLimiter, error) {
+	limit := middleware.RateLimit{Rate: rule.Rate, Burst: rule.Burst, Period: rule.Period}
+	// A new jwt_secret needs a new key too, hence its hash in the id.
+	id := fmt.Sprintf("%s#%s#%s#%x", scope, rule.Name, strings.Join(rule.Key, "+"), sha256.Sum256([]byte(rule.JWTSecret)))
+	limits[id] = limit
+
+	if rl, ok := g.limiters[id]; ok {
+		return rl, nil
+	}
+	key, err := middleware.ParseRateKey(rule.Key, rule.JWTSecret)
+	if err != nil {
+		return nil, fmt.Errorf("rate limit %q: %w", rule.Name, err)
+	}
+	rl := middleware.NewRateLimiter(middleware.RateLimiterOptions{
+		ID:       scopedID(rule.Name, scope),
+		Name:     rule.Name,
+		Key:      key,
+		Limit:    limit,
+		Store:    g.rateStore,
+		FailOpen: g.failOpen,
+	})
+	g.limiters[id] = rl
+	return rl, nil
+}
+
+// scopedID names a limiter's buckets in a shared store: "per-user" for a
+// global limit, "per-user@/api" for the /api route's own.
+func scopedID(name, route string) string {
+	if route == "" {
+		return name
+	}
+	return name + "@" + route
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/princetheprogrammer/apisentinel/internal/config"
+	"github.com/princetheprogrammer/apisentinel/internal/middleware"
+)
+
+func writeConfig(t *testing.T, path, target string) {
+	t.Helper()
+	data := fmt.Sprintf(`
+server:
+  admin_key: "test-key"
+  rate_limit: 100
+routes:
+  - path: "/"
+    target: %q
+security:
+  enable_xss: true
+`, target)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func backend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+}
+
+func get(t *testing.T, h http.Handler, url string) (int, string) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+	return rr.Code, rr.Body.String()
+}
+
+func TestGatewayReload(t *testing.T) {
+	a, b := backend("A"), backend("B")
+	defer a.Close()
+	defer b.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, a.URL)
+
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	if _, body := get(t, gw, "/"); body != "A" {
+		t.Fatalf("expected backend A, got %q", body)
+	}
+
+	// A valid change is swapped in.
+	writeConfig(t, path, b.URL)
+	gw.Reload()
+	if _, body := get(t, gw, "/"); body != "B" {
+		t.Fatalf("expected backend B after reload, got %q", body)
+	}
+
+	// An invalid file is rejected and the old generation stays live.
+	if err := os.WriteFile(path, []byte("routes: [this is: not valid"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gw.Reload()
+	if _, body := get(t, gw, "/"); body != "B" {
+		t.Fatalf("expected backend B after rejected reload, got %q", body)
+	}
+}
+
+func TestGatewayInFlightFinishesOnOldGeneration(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "old")
+	}))
+	defer slow.Close()
+	fresh := backend("new")
+	defer fresh.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, slow.URL)
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	old := gw.current.Load()
+	done := make(chan string)
+	go func() {
+		_, body := get(t, gw, "/")
+		done <- body
+	}()
+	<-started
+
+	writeConfig(t, path, fresh.URL)
+	gw.Reload()
+
+	if _, body := get(t, gw, "/"); body != "new" {
+		t.Fatalf("expected new generation to serve, got %q", body)
+	}
+
+	select {
+	case <-old.drained:
+		t.Fatal("old generation drained while a request was still in flight")
+	default:
+	}
+
+	close(release)
+	if body := <-done; body != "old" {
+		t.Fatalf("in-flight request should finish on old generation, got %q", body)
+	}
+	<-old.drained
+}
+
+func TestGatewayPerRoutePolicy(t *testing.T) {
+	b := backend("ok")
+	defer b.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := fmt.Sprintf(`
+server:
+  admin_key: "test-key"
+  rate_limit: 100
+routes:
+  - path: "/webhooks"
+    target: %[1]q
+    security:
+      enable_xss: false
+      allowed_methods: ["POST"]
+      headers:
+        Content-Security-Policy: "default-src 'none'"
+  - path: "/"
+    target: %[1]q
+security:
+  enable_xss: true
+`, b.URL)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	html := "<script>alert(1)</script>"
+	post := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		gw.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, url, strings.NewReader(html)))
+		return rr
+	}
+
+	if rr := post("/webhooks/github"); rr.Code != http.StatusOK {
+		t.Errorf("/webhooks should accept HTML, got %d", rr.Code)
+	} else if csp := rr.Header().Get("Content-Security-Policy"); csp != "default-src 'none'" {
+		t.Errorf("/webhooks should use its own CSP, got %q", csp)
+	}
+	if rr := post("/api/login"); rr.Code != http.StatusForbidden {
+		t.Errorf("/api/login should block XSS, got %d", rr.Code)
+	}
+	if code, _ := get(t, gw, "/webhooks/github"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /webhooks should be 405, got %d", code)
+	}
+}
+
+func TestGatewayLearningAdmin(t *testing.T) {
+	b := backend(`{"ok": true}`)
+	defer b.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := fmt.Sprintf(`
+server:
+  admin_key: "test-key"
+  rate_limit: 100
+routes:
+  - path: "/api"
+    target: %q
+    security:
+      learning:
+        enabled: true
+        window: 72h
+`, b.URL)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	for i := 0; i < 3; i++ {
+		get(t, gw, fmt.Sprintf("/api/orders/%d?expand=true", i+1))
+	}
+
+	if code, _ := get(t, http.HandlerFunc(gw.LearningHandler), "/learning?route=/api"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin key, got %d", code)
+	}
+	code, body := get(t, http.HandlerFunc(gw.LearningHandler), "/learning?key=test-key")
+	if code != http.StatusOK || !strings.Contains(body, `"route":"/api"`) || !strings.Contains(body, `"requests":3`) {
+		t.Errorf("unexpected status list %d: %s", code, body)
+	}
+	code, body = get(t, http.HandlerFunc(gw.LearningHandler), "/learning?key=test-key&route=/api&format=yaml")
+	if code != http.StatusOK || !strings.Contains(body, "/api/orders/{id}:") || !strings.Contains(body, "name: expand") {
+		t.Errorf("unexpected draft spec %d: %s", code, body)
+	}
+	if code, _ := get(t, http.HandlerFunc(gw.LearningHandler), "/learning?key=test-key&route=/other"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a route without a learner, got %d", code)
+	}
+}
+
+func TestGatewayExclusionProposal(t *testing.T) {
+	b := backend("ok")
+	defer b.Close()
+
+	dir := t.TempDir()
+	audit := filepath.Join(dir, "audit.log")
+	events := `{"request_id":"r1","method":"POST","path":"/api/tickets/42","violation_type":"WAF Anomaly Score",` +
+		`"matches":[{"rule_id":"942100","target":"body","field":"comments[3].text"},` +
+		`{"rule_id":"942110","target":"body","field":"comments[3].text"},` +
+		`{"rule_id":"941100","target":"query","field":"q"}]}
+{"request_id":"r2","method":"GET","path":"/","violation_type":"Blocklist"}
+`
+	if err := os.WriteFile(audit, []byte(events), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	write := func(rule string) {
+		data := fmt.Sprintf(`
+server:
+  admin_key: "test-key"
+  audit_log: %q
+routes:
+  - path: "/api/tickets"
+    target: %q
+    security:
+      exclusions:
+        - field: notes
+security:
+  enable_xss: true
+  exclusions:
+    - rules: [%q]
+      field: description
+`, audit, b.URL, rule)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("999999")
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGateway(path, cfg); err == nil || !strings.Contains(err.Error(), `"999999"`) {
+		t.Fatalf("expected an unknown rule error, got %v", err)
+	}
+
+	write("942100")
+	cfg, err = config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	// Route exclusions are added to the global ones.
+	post := func(body string) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/tickets", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		gw.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := post(`{"notes": "<script>alert(1)</script>"}`); code != http.StatusOK {
+		t.Errorf("excluded field should pass, got %d", code)
+	}
+	if code := post(`{"title": "<script>alert(1)</script>"}`); code != http.StatusForbidden {
+		t.Errorf("other fields should still be inspected, got %d", code)
+	}
+
+	h := http.HandlerFunc(gw.ExclusionHandler)
+
+	if code, _ := get(t, h, "/exclusions?request_id=r1"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin key, got %d", code)
+	}
+	if code, _ := get(t, h, "/exclusions?key=test-key&request_id=r2"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a request without rule matches, got %d", code)
+	}
+
+	code, body := get(t, h, "/exclusions?key=test-key&request_id=r1&format=yaml")
+	want := `exclusions:
+    - rules:
+        - "942100"
+        - "942110"
+      path: /api/tickets
+      methods:
+        - POST
+      target: body
+      field: comments[*].text
+    - rules:
+        - "941100"
+      path: /api/tickets
+      methods:
+        - POST
+      target: query
+      field: q
+`
+	if code != http.StatusOK || body != want {
+		t.Errorf("unexpected proposal %d:\n%s", code, body)
+	}
+
+	// The proposal is a valid exclusion list.
+	var proposal struct {
+		Exclusions []config.ExclusionConfig `json:"exclusions"`
+	}
+	_, body = get(t, h, "/exclusions?key=test-key&request_id=r1")
+	if err := json.Unmarshal([]byte(body), &proposal); err != nil || len(proposal.Exclusions) != 2 {
+		t.Fatalf("unexpected JSON proposal (%v): %s", err, body)
+	}
+	cfg.Security.Exclusions = proposal.Exclusions
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Errorf("proposal does not validate: %v", errs)
+	}
+}
+
+func TestGatewayVirtualPatches(t *testing.T) {
+	b := backend("ok")
+	defer b.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	patchFile := filepath.Join(dir, "patches.json")
+	data := fmt.Sprintf(`
+server:
+  admin_key: "test-key"
+  rate_limit: 100
+  virtual_patches: %q
+routes:
+  - path: "/"
+    target: %q
+`, patchFile, b.URL)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	admin := func(method, url, body string) (int, string) {
+		rr := httptest.NewRecorder()
+		gw.PatchHandler(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rr.Code, rr.Body.String()
+	}
+
+	if code, _ := admin("GET", "/patches", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin key, got %d", code)
+	}
+	if code, body := admin("POST", "/patches?key=test-key", `{"path": "^/api/", "headerz": {}}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown key, got %d: %s", code, body)
+	}
+	if code, body := admin("POST", "/patches?key=test-key", `{"path": "(", "ttl": "1h"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad regex, got %d: %s", code, body)
+	}
+
+	code, body := admin("POST", "/patches?key=test-key", `{
+		"id": "cve-2026-0001",
+		"description": "Exploit in the export endpoint",
+		"path": "^/api/export",
+		"params": {"format": "(?i)\\.\\./"},
+		"ttl": "48h"
+	}`)
+	if code != http.StatusCreated || !strings.Contains(body, `"expires_at"`) {
+		t.Fatalf("unexpected response to add %d: %s", code, body)
+	}
+
+	// It applies at once, on the live generation.
+	if code, _ := get(t, gw, "/api/export?format=../../etc"); code != http.StatusForbidden {
+		t.Errorf("patched request should be blocked, got %d", code)
+	}
+	if code, _ := get(t, gw, "/api/export?format=csv"); code != http.StatusOK {
+		t.Errorf("other requests should pass, got %d", code)
+	}
+
+	// And shows up on the dashboard with its hits.
+	rr := httptest.NewRecorder()
+	middleware.DashboardHandler(gw.blocklist, gw.patches, cfg.Server.AuditLog)(rr, httptest.NewRequest("GET", "/dashboard", nil))
+	if page := rr.Body.String(); !strings.Contains(page, "cve-2026-0001") || !strings.Contains(page, `<td class="violation">1</td>`) {
+		t.Errorf("dashboard does not list the patch with 1 hit:\n%s", page)
+	}
+
+	if code, body := admin("POST", "/patches/expire?key=test-key&id=cve-2026-0001", ""); code != http.StatusOK {
+		t.Errorf("unexpected response to expire %d: %s", code, body)
+	}
+	if code, _ := get(t, gw, "/api/export?format=../../etc"); code != http.StatusOK {
+		t.Errorf("expired patch should not apply, got %d", code)
+	}
+	if code, body := admin("GET", "/patches?key=test-key", ""); code != http.StatusOK || !strings.Contains(body, `"hits": 1`) {
+		t.Errorf("unexpected list %d: %s", code, body)
+	}
+
+	// Saved for the next start.
+	saved, err := os.ReadFile(patchFile)
+	if err != nil || !strings.Contains(string(saved), "cve-2026-0001") {
+		t.Fatalf("patch not saved (%v): %s", err, saved)
+	}
+
+	if code, _ := admin("DELETE", "/patches?key=test-key&id=cve-2026-0001", ""); code != http.StatusOK {
+		t.Errorf("unexpected response to delete %d", code)
+	}
+	if code, _ := admin("DELETE", "/patches?key=test-key&id=cve-2026-0001", ""); code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting twice, got %d", code)
+	}
+}
+
+func TestGatewayRateLimitRules(t *testing.T) {
+	b := backend("ok")
+	defer b.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := fmt.Sprintf(`
+server:
+  admin_key: "test-key"
+  rate_limit: 100
+  rate_limits:
+    - name: per-key
+      key: [api_key]
+      rate: 2
+routes:
+  - path: "/reports"
+    target: %[1]q
+    security:
+      rate_limits:
+        - name: reports-total
+          key: [route]
+          rate: 3
+  - path: "/"
+    target: %[1]q
+`, b.URL)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	// Every request comes from the same IP, as behind a NAT.
+	send := func(url, key string) int {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		gw.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := send("/api", "alice"); code != http.StatusOK {
+			t.Fatalf("alice request %d: got %d", i+1, code)
+		}
+	}
+	if code := send("/api", "alice"); code != http.StatusTooManyRequests {
+		t.Errorf("alice over her limit: got %d", code)
+	}
+	if code := send("/api", "bob"); code != http.StatusOK {
+		t.Errorf("bob shares alice's IP but not her bucket: got %d", code)
+	}
+	if code := send("/api", ""); code != http.StatusOK {
+		t.Errorf("no key counts by IP: got %d", code)
+	}
+
+	// The route's own limit applies on top, across keys.
+	for _, key := range []string{"carol", "dave", "erin"} {
+		if code := send("/reports", key); code != http.StatusOK {
+			t.Fatalf("%s: got %d", key, code)
+		}
+	}
+	if code := send("/reports", "frank"); code != http.StatusTooManyRequests {
+		t.Errorf("route total exceeded: got %d", code)
+	}
+
+	// A reload keeps the buckets.
+	gw.Reload()
+	if code := send("/api", "alice"); code != http.StatusTooManyRequests {
+		t.Errorf("alice after reload: got %d", code)
+	}
+}
+
+func TestGatewayRateLimitStoreUnreachable(t *testing.T) {
+	b := backend("ok")
+	defer b.Close()
+
+	// Nothing listens on the store's address.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	for _, failOpen := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		data := fmt.Sprintf(`
+server:
+  admin_key: "test-key"
+  rate_limit_store:
+    type: redis
+    address: %q
+    timeout: 100ms
+    fail_open: %t
+routes:
+  - path: "/"
+    target: %q
+`, addr, failOpen, b.URL)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config.LoadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gw, err := NewGateway(path, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := http.StatusServiceUnavailable
+		if failOpen {
+			want = http.StatusOK
+		}
+		if code, _ := get(t, gw, "/"); code != want {
+			t.Errorf("fail_open %t: got %d, want %d", failOpen, code, want)
+		}
+		gw.Close()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/princetheprogrammer/apisentinel/internal/config"
+	"github.com/princetheprogrammer/apisentinel/internal/middleware"
+	"gopkg.in/yaml.v3"
+)
+
+// learnerFor returns the route's Learner, creating it on first use.
+// Learners outlive reloads (and learning being switched off), so what was
+// learned can still be exported.
+func (g *Gateway) learnerFor(route string, c config.LearningConfig) *middleware.Learner {
+	g.learnMu.Lock()
+	defer g.learnMu.Unlock()
+
+	l, ok := g.learners[route]
+	if !ok {
+		l = middleware.NewLearner(c.Window)
+		g.learners[route] = l
+		return l
+	}
+	l.SetWindow(c.Window)
+	return l
+}
+
+// LearningHandler is the learning mode admin API.
+//
+//	GET /learning?key=K                         status of every learner
+//	GET /learning?key=K&route=/api              draft OpenAPI spec (JSON)
+//	GET /learning?key=K&route=/api&format=yaml  the same as YAML
+//	DELETE /learning?key=K&route=/api           forget and start over
+func (g *Gateway) LearningHandler(w http.ResponseWriter, r *http.Request) {
+	if !g.blocklist.Authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	route := r.URL.Query().Get("route")
+	if !r.URL.Query().Has("route") {
+		g.learnerList(w)
+		return
+	}
+
+	g.learnMu.Lock()
+	l, ok := g.learners[route]
+	g.learnMu.Unlock()
+	if !ok {
+		http.Error(w, "No learner for this route", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		spec := l.Spec("Learned API: " + route)
+		if r.URL.Query().Get("format") == "yaml" {
+			w.Header().Set("Content-Type", "application/yaml")
+			yaml.NewEncoder(w).Encode(spec)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(spec)
+
+	case http.MethodDelete:
+		l.Reset()
+		w.Write([]byte("Learner reset"))
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// learnerList writes the status of every learner.
+func (g *Gateway) learnerList(w http.ResponseWriter) {
+	type entry struct {
+		Route string `json:"route"`
+		middleware.LearnerStatus
+	}
+
+	g.learnMu.Lock()
+	list := make([]entry, 0, len(g.learners))
+	for route, l := range g.learners {
+		list = append(list, entry{route, l.Status()})
+	}
+	g.learnMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Route < list[j].Route })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
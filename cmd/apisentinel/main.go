@@ -14,22 +14,22 @@ import (
 	"github.com/princetheprogrammer/apisentinel/internal/config"
 	"github.com/princetheprogrammer/apisentinel/internal/logger"
 	"github.com/princetheprogrammer/apisentinel/internal/middleware"
-	"github.com/princetheprogrammer/apisentinel/internal/proxy"
-	"github.com/princetheprogrammer/apisentinel/internal/testserver"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+
 	configPath := flag.String("config", "config.yaml", "Path to configuration file")
 	flag.Parse()
 
 	// 1. Load Configuration
+	// A broken config is fatal: falling back to defaults would silently
+	// disable protections (or worse, enable a well-known admin key).
 	cfg, err := config.LoadConfig(*configPath)
 	if err != nil {
-		log.Printf("⚠️ Config file not found or invalid (%s). Using defaults.", *configPath)
-		cfg = &config.Config{
-			Server: config.ServerConfig{Port: 8080, AdminKey: "secret-sentinel-key", RateLimit: 10, AuditLog: "audit.log"},
-			Security: config.SecurityConfig{EnableXSS: true, EnableSQLi: true, EnableDLP: true},
-		}
+		log.Fatalf("❌ Invalid configuration: %v", err)
 	}
 
 	// 2. Initialize Audit Logger
@@ -38,79 +38,49 @@ func main() {
 	}
 	defer logger.Close()
 
-	// 3. Setup the Multi-Target Proxy
-	mtProxy := proxy.NewMultiTargetProxy()
-	if len(cfg.Routes) == 0 {
-		log.Println("📦 No routes in config. Starting mock backends.")
-		// Default Mock Setup
-		p1, p2 := "9000", "9001"
-		go testserver.StartTestServer(p1)
-		go testserver.StartTestServer(p2)
-		mtProxy.AddRoute("/", []string{"http://localhost:" + p1})
-		mtProxy.AddRoute("/api/v2", []string{"http://localhost:" + p2})
-	} else {
-		for _, r := range cfg.Routes {
-			targets := r.Targets
-			if len(targets) == 0 && r.Target != "" {
-				targets = []string{r.Target}
-			}
-			
-			log.Printf("🛣️  Adding route: %s -> %v", r.Path, targets)
-			if err := mtProxy.AddRoute(r.Path, targets); err != nil {
-				log.Fatalf("❌ Failed to add route %s: %v", r.Path, err)
-			}
-		}
-	}
-
-	// 4. Initialize Middlewares
-	rl := middleware.NewRateLimiter(cfg.Server.RateLimit)
-	inspector := middleware.NewSecurityInspector(cfg.Security.EnableXSS, cfg.Security.EnableSQLi)
-	blocklist := middleware.NewIPBlocklist(cfg.Server.AdminKey)
-	
-	var dlp *middleware.DLPMiddleware
-	if cfg.Security.EnableDLP {
-		dlp = middleware.NewDLPMiddleware(cfg.Security.DLPAction)
+	// 3. Build the proxy pipeline (routes + middleware chain).
+	// The Gateway rebuilds it on every config reload.
+	gateway, err := NewGateway(*configPath, cfg)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
 	}
 
-	// 5. Start the API Sentinel Proxy Server
+	// 4. Start the API Sentinel Proxy Server
 	proxyPort := fmt.Sprintf("%d", cfg.Server.Port)
-	log.Printf("🛡️ API Sentinel Proxy starting on :%s", proxyPort)
 
 	// Create a multiplexer
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", middleware.HealthHandler("1.0.0"))
 	mux.HandleFunc("/stats", middleware.StatsHandler)
-	mux.HandleFunc("/block", blocklist.AdminHandler)
-	mux.HandleFunc("/unblock", blocklist.AdminHandler)
-	mux.HandleFunc("/dashboard", middleware.DashboardHandler(blocklist, cfg.Server.AuditLog))
-
-	// Build the middleware chain
-	mws := []middleware.Middleware{
-		middleware.Tracing,
-		func(next http.Handler) http.Handler {
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				middleware.IncrementTotal()
-				next.ServeHTTP(w, r)
-			})
-		},
-		blocklist.Middleware,
-	}
+	mux.HandleFunc("/block", gateway.blocklist.AdminHandler)
+	mux.HandleFunc("/unblock", gateway.blocklist.AdminHandler)
+	mux.HandleFunc("/learning", gateway.LearningHandler)
+	mux.HandleFunc("/exclusions", gateway.ExclusionHandler)
+	mux.HandleFunc("/patches", gateway.PatchHandler)
+	mux.HandleFunc("/patches/expire", gateway.PatchHandler)
+	mux.HandleFunc("/dashboard", middleware.DashboardHandler(gateway.blocklist, gateway.patches, cfg.Server.AuditLog))
 
-	if dlp != nil {
-		mws = append(mws, dlp.Middleware)
-	}
+	// Route everything else to the proxy
+	mux.Handle("/", gateway)
 
-	mws = append(mws,
-		inspector.Middleware,
-		rl.Middleware,
-		middleware.SecurityHeaders,
-	)
+	// 5. Hot Reload: watch the config file and listen for SIGHUP
+	watcher := config.NewWatcher(*configPath, 2*time.Second)
+	defer watcher.Close()
 
-	// Apply Middlewares to the Proxy
-	proxyWithMiddleware := middleware.Chain(mtProxy, mws...)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	// Route everything else to the proxy
-	mux.Handle("/", proxyWithMiddleware)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Println("📥 SIGHUP received. Reloading config...")
+			case <-watcher.C:
+				log.Printf("📥 %s changed. Reloading config...", *configPath)
+			}
+			gateway.Reload()
+		}
+	}()
 
 	// --- 6. Start Server with Graceful Shutdown ---
 	server := &http.Server{
@@ -141,6 +111,7 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("❌ Server Shutdown Failed: %v", err)
 	}
+	gateway.Close()
 
 	log.Println("✅ API Sentinel Shutdown Gracefully. See you next time, Prince!")
 }
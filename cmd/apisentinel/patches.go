@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/princetheprogrammer/apisentinel/internal/middleware"
+)
+
+// patchRequest is a new virtual patch as the admin API takes it.
+type patchRequest struct {
+	middleware.VirtualPatch
+	TTL string `json:"ttl"` // Alternative to expires_at, e.g. "48h"
+}
+
+// PatchHandler is the virtual patching admin API. Changes apply to every
+// route at once and are saved to server.virtual_patches.
+//
+//	GET    /patches?key=K                every patch, with hit counts
+//	POST   /patches?key=K                add one (JSON body)
+//	POST   /patches/expire?key=K&id=ID   stop applying it, keep it listed
+//	DELETE /patches?key=K&id=ID          remove it
+func (g *Gateway) PatchHandler(w http.ResponseWriter, r *http.Request) {
+	if !g.blocklist.Authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := r.URL.Query().Get("id")
+
+	switch {
+	case r.URL.Path == "/patches/expire" && r.Method == http.MethodPost:
+		p, err := g.patches.Expire(id)
+		if err != nil {
+			patchError(w, err)
+			return
+		}
+		writePatchJSON(w, http.StatusOK, p)
+
+	case r.URL.Path == "/patches/expire":
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+
+	case r.Method == http.MethodGet:
+		writePatchJSON(w, http.StatusOK, g.patches.List())
+
+	case r.Method == http.MethodPost:
+		p, err := decodePatch(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err = g.patches.Add(p)
+		if err != nil {
+			patchError(w, err)
+			return
+		}
+		writePatchJSON(w, http.StatusCreated, p)
+
+	case r.Method == http.MethodDelete:
+		if err := g.patches.Delete(id); err != nil {
+			patchError(w, err)
+			return
+		}
+		w.Write([]byte("Virtual patch deleted"))
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// decodePatch reads a new patch from the request body. Unknown keys are
+// errors: a misspelt condition would otherwise be a patch that matches
+// more than intended.
+func decodePatch(r *http.Request) (middleware.VirtualPatch, error) {
+	var req patchRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return middleware.VirtualPatch{}, fmt.Errorf("invalid virtual patch: %v", err)
+	}
+
+	p := req.VirtualPatch
+	if req.TTL != "" {
+		if p.ExpiresAt != nil {
+			return p, errors.New("set either ttl or expires_at, not both")
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return p, fmt.Errorf("invalid ttl %q", req.TTL)
+		}
+		expires := time.Now().UTC().Add(ttl)
+		p.ExpiresAt = &expires
+	}
+	return p, nil
+}
+
+// patchError maps a VirtualPatches error to a response.
+func patchError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, middleware.ErrNoSuchPatch):
+		http.Error(w, "No such virtual patch", http.StatusNotFound)
+	case errors.Is(err, middleware.ErrInvalidPatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("❌ Failed to save virtual patches: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func writePatchJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
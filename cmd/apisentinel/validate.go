@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/princetheprogrammer/apisentinel/internal/config"
+	"github.com/princetheprogrammer/apisentinel/internal/middleware"
+)
+
+// runValidate implements `apisentinel validate -config x.yaml`.
+// It returns the process exit code: 0 if valid, 1 if invalid, 2 on usage errors.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "Path to configuration file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	rules, err := middleware.LoadRuleSet(cfg.Security.RuleFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	if err := checkExclusions(cfg, cfg.Routes, rules); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	if _, err := loadOpenAPISpecs(cfg, cfg.Routes); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("✅ %s is valid\n", *configPath)
+	return 0
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(rule string) {
+		data := fmt.Sprintf(`
+server:
+  admin_key: "test-key"
+routes:
+  - path: "/api/tickets"
+    target: "http://localhost:9000"
+security:
+  exclusions:
+    - rules: [%q]
+      field: description
+`, rule)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("942100")
+	if code := runValidate([]string{"-config", path}); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	write("nonexistent-rule")
+	if code := runValidate([]string{"-config", path}); code != 1 {
+		t.Errorf("expected exit code 1 for an exclusion of an unknown rule, got %d", code)
+	}
+	if code := runValidate([]string{"-unknown-flag"}); code != 2 {
+		t.Errorf("expected exit code 2 on a usage error, got %d", code)
+	}
+}
@@ -2,4 +2,7 @@ module github.com/princetheprogrammer/apisentinel
 
 go 1.25.4
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require (
+	golang.org/x/text v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
+)
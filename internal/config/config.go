@@ -1,8 +1,13 @@
 package config
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"slices"
 	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,35 +20,326 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	Port      int    `yaml:"port"`
-	AdminKey  string `yaml:"admin_key"`
-	RateLimit int    `yaml:"rate_limit"`
-	AuditLog  string `yaml:"audit_log"`
+	Port           int                  `yaml:"port"`
+	AdminKey       string               `yaml:"admin_key"`
+	RateLimit      int                  `yaml:"rate_limit"`       // Requests per rate_period and client (default 10)
+	RateBurst      int                  `yaml:"rate_burst"`       // Requests a client may send at once (default rate_limit)
+	RatePeriod     time.Duration        `yaml:"rate_period"`      // Default 1m
+	RateLimits     []RateLimitRule      `yaml:"rate_limits"`      // More limits, by API key, user, path... Shared by every route
+	RateLimitStore RateLimitStoreConfig `yaml:"rate_limit_store"` // Where the buckets are kept
+	AuditLog       string               `yaml:"audit_log"`
+	VirtualPatches string               `yaml:"virtual_patches"` // File the virtual patches are saved to (default virtual_patches.json)
 }
 
 type RouteConfig struct {
-	Path    string   `yaml:"path"`
-	Target  string   `yaml:"target"`
-	Targets []string `yaml:"targets"`
+	Path     string         `yaml:"path"`
+	Target   string         `yaml:"target"`
+	Targets  []string       `yaml:"targets"`
+	Security *RouteSecurity `yaml:"security"`
 }
 
 type SecurityConfig struct {
-	EnableXSS  bool   `yaml:"enable_xss"`
-	EnableSQLi bool   `yaml:"enable_sqli"`
-	EnableDLP  bool   `yaml:"enable_dlp"`
-	DLPAction  string `yaml:"dlp_action"`
+	EnableXSS      bool              `yaml:"enable_xss"`
+	EnableSQLi     bool              `yaml:"enable_sqli"`
+	EnableNoSQLi   bool              `yaml:"enable_nosqli"`              // MongoDB operator injection ($ne, $where...)
+	EnableProto    bool              `yaml:"enable_prototype_pollution"` // __proto__ / constructor.prototype keys
+	EnableLFI      bool              `yaml:"enable_path_traversal"`      // ../../, /etc/passwd, php:// wrappers
+	EnableCmdi     bool              `yaml:"enable_cmdi"`                // OS command injection and Shellshock
+	EnableSSRF     bool              `yaml:"enable_ssrf"`                // URLs to internal, link-local and metadata addresses
+	EnableSSTI     bool              `yaml:"enable_ssti"`                // Server-side template injection
+	EnableJNDI     bool              `yaml:"enable_jndi"`                // ${jndi:...} lookups (Log4Shell)
+	EnableDLP      bool              `yaml:"enable_dlp"`
+	DLPAction      string            `yaml:"dlp_action"`
+	Mode           string            `yaml:"mode"`              // WAF mode: "block" (default) or "monitor"
+	Threshold      int               `yaml:"anomaly_threshold"` // Score at which a request is blocked (default 5)
+	Paranoia       int               `yaml:"paranoia_level"`    // 1-4, enables stricter rules (default 1)
+	MaxBodySize    int64             `yaml:"max_body_size"`     // Bytes (default 10 MiB), -1 = unlimited
+	InspectBody    int64             `yaml:"inspect_body_size"` // Bytes buffered for full inspection, larger bodies are streamed (default 1 MiB)
+	MaxInspect     int64             `yaml:"max_inspect_size"`  // Bytes of a streamed body the rules run over, the rest is audited and passed on. 0 = all of it
+	AllowedMethods []string          `yaml:"allowed_methods"`   // Empty = all methods
+	Headers        map[string]string `yaml:"headers"`           // Security header overrides, "" removes a header
+	RuleFiles      []string          `yaml:"rule_files"`        // Extra WAF rule files (YAML/JSON, globs allowed)
+	InspectTargets []string          `yaml:"inspect_targets"`   // path, query, keys, header, cookie, body. Empty = all
+	ExcludeHeaders []string          `yaml:"exclude_headers"`   // Headers never inspected (default Authorization)
+	ExcludeCookies []string          `yaml:"exclude_cookies"`   // Cookies never inspected
+	Uploads        UploadConfig      `yaml:"uploads"`           // multipart/form-data file policies
+	GraphQL        GraphQLConfig     `yaml:"graphql"`           // GraphQL mode, usually set per route
+	OpenAPI        OpenAPIConfig     `yaml:"openapi"`           // Schema enforcement, usually set per route
+	Learning       LearningConfig    `yaml:"learning"`          // Infer a draft OpenAPI spec from traffic
+	JSONLimits     JSONLimitsConfig  `yaml:"json_limits"`       // Structural limits for JSON bodies
+	Exclusions     []ExclusionConfig `yaml:"exclusions"`        // Rules that must not inspect parts of some requests
 }
 
-// LoadConfig reads the YAML configuration file and applies environment overrides.
+// UploadConfig restricts uploaded files. File names with path traversal are
+// always rejected.
+type UploadConfig struct {
+	MaxFileSize       int64    `yaml:"max_file_size"`       // Bytes per file, 0 = unlimited
+	AllowedExtensions []string `yaml:"allowed_extensions"`  // e.g. [".jpg", ".pdf"]. Empty = any
+	VerifyContentType bool     `yaml:"verify_content_type"` // Check magic bytes against the declared type
+	ClamAV            string   `yaml:"clamav_address"`      // clamd unix socket path or host:port, "" = no scan
+	ClamAVFailOpen    bool     `yaml:"clamav_fail_open"`    // Accept uploads when clamd is unreachable
+}
+
+// GraphQLConfig enables GraphQL-aware inspection. Limits of 0 are unlimited.
+type GraphQLConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	MaxDepth           int  `yaml:"max_depth"`
+	MaxAliases         int  `yaml:"max_aliases"`
+	MaxFields          int  `yaml:"max_fields"`
+	MaxCost            int  `yaml:"max_cost"`
+	BlockIntrospection bool `yaml:"block_introspection"`
+}
+
+// OpenAPIConfig enforces an OpenAPI 3 spec: only the paths, methods,
+// parameters and JSON bodies it describes are let through.
+type OpenAPIConfig struct {
+	Spec              string `yaml:"spec"`               // Path to the spec (YAML or JSON), "" = off
+	BasePath          string `yaml:"base_path"`          // Prefix stripped before matching. Default: the spec's first server URL path
+	ValidateResponses bool   `yaml:"validate_responses"` // Audit responses that don't match the spec (never blocked)
+
+	AllowUndeclaredQuery bool `yaml:"allow_undeclared_query"` // Let through query parameters the spec doesn't declare (rejected by default)
+}
+
+// JSONLimitsConfig bounds the structure of JSON request bodies.
+// Limits of 0 use the built-in defaults (depth 32, 1000 keys per object,
+// 10000 items per array, 1 MiB per string).
+type JSONLimitsConfig struct {
+	MaxDepth           int  `yaml:"max_depth"`
+	MaxKeys            int  `yaml:"max_keys"`
+	MaxArrayLength     int  `yaml:"max_array_length"`
+	MaxStringLength    int  `yaml:"max_string_length"`
+	AllowDuplicateKeys bool `yaml:"allow_duplicate_keys"` // Rejected by default
+}
+
+// ExclusionConfig keeps WAF rules from inspecting part of a request: the
+// fix for a false positive on one parameter. Empty scopes match anything,
+// but an exclusion needs rules or a field.
+type ExclusionConfig struct {
+	Rules   []string `yaml:"rules,omitempty" json:"rules,omitempty"`     // Rule IDs, e.g. ["942100"]
+	Path    string   `yaml:"path,omitempty" json:"path,omitempty"`       // Request path and everything under it, segment by segment
+	Methods []string `yaml:"methods,omitempty" json:"methods,omitempty"` // e.g. [POST, PUT]
+	Target  string   `yaml:"target,omitempty" json:"target,omitempty"`   // path, query, keys, header, cookie or body
+	Field   string   `yaml:"field,omitempty" json:"field,omitempty"`     // Parameter, header or cookie name, or JSON path ("items[*].note")
+}
+
+// RateLimitRule is a rate limit counting requests by something other than
+// the client IP. It applies on top of rate_limit, which still counts by IP.
+type RateLimitRule struct {
+	Name   string        `yaml:"name"`   // Shown in logs and audit events
+	Key    []string      `yaml:"key"`    // ip, api_key, jwt_sub, cookie:NAME, header:NAME, path, method, route. Several make a composite key
+	Rate   int           `yaml:"rate"`   // Requests per period and key
+	Burst  int           `yaml:"burst"`  // Default rate
+	Period time.Duration `yaml:"period"` // Default 1m
+
+	// HMAC secret jwt_sub tokens are verified with (HS256/384/512). Without
+	// it, jwt_sub counts by subject and client IP together.
+	JWTSecret string `yaml:"jwt_secret"`
+}
+
+// RateLimitStoreConfig says where token buckets are kept. In memory, each
+// replica counts on its own: three replicas let three times the limit
+// through. Redis shares the buckets between them.
+type RateLimitStoreConfig struct {
+	Type     string        `yaml:"type"`      // "memory" (default) or "redis"
+	Address  string        `yaml:"address"`   // host:port or unix socket path
+	Password string        `yaml:"password"`  // Or set SENTINEL_REDIS_PASSWORD
+	DB       int           `yaml:"db"`        // Database number
+	Prefix   string        `yaml:"prefix"`    // Key prefix (default "apisentinel:ratelimit:")
+	Timeout  time.Duration `yaml:"timeout"`   // Per command (default 250ms)
+	FailOpen bool          `yaml:"fail_open"` // Let requests through while the store is unreachable, instead of a 503
+
+	RetryEvery time.Duration `yaml:"retry_every"` // After a failure, skip the store this long before trying again (default 1s)
+}
+
+// LearningConfig turns on learning mode: the route's traffic is observed and
+// a draft OpenAPI spec can be exported from the admin API (/learning).
+type LearningConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Window  time.Duration `yaml:"window"` // How long to observe, e.g. "72h". 0 = until disabled
+}
+
+// RouteSecurity overrides the global security settings for a single route.
+// Nil/empty fields inherit the global value.
+type RouteSecurity struct {
+	EnableXSS      *bool             `yaml:"enable_xss"`
+	EnableSQLi     *bool             `yaml:"enable_sqli"`
+	EnableNoSQLi   *bool             `yaml:"enable_nosqli"`
+	EnableProto    *bool             `yaml:"enable_prototype_pollution"`
+	EnableLFI      *bool             `yaml:"enable_path_traversal"`
+	EnableCmdi     *bool             `yaml:"enable_cmdi"`
+	EnableSSRF     *bool             `yaml:"enable_ssrf"`
+	EnableSSTI     *bool             `yaml:"enable_ssti"`
+	EnableJNDI     *bool             `yaml:"enable_jndi"`
+	EnableDLP      *bool             `yaml:"enable_dlp"`
+	DLPAction      *string           `yaml:"dlp_action"`
+	Mode           *string           `yaml:"mode"`
+	Threshold      *int              `yaml:"anomaly_threshold"`
+	Paranoia       *int              `yaml:"paranoia_level"`
+	RateLimit      *int              `yaml:"rate_limit"`
+	RateBurst      *int              `yaml:"rate_burst"`
+	RatePeriod     *time.Duration    `yaml:"rate_period"`
+	RateLimits     []RateLimitRule   `yaml:"rate_limits"` // Added to the global ones, with buckets of the route's own
+	MaxBodySize    *int64            `yaml:"max_body_size"`
+	InspectBody    *int64            `yaml:"inspect_body_size"`
+	MaxInspect     *int64            `yaml:"max_inspect_size"`
+	AllowedMethods []string          `yaml:"allowed_methods"`
+	Headers        map[string]string `yaml:"headers"` // Merged over the global headers
+	InspectTargets []string          `yaml:"inspect_targets"`
+	ExcludeHeaders []string          `yaml:"exclude_headers"`
+	ExcludeCookies []string          `yaml:"exclude_cookies"`
+	Uploads        *UploadConfig     `yaml:"uploads"` // Replaces the global upload policy
+	GraphQL        *GraphQLConfig    `yaml:"graphql"` // Replaces the global GraphQL settings
+	OpenAPI        *OpenAPIConfig    `yaml:"openapi"` // Replaces the global OpenAPI settings
+	Learning       *LearningConfig   `yaml:"learning"`
+	JSONLimits     *JSONLimitsConfig `yaml:"json_limits"` // Replaces the global JSON limits
+	Exclusions     []ExclusionConfig `yaml:"exclusions"`  // Added to the global exclusions
+}
+
+// RoutePolicy is the effective security policy for one route.
+type RoutePolicy struct {
+	SecurityConfig
+	RateLimit  int
+	RateBurst  int
+	RatePeriod time.Duration
+}
+
+// Policy resolves the effective policy for a route: global settings with the
+// route's overrides applied on top.
+func (c *Config) Policy(r RouteConfig) RoutePolicy {
+	p := RoutePolicy{
+		SecurityConfig: c.Security,
+		RateLimit:      c.Server.RateLimit,
+		RateBurst:      c.Server.RateBurst,
+		RatePeriod:     c.Server.RatePeriod,
+	}
+
+	headers := make(map[string]string, len(c.Security.Headers))
+	for k, v := range c.Security.Headers {
+		headers[k] = v
+	}
+	p.Headers = headers
+
+	o := r.Security
+	if o == nil {
+		return p
+	}
+	if o.EnableXSS != nil {
+		p.EnableXSS = *o.EnableXSS
+	}
+	if o.EnableSQLi != nil {
+		p.EnableSQLi = *o.EnableSQLi
+	}
+	if o.EnableNoSQLi != nil {
+		p.EnableNoSQLi = *o.EnableNoSQLi
+	}
+	if o.EnableProto != nil {
+		p.EnableProto = *o.EnableProto
+	}
+	if o.EnableLFI != nil {
+		p.EnableLFI = *o.EnableLFI
+	}
+	if o.EnableCmdi != nil {
+		p.EnableCmdi = *o.EnableCmdi
+	}
+	if o.EnableSSRF != nil {
+		p.EnableSSRF = *o.EnableSSRF
+	}
+	if o.EnableSSTI != nil {
+		p.EnableSSTI = *o.EnableSSTI
+	}
+	if o.EnableJNDI != nil {
+		p.EnableJNDI = *o.EnableJNDI
+	}
+	if o.EnableDLP != nil {
+		p.EnableDLP = *o.EnableDLP
+	}
+	if o.DLPAction != nil {
+		p.DLPAction = *o.DLPAction
+	}
+	if o.Mode != nil {
+		p.Mode = *o.Mode
+	}
+	if o.Threshold != nil {
+		p.Threshold = *o.Threshold
+	}
+	if o.Paranoia != nil {
+		p.Paranoia = *o.Paranoia
+	}
+	if o.RateLimit != nil {
+		p.RateLimit = *o.RateLimit
+	}
+	if o.RateBurst != nil {
+		p.RateBurst = *o.RateBurst
+	}
+	if o.RatePeriod != nil {
+		p.RatePeriod = *o.RatePeriod
+	}
+	if o.MaxBodySize != nil {
+		p.MaxBodySize = *o.MaxBodySize
+	}
+	if o.InspectBody != nil {
+		p.InspectBody = *o.InspectBody
+	}
+	if o.MaxInspect != nil {
+		p.MaxInspect = *o.MaxInspect
+	}
+	if len(o.AllowedMethods) > 0 {
+		p.AllowedMethods = o.AllowedMethods
+	}
+	for k, v := range o.Headers {
+		p.Headers[k] = v
+	}
+	if len(o.InspectTargets) > 0 {
+		p.InspectTargets = o.InspectTargets
+	}
+	if len(o.ExcludeHeaders) > 0 {
+		p.ExcludeHeaders = o.ExcludeHeaders
+	}
+	if len(o.ExcludeCookies) > 0 {
+		p.ExcludeCookies = o.ExcludeCookies
+	}
+	if o.Uploads != nil {
+		p.Uploads = *o.Uploads
+	}
+	if o.GraphQL != nil {
+		p.GraphQL = *o.GraphQL
+	}
+	if o.OpenAPI != nil {
+		p.OpenAPI = *o.OpenAPI
+	}
+	if o.Learning != nil {
+		p.Learning = *o.Learning
+	}
+	if o.JSONLimits != nil {
+		p.JSONLimits = *o.JSONLimits
+	}
+	if len(o.Exclusions) > 0 {
+		p.Exclusions = append(slices.Clip(c.Security.Exclusions), o.Exclusions...)
+	}
+	return p
+}
+
+// LoadConfig reads the YAML configuration file, applies environment overrides
+// and validates the result. Unknown keys and invalid values are errors:
+// we never want to silently run with a config the operator didn't write.
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
+	// Parse into a node tree first so we can report line numbers later.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Strict decode: reject unknown keys (typos like "enable_xxs").
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
 
 	// Apply Defaults
@@ -56,26 +352,49 @@ func LoadConfig(path string) (*Config, error) {
 	if cfg.Server.AuditLog == "" {
 		cfg.Server.AuditLog = "audit.log"
 	}
+	if cfg.Server.VirtualPatches == "" {
+		cfg.Server.VirtualPatches = "virtual_patches.json"
+	}
+	if cfg.Security.ExcludeHeaders == nil {
+		// Credentials are high-entropy noise for the WAF, and shouldn't end up in audit logs.
+		cfg.Security.ExcludeHeaders = []string{"Authorization"}
+	}
 
 	// Apply Environment Overrides
-	cfg.applyEnvOverrides()
+	errs := cfg.applyEnvOverrides()
+
+	// Validate and attach line numbers
+	for _, fe := range cfg.Validate() {
+		fe.Line = lineOf(&doc, fe.Field)
+		errs = append(errs, fe)
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{File: path, Errors: errs}
+	}
 
 	return &cfg, nil
 }
 
-func (c *Config) applyEnvOverrides() {
-	if val := os.Getenv("SENTINEL_PORT"); val != "" {
-		if i, err := strconv.Atoi(val); err == nil {
-			c.Server.Port = i
+func (c *Config) applyEnvOverrides() []FieldError {
+	var errs []FieldError
+	envInt := func(name string, dst *int) {
+		if val := os.Getenv(name); val != "" {
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				errs = append(errs, FieldError{Field: name, Msg: fmt.Sprintf("not an integer: %q", val)})
+				return
+			}
+			*dst = i
 		}
 	}
+
+	envInt("SENTINEL_PORT", &c.Server.Port)
 	if val := os.Getenv("SENTINEL_ADMIN_KEY"); val != "" {
 		c.Server.AdminKey = val
 	}
-	if val := os.Getenv("SENTINEL_RATE_LIMIT"); val != "" {
-		if i, err := strconv.Atoi(val); err == nil {
-			c.Server.RateLimit = i
-		}
+	envInt("SENTINEL_RATE_LIMIT", &c.Server.RateLimit)
+	if val := os.Getenv("SENTINEL_REDIS_PASSWORD"); val != "" {
+		c.Server.RateLimitStore.Password = val
 	}
 	if val := os.Getenv("SENTINEL_AUDIT_LOG"); val != "" {
 		c.Server.AuditLog = val
@@ -83,4 +402,5 @@ func (c *Config) applyEnvOverrides() {
 	if val := os.Getenv("SENTINEL_DLP_ACTION"); val != "" {
 		c.Security.DLPAction = val
 	}
+	return errs
 }
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTemp(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigValid(t *testing.T) {
+	path := writeTemp(t, `
+server:
+  admin_key: "k3y"
+routes:
+  - path: "/"
+    targets: ["http://localhost:9000"]
+security:
+  dlp_action: "mask"
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.Port != 8080 || cfg.Server.RateLimit != 10 || cfg.Server.AuditLog != "audit.log" {
+		t.Errorf("defaults not applied: %+v", cfg.Server)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := writeTemp(t, "server:\n  admin_key: k\n  prot: 9000\n")
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected unknown-key error on line 3, got %v", err)
+	}
+}
+
+func TestLoadConfigSemanticErrors(t *testing.T) {
+	path := writeTemp(t, `server:
+  port: 70000
+routes:
+  - path: "/api"
+    targets:
+      - "http://localhost:9000"
+      - "localhost:9001"
+security:
+  dlp_action: "mask "
+  inspect_targets: [query, headers]
+  openapi:
+    base_path: "api"
+  exclusions:
+    - path: "api"
+      target: bodies
+`)
+	_, err := LoadConfig(path)
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+
+	want := map[string]int{
+		"server.port":                   2,
+		"server.admin_key":              1,
+		"routes[0].targets[1]":          7,
+		"security.dlp_action":           9,
+		"security.inspect_targets[1]":   10,
+		"security.openapi.spec":         11,
+		"security.openapi.base_path":    12,
+		"security.exclusions[0]":        14,
+		"security.exclusions[0].path":   14,
+		"security.exclusions[0].target": 15,
+	}
+	got := make(map[string]int)
+	for _, fe := range verr.Errors {
+		got[fe.Field] = fe.Line
+	}
+	for field, line := range want {
+		if got[field] != line {
+			t.Errorf("%s: expected error on line %d, got %d (all: %v)", field, line, got[field], verr.Errors)
+		}
+	}
+}
+
+func TestLoadConfigBadEnvOverride(t *testing.T) {
+	t.Setenv("SENTINEL_PORT", "eighty")
+	path := writeTemp(t, "server:\n  admin_key: k\n")
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "SENTINEL_PORT") {
+		t.Fatalf("expected SENTINEL_PORT error, got %v", err)
+	}
+}
+
+func TestLoadConfigRateLimits(t *testing.T) {
+	path := writeTemp(t, `server:
+  admin_key: k
+  rate_limits:
+    - name: per-user
+      key: [jwt_sub]
+      rate: 100
+    - name: per-user
+      key: [cookie, ip:1]
+      rate: 0
+    - key: [api_key, hostname]
+      rate: 5
+      period: -1m
+    - name: _global
+      key: [ip]
+      rate: 5
+    - name: per-user@/api
+      key: [ip]
+      rate: 5
+`)
+	_, err := LoadConfig(path)
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+	want := map[string]int{
+		"server.rate_limits[1].name":   7,
+		"server.rate_limits[1].key[0]": 8,
+		"server.rate_limits[1].key[1]": 8,
+		"server.rate_limits[1].rate":   9,
+		"server.rate_limits[2].name":   10,
+		"server.rate_limits[2].key[1]": 10,
+		"server.rate_limits[2].period": 12,
+		"server.rate_limits[3].name":   13,
+		"server.rate_limits[4].name":   16,
+	}
+	got := make(map[string]int)
+	for _, fe := range verr.Errors {
+		got[fe.Field] = fe.Line
+	}
+	for field, line := range want {
+		if got[field] != line {
+			t.Errorf("%s: expected error on line %d, got %d (all: %v)", field, line, got[field], verr.Errors)
+		}
+	}
+	if len(verr.Errors) != len(want) {
+		t.Errorf("expected %d errors, got %v", len(want), verr.Errors)
+	}
+}
+
+func TestLoadConfigRateLimitStore(t *testing.T) {
+	t.Setenv("SENTINEL_REDIS_PASSWORD", "from-env")
+	cfg, err := LoadConfig(writeTemp(t, `server:
+  admin_key: k
+  rate_limit_store:
+    type: redis
+    address: "redis:6379"
+    fail_open: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cfg.Server.RateLimitStore; s.Password != "from-env" || !s.FailOpen {
+		t.Errorf("unexpected store settings: %+v", s)
+	}
+
+	bad := map[string]string{
+		"server.rate_limit_store.address": "type: redis\n    address: redis",
+		"server.rate_limit_store.type":    "address: \"redis:6379\"",
+	}
+	for field, store := range bad {
+		_, err := LoadConfig(writeTemp(t, "server:\n  admin_key: k\n  rate_limit_store:\n    "+store+"\n"))
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("%s: expected an error, got %v", field, err)
+		}
+	}
+}
+
+func TestLoadConfigRejectsSampleAdminKey(t *testing.T) {
+	path := writeTemp(t, "server:\n  admin_key: \"secret-sentinel-key\"\n")
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "server.admin_key") {
+		t.Fatalf("expected the sample admin key to be rejected, got %v", err)
+	}
+
+	// The shipped configs have no key: the environment must provide one.
+	for _, file := range []string{"../../config.yaml", "../../config.example.yaml"} {
+		if _, err := LoadConfig(file); err == nil || !strings.Contains(err.Error(), "server.admin_key") {
+			t.Errorf("%s: expected a missing admin key, got %v", file, err)
+		}
+		t.Setenv("SENTINEL_ADMIN_KEY", "k3y")
+		if _, err := LoadConfig(file); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+		os.Unsetenv("SENTINEL_ADMIN_KEY")
+	}
+}
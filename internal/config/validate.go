@@ -0,0 +1,522 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldError describes a single invalid setting.
+type FieldError struct {
+	Field string // Dotted path, e.g. "routes[1].targets[0]"
+	Line  int    // Line in the YAML file, 0 if unknown
+	Msg   string
+}
+
+func (e FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Msg)
+}
+
+// ValidationError collects every problem found in a config file,
+// so the operator can fix them all in one go.
+type ValidationError struct {
+	File   string
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d invalid setting(s)", e.File, len(e.Errors))
+	for _, fe := range e.Errors {
+		b.WriteString("\n  ")
+		b.WriteString(fe.Error())
+	}
+	return b.String()
+}
+
+// validator accumulates FieldErrors while walking the config.
+type validator struct {
+	errs []FieldError
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks every field for semantic errors (ranges, URLs, enums).
+// It does not know line numbers; LoadConfig fills them in from the YAML tree.
+func (c *Config) Validate() []FieldError {
+	v := &validator{}
+	c.Server.validate(v, "server")
+	for i, r := range c.Routes {
+		r.validate(v, fmt.Sprintf("routes[%d]", i))
+	}
+	c.validateRoutePaths(v)
+	c.Security.validate(v, "security")
+	return v.errs
+}
+
+// sampleAdminKey shipped in the example configs of earlier releases.
+const sampleAdminKey = "secret-sentinel-key"
+
+func (s *ServerConfig) validate(v *validator, field string) {
+	if s.Port < 1 || s.Port > 65535 {
+		v.add(field+".port", "must be between 1 and 65535, got %d", s.Port)
+	}
+	if s.AdminKey == "" {
+		v.add(field+".admin_key", "is required (or set SENTINEL_ADMIN_KEY)")
+	} else if strings.TrimSpace(s.AdminKey) != s.AdminKey {
+		v.add(field+".admin_key", "must not have leading or trailing whitespace")
+	} else if s.AdminKey == sampleAdminKey {
+		v.add(field+".admin_key", "is the published sample key, anyone could use the admin API: set your own (or SENTINEL_ADMIN_KEY)")
+	}
+	if s.RateLimit < 1 {
+		v.add(field+".rate_limit", "must be at least 1, got %d", s.RateLimit)
+	}
+	if s.RateBurst < 0 {
+		v.add(field+".rate_burst", "must not be negative, got %d", s.RateBurst)
+	}
+	if s.RatePeriod < 0 {
+		v.add(field+".rate_period", "must not be negative, got %s", s.RatePeriod)
+	}
+	validateRateLimits(v, field+".rate_limits", s.RateLimits)
+	s.RateLimitStore.validate(v, field+".rate_limit_store")
+	if strings.TrimSpace(s.AuditLog) == "" {
+		v.add(field+".audit_log", "must not be empty")
+	}
+	if strings.TrimSpace(s.VirtualPatches) == "" {
+		v.add(field+".virtual_patches", "must not be empty")
+	}
+}
+
+func (r *RouteConfig) validate(v *validator, field string) {
+	if r.Path == "" {
+		v.add(field+".path", "is required")
+	} else if !strings.HasPrefix(r.Path, "/") {
+		v.add(field+".path", "must start with '/', got %q", r.Path)
+	}
+
+	switch {
+	case r.Target != "" && len(r.Targets) > 0:
+		v.add(field+".target", "set either target or targets, not both")
+	case r.Target == "" && len(r.Targets) == 0:
+		v.add(field+".targets", "at least one target URL is required")
+	}
+
+	if r.Target != "" {
+		validateTargetURL(v, field+".target", r.Target)
+	}
+	for i, t := range r.Targets {
+		validateTargetURL(v, fmt.Sprintf("%s.targets[%d]", field, i), t)
+	}
+
+	if r.Security != nil {
+		r.Security.validate(v, field+".security")
+	}
+}
+
+func (s *RouteSecurity) validate(v *validator, field string) {
+	if s.DLPAction != nil {
+		validateDLPAction(v, field+".dlp_action", *s.DLPAction)
+	}
+	if s.Mode != nil {
+		validateMode(v, field+".mode", *s.Mode)
+	}
+	if s.Threshold != nil && *s.Threshold < 1 {
+		v.add(field+".anomaly_threshold", "must be at least 1, got %d", *s.Threshold)
+	}
+	if s.Paranoia != nil {
+		validateParanoia(v, field+".paranoia_level", *s.Paranoia)
+	}
+	if s.RateLimit != nil && *s.RateLimit < 1 {
+		v.add(field+".rate_limit", "must be at least 1, got %d", *s.RateLimit)
+	}
+	if s.RateBurst != nil && *s.RateBurst < 0 {
+		v.add(field+".rate_burst", "must not be negative, got %d", *s.RateBurst)
+	}
+	if s.RatePeriod != nil && *s.RatePeriod < 0 {
+		v.add(field+".rate_period", "must not be negative, got %s", *s.RatePeriod)
+	}
+	validateRateLimits(v, field+".rate_limits", s.RateLimits)
+	if s.MaxBodySize != nil && *s.MaxBodySize < -1 {
+		v.add(field+".max_body_size", "must be -1 (unlimited) or more, got %d", *s.MaxBodySize)
+	}
+	if s.InspectBody != nil && *s.InspectBody < 0 {
+		v.add(field+".inspect_body_size", "must not be negative, got %d", *s.InspectBody)
+	}
+	if s.MaxInspect != nil && *s.MaxInspect < 0 {
+		v.add(field+".max_inspect_size", "must not be negative, got %d", *s.MaxInspect)
+	}
+	validateMethods(v, field+".allowed_methods", s.AllowedMethods)
+	validateHeaders(v, field+".headers", s.Headers)
+	validateInspection(v, field, s.InspectTargets, s.ExcludeHeaders, s.ExcludeCookies)
+	if s.Uploads != nil {
+		s.Uploads.validate(v, field+".uploads")
+	}
+	if s.GraphQL != nil {
+		s.GraphQL.validate(v, field+".graphql")
+	}
+	if s.OpenAPI != nil {
+		s.OpenAPI.validate(v, field+".openapi")
+	}
+	if s.JSONLimits != nil {
+		s.JSONLimits.validate(v, field+".json_limits")
+	}
+	if s.Learning != nil && s.Learning.Window < 0 {
+		v.add(field+".learning.window", "must not be negative, got %s", s.Learning.Window)
+	}
+	validateExclusions(v, field+".exclusions", s.Exclusions)
+}
+
+func (c *Config) validateRoutePaths(v *validator) {
+	seen := make(map[string]int)
+	for i, r := range c.Routes {
+		if first, ok := seen[r.Path]; ok {
+			v.add(fmt.Sprintf("routes[%d].path", i), "duplicate of routes[%d].path %q", first, r.Path)
+			continue
+		}
+		seen[r.Path] = i
+	}
+}
+
+func validateTargetURL(v *validator, field, raw string) {
+	if strings.TrimSpace(raw) != raw {
+		v.add(field, "must not have leading or trailing whitespace: %q", raw)
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.add(field, "invalid URL: %v", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.add(field, "scheme must be http or https, got %q", raw)
+		return
+	}
+	if u.Host == "" {
+		v.add(field, "missing host in %q", raw)
+	}
+}
+
+func (s *SecurityConfig) validate(v *validator, field string) {
+	validateDLPAction(v, field+".dlp_action", s.DLPAction)
+	validateMode(v, field+".mode", s.Mode)
+	if s.Threshold < 0 {
+		v.add(field+".anomaly_threshold", "must not be negative, got %d", s.Threshold)
+	}
+	if s.Paranoia != 0 {
+		validateParanoia(v, field+".paranoia_level", s.Paranoia)
+	}
+	if s.MaxBodySize < -1 {
+		v.add(field+".max_body_size", "must be -1 (unlimited) or more, got %d", s.MaxBodySize)
+	}
+	if s.InspectBody < 0 {
+		v.add(field+".inspect_body_size", "must not be negative, got %d", s.InspectBody)
+	}
+	if s.MaxInspect < 0 {
+		v.add(field+".max_inspect_size", "must not be negative, got %d", s.MaxInspect)
+	}
+	validateMethods(v, field+".allowed_methods", s.AllowedMethods)
+	validateHeaders(v, field+".headers", s.Headers)
+	validateInspection(v, field, s.InspectTargets, s.ExcludeHeaders, s.ExcludeCookies)
+	s.Uploads.validate(v, field+".uploads")
+	s.GraphQL.validate(v, field+".graphql")
+	s.OpenAPI.validate(v, field+".openapi")
+	if s.Learning.Window < 0 {
+		v.add(field+".learning.window", "must not be negative, got %s", s.Learning.Window)
+	}
+	s.JSONLimits.validate(v, field+".json_limits")
+	validateExclusions(v, field+".exclusions", s.Exclusions)
+	for i, f := range s.RuleFiles {
+		if strings.TrimSpace(f) == "" {
+			v.add(fmt.Sprintf("%s.rule_files[%d]", field, i), "must not be empty")
+		}
+	}
+}
+
+func (u *UploadConfig) validate(v *validator, field string) {
+	if u.MaxFileSize < 0 {
+		v.add(field+".max_file_size", "must not be negative, got %d", u.MaxFileSize)
+	}
+	for i, ext := range u.AllowedExtensions {
+		if strings.Trim(ext, ".") == "" || strings.ContainsAny(ext, "/\\ ") {
+			v.add(fmt.Sprintf("%s.allowed_extensions[%d]", field, i), "invalid extension %q", ext)
+		}
+	}
+	if u.ClamAV != "" && !strings.HasPrefix(u.ClamAV, "/") {
+		if _, _, err := net.SplitHostPort(u.ClamAV); err != nil {
+			v.add(field+".clamav_address", "must be a unix socket path or host:port, got %q", u.ClamAV)
+		}
+	}
+}
+
+func (g *GraphQLConfig) validate(v *validator, field string) {
+	limits := []struct {
+		name string
+		n    int
+	}{{"max_depth", g.MaxDepth}, {"max_aliases", g.MaxAliases}, {"max_fields", g.MaxFields}, {"max_cost", g.MaxCost}}
+	for _, l := range limits {
+		if l.n < 0 {
+			v.add(field+"."+l.name, "must not be negative, got %d", l.n)
+		}
+	}
+}
+
+func (j *JSONLimitsConfig) validate(v *validator, field string) {
+	limits := []struct {
+		name string
+		n    int
+	}{{"max_depth", j.MaxDepth}, {"max_keys", j.MaxKeys}, {"max_array_length", j.MaxArrayLength}, {"max_string_length", j.MaxStringLength}}
+	for _, l := range limits {
+		if l.n < 0 {
+			v.add(field+"."+l.name, "must not be negative, got %d", l.n)
+		}
+	}
+}
+
+func (s *RateLimitStoreConfig) validate(v *validator, field string) {
+	switch s.Type {
+	case "", "memory":
+		if s.Address != "" || s.DB != 0 || s.Prefix != "" || s.Timeout != 0 || s.FailOpen || s.RetryEvery != 0 {
+			v.add(field+".type", "must be \"redis\" for the other rate_limit_store settings to apply")
+		}
+		return
+	case "redis":
+	default:
+		v.add(field+".type", "must be \"memory\" or \"redis\", got %q", s.Type)
+		return
+	}
+	if s.Address == "" {
+		v.add(field+".address", "is required for redis")
+	} else if !strings.HasPrefix(s.Address, "/") {
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			v.add(field+".address", "must be a unix socket path or host:port, got %q", s.Address)
+		}
+	}
+	if s.DB < 0 {
+		v.add(field+".db", "must not be negative, got %d", s.DB)
+	}
+	if s.Timeout < 0 {
+		v.add(field+".timeout", "must not be negative, got %s", s.Timeout)
+	}
+	if s.RetryEvery < 0 {
+		v.add(field+".retry_every", "must not be negative, got %s", s.RetryEvery)
+	}
+}
+
+func (o *OpenAPIConfig) validate(v *validator, field string) {
+	if o.Spec == "" && (o.BasePath != "" || o.ValidateResponses || o.AllowUndeclaredQuery) {
+		v.add(field+".spec", "is required when other openapi settings are set")
+	}
+	if o.BasePath != "" && !strings.HasPrefix(o.BasePath, "/") {
+		v.add(field+".base_path", "must start with '/', got %q", o.BasePath)
+	}
+}
+
+func validateDLPAction(v *validator, field, action string) {
+	switch action {
+	case "", "block", "mask":
+	default:
+		v.add(field, "must be \"block\" or \"mask\", got %q", action)
+	}
+}
+
+func validateMode(v *validator, field, mode string) {
+	switch mode {
+	case "", "block", "monitor":
+	default:
+		v.add(field, "must be \"block\" or \"monitor\", got %q", mode)
+	}
+}
+
+func validateParanoia(v *validator, field string, level int) {
+	if level < 1 || level > 4 {
+		v.add(field, "must be between 1 and 4, got %d", level)
+	}
+}
+
+var knownRateKeys = map[string]bool{
+	"ip": true, "api_key": true, "jwt_sub": true, "path": true, "method": true, "route": true,
+}
+
+func validateRateLimits(v *validator, field string, rules []RateLimitRule) {
+	names := make(map[string]bool, len(rules))
+	for i, r := range rules {
+		f := fmt.Sprintf("%s[%d]", field, i)
+		switch {
+		case r.Name == "":
+			v.add(f+".name", "is required")
+		case names[r.Name]:
+			v.add(f+".name", "duplicate rate limit %q", r.Name)
+		case strings.HasPrefix(r.Name, "_"):
+			// The gateway's own limiters use these
+			v.add(f+".name", "names starting with \"_\" are reserved, got %q", r.Name)
+		case strings.Contains(r.Name, "@"):
+			// "@" scopes a name to a route: "a@/api" would share the /api route's "a" buckets
+			v.add(f+".name", "must not contain \"@\", got %q", r.Name)
+		}
+		names[r.Name] = true
+
+		if len(r.Key) == 0 {
+			v.add(f+".key", "is required")
+		}
+		for j, k := range r.Key {
+			kind, arg, hasArg := strings.Cut(k, ":")
+			switch {
+			case kind == "cookie" || kind == "header":
+				if arg == "" {
+					v.add(fmt.Sprintf("%s.key[%d]", f, j), "%s needs a name, e.g. %q", kind, kind+":session")
+				}
+			case !knownRateKeys[kind] || hasArg:
+				v.add(fmt.Sprintf("%s.key[%d]", f, j), "unknown rate limit key %q", k)
+			}
+		}
+
+		if r.JWTSecret != "" && !slices.Contains(r.Key, "jwt_sub") {
+			v.add(f+".jwt_secret", "only applies to a jwt_sub key")
+		}
+		if r.Rate < 1 {
+			v.add(f+".rate", "must be at least 1, got %d", r.Rate)
+		}
+		if r.Burst < 0 {
+			v.add(f+".burst", "must not be negative, got %d", r.Burst)
+		}
+		if r.Period < 0 {
+			v.add(f+".period", "must not be negative, got %s", r.Period)
+		}
+	}
+}
+
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+func validateMethods(v *validator, field string, methods []string) {
+	for i, m := range methods {
+		if !knownMethods[m] {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "unknown HTTP method %q (methods are upper-case)", m)
+		}
+	}
+}
+
+func validateHeaders(v *validator, field string, headers map[string]string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			v.add(field, "invalid header name %q", name)
+		}
+	}
+}
+
+var knownInspectTargets = map[string]bool{
+	"path": true, "query": true, "keys": true, "header": true, "cookie": true, "body": true,
+}
+
+func validateInspection(v *validator, field string, targets, headers, cookies []string) {
+	for i, t := range targets {
+		if !knownInspectTargets[t] {
+			v.add(fmt.Sprintf("%s.inspect_targets[%d]", field, i), "unknown target %q (path, query, keys, header, cookie or body)", t)
+		}
+	}
+	for i, h := range headers {
+		if h == "" || strings.ContainsAny(h, " \t\r\n:") {
+			v.add(fmt.Sprintf("%s.exclude_headers[%d]", field, i), "invalid header name %q", h)
+		}
+	}
+	for i, c := range cookies {
+		if c == "" {
+			v.add(fmt.Sprintf("%s.exclude_cookies[%d]", field, i), "must not be empty")
+		}
+	}
+}
+
+func validateExclusions(v *validator, field string, exclusions []ExclusionConfig) {
+	for i, e := range exclusions {
+		f := fmt.Sprintf("%s[%d]", field, i)
+		if len(e.Rules) == 0 && e.Field == "" {
+			v.add(f, "needs rules or a field (to skip a whole target, use inspect_targets)")
+		}
+		for j, id := range e.Rules {
+			if strings.TrimSpace(id) == "" {
+				v.add(fmt.Sprintf("%s.rules[%d]", f, j), "must not be empty")
+			}
+		}
+		if e.Path != "" && !strings.HasPrefix(e.Path, "/") {
+			v.add(f+".path", "must start with '/', got %q", e.Path)
+		}
+		validateMethods(v, f+".methods", e.Methods)
+		if e.Target != "" && !knownInspectTargets[e.Target] {
+			v.add(f+".target", "unknown target %q (path, query, keys, header, cookie or body)", e.Target)
+		}
+	}
+}
+
+// lineOf finds the line of a dotted field path such as "routes[1].targets[0]"
+// in a parsed YAML document. If the exact field is missing (e.g. a required key
+// that was never written), it returns the line of the closest existing parent.
+func lineOf(doc *yaml.Node, field string) int {
+	if doc == nil || len(doc.Content) == 0 {
+		return 0
+	}
+	node := doc.Content[0]
+	line := node.Line
+
+	for _, part := range strings.Split(field, ".") {
+		name, indexes := splitIndexes(part)
+
+		found := false
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == name {
+					line = node.Content[i].Line
+					node = node.Content[i+1]
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return line
+		}
+
+		for _, idx := range indexes {
+			if node.Kind != yaml.SequenceNode || idx >= len(node.Content) {
+				return line
+			}
+			node = node.Content[idx]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+// splitIndexes turns "targets[1]" into ("targets", [1]).
+func splitIndexes(part string) (string, []int) {
+	open := strings.IndexByte(part, '[')
+	if open < 0 {
+		return part, nil
+	}
+	name := part[:open]
+	var idx []int
+	for _, seg := range strings.Split(part[open:], "[")[1:] {
+		n, err := strconv.Atoi(strings.TrimSuffix(seg, "]"))
+		if err == nil {
+			idx = append(idx, n)
+		}
+	}
+	return name, idx
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"sync"
+	"time"
+)
+
+// Watcher polls a configuration file and signals on C whenever its contents change.
+// Polling (instead of inotify) keeps us dependency-free and works on every platform,
+// including files replaced atomically by editors or ConfigMap volume swaps.
+type Watcher struct {
+	C chan struct{}
+
+	path     string
+	interval time.Duration
+	lastSum  []byte
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewWatcher starts watching path, checking for changes every interval.
+func NewWatcher(path string, interval time.Duration) *Watcher {
+	w := &Watcher{
+		C:        make(chan struct{}, 1),
+		path:     path,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	w.lastSum = w.checksum()
+
+	go w.run()
+
+	return w
+}
+
+func (w *Watcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			sum := w.checksum()
+			if sum == nil || bytes.Equal(sum, w.lastSum) {
+				continue
+			}
+			w.lastSum = sum
+
+			// Coalesce: if a reload is already pending, don't queue another.
+			select {
+			case w.C <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// checksum returns the SHA-256 of the file, or nil if it can't be read
+// (e.g. in the middle of an editor's rename-and-replace).
+func (w *Watcher) checksum() []byte {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() {
+	w.once.Do(func() { close(w.stop) })
+}
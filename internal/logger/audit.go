@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -19,6 +20,24 @@ type AuditEvent struct {
 	Path          string    `json:"path"`
 	ViolationType string    `json:"violation_type"`
 	Details       string    `json:"details"`
+
+	// WouldHaveBlocked is set for matches in monitor (detection-only) mode:
+	// the request was allowed through but would have been blocked.
+	WouldHaveBlocked bool `json:"would_have_blocked,omitempty"`
+
+	// WAF anomaly scoring: every rule that matched and the request's total score.
+	Matches      []RuleMatch `json:"matches,omitempty"`
+	AnomalyScore int         `json:"anomaly_score,omitempty"`
+}
+
+// RuleMatch records one WAF rule that matched and where.
+type RuleMatch struct {
+	RuleID   string `json:"rule_id"`
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	Score    int    `json:"score"`
+	Target   string `json:"target"`
+	Field    string `json:"field,omitempty"`
 }
 
 // AuditLogger handles thread-safe writing of audit events to a file.
@@ -45,6 +64,18 @@ func InitAuditLogger(filepath string) error {
 
 // LogEvent writes a structured security event to the audit log (Asynchronously).
 func LogEvent(requestID, ip, method, path, violation, details string) {
+	Log(AuditEvent{
+		RequestID:     requestID,
+		SourceIP:      ip,
+		Method:        method,
+		Path:          path,
+		ViolationType: violation,
+		Details:       details,
+	})
+}
+
+// Log writes an audit event (Asynchronously). Timestamp and Location are filled in here.
+func Log(event AuditEvent) {
 	if globalAuditLogger == nil {
 		return
 	}
@@ -52,20 +83,12 @@ func LogEvent(requestID, ip, method, path, violation, details string) {
 	// Run in background so we don't slow down the proxy
 	go func() {
 		locStr := "Unknown"
-		if loc, err := GetLocation(ip); err == nil {
+		if loc, err := GetLocation(event.SourceIP); err == nil {
 			locStr = fmt.Sprintf("%s, %s", loc.City, loc.Country)
 		}
 
-		event := AuditEvent{
-			Timestamp:     time.Now().UTC(),
-			RequestID:     requestID,
-			SourceIP:      ip,
-			Location:      locStr,
-			Method:        method,
-			Path:          path,
-			ViolationType: violation,
-			Details:       details,
-		}
+		event.Timestamp = time.Now().UTC()
+		event.Location = locStr
 
 		jsonData, err := json.Marshal(event)
 		if err != nil {
@@ -82,6 +105,26 @@ func LogEvent(requestID, ip, method, path, violation, details string) {
 	}()
 }
 
+// Find returns every event logged for a request ID, oldest first.
+func Find(path, requestID string) ([]AuditEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var event AuditEvent
+		if json.Unmarshal(scanner.Bytes(), &event) == nil && event.RequestID == requestID {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
+
 // Close closes the audit log file.
 func Close() {
 	if globalAuditLogger != nil && globalAuditLogger.file != nil {
@@ -23,6 +23,13 @@ func NewIPBlocklist(adminKey string) *IPBlocklist {
 	}
 }
 
+// SetAdminKey replaces the key required by the admin endpoints.
+func (bl *IPBlocklist) SetAdminKey(key string) {
+	bl.mu.Lock()
+	bl.adminKey = key
+	bl.mu.Unlock()
+}
+
 func (bl *IPBlocklist) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip, _, err := net.SplitHostPort(r.RemoteAddr)
@@ -47,11 +54,19 @@ func (bl *IPBlocklist) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// Authorized reports whether an admin request carries the admin key (?key=).
+func (bl *IPBlocklist) Authorized(r *http.Request) bool {
+	key := r.URL.Query().Get("key")
+	bl.mu.RLock()
+	adminKey := bl.adminKey
+	bl.mu.RUnlock()
+	return key != "" && key == adminKey
+}
+
 // AdminHandler handles /block and /unblock requests.
 // In a real app, this would be a more robust API.
 func (bl *IPBlocklist) AdminHandler(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("key")
-	if key == "" || key != bl.adminKey {
+	if !bl.Authorized(r) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
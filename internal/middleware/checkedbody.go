@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// The JSON and upload guards check bodies with parsers that read them like
+// any other reader (a json.Decoder, a multipart.Reader). checkedBody runs
+// such a check on a body while it streams to the next handler, without
+// holding it in memory.
+//
+// The check runs in its own goroutine and is handed the body one window at
+// a time. A window is only passed on once the check has asked for the next
+// one, meaning it has parsed as far into it as it can, or has returned. A
+// check that fails cuts the body off: reads fail, which aborts the upstream
+// request, and streamWriter answers the client.
+//
+// The first guardAhead bytes are checked before the next handler is even
+// called, so a body that fits gets a plain answer, as it did when guards
+// buffered whole bodies.
+
+// guardAhead is how much of a body a guard checks before passing any of it
+// on.
+const guardAhead = 1 << 20
+
+// errCheckStopped ends a check whose body won't be read any further.
+var errCheckStopped = errors.New("body check stopped")
+
+// checkedBody passes src on as check reads it.
+type checkedBody struct {
+	src    io.ReadCloser
+	reject func(err error) int // Audits a failed check, returns the status to cut the body off with, or 0
+	status int                 // Set when the body was cut off
+
+	chunk   []byte
+	buf     []byte
+	pending []byte // Checked, not yet returned (in buf, or chunk once checked)
+	err     error  // From src, or the check that cut the body off
+	checked bool   // The check returned: the rest passes straight through
+
+	in      chan []byte   // Windows for the check
+	more    chan struct{} // The check wants the next window
+	done    chan struct{} // Closed when the check returns, result set
+	stop    chan struct{} // Closed to end the check early
+	once    sync.Once
+	asked   bool // The check is waiting for a window
+	result  error
+	current []byte // The window the check is reading
+}
+
+func newCheckedBody(src io.ReadCloser, check func(io.Reader) error, reject func(error) int) *checkedBody {
+	b := &checkedBody{
+		src:    src,
+		reject: reject,
+		chunk:  make([]byte, streamWindow),
+		in:     make(chan []byte),
+		more:   make(chan struct{}),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	go func() {
+		defer close(b.done)
+		b.result = check(checkReader{b})
+	}()
+	return b
+}
+
+// checkReader is the check's end of a checkedBody.
+type checkReader struct{ b *checkedBody }
+
+func (r checkReader) Read(p []byte) (int, error) {
+	b := r.b
+	for len(b.current) == 0 {
+		select {
+		case b.more <- struct{}{}:
+		case <-b.stop:
+			return 0, errCheckStopped
+		}
+		select {
+		case w, ok := <-b.in:
+			if !ok {
+				return 0, io.EOF
+			}
+			b.current = w
+		case <-b.stop:
+			return 0, errCheckStopped
+		}
+	}
+	n := copy(p, b.current)
+	b.current = b.current[n:]
+	return n, nil
+}
+
+// ahead checks up to limit bytes, or the whole body if it is shorter,
+// without passing any of it on. It returns the status to answer with if
+// the check failed, or 0.
+func (b *checkedBody) ahead(limit int) int {
+	for b.err == nil && !b.checked && len(b.pending) < limit {
+		b.fill()
+	}
+	return b.status
+}
+
+func (b *checkedBody) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.fill()
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+// fill reads the next window and hands it to the check. Only ahead calls
+// it with windows still pending.
+func (b *checkedBody) fill() {
+	if b.checked {
+		n, err := b.src.Read(b.chunk)
+		b.pending, b.err = b.chunk[:n], err
+		return
+	}
+
+	n, err := io.ReadFull(b.src, b.chunk)
+	if n > 0 {
+		b.feed(b.chunk[:n])
+	}
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		b.finish()
+		err = io.EOF
+	case err != nil:
+		b.Stop()
+		<-b.done
+		b.checked = true
+	}
+	if b.status != 0 {
+		return // Cut off: this window isn't passed on
+	}
+	if len(b.pending) == 0 {
+		b.pending = b.buf[:0]
+	}
+	b.pending = append(b.pending, b.chunk[:n]...)
+	b.buf = b.pending[:0]
+	b.err = err
+}
+
+// feed hands the check a window and waits until it asks for the next one
+// or returns.
+func (b *checkedBody) feed(window []byte) {
+	if !b.wait() {
+		return
+	}
+	b.asked = false
+	select {
+	case b.in <- window:
+		b.wait()
+	case <-b.done: // Stopped
+		b.returned()
+	}
+}
+
+// finish tells the check the body has ended and waits for it to return.
+func (b *checkedBody) finish() {
+	if b.wait() {
+		b.asked = false
+		close(b.in)
+		<-b.done
+		b.returned()
+	}
+}
+
+// wait waits until the check asks for a window, or returns false once it
+// has returned.
+func (b *checkedBody) wait() bool {
+	if b.checked || b.status != 0 {
+		return false
+	}
+	if b.asked {
+		return true
+	}
+	select {
+	case <-b.more:
+		b.asked = true
+		return true
+	case <-b.done:
+		b.returned()
+		return false
+	}
+}
+
+// returned handles the check's result.
+func (b *checkedBody) returned() {
+	if b.result == nil || errors.Is(b.result, errCheckStopped) {
+		b.checked = true
+		return
+	}
+	if b.status = b.reject(b.result); b.status != 0 {
+		b.err = b.result
+		return
+	}
+	b.checked = true // Only audited: the rest passes through
+}
+
+// Stop ends the check if it is still running. Whatever is read after
+// that passes unchecked: call it once the body won't be read any more.
+func (b *checkedBody) Stop() {
+	b.once.Do(func() { close(b.stop) })
+}
+
+func (b *checkedBody) Close() error { return b.src.Close() }
+
+// serveChecked runs next with r's body checked as it streams. If the
+// check fails within guardAhead bytes, the answer is reject's status and
+// next never runs; past that, the body is cut off and streamWriter answers
+// with the status instead of whatever next makes of the failed read.
+func serveChecked(w http.ResponseWriter, r *http.Request, next http.Handler, check func(io.Reader) error, reject func(error) int) {
+	body := newCheckedBody(r.Body, check, reject)
+	defer body.Stop()
+
+	if status := body.ahead(guardAhead); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(body.err, &tooLarge):
+		IncrementBlocked()
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	case body.err != nil && body.err != io.EOF:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	r.Body = body
+	if body.checked {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	verdict := &streamVerdict{}
+	body.reject = func(err error) int {
+		status := reject(err)
+		verdict.mu.Lock()
+		verdict.decided, verdict.status = status != 0, status
+		verdict.mu.Unlock()
+		return status
+	}
+	sw := &streamWriter{ResponseWriter: w, verdict: verdict}
+	next.ServeHTTP(sw, r)
+	if status := verdict.cutOff(); status != 0 && !sw.wrote {
+		sw.WriteHeader(status)
+	}
+}
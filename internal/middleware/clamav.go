@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClamAVScanner scans files with a clamd-compatible daemon using the INSTREAM
+// command. Address is a unix socket path ("/run/clamav/clamd.ctl") or host:port.
+type ClamAVScanner struct {
+	Address string
+	Timeout time.Duration // Per scan, default 10s
+}
+
+// clamChunkSize is how much we send per INSTREAM chunk. clamd rejects
+// streams above its StreamMaxLength, not chunks, so any size below that works.
+const clamChunkSize = 64 * 1024
+
+func (c *ClamAVScanner) Scan(data []byte) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.Address, "/") {
+		network = "unix"
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	conn, err := net.DialTimeout(network, c.Address, timeout)
+	if err != nil {
+		return "", fmt.Errorf("clamav: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// zINSTREAM\0, then <4-byte big-endian length><data> chunks, then a zero length.
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		n := min(len(data), clamChunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("clamav: %w", err)
+	}
+
+	// "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR", NUL-terminated.
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("clamav: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamav: %s", reply)
+	}
+}
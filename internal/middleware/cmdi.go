@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"regexp"
+	"strings"
+)
+
+// OS command injection.
+//
+// An injection needs two things: a way out of the intended command (";",
+// "|", "&", a newline, backticks or "$(") and a command after it. Shell
+// evasions are undone first: quotes and backslashes inside words
+// (c'a't, w\hoami) and $IFS standing in for a space.
+//
+// Commands that are also English words (cat, id, sleep...) only count with
+// an argument that looks like a shell's, so "Tom & Jerry; cat lovers" passes.
+
+// shellEvasions undoes quoting tricks that the shell ignores.
+var shellEvasions = strings.NewReplacer(
+	"${IFS}", " ", "$IFS$9", " ", "$IFS", " ",
+	`'`, "", `"`, "", `\`, "",
+)
+
+// cmdInjection is anchored: it is only tried where a separator starts (see
+// cmdSeparators). Searching a large body with it unanchored would run the
+// whole alternation at every byte.
+var cmdInjection = regexp.MustCompile(
+	// Separator, optionally a path to the binary
+	`^(?:[;&|\n\r` + "`" + `]|\$\()\s*(?:/(?:usr/)?(?:local/)?s?bin/)?` +
+		`(?:` +
+		// Commands nobody types in a form field
+		`(?:whoami|uname|wget|curl|nc|ncat|netcat|bash|zsh|ksh|sh|python[23]?|perl|ruby|php|` +
+		`powershell|pwsh|cmd(?:\.exe)?|busybox|chmod|chown|nslookup|ifconfig|ipconfig|` +
+		`telnet|tftp|systeminfo|net\s+user|certutil|bitsadmin)\b` +
+		// Word-like commands with a shell-looking argument
+		`|(?:cat|more|less|head|tail|type|nl|tac)\s+(?:[/\\.~]|[A-Za-z]:)` +
+		`|(?:ls|dir)\s*(?:-\w|/|\\|$)` +
+		`|id\s*(?:$|[;&|` + "`" + `)])` +
+		`|(?:sleep|ping)\s+(?:-\w+\s+)*\d` +
+		`|rm\s+-\w*[rf]` +
+		`|echo\s+[^\s;&|]+\s*(?:$|[;&|>` + "`" + `)])` +
+		`)`)
+
+// DetectCommandInjection reports whether the input chains a shell command,
+// and which.
+func DetectCommandInjection(input string) (bool, string) {
+	s := shellEvasions.Replace(input)
+	for i := 0; i < len(s); i++ {
+		j := strings.IndexAny(s[i:], cmdSeparators)
+		if j < 0 {
+			break
+		}
+		i += j
+		if m := cmdInjection.FindString(s[i:]); m != "" {
+			return true, "shell command: " + strings.TrimSpace(m)
+		}
+	}
+	return false, ""
+}
+
+// cmdSeparators are the bytes an injection can start with.
+const cmdSeparators = ";&|\n\r`$"
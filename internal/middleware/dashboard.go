@@ -6,6 +6,7 @@ import (
 	"html/template"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/princetheprogrammer/apisentinel/internal/logger"
 )
@@ -15,6 +16,13 @@ type DashboardData struct {
 	Stats      *Metrics
 	RecentLogs []logger.AuditEvent
 	BlockedIPs []string
+	Patches    []PatchRow
+}
+
+// PatchRow is a virtual patch as the dashboard shows it.
+type PatchRow struct {
+	VirtualPatch
+	Expired bool
 }
 
 const dashboardTemplate = `
@@ -45,6 +53,7 @@ const dashboardTemplate = `
             <h2>📊 METRICS</h2>
             <div>TOTAL REQUESTS: <span class="stat-value">{{.Stats.TotalRequests}}</span></div>
             <div style="color: #ff0000;">BLOCKED ATTACKS: <span class="stat-value">{{.Stats.BlockedRequests}}</span></div>
+            <div>MONITORED (WOULD BLOCK): <span class="stat-value">{{.Stats.MonitoredRequests}}</span></div>
         </div>
         
         <div class="card">
@@ -59,6 +68,36 @@ const dashboardTemplate = `
         </div>
     </div>
 
+    <div class="card" style="margin-top: 3rem;">
+        <h2>🩹 VIRTUAL PATCHES</h2>
+        <table>
+            <thead>
+                <tr>
+                    <th>ID</th>
+                    <th>DESCRIPTION</th>
+                    <th>ACTION</th>
+                    <th>HITS</th>
+                    <th>EXPIRES</th>
+                </tr>
+            </thead>
+            <tbody>
+                {{range .Patches}}
+                <tr>
+                    <td><code>{{.ID}}</code></td>
+                    <td>{{.Description}}</td>
+                    <td>{{.Action}}</td>
+                    <td class="violation">{{.Hits}}</td>
+                    <td>{{if .Expired}}EXPIRED{{else if .ExpiresAt}}{{.ExpiresAt.Format "2006-01-02 15:04:05"}}{{else}}never{{end}}</td>
+                </tr>
+                {{else}}
+                <tr>
+                    <td colspan="5" style="text-align: center;">No virtual patches.</td>
+                </tr>
+                {{end}}
+            </tbody>
+        </table>
+    </div>
+
     <div class="card danger" style="margin-top: 3rem;">
         <h2>📜 RECENT SECURITY AUDIT LOGS</h2>
         <table>
@@ -79,7 +118,7 @@ const dashboardTemplate = `
                     <td><code>{{.RequestID}}</code></td>
                     <td>{{.Location}}</td>
                     <td>{{.SourceIP}}</td>
-                    <td class="violation">{{.ViolationType}}</td>
+                    <td class="violation">{{.ViolationType}}{{if .WouldHaveBlocked}} (MONITOR){{end}}</td>
                     <td>{{.Path}}</td>
                 </tr>
                 {{else}}
@@ -99,7 +138,7 @@ const dashboardTemplate = `
 `
 
 // DashboardHandler renders the HTML dashboard.
-func DashboardHandler(bl *IPBlocklist, auditPath string) http.HandlerFunc {
+func DashboardHandler(bl *IPBlocklist, patches *VirtualPatches, auditPath string) http.HandlerFunc {
 	tmpl := template.Must(template.New("dashboard").Parse(dashboardTemplate))
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -119,6 +158,12 @@ func DashboardHandler(bl *IPBlocklist, auditPath string) http.HandlerFunc {
 		// 2. Read Recent Logs
 		data.RecentLogs = readLastLogs(auditPath, 10)
 
+		// 3. Virtual patches and their hits
+		now := time.Now()
+		for _, p := range patches.List() {
+			data.Patches = append(data.Patches, PatchRow{VirtualPatch: p, Expired: p.Expired(now)})
+		}
+
 		w.Header().Set("Content-Type", "text/html")
 		tmpl.Execute(w, data)
 	}
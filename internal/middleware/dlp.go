@@ -9,6 +9,13 @@ import (
 	"github.com/princetheprogrammer/apisentinel/internal/logger"
 )
 
+// Pattern defines a sensitive-data signature to look for.
+type Pattern struct {
+	Name    string
+	Regexp  *regexp.Regexp
+	Message string
+}
+
 // DLPMiddleware scans outgoing responses for sensitive data leaks.
 type DLPMiddleware struct {
 	patterns []Pattern
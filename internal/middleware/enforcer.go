@@ -0,0 +1,438 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/princetheprogrammer/apisentinel/internal/logger"
+)
+
+// SchemaOptions configures a SchemaEnforcer.
+type SchemaOptions struct {
+	// BasePath is stripped from request paths before matching the spec's
+	// paths. Default: the path of the spec's first server URL.
+	BasePath string
+	Mode     string // ModeBlock (default) or ModeMonitor
+
+	// ValidateResponses checks backend responses against the spec and
+	// audits any drift. Responses are never blocked or changed.
+	ValidateResponses bool
+
+	// AllowUndeclaredQuery lets through query parameters the operation
+	// doesn't declare. By default they are rejected like any other
+	// violation: ?debug=1 is exactly what a positive model is for.
+	AllowUndeclaredQuery bool
+}
+
+// SchemaEnforcer is a positive security model: only requests the OpenAPI
+// spec describes get through. Unknown paths are 404, undeclared methods 405,
+// and parameters or JSON bodies that don't match their schema 400.
+type SchemaEnforcer struct {
+	spec *OpenAPISpec
+	opts SchemaOptions
+}
+
+func NewSchemaEnforcer(spec *OpenAPISpec, opts SchemaOptions) *SchemaEnforcer {
+	if opts.BasePath == "" {
+		opts.BasePath = spec.BasePath()
+	}
+	opts.BasePath = strings.TrimSuffix(opts.BasePath, "/")
+	if opts.Mode == "" {
+		opts.Mode = ModeBlock
+	}
+	return &SchemaEnforcer{spec: spec, opts: opts}
+}
+
+// maxResponseCapture is how much of a response body is kept for validation.
+// Larger responses are passed through unchecked.
+const maxResponseCapture = 1 << 20
+
+// maxValidatedBody is how much of a JSON request body is read to validate
+// it against its schema. Larger ones are rejected: they can't be checked
+// without holding them whole.
+const maxValidatedBody = 10 << 20
+
+// schemaError is a request the spec doesn't allow.
+type schemaError struct {
+	status  int
+	details []string
+	allow   string // Allow header for 405
+}
+
+func (e *schemaError) Error() string { return strings.Join(e.details, "; ") }
+
+func (e *SchemaEnforcer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, err := e.check(r)
+		if err != nil {
+			var se *schemaError
+			if !errors.As(err, &se) {
+				se = &schemaError{status: http.StatusBadRequest, details: []string{err.Error()}}
+			}
+			if e.reject(w, r, se) {
+				return
+			}
+		}
+
+		if !e.opts.ValidateResponses || op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if drift := e.checkResponse(op, rec); len(drift) > 0 {
+			details := strings.Join(drift, "; ")
+			log.Printf("📐 Response schema drift on %s %s: %s", r.Method, r.URL.Path, details)
+			logger.LogEvent(r.Header.Get("X-Request-ID"), sourceIP(r), r.Method, r.URL.Path, "Response Schema Drift", details)
+		}
+	})
+}
+
+// reject answers a request that violates the spec. In monitor mode it only
+// audits and returns false.
+func (e *SchemaEnforcer) reject(w http.ResponseWriter, r *http.Request, se *schemaError) bool {
+	event := logger.AuditEvent{
+		RequestID:     r.Header.Get("X-Request-ID"),
+		SourceIP:      sourceIP(r),
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		ViolationType: "Schema Violation",
+		Details:       se.Error(),
+	}
+
+	if e.opts.Mode == ModeMonitor {
+		log.Printf("👀 API Sentinel [monitor]: Request doesn't match the OpenAPI spec: %s", event.Details)
+		event.Details = "Would have blocked: " + event.Details
+		event.WouldHaveBlocked = true
+		logger.Log(event)
+		IncrementMonitored()
+		return false
+	}
+
+	log.Printf("📐 Schema violation on %s %s: %s", r.Method, r.URL.Path, event.Details)
+	logger.Log(event)
+	IncrementBlocked()
+	if se.allow != "" {
+		w.Header().Set("Allow", se.allow)
+	}
+	http.Error(w, http.StatusText(se.status)+": "+event.Details, se.status)
+	return true
+}
+
+// check validates a request and returns its operation.
+func (e *SchemaEnforcer) check(r *http.Request) (*Operation, error) {
+	path, ok := strings.CutPrefix(r.URL.Path, e.opts.BasePath)
+	if !ok || path != "" && path[0] != '/' {
+		return nil, &schemaError{status: http.StatusNotFound, details: []string{"path not in the API spec"}}
+	}
+	template, pathParams, ok := e.spec.Match(path)
+	if !ok {
+		return nil, &schemaError{status: http.StatusNotFound, details: []string{"path not in the API spec"}}
+	}
+
+	item := e.spec.Paths[template]
+	ops := item.Operations()
+	op, ok := ops[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		op, ok = ops[http.MethodGet]
+	}
+	if !ok {
+		methods := make([]string, 0, len(ops))
+		for m := range ops {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		return nil, &schemaError{
+			status:  http.StatusMethodNotAllowed,
+			details: []string{fmt.Sprintf("method %s not allowed on %s", r.Method, template)},
+			allow:   strings.Join(methods, ", "),
+		}
+	}
+
+	v := &schemaValidator{spec: e.spec}
+	params := e.parameters(item, op)
+	if !e.opts.AllowUndeclaredQuery {
+		e.checkUndeclaredQuery(v, r, params)
+	}
+	for _, p := range params {
+		raw := paramValues(r, p, pathParams)
+		if len(raw) == 0 {
+			if p.Required || p.In == "path" {
+				v.fail(p.In+"."+p.Name, "is required")
+			}
+			continue
+		}
+		if sc := e.spec.schema(p.Schema); len(raw) > 1 && sc != nil && sc.Type != "array" {
+			// Backends take the first value or the last; only one would be checked.
+			v.fail(p.In+"."+p.Name, "must not be repeated")
+			continue
+		}
+		v.validate(p.Schema, e.spec.coerceParam(p.Schema, raw), p.In+"."+p.Name, 0)
+	}
+	if len(v.errs) > 0 {
+		return op, &schemaError{status: http.StatusBadRequest, details: v.errs}
+	}
+
+	return op, e.checkBody(r, op)
+}
+
+// parameters merges path-level and operation parameters; the operation's
+// win when both declare the same name and location.
+func (e *SchemaEnforcer) parameters(item *PathItem, op *Operation) []*Parameter {
+	var params []*Parameter
+	seen := make(map[string]bool)
+	for _, list := range [][]*Parameter{op.Parameters, item.Parameters} {
+		for _, p := range list {
+			p = e.spec.parameter(p)
+			if p == nil || p.Name == "" {
+				continue
+			}
+			key := p.In + "\x00" + strings.ToLower(p.Name)
+			if !seen[key] {
+				seen[key] = true
+				params = append(params, p)
+			}
+		}
+	}
+	return params
+}
+
+// checkUndeclaredQuery fails every query parameter not in params. Names
+// are matched exactly, as in paramValues.
+func (e *SchemaEnforcer) checkUndeclaredQuery(v *schemaValidator, r *http.Request, params []*Parameter) {
+	declared := make(map[string]bool)
+	for _, p := range params {
+		if p.In == "query" {
+			declared[p.Name] = true
+		}
+	}
+	var names []string
+	for name := range r.URL.Query() {
+		if !declared[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v.fail("query."+name, "is not allowed")
+	}
+}
+
+func paramValues(r *http.Request, p *Parameter, pathParams map[string]string) []string {
+	switch p.In {
+	case "path":
+		if v, ok := pathParams[p.Name]; ok {
+			return []string{v}
+		}
+	case "query":
+		return r.URL.Query()[p.Name]
+	case "header":
+		return r.Header.Values(p.Name)
+	case "cookie":
+		if c, err := r.Cookie(p.Name); err == nil {
+			return []string{c.Value}
+		}
+	}
+	return nil
+}
+
+// checkBody validates the request body against the operation's requestBody.
+// Only JSON bodies with a schema are read whole, up to maxValidatedBody;
+// of the others, one byte is read to tell whether there is a body at all.
+// The body is restored for the next handler.
+func (e *SchemaEnforcer) checkBody(r *http.Request, op *Operation) error {
+	empty, err := peekBody(r)
+	if err != nil {
+		return bodyReadError(err)
+	}
+
+	rb := e.spec.requestBody(op.RequestBody)
+	if rb == nil {
+		if !empty {
+			return &schemaError{status: http.StatusBadRequest, details: []string{"request body not allowed"}}
+		}
+		return nil
+	}
+	if empty {
+		if rb.Required {
+			return &schemaError{status: http.StatusBadRequest, details: []string{"request body is required"}}
+		}
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	media, ok := lookupMedia(rb.Content, mediaType)
+	if !ok {
+		return &schemaError{status: http.StatusUnsupportedMediaType, details: []string{fmt.Sprintf("content type %q not allowed", mediaType)}}
+	}
+	if media == nil || media.Schema == nil || !isJSONMedia(mediaType) {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxValidatedBody+1))
+	if err != nil {
+		return bodyReadError(err)
+	}
+	if len(body) > maxValidatedBody {
+		return &schemaError{status: http.StatusRequestEntityTooLarge, details: []string{fmt.Sprintf("JSON body over %d bytes can't be validated", maxValidatedBody)}}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	value, err := decodeJSON(body)
+	if err != nil {
+		return &schemaError{status: http.StatusBadRequest, details: []string{"invalid JSON body: " + err.Error()}}
+	}
+	v := &schemaValidator{spec: e.spec}
+	v.validate(media.Schema, value, "body", 0)
+	if len(v.errs) > 0 {
+		return &schemaError{status: http.StatusBadRequest, details: v.errs}
+	}
+	return nil
+}
+
+// peekBody reports whether the request has no body, reading at most one
+// byte of it. The byte is put back.
+func peekBody(r *http.Request) (empty bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+	var b [1]byte
+	n, err := io.ReadFull(r.Body, b[:])
+	if n == 0 {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b[:n]), r.Body), r.Body}
+	return false, nil
+}
+
+// bodyReadError turns a failed body read into a 413 if the body was too
+// large.
+func bodyReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &schemaError{status: http.StatusRequestEntityTooLarge, details: []string{"request body too large"}}
+	}
+	return err
+}
+
+// lookupMedia finds the content entry for a media type: exact, then
+// "type/*", then "*/*".
+func lookupMedia(content map[string]*MediaType, mediaType string) (*MediaType, bool) {
+	if len(content) == 0 {
+		return nil, true // Nothing declared: any type
+	}
+	candidates := []string{mediaType, "*/*"}
+	if i := strings.IndexByte(mediaType, '/'); i > 0 {
+		candidates = []string{mediaType, mediaType[:i] + "/*", "*/*"}
+	}
+	for _, c := range candidates {
+		for key, m := range content {
+			if strings.EqualFold(key, c) {
+				return m, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func isJSONMedia(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeJSON decodes exactly one JSON value, keeping numbers as json.Number.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+// --- Response validation ---
+
+// responseCapture passes a response through and keeps a copy of its start.
+type responseCapture struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+	c.status = code
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	room := maxResponseCapture - c.body.Len()
+	if len(b) > room {
+		c.truncated = true
+	}
+	c.body.Write(b[:min(len(b), max(room, 0))])
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *responseCapture) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// checkResponse compares a captured response with the operation's responses.
+func (e *SchemaEnforcer) checkResponse(op *Operation, rec *responseCapture) []string {
+	if len(op.Responses) == 0 {
+		return nil
+	}
+	code := strconv.Itoa(rec.status)
+	resp, ok := op.Responses[code]
+	if !ok {
+		resp, ok = op.Responses[code[:1]+"XX"]
+	}
+	if !ok {
+		resp, ok = op.Responses["default"]
+	}
+	if !ok {
+		return []string{"undocumented status " + code}
+	}
+
+	resp = e.spec.response(resp)
+	if resp == nil || len(resp.Content) == 0 || rec.truncated || rec.body.Len() == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	media, ok := lookupMedia(resp.Content, mediaType)
+	if !ok {
+		return []string{fmt.Sprintf("status %s: undocumented content type %q", code, mediaType)}
+	}
+	if media == nil || media.Schema == nil || !isJSONMedia(mediaType) {
+		return nil
+	}
+
+	value, err := decodeJSON(rec.body.Bytes())
+	if err != nil {
+		return []string{fmt.Sprintf("status %s: invalid JSON: %v", code, err)}
+	}
+	v := &schemaValidator{spec: e.spec}
+	v.validate(media.Schema, value, "response", 0)
+	return v.errs
+}
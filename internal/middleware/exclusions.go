@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Exclusion keeps rules from inspecting part of a request. It is how a false
+// positive on one parameter is tuned away without disabling a whole
+// category. Empty scopes match anything.
+type Exclusion struct {
+	Rules   []string // Rule IDs
+	Path    string   // The request path, or a prefix of it ending at a "/"
+	Methods []string
+	Target  string // TargetQuery, TargetBody...
+	Field   string // Parameter, header or cookie name, or JSON path; "*" matches any run of characters
+}
+
+// appliesTo reports whether the exclusion is scoped to this request.
+func (e *Exclusion) appliesTo(r *http.Request) bool {
+	if e.Path != "" && !pathUnder(r.URL.Path, e.Path) {
+		return false
+	}
+	return len(e.Methods) == 0 || slices.Contains(e.Methods, r.Method)
+}
+
+// pathUnder reports whether path is prefix or below it, segment by segment:
+// "/api/tickets" covers "/api/tickets/7" but not "/api/tickets-admin".
+func pathUnder(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// covers reports whether the exclusion keeps rule from inspecting f.
+func (e *Exclusion) covers(rule *Rule, f *field) bool {
+	if len(e.Rules) > 0 && !slices.Contains(e.Rules, rule.ID) {
+		return false
+	}
+	if e.Target != "" && e.Target != f.target {
+		return false
+	}
+	return e.Field == "" || wildcardMatch(e.Field, f.name)
+}
+
+// exclusionsFor returns the exclusions scoped to r.
+func (si *SecurityInspector) exclusionsFor(r *http.Request) []*Exclusion {
+	var active []*Exclusion
+	for i := range si.exclusions {
+		if si.exclusions[i].appliesTo(r) {
+			active = append(active, &si.exclusions[i])
+		}
+	}
+	return active
+}
+
+// excluded reports whether one of the request's exclusions keeps rule from
+// inspecting f.
+func (ev *evaluation) excluded(rule *Rule, f *field) bool {
+	for _, e := range ev.exclusions {
+		if e.covers(rule, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch matches name against pattern, where "*" stands for any run
+// of characters: "items[*].note" matches "items[3].note". Unlike path.Match,
+// brackets are literal, as they are in JSON paths.
+func wildcardMatch(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, p)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(p):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
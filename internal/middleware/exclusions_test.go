@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"description", "description", true},
+		{"description", "ticket.description", false},
+		{"*.description", "ticket.description", true},
+		{"items[*].note", "items[12].note", true},
+		{"items[*].note", "items[1].title", false},
+		{"items[0].note", "items[0].note", true},
+		{"items[0].note", "items[1].note", false},
+		{"*", "anything", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"ab*ba", "aba", false},
+	}
+	for _, tt := range tests {
+		if got := wildcardMatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - id: "100001"
+    targets: [query, body]
+    operator: contains
+    value: "drop table"
+  - id: "100002"
+    targets: [query, body]
+    operator: contains
+    value: "union select"
+`), "test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	si := NewSecurityInspector(InspectorOptions{
+		Rules: rules,
+		Exclusions: []Exclusion{
+			// Tickets describe database problems all day.
+			{Rules: []string{"100001"}, Path: "/api/tickets", Methods: []string{"POST"}, Target: TargetBody, Field: "description"},
+			{Path: "/api/search", Target: TargetQuery, Field: "q"},
+			{Rules: []string{"100002"}, Field: "items[*].sql"},
+		},
+	})
+	handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name, method, url, body string
+		want                    int
+	}{
+		{"excluded field", "POST", "/api/tickets", `{"description": "someone ran drop table"}`, http.StatusOK},
+		{"other rule on the excluded field", "POST", "/api/tickets", `{"description": "union select 1"}`, http.StatusForbidden},
+		{"other field", "POST", "/api/tickets", `{"title": "drop table"}`, http.StatusForbidden},
+		{"other method", "PUT", "/api/tickets", `{"description": "drop table"}`, http.StatusForbidden},
+		{"other path", "POST", "/api/users", `{"description": "drop table"}`, http.StatusForbidden},
+		{"path below", "POST", "/api/tickets/7", `{"description": "someone ran drop table"}`, http.StatusOK},
+		{"path sharing a prefix", "POST", "/api/tickets-admin", `{"description": "drop table"}`, http.StatusForbidden},
+		{"other target", "POST", "/api/tickets?description=drop+table", "", http.StatusForbidden},
+		{"every rule", "GET", "/api/search?q=drop+table+union+select", "", http.StatusOK},
+		{"every rule, other field", "GET", "/api/search?sort=drop+table", "", http.StatusForbidden},
+		{"array wildcard", "POST", "/batch", `{"items": [{"sql": "ok"}, {"sql": "union select"}]}`, http.StatusOK},
+		{"array wildcard, other rule", "POST", "/batch", `{"items": [{"sql": "drop table"}]}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("got %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,678 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GraphQL inspection.
+//
+// A GraphQL request is one JSON string full of syntax, so running the rules
+// over it finds either nothing or noise. In GraphQL mode the operation is
+// parsed instead: limits are enforced on its shape, and the rules run over
+// each argument value and variable on its own.
+
+// GraphQLLimits bounds the shape of GraphQL operations. Zero means unlimited.
+type GraphQLLimits struct {
+	MaxDepth           int  // Nesting of selection sets
+	MaxAliases         int  // Aliased fields (a common batching/DoS trick)
+	MaxFields          int  // Fields after expanding fragments
+	MaxCost            int  // See gqlDocument.cost
+	BlockIntrospection bool // Reject __schema and __type queries
+}
+
+// maxGraphQLNesting stops the parser before pathological input exhausts the stack.
+const maxGraphQLNesting = 128
+
+// graphqlWalkLimit stops counting once an operation is clearly too big, so
+// fragments that spread each other many times can't make the check itself slow.
+const graphqlWalkLimit = 1_000_000
+
+// listArgs are arguments that multiply the cost of a field's children.
+var listArgs = []string{"first", "last", "limit", "take", "pageSize"}
+
+// graphqlRequest is one operation as sent over HTTP.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphqlRequests extracts the operations from a request: JSON (single or
+// batched) or application/graphql in the body, and ?query=...&variables=...
+// in the URL whatever the method. A request with no query isn't GraphQL; one
+// with a query we can't read is an error, since the backend may read it.
+func graphqlRequests(r *http.Request, body []byte) ([]graphqlRequest, error) {
+	var reqs []graphqlRequest
+
+	// Servers read the URL on a POST too, some of them before the body.
+	if hasURLQuery(r) {
+		q := r.URL.Query()
+		if len(q["query"]) > 1 {
+			return nil, fmt.Errorf("query sent %d times in the URL", len(q["query"]))
+		}
+		req := graphqlRequest{Query: q.Get("query"), OperationName: q.Get("operationName")}
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return nil, fmt.Errorf("URL variables: %v", err)
+			}
+		}
+		reqs = append(reqs, req)
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case len(body) == 0:
+	case strings.Contains(contentType, "application/graphql"):
+		reqs = append(reqs, graphqlRequest{Query: string(body)})
+
+	case strings.Contains(contentType, "application/json"):
+		var batch []graphqlRequest
+		var err error
+		if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+			err = json.Unmarshal(body, &batch)
+		} else {
+			var req graphqlRequest
+			err = json.Unmarshal(body, &req)
+			batch = []graphqlRequest{req}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("body: %v", err)
+		}
+		for _, req := range batch {
+			// A persisted query sends only its hash: there's nothing to measure.
+			if req.Query != "" {
+				reqs = append(reqs, req)
+			}
+		}
+	}
+	return reqs, nil
+}
+
+// hasURLQuery reports whether the URL carries an operation.
+func hasURLQuery(r *http.Request) bool {
+	q := r.URL.Query()
+	return len(q["query"]) > 1 || q.Get("query") != ""
+}
+
+// isGraphQLBody reports whether graphqlRequests would look for an operation
+// in the body.
+func isGraphQLBody(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return strings.Contains(contentType, "application/graphql") || strings.Contains(contentType, "application/json")
+}
+
+// graphqlViolation is a limit an operation exceeded.
+type graphqlViolation struct {
+	violation string
+	details   string
+}
+
+// analyzeGraphQL parses every operation, checks it against the limits and
+// returns the fields to inspect (argument values and variables) along with
+// the first limit exceeded, if any.
+func analyzeGraphQL(reqs []graphqlRequest, limits GraphQLLimits) ([]field, *graphqlViolation, error) {
+	var fields []field
+	var violation *graphqlViolation
+	for _, req := range reqs {
+		doc, err := parseGraphQL(req.Query)
+		if err != nil {
+			return nil, nil, err
+		}
+		if v := doc.check(limits); v != nil && violation == nil {
+			violation = v
+		}
+
+		fields = append(fields, doc.args...)
+		if req.OperationName != "" {
+			fields = append(fields, field{target: TargetBody, source: "GraphQL", name: "operationName", value: req.OperationName})
+		}
+		for name, v := range req.Variables {
+			fields = append(fields, field{target: TargetKeys, source: "GraphQL variable", name: "$" + name, value: name})
+			fields = jsonFields(v, "$"+name, fields)
+		}
+	}
+	return fields, violation, nil
+}
+
+// --- Document model ---
+
+type gqlSelection struct {
+	name       string
+	alias      string
+	spread     string // Fragment name for "...Name"
+	multiplier int    // Value of a list argument like first: 50, or 1
+	children   []*gqlSelection
+}
+
+type gqlDocument struct {
+	operations [][]*gqlSelection
+	fragments  map[string][]*gqlSelection
+	args       []field // Every argument name and leaf value, e.g. "user(id)"
+}
+
+// check enforces the limits on every operation in the document.
+func (d *gqlDocument) check(l GraphQLLimits) *graphqlViolation {
+	for _, op := range d.operations {
+		s := gqlStats{}
+		d.walk(op, 1, &s, map[string]bool{})
+
+		switch {
+		case l.BlockIntrospection && s.introspection:
+			return &graphqlViolation{"GraphQL Introspection", "__schema/__type queries are disabled"}
+		case l.MaxDepth > 0 && s.depth > l.MaxDepth:
+			return &graphqlViolation{"GraphQL Query Too Deep", fmt.Sprintf("depth %d exceeds %d", s.depth, l.MaxDepth)}
+		case l.MaxAliases > 0 && s.aliases > l.MaxAliases:
+			return &graphqlViolation{"GraphQL Too Many Aliases", fmt.Sprintf("%d aliases exceed %d", s.aliases, l.MaxAliases)}
+		case l.MaxFields > 0 && s.fields > l.MaxFields:
+			return &graphqlViolation{"GraphQL Too Many Fields", fmt.Sprintf("%d fields exceed %d", s.fields, l.MaxFields)}
+		}
+		if l.MaxCost > 0 {
+			if cost := d.cost(op, map[string]bool{}); cost > l.MaxCost {
+				return &graphqlViolation{"GraphQL Query Too Expensive", fmt.Sprintf("cost %d exceeds %d", cost, l.MaxCost)}
+			}
+		}
+	}
+	return nil
+}
+
+type gqlStats struct {
+	depth, aliases, fields int
+	introspection          bool
+}
+
+// walk collects stats over a selection set, expanding fragment spreads.
+// seen guards against fragment cycles.
+func (d *gqlDocument) walk(set []*gqlSelection, depth int, s *gqlStats, seen map[string]bool) {
+	for _, sel := range set {
+		if s.fields > graphqlWalkLimit {
+			return
+		}
+		if sel.spread != "" {
+			if !seen[sel.spread] {
+				seen[sel.spread] = true
+				d.walk(d.fragments[sel.spread], depth, s, seen)
+				delete(seen, sel.spread)
+			}
+			continue
+		}
+		if sel.name == "" { // Inline fragment: same level
+			d.walk(sel.children, depth, s, seen)
+			continue
+		}
+
+		s.fields++
+		s.depth = max(s.depth, depth)
+		if sel.alias != "" {
+			s.aliases++
+		}
+		if sel.name == "__schema" || sel.name == "__type" {
+			s.introspection = true
+		}
+		d.walk(sel.children, depth+1, s, seen)
+	}
+}
+
+// cost is the number of objects an operation could resolve: each field costs
+// 1, and a list argument (first: 100) multiplies the cost of its children.
+func (d *gqlDocument) cost(set []*gqlSelection, seen map[string]bool) int {
+	total := 0
+	for _, sel := range set {
+		if total > graphqlWalkLimit {
+			return total
+		}
+		switch {
+		case sel.spread != "":
+			if !seen[sel.spread] {
+				seen[sel.spread] = true
+				total += d.cost(d.fragments[sel.spread], seen)
+				delete(seen, sel.spread)
+			}
+		case sel.name == "":
+			total += d.cost(sel.children, seen)
+		default:
+			total += 1 + sel.multiplier*min(d.cost(sel.children, seen), graphqlWalkLimit)
+		}
+	}
+	return total
+}
+
+// --- Parser ---
+
+// parseGraphQL parses an executable document (operations and fragments).
+func parseGraphQL(query string) (*gqlDocument, error) {
+	p := &gqlParser{lex: gqlLexer{src: query}}
+	p.next()
+	doc := &gqlDocument{fragments: make(map[string][]*gqlSelection)}
+	p.doc = doc
+
+	for p.tok.kind != gqlEOF {
+		switch {
+		case p.tok.kind == '{':
+			set, err := p.selectionSet("")
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, set)
+
+		case p.tok.kind == gqlName && (p.tok.text == "query" || p.tok.text == "mutation" || p.tok.text == "subscription"):
+			p.next()
+			if p.tok.kind == gqlName {
+				p.next()
+			}
+			if p.tok.kind == '(' {
+				if err := p.skipBalanced('(', ')'); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.directives(""); err != nil {
+				return nil, err
+			}
+			set, err := p.selectionSet("")
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, set)
+
+		case p.tok.kind == gqlName && p.tok.text == "fragment":
+			p.next()
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			if p.tok.kind != gqlName || p.tok.text != "on" {
+				return nil, p.errorf("expected \"on\"")
+			}
+			p.next()
+			if _, err := p.expectName(); err != nil {
+				return nil, err
+			}
+			if err := p.directives(name); err != nil {
+				return nil, err
+			}
+			set, err := p.selectionSet(name)
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = set
+
+		default:
+			return nil, p.errorf("unexpected %q", p.tok.text)
+		}
+		if p.lex.err != nil {
+			return nil, p.lex.err
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("graphql: no operation")
+	}
+	return doc, nil
+}
+
+type gqlParser struct {
+	lex     gqlLexer
+	tok     gqlToken
+	doc     *gqlDocument
+	nesting int
+}
+
+func (p *gqlParser) next() { p.tok = p.lex.next() }
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	if p.lex.err != nil {
+		return p.lex.err
+	}
+	return fmt.Errorf("graphql: offset %d: %s", p.lex.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *gqlParser) expectName() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", p.errorf("expected a name, got %q", p.tok.text)
+	}
+	name := p.tok.text
+	p.next()
+	return name, nil
+}
+
+func (p *gqlParser) enter() error {
+	p.nesting++
+	if p.nesting > maxGraphQLNesting {
+		return p.errorf("nested too deeply")
+	}
+	return nil
+}
+
+// selectionSet parses { ... }. path names the enclosing field for argument fields.
+func (p *gqlParser) selectionSet(path string) ([]*gqlSelection, error) {
+	if p.tok.kind != '{' {
+		return nil, p.errorf("expected '{', got %q", p.tok.text)
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.nesting-- }()
+	p.next()
+
+	var set []*gqlSelection
+	for p.tok.kind != '}' {
+		if p.tok.kind == gqlEOF {
+			return nil, p.errorf("unterminated selection set")
+		}
+		sel, err := p.selection(path)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, sel)
+	}
+	p.next()
+	return set, nil
+}
+
+func (p *gqlParser) selection(path string) (*gqlSelection, error) {
+	if p.tok.kind == gqlSpread {
+		p.next()
+		// ...Name is a fragment spread; "... on Type" or "... {" is inline.
+		if p.tok.kind == gqlName && p.tok.text != "on" {
+			sel := &gqlSelection{spread: p.tok.text}
+			p.next()
+			return sel, p.directives(path)
+		}
+		if p.tok.kind == gqlName && p.tok.text == "on" {
+			p.next()
+			if _, err := p.expectName(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.directives(path); err != nil {
+			return nil, err
+		}
+		children, err := p.selectionSet(path)
+		return &gqlSelection{children: children}, err
+	}
+
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	sel := &gqlSelection{name: name, multiplier: 1}
+	if p.tok.kind == ':' {
+		p.next()
+		sel.alias = name
+		if sel.name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+
+	fieldPath := sel.name
+	if path != "" {
+		fieldPath = path + "." + sel.name
+	}
+
+	if p.tok.kind == '(' {
+		if err := p.arguments(fieldPath, sel); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.directives(fieldPath); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == '{' {
+		if sel.children, err = p.selectionSet(fieldPath); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+// arguments parses (name: value, ...). If sel is set, list arguments set its multiplier.
+func (p *gqlParser) arguments(path string, sel *gqlSelection) error {
+	p.next() // (
+	for p.tok.kind != ')' {
+		name, err := p.expectName()
+		if err != nil {
+			return err
+		}
+		if p.tok.kind != ':' {
+			return p.errorf("expected ':' after argument %s", name)
+		}
+		p.next()
+
+		if sel != nil && p.tok.kind == gqlInt {
+			for _, la := range listArgs {
+				if name == la {
+					if n, err := strconv.Atoi(p.tok.text); err == nil && n > 0 {
+						sel.multiplier = min(n, graphqlWalkLimit)
+					}
+				}
+			}
+		}
+		p.doc.args = append(p.doc.args, field{target: TargetKeys, source: "GraphQL argument", name: path + "(" + name + ")", value: name})
+		if err := p.value(path + "(" + name + ")"); err != nil {
+			return err
+		}
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) directives(path string) error {
+	for p.tok.kind == '@' {
+		p.next()
+		name, err := p.expectName()
+		if err != nil {
+			return err
+		}
+		if p.tok.kind == '(' {
+			if err := p.arguments(path+"@"+name, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// value parses an argument value, recording every leaf as a field.
+func (p *gqlParser) value(path string) error {
+	if err := p.enter(); err != nil {
+		return err
+	}
+	defer func() { p.nesting-- }()
+
+	switch p.tok.kind {
+	case '$':
+		p.next()
+		_, err := p.expectName() // Variables are inspected from the variables object
+		return err
+
+	case gqlString, gqlInt, gqlFloat, gqlName:
+		p.doc.args = append(p.doc.args, field{target: TargetBody, source: "GraphQL argument", name: path, value: p.tok.text})
+		p.next()
+		return nil
+
+	case '[':
+		p.next()
+		for i := 0; p.tok.kind != ']'; i++ {
+			if p.tok.kind == gqlEOF {
+				return p.errorf("unterminated list")
+			}
+			if err := p.value(path + "[" + strconv.Itoa(i) + "]"); err != nil {
+				return err
+			}
+		}
+		p.next()
+		return nil
+
+	case '{':
+		p.next()
+		for p.tok.kind != '}' {
+			name, err := p.expectName()
+			if err != nil {
+				return err
+			}
+			if p.tok.kind != ':' {
+				return p.errorf("expected ':' after %s", name)
+			}
+			p.next()
+			p.doc.args = append(p.doc.args, field{target: TargetKeys, source: "GraphQL argument", name: path + "." + name, value: name})
+			if err := p.value(path + "." + name); err != nil {
+				return err
+			}
+		}
+		p.next()
+		return nil
+	}
+	return p.errorf("unexpected %q in value", p.tok.text)
+}
+
+// skipBalanced skips a bracketed group such as variable definitions.
+func (p *gqlParser) skipBalanced(open, close byte) error {
+	depth := 0
+	for {
+		switch p.tok.kind {
+		case gqlEOF:
+			return p.errorf("unterminated %c", open)
+		case open:
+			depth++
+		case close:
+			depth--
+		}
+		p.next()
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// --- Lexer ---
+
+// Token kinds. Punctuators use their own byte.
+const (
+	gqlEOF    byte = 0
+	gqlName   byte = 'N'
+	gqlInt    byte = 'I'
+	gqlFloat  byte = 'F'
+	gqlString byte = 'S'
+	gqlSpread byte = '.'
+)
+
+type gqlToken struct {
+	kind byte
+	text string // Strings are unquoted
+}
+
+type gqlLexer struct {
+	src string
+	pos int
+	err error
+}
+
+func (l *gqlLexer) next() gqlToken {
+	// Whitespace, commas, byte order marks and comments are insignificant.
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.pos++
+			continue
+		}
+		if strings.HasPrefix(l.src[l.pos:], "\ufeff") {
+			l.pos += len("\ufeff")
+			continue
+		}
+		if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+			continue
+		}
+		break
+	}
+	if l.pos >= len(l.src) || l.err != nil {
+		return gqlToken{kind: gqlEOF}
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		l.pos++
+		return gqlToken{kind: c, text: string(c)}
+
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{kind: gqlSpread, text: "..."}
+
+	case c == '"':
+		return l.string()
+
+	case c == '_' || isASCIILetter(c):
+		start := l.pos
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isASCIILetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return gqlToken{kind: gqlName, text: l.src[start:l.pos]}
+
+	case c == '-' || isDigit(c):
+		start := l.pos
+		l.pos++
+		kind := gqlInt
+		for l.pos < len(l.src) {
+			d := l.src[l.pos]
+			if d == '.' || d == 'e' || d == 'E' || d == '+' || d == '-' {
+				kind = gqlFloat
+			} else if !isDigit(d) {
+				break
+			}
+			l.pos++
+		}
+		return gqlToken{kind: kind, text: l.src[start:l.pos]}
+	}
+
+	l.err = fmt.Errorf("graphql: offset %d: unexpected character %q", l.pos, c)
+	return gqlToken{kind: gqlEOF}
+}
+
+// string reads a "string" or a """block string""".
+func (l *gqlLexer) string() gqlToken {
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		// The only escape in a block string is \""", which doesn't end it.
+		from := l.pos + 3
+		for {
+			end := strings.Index(l.src[from:], `"""`)
+			if end < 0 {
+				l.err = fmt.Errorf("graphql: unterminated block string")
+				return gqlToken{kind: gqlEOF}
+			}
+			end += from
+			if l.src[end-1] == '\\' {
+				from = end + 3
+				continue
+			}
+			text := strings.ReplaceAll(l.src[l.pos+3:end], `\"""`, `"""`)
+			l.pos = end + 3
+			return gqlToken{kind: gqlString, text: text}
+		}
+	}
+
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.src) && l.src[l.pos] != '"' && l.src[l.pos] != '\n' {
+		if l.src[l.pos] == '\\' {
+			l.pos++
+		}
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '"' {
+		l.err = fmt.Errorf("graphql: unterminated string")
+		return gqlToken{kind: gqlEOF}
+	}
+	l.pos++
+
+	// GraphQL string escapes are a subset of JSON's.
+	var text string
+	if err := json.Unmarshal([]byte(l.src[start:l.pos]), &text); err != nil {
+		text = l.src[start+1 : l.pos-1]
+	}
+	return gqlToken{kind: gqlString, text: text}
+}
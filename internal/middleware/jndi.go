@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"regexp"
+	"strings"
+)
+
+// JNDI lookups (Log4Shell, CVE-2021-44228).
+//
+// Log4j 2 expands ${...} in anything it logs, and ${jndi:ldap://...} loads
+// a class from the attacker's server. Payloads hide "jndi" behind other
+// lookups that log4j resolves first: ${${lower:j}ndi:...},
+// ${${::-j}${::-n}di:...}, ${${env:NOPE:-j}ndi:...}. Those are resolved
+// here the same way, innermost first, before looking for ${jndi:.
+
+// maxLookupPasses bounds nested lookup resolution.
+const maxLookupPasses = 16
+
+var (
+	// innerLookup is a ${...} with no lookup inside it.
+	innerLookup = regexp.MustCompile(`\$\{([^${}]*)\}`)
+	jndiLookup  = regexp.MustCompile(`(?i)\$\{\s*jndi\s*:`)
+)
+
+// DetectJNDI reports whether the input holds a JNDI lookup, however it is
+// obfuscated.
+func DetectJNDI(input string) (bool, string) {
+	if !strings.Contains(input, "${") {
+		return false, ""
+	}
+	s := input
+	for i := 0; i < maxLookupPasses; i++ {
+		if jndiLookup.MatchString(s) {
+			return true, "JNDI lookup"
+		}
+		next := innerLookup.ReplaceAllStringFunc(s, resolveLookup)
+		if next == s {
+			break
+		}
+		s = next
+	}
+	return false, ""
+}
+
+// resolveLookup returns what log4j would substitute for a lookup that hides
+// part of a payload: the default value after ":-", or the argument of
+// lower/upper. Any other lookup, jndi included, is kept as is.
+func resolveLookup(lookup string) string {
+	body := lookup[2 : len(lookup)-1]
+	if i := strings.Index(body, ":-"); i >= 0 {
+		return body[i+2:]
+	}
+	name, arg, ok := strings.Cut(body, ":")
+	if !ok {
+		return lookup
+	}
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "lower":
+		return strings.ToLower(arg)
+	case "upper":
+		return strings.ToUpper(arg)
+	}
+	return lookup
+}
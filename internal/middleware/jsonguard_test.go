@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckJSON(t *testing.T) {
+	limits := JSONLimits{MaxDepth: 4, MaxKeys: 3, MaxArrayLength: 5, MaxStringLength: 16}.withDefaults()
+
+	tests := []struct {
+		name      string
+		body      string
+		violation string
+	}{
+		{"flat object", `{"a": 1, "b": "two", "c": [1, 2, 3]}`, ""},
+		{"scalar", `"hello"`, ""},
+		{"empty containers", `{"a": {}, "b": [], "c": [[], {}]}`, ""},
+		{"at the depth limit", `{"a": {"b": {"c": [1]}}}`, ""},
+		{"same key in sibling objects", `[{"id": 1}, {"id": 2}]`, ""},
+		{"malformed is left to the backend", `{"a": `, ""},
+		{"trailing data is ignored", `{"a": 1} {"a": 1, "a": 2}`, ""},
+
+		{"too deep", `{"a": {"b": {"c": {"d": [1]}}}}`, "JSON Too Deep"},
+		{"deep arrays", strings.Repeat("[", 10000) + strings.Repeat("]", 10000), "JSON Too Deep"},
+		{"too many keys", `{"a": 1, "b": 2, "c": 3, "d": 4}`, "JSON Too Many Keys"},
+		{"too many items", `[1, 2, 3, 4, 5, 6]`, "JSON Array Too Long"},
+		{"nested arrays count as items", `[[], [], [], [], [], []]`, "JSON Array Too Long"},
+		{"long string", `{"a": "` + strings.Repeat("x", 17) + `"}`, "JSON String Too Long"},
+		{"long key", `{"` + strings.Repeat("k", 17) + `": 1}`, "JSON String Too Long"},
+		{"duplicate key", `{"role": "user", "role": "admin"}`, "JSON Duplicate Key"},
+		{"nested duplicate key", `{"user": {"id": 1, "id": 2}}`, "JSON Duplicate Key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJSON(strings.NewReader(tt.body), limits)
+			got := ""
+			if v, ok := err.(*jsonViolation); ok {
+				got = v.violation
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.violation {
+				t.Errorf("expected %q, got %q", tt.violation, got)
+			}
+		})
+	}
+
+	limits.AllowDuplicateKeys = true
+	if err := checkJSON(strings.NewReader(`{"a": 1, "a": 2}`), limits); err != nil {
+		t.Errorf("duplicate keys should be allowed, got %v", err)
+	}
+}
+
+func TestJSONGuard(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	send := func(h http.Handler, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	guard := NewJSONGuard(JSONLimits{MaxDepth: 2, MaxStringLength: 8}, ModeBlock).Middleware(echo)
+
+	ok := `{"a": [1, 2]}  `
+	if rr := send(guard, "application/json", ok); rr.Code != 200 || rr.Body.String() != ok {
+		t.Errorf("expected the body to pass through unchanged, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := send(guard, "application/json; charset=utf-8", `[[[1]]]`); rr.Code != http.StatusBadRequest {
+		t.Errorf("too deep: expected 400, got %d", rr.Code)
+	}
+	if rr := send(guard, "application/vnd.api+json", `{"a": "123456789"}`); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("long string: expected 413, got %d", rr.Code)
+	}
+	if rr := send(guard, "text/plain", `[[[1]]]`); rr.Code != 200 {
+		t.Errorf("non-JSON bodies are not checked, got %d", rr.Code)
+	}
+
+	// Rejected without reading the rest of the body.
+	req := httptest.NewRequest("POST", "/api", io.MultiReader(strings.NewReader(`[[[`), failingReader{}))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	guard.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an early 400, got %d", rr.Code)
+	}
+
+	monitor := NewJSONGuard(JSONLimits{MaxDepth: 2}, ModeMonitor).Middleware(echo)
+	if rr := send(monitor, "application/json", `[[[1]]]`); rr.Code != 200 || rr.Body.String() != `[[[1]]]` {
+		t.Errorf("monitor mode must let the body through, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestJSONGuardStreamed(t *testing.T) {
+	var delivered bool
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		delivered = err == nil
+		w.Write(body)
+	})
+	guard := NewJSONGuard(JSONLimits{MaxDepth: 2}, ModeBlock).Middleware(echo)
+	send := func(body string) *httptest.ResponseRecorder {
+		delivered = false
+		req := httptest.NewRequest("POST", "/api", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		guard.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Past guardAhead, the body streams to the next handler as it's checked.
+	filler := strings.Repeat(`"`+strings.Repeat("x", 1000)+`", `, 2*guardAhead/1000)
+	ok := `[` + filler + `1]`
+	if rr := send(ok); rr.Code != 200 || rr.Body.String() != ok || !delivered {
+		t.Errorf("expected the body to pass through unchanged, got %d (%d bytes)", rr.Code, rr.Body.Len())
+	}
+	// A violation past it cuts the body off.
+	if rr := send(`[` + filler + `[[1]]]`); rr.Code != http.StatusBadRequest || delivered {
+		t.Errorf("too deep: expected a cut-off 400, got %d (delivered=%v)", rr.Code, delivered)
+	}
+}
+
+// failingReader fails the test's request if anyone reads past the attack.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, io.ErrClosedPipe }
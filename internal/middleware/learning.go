@@ -0,0 +1,535 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Learning mode watches a route's traffic and infers what its API looks
+// like: endpoints (with IDs in paths turned into {id} parameters), query
+// parameter types and ranges, and the shape of JSON request and response
+// bodies. The result is a draft OpenAPI document to review and enforce.
+//
+// Only requests the backend accepted (status < 400) teach request shapes,
+// so probes and attacks don't end up in the draft.
+
+const (
+	maxLearnedEndpoints = 500 // Endpoints per route; new ones are ignored beyond this
+	maxLearnedProps     = 200 // Properties per object
+	maxLearnedParams    = 50  // Query parameters per endpoint
+	maxLearnedDepth     = 32  // Nesting of JSON bodies
+	maxEnumValues       = 8   // Distinct strings kept as an enum candidate
+)
+
+// Learner infers an API description from observed traffic.
+type Learner struct {
+	mu        sync.Mutex
+	started   time.Time
+	window    time.Duration // 0 = learn until disabled
+	requests  int
+	endpoints map[string]*learnedEndpoint // "GET /users/{id}"
+}
+
+func NewLearner(window time.Duration) *Learner {
+	return &Learner{started: time.Now(), window: window, endpoints: make(map[string]*learnedEndpoint)}
+}
+
+// SetWindow changes how long the learner observes, counted from its start.
+func (l *Learner) SetWindow(window time.Duration) {
+	l.mu.Lock()
+	l.window = window
+	l.mu.Unlock()
+}
+
+// Reset forgets everything learned and restarts the window.
+func (l *Learner) Reset() {
+	l.mu.Lock()
+	l.started = time.Now()
+	l.requests = 0
+	l.endpoints = make(map[string]*learnedEndpoint)
+	l.mu.Unlock()
+}
+
+// LearnerStatus summarizes a learner for the admin API.
+type LearnerStatus struct {
+	Started   time.Time `json:"started"`
+	Window    string    `json:"window,omitempty"`
+	Requests  int       `json:"requests"`
+	Endpoints int       `json:"endpoints"`
+	Done      bool      `json:"done"`
+}
+
+func (l *Learner) Status() LearnerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := LearnerStatus{Started: l.started, Requests: l.requests, Endpoints: len(l.endpoints), Done: l.done()}
+	if l.window > 0 {
+		s.Window = l.window.String()
+	}
+	return s
+}
+
+// done reports whether the window is over. Callers hold l.mu.
+func (l *Learner) done() bool {
+	return l.window > 0 && time.Since(l.started) > l.window
+}
+
+func (l *Learner) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mu.Lock()
+		done := l.done()
+		l.mu.Unlock()
+		if done {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var complete bool
+			var err error
+			if body, complete, err = bufferBody(r, DefaultInspectBodySize); err != nil {
+				next.ServeHTTP(w, r) // Let the next handler report it
+				return
+			}
+			if !complete {
+				body = nil // Too large to learn from, and to keep around
+			}
+		}
+
+		rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		l.observe(r, body, rec)
+	})
+}
+
+// observe records one request/response pair.
+func (l *Learner) observe(r *http.Request, body []byte, rec *responseCapture) {
+	template, params := inferTemplate(r.URL.Path)
+	key := r.Method + " " + template
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ep, ok := l.endpoints[key]
+	if !ok {
+		if len(l.endpoints) >= maxLearnedEndpoints {
+			return
+		}
+		ep = &learnedEndpoint{
+			method:    r.Method,
+			template:  template,
+			params:    make(map[string]*learnedParam),
+			responses: make(map[int]*learnedBody),
+		}
+		l.endpoints[key] = ep
+		log.Printf("🎓 Learned new endpoint: %s", key)
+	}
+	l.requests++
+
+	resp := ep.responses[rec.status]
+	if resp == nil {
+		resp = &learnedBody{}
+		ep.responses[rec.status] = resp
+	}
+	if !rec.truncated {
+		resp.observe(rec.Header().Get("Content-Type"), rec.body.Bytes())
+	}
+
+	if rec.status >= 400 {
+		return
+	}
+	ep.count++
+	for name, v := range params {
+		p := ep.param("path", name)
+		p.requests++
+		p.observe(v)
+	}
+	for name, values := range r.URL.Query() {
+		p := ep.param("query", name)
+		if p == nil {
+			continue
+		}
+		p.requests++
+		p.multi = p.multi || len(values) > 1
+		for _, v := range values {
+			p.observe(v)
+		}
+	}
+	if len(body) > 0 {
+		if ep.body == nil {
+			ep.body = &learnedBody{}
+		}
+		ep.body.observe(r.Header.Get("Content-Type"), body)
+	}
+}
+
+var (
+	hexIDPattern     = regexp.MustCompile(`^[0-9a-fA-F]{12,}$`)
+	numericIDPattern = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// inferTemplate turns IDs in a path into parameters:
+// /users/42/posts/9f1c... becomes /users/{id}/posts/{id2}.
+func inferTemplate(path string) (string, map[string]string) {
+	segments := splitPath(path)
+	params := make(map[string]string)
+	for i, seg := range segments {
+		if numericIDPattern.MatchString(seg) || uuidPattern.MatchString(seg) || hexIDPattern.MatchString(seg) {
+			name := "id"
+			if n := len(params); n > 0 {
+				name += strconv.Itoa(n + 1)
+			}
+			params[name] = seg
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return "/" + strings.Join(segments, "/"), params
+}
+
+type learnedEndpoint struct {
+	method    string
+	template  string
+	count     int // Successful requests
+	params    map[string]*learnedParam
+	body      *learnedBody
+	responses map[int]*learnedBody
+}
+
+// param returns the named parameter, or nil for a new query parameter
+// once the endpoint has maxLearnedParams: random names would grow memory
+// and the draft without bound.
+func (ep *learnedEndpoint) param(in, name string) *learnedParam {
+	key := in + "\x00" + name
+	p, ok := ep.params[key]
+	if !ok {
+		if in == "query" && len(ep.params) >= maxLearnedParams {
+			return nil
+		}
+		p = &learnedParam{in: in, name: name}
+		ep.params[key] = p
+	}
+	return p
+}
+
+type learnedParam struct {
+	in, name string
+	requests int  // Successful requests that had it
+	multi    bool // Repeated in one request (?tag=a&tag=b): an array
+	shape    shape
+}
+
+func (p *learnedParam) observe(raw string) {
+	var v interface{} = raw
+	if _, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		v = json.Number(raw)
+	} else if _, err := strconv.ParseFloat(raw, 64); err == nil {
+		v = json.Number(raw)
+	} else if b, err := strconv.ParseBool(raw); err == nil && (raw == "true" || raw == "false") {
+		v = b
+	}
+	p.shape.observe(v, 0)
+}
+
+// learnedBody collects the shapes of bodies per media type.
+type learnedBody struct {
+	requests int
+	media    map[string]*shape // nil shape: seen, but not JSON
+}
+
+func (b *learnedBody) observe(contentType string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b.requests++
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+	if b.media == nil {
+		b.media = make(map[string]*shape)
+	}
+	s, seen := b.media[mediaType]
+	if !isJSONMedia(mediaType) {
+		if !seen {
+			b.media[mediaType] = nil
+		}
+		return
+	}
+	value, err := decodeJSON(data)
+	if err != nil {
+		return
+	}
+	if s == nil {
+		s = &shape{}
+		b.media[mediaType] = s
+	}
+	s.observe(value, 0)
+}
+
+// shape accumulates every value seen at one place in a document.
+type shape struct {
+	seen     int
+	nullable bool
+	kind     string // boolean, integer, number, string, array, object, or mixed
+
+	min, max       float64 // Numbers
+	minLen, maxLen int     // Strings
+	format         string  // Kept while every string matches it
+	enum           map[string]bool
+
+	items              *shape
+	minItems, maxItems int
+
+	objects int // How many objects; a property seen in all of them is required
+	props   map[string]*shape
+}
+
+func (s *shape) observe(v interface{}, depth int) {
+	if depth > maxLearnedDepth {
+		return
+	}
+	if v == nil {
+		s.nullable = true
+		return
+	}
+	s.seen++
+	first := s.seen == 1
+
+	switch val := v.(type) {
+	case bool:
+		s.merge("boolean")
+	case json.Number:
+		f, err := val.Float64()
+		if err != nil {
+			return
+		}
+		kind := "number"
+		if _, err := val.Int64(); err == nil {
+			kind = "integer"
+		}
+		s.merge(kind)
+		if first || f < s.min {
+			s.min = f
+		}
+		if first || f > s.max {
+			s.max = f
+		}
+	case string:
+		s.merge("string")
+		n := len([]rune(val))
+		if first || n < s.minLen {
+			s.minLen = n
+		}
+		if first || n > s.maxLen {
+			s.maxLen = n
+		}
+		if first {
+			s.format = guessFormat(val)
+			s.enum = make(map[string]bool)
+		} else if s.format != "" && !validFormat(s.format, val) {
+			s.format = ""
+		}
+		if s.enum != nil {
+			s.enum[val] = true
+			if len(s.enum) > maxEnumValues {
+				s.enum = nil
+			}
+		}
+	case []interface{}:
+		s.merge("array")
+		if first || len(val) < s.minItems {
+			s.minItems = len(val)
+		}
+		if first || len(val) > s.maxItems {
+			s.maxItems = len(val)
+		}
+		for _, item := range val {
+			if s.items == nil {
+				s.items = &shape{}
+			}
+			s.items.observe(item, depth+1)
+		}
+	case map[string]interface{}:
+		s.merge("object")
+		s.objects++
+		if s.props == nil {
+			s.props = make(map[string]*shape)
+		}
+		for k, item := range val {
+			p, ok := s.props[k]
+			if !ok {
+				if len(s.props) >= maxLearnedProps {
+					continue
+				}
+				p = &shape{}
+				s.props[k] = p
+			}
+			p.observe(item, depth+1)
+		}
+	}
+}
+
+// merge widens the kind: integer and number give number, anything else mixed.
+func (s *shape) merge(kind string) {
+	switch {
+	case s.kind == "" || s.kind == kind:
+		s.kind = kind
+	case s.kind == "integer" && kind == "number", s.kind == "number" && kind == "integer":
+		s.kind = "number"
+	default:
+		s.kind = "mixed"
+	}
+}
+
+func guessFormat(v string) string {
+	for _, f := range []string{"uuid", "date-time", "date", "email", "ipv4"} {
+		if validFormat(f, v) {
+			return f
+		}
+	}
+	return ""
+}
+
+// schema turns the shape into a draft schema. Ranges are the observed ones;
+// the reviewer is expected to widen them.
+func (s *shape) schema() *Schema {
+	sc := &Schema{Nullable: s.nullable}
+	switch s.kind {
+	case "", "mixed":
+		return sc
+	case "integer", "number":
+		sc.Type = s.kind
+		lo, hi := s.min, s.max
+		sc.Minimum, sc.Maximum = &lo, &hi
+	case "string":
+		sc.Type = "string"
+		sc.Format = s.format
+		if sc.Format == "" {
+			hi := s.maxLen
+			sc.MaxLength = &hi
+			if s.minLen > 0 {
+				one := 1 // Never seen empty; the shortest value seen says little
+				sc.MinLength = &one
+			}
+		}
+		// Only call it an enum once each value has been seen a few times.
+		if len(s.enum) > 0 && s.seen >= 4*len(s.enum) && sc.Format == "" {
+			for v := range s.enum {
+				sc.Enum = append(sc.Enum, v)
+			}
+			sort.Slice(sc.Enum, func(i, j int) bool { return sc.Enum[i].(string) < sc.Enum[j].(string) })
+		}
+	case "array":
+		sc.Type = "array"
+		lo, hi := s.minItems, s.maxItems
+		sc.MinItems, sc.MaxItems = &lo, &hi
+		if s.items != nil {
+			sc.Items = s.items.schema()
+		}
+	case "object":
+		sc.Type = "object"
+		sc.Properties = make(map[string]*Schema, len(s.props))
+		for name, p := range s.props {
+			sc.Properties[name] = p.schema()
+			if p.seen == s.objects {
+				sc.Required = append(sc.Required, name)
+			}
+		}
+		sort.Strings(sc.Required)
+		sc.AdditionalProperties = &AdditionalProperties{}
+	default:
+		sc.Type = s.kind
+	}
+	return sc
+}
+
+// Spec exports everything learned so far as a draft OpenAPI 3 document.
+// Paths are full request paths, so it can be enforced without a base_path.
+func (l *Learner) Spec(title string) *OpenAPISpec {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	spec := &OpenAPISpec{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: title, Version: "draft-" + l.started.UTC().Format("20060102")},
+		Paths:   make(map[string]*PathItem),
+	}
+	for _, ep := range l.endpoints {
+		item := spec.Paths[ep.template]
+		if item == nil {
+			item = &PathItem{}
+			spec.Paths[ep.template] = item
+		}
+		item.SetOperation(ep.method, ep.operation())
+	}
+	spec.compile()
+	return spec
+}
+
+func (ep *learnedEndpoint) operation() *Operation {
+	op := &Operation{Responses: make(map[string]*Response)}
+
+	params := make([]*learnedParam, 0, len(ep.params))
+	for _, p := range ep.params {
+		params = append(params, p)
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].in != params[j].in {
+			return params[i].in < params[j].in
+		}
+		return params[i].name < params[j].name
+	})
+	for _, p := range params {
+		sc := p.shape.schema()
+		if p.multi {
+			sc = &Schema{Type: "array", Items: sc}
+		}
+		op.Parameters = append(op.Parameters, &Parameter{
+			Name:     p.name,
+			In:       p.in,
+			Required: p.in == "path" || p.requests >= ep.count,
+			Schema:   sc,
+		})
+	}
+	// Path parameters seen only on failed requests still have to be declared.
+	for _, seg := range splitPath(ep.template) {
+		if isPathParam(seg) && ep.params["path\x00"+seg[1:len(seg)-1]] == nil {
+			op.Parameters = append(op.Parameters, &Parameter{Name: seg[1 : len(seg)-1], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+	}
+
+	if ep.body != nil && len(ep.body.media) > 0 {
+		op.RequestBody = &RequestBody{Required: ep.body.requests >= ep.count, Content: ep.body.content()}
+	}
+	for status, body := range ep.responses {
+		op.Responses[strconv.Itoa(status)] = &Response{
+			Description: http.StatusText(status),
+			Content:     body.content(),
+		}
+	}
+	return op
+}
+
+func (b *learnedBody) content() map[string]*MediaType {
+	if len(b.media) == 0 {
+		return nil
+	}
+	content := make(map[string]*MediaType, len(b.media))
+	for mediaType, s := range b.media {
+		m := &MediaType{}
+		if s != nil {
+			m.Schema = s.schema()
+		}
+		content[mediaType] = m
+	}
+	return content
+}
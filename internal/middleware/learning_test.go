@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestInferTemplate(t *testing.T) {
+	tests := map[string]string{
+		"/users":            "/users",
+		"/users/42":         "/users/{id}",
+		"/users/42/posts/7": "/users/{id}/posts/{id2}",
+		"/orders/0b9e8d3c-6f9b-4b0e-9a43-3f1f6c2d8a11": "/orders/{id}",
+		"/blobs/9f1c2e3d4a5b6c7d":                      "/blobs/{id}",
+		"/users/me":                                    "/users/me",
+		"/v2/status":                                   "/v2/status",
+	}
+	for path, want := range tests {
+		if got, _ := inferTemplate(path); got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+}
+
+// learnAPI runs some traffic for a small user API through a Learner.
+func learnAPI(t *testing.T) *Learner {
+	t.Helper()
+	l := NewLearner(0)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST":
+			body, _ := io.ReadAll(r.Body)
+			if !strings.Contains(string(body), `"email"`) {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"error": "email required"}`)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"id": 100}`)
+		case r.URL.Path == "/api/users":
+			io.WriteString(w, `[{"id": 1, "name": "Ada"}, {"id": 2, "name": "Linus"}]`)
+		default:
+			io.WriteString(w, `{"id": 1, "name": "Ada", "role": "admin", "manager": null}`)
+		}
+	})
+	h := l.Middleware(backend)
+
+	send := func(method, target, body string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for i := 1; i <= 20; i++ {
+		send("GET", fmt.Sprintf("/api/users?limit=%d&sort=%s", 10+i, []string{"name", "created"}[i%2]), "")
+		send("GET", fmt.Sprintf("/api/users/%d", i), "")
+	}
+	send("GET", "/api/users?tag=a&tag=b", "")
+	send("POST", "/api/users", `{"name": "Grace", "email": "grace@example.com", "age": 45}`)
+	send("POST", "/api/users", `{"name": "Alan", "email": "alan@example.com", "age": 41.5, "admin": false}`)
+	send("POST", "/api/users", `{"name": "' OR 1=1--"}`) // Rejected by the backend: not learned
+	return l
+}
+
+func TestLearnerSpec(t *testing.T) {
+	spec := learnAPI(t).Spec("users")
+
+	if len(spec.Paths) != 2 || spec.Paths["/api/users"] == nil || spec.Paths["/api/users/{id}"] == nil {
+		t.Fatalf("unexpected paths: %v", spec.Paths)
+	}
+
+	list := spec.Paths["/api/users"].Get
+	params := make(map[string]*Parameter)
+	for _, p := range list.Parameters {
+		params[p.Name] = p
+	}
+	if p := params["limit"]; p == nil || p.Schema.Type != "integer" || *p.Schema.Minimum != 11 || *p.Schema.Maximum != 30 || p.Required {
+		t.Errorf("limit: unexpected %+v", p)
+	}
+	if p := params["sort"]; p == nil || fmt.Sprint(p.Schema.Enum) != "[created name]" {
+		t.Errorf("sort: expected an enum, got %+v", p)
+	}
+	if p := params["tag"]; p == nil || p.Schema.Type != "array" {
+		t.Errorf("tag: expected an array, got %+v", p)
+	}
+	if items := list.Responses["200"].Content["application/json"].Schema; items.Type != "array" || items.Items.Properties["name"].Type != "string" {
+		t.Errorf("unexpected list response %+v", items)
+	}
+
+	get := spec.Paths["/api/users/{id}"].Get
+	if len(get.Parameters) != 1 || get.Parameters[0].In != "path" || get.Parameters[0].Schema.Type != "integer" {
+		t.Errorf("unexpected path parameter %+v", get.Parameters)
+	}
+	user := get.Responses["200"].Content["application/json"].Schema
+	if !user.Properties["manager"].Nullable || fmt.Sprint(user.Required) != "[id name role]" {
+		t.Errorf("unexpected user schema %+v", user)
+	}
+
+	create := spec.Paths["/api/users"].Post
+	body := create.RequestBody.Content["application/json"].Schema
+	if fmt.Sprint(body.Required) != "[age email name]" || body.Properties["age"].Type != "number" || body.Properties["email"].Format != "email" {
+		t.Errorf("unexpected request body %+v", body)
+	}
+	if create.Responses["400"] == nil || create.Responses["201"] == nil {
+		t.Errorf("expected 201 and 400 responses, got %v", create.Responses)
+	}
+}
+
+// A learned spec must be enforceable as-is, including after a YAML round trip.
+func TestLearnedSpecEnforced(t *testing.T) {
+	data, err := yaml.Marshal(learnAPI(t).Spec("users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := ParseOpenAPI(data)
+	if err != nil {
+		t.Fatalf("exported spec doesn't parse: %v\n%s", err, data)
+	}
+
+	enforcer := NewSchemaEnforcer(spec, SchemaOptions{})
+	handler := enforcer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		method, target, body string
+		status               int
+	}{
+		{"GET", "/api/users?limit=20&sort=name", "", 200},
+		{"GET", "/api/users/5", "", 200},
+		{"POST", "/api/users", `{"name": "Ken", "email": "ken@example.com", "age": 43}`, 200},
+		{"GET", "/api/users?sort=password", "", 400},
+		{"GET", "/api/users/5%27", "", 400},
+		{"DELETE", "/api/users/5", "", 405},
+		{"GET", "/api/admin", "", 404},
+		{"POST", "/api/users", `{"name": "Ken", "email": "ken@example.com", "age": 43, "isAdmin": true}`, 400},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.method, tt.target, tt.status, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestLearnerWindow(t *testing.T) {
+	l := NewLearner(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/late", nil))
+
+	if s := l.Status(); !s.Done || s.Endpoints != 0 {
+		t.Errorf("expected nothing learned after the window, got %+v", s)
+	}
+
+	l.SetWindow(0)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/late", nil))
+	if s := l.Status(); s.Done || s.Endpoints != 1 {
+		t.Errorf("expected learning to resume, got %+v", s)
+	}
+	l.Reset()
+	if s := l.Status(); s.Requests != 0 || s.Endpoints != 0 {
+		t.Errorf("expected reset learner, got %+v", s)
+	}
+}
+
+func TestLearnerCapsQueryParams(t *testing.T) {
+	l := NewLearner(0)
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/search?q=go", nil))
+	for i := 0; i < 2*maxLearnedParams; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/search?k%d=x", i), nil))
+	}
+
+	params := l.Spec("search").Paths["/search"].Get.Parameters
+	if len(params) != maxLearnedParams {
+		t.Errorf("expected %d parameters, got %d", maxLearnedParams, len(params))
+	}
+	if !slices.ContainsFunc(params, func(p *Parameter) bool { return p.Name == "q" }) {
+		t.Error("parameters learned before the cap should be kept")
+	}
+}
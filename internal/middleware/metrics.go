@@ -10,6 +10,9 @@ import (
 type Metrics struct {
 	TotalRequests   uint64 `json:"total_requests"`
 	BlockedRequests uint64 `json:"blocked_requests"`
+
+	// MonitoredRequests counts WAF matches in monitor mode (would have been blocked).
+	MonitoredRequests uint64 `json:"monitored_requests"`
 }
 
 var GlobalMetrics = &Metrics{}
@@ -22,6 +25,10 @@ func IncrementBlocked() {
 	atomic.AddUint64(&GlobalMetrics.BlockedRequests, 1)
 }
 
+func IncrementMonitored() {
+	atomic.AddUint64(&GlobalMetrics.MonitoredRequests, 1)
+}
+
 // StatsHandler returns the current metrics as JSON.
 func StatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
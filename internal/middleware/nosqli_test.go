@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNoSQLAndPrototypePollution(t *testing.T) {
+	const (
+		jsonType = "application/json"
+		formType = "application/x-www-form-urlencoded"
+	)
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		paranoia    int
+		want        int
+	}{
+		// Benign: Mongo-ish words and dollar amounts are fine.
+		{"login", "/login", jsonType, `{"username": "ada", "password": "hunter2"}`, 1, 200},
+		{"price in dollars", "/cart", jsonType, `{"note": "$ne is not an operator here", "total": "$12.50"}`, 1, 200},
+		{"prototype as a word", "/docs", jsonType, `{"title": "The prototype chain", "constructor": "Acme Inc"}`, 1, 200},
+		{"prototype key elsewhere", "/designs", jsonType, `{"prototype": {"name": "v2"}}`, 1, 200},
+		{"array form key", "/search", formType, `tags[]=go&tags[]=waf`, 1, 200},
+		{"proto path in value at PL1", "/settings", jsonType, `{"path": "__proto__.isAdmin"}`, 1, 200},
+
+		// NoSQL operator injection.
+		{"JSON $ne auth bypass", "/login", jsonType, `{"username": "admin", "password": {"$ne": null}}`, 1, 403},
+		{"JSON $where", "/users", jsonType, `{"$where": "sleep(5000) || true"}`, 1, 403},
+		{"JSON $regex", "/users", jsonType, `{"username": {"$regex": "^a"}}`, 1, 403},
+		{"form bracket $ne", "/login", formType, `username=admin&password[$ne]=x`, 1, 403},
+		{"query bracket $gt", "/users?age[$gt]=0", "", ``, 1, 403},
+		{"encoded query bracket", "/users?age%5B%24gt%5D=0", "", ``, 1, 403},
+		{"serialized operator in query", "/users?filter=" + strings.ReplaceAll(`{"role":{"$ne":"guest"}}`, `"`, "%22"), "", ``, 1, 403},
+
+		// Prototype pollution.
+		{"JSON __proto__", "/profile", jsonType, `{"name": "x", "__proto__": {"isAdmin": true}}`, 1, 403},
+		{"JSON constructor.prototype", "/profile", jsonType, `{"constructor": {"prototype": {"isAdmin": true}}}`, 1, 403},
+		{"form __proto__", "/profile", formType, `__proto__[isAdmin]=true`, 1, 403},
+		{"query constructor[prototype]", "/profile?constructor[prototype][isAdmin]=1", "", ``, 1, 403},
+		{"dotted query key", "/profile?__proto__.isAdmin=1", "", ``, 1, 403},
+		{"proto path in value at PL2", "/settings", jsonType, `{"path": "__proto__.isAdmin"}`, 2, 403},
+		{"constructor path in value at PL2", "/settings", jsonType, `{"path": "a.constructor.prototype.polluted"}`, 2, 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), ParanoiaLevel: tt.paranoia})
+			handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			method := http.MethodGet
+			if tt.body != "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
+
+func TestNoSQLCategoriesToggle(t *testing.T) {
+	body := `{"password": {"$ne": null}, "__proto__": {"isAdmin": true}}`
+
+	tests := []struct {
+		categories map[string]bool
+		want       int
+	}{
+		{map[string]bool{"nosqli": true, "prototype_pollution": true}, 403},
+		{map[string]bool{"nosqli": false, "prototype_pollution": true}, 403},
+		{map[string]bool{"nosqli": true, "prototype_pollution": false}, 403},
+		{map[string]bool{"nosqli": false, "prototype_pollution": false}, 200},
+	}
+	for _, tt := range tests {
+		si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), Categories: tt.categories})
+		handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%v: expected %d, got %d", tt.categories, tt.want, rr.Code)
+		}
+	}
+}
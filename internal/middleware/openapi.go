@@ -0,0 +1,424 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A minimal OpenAPI 3 model: enough to describe and validate JSON APIs
+// (paths, operations, parameters, JSON bodies and responses). Anything the
+// validator doesn't understand is ignored rather than rejected.
+
+// OpenAPISpec is an OpenAPI 3 document.
+type OpenAPISpec struct {
+	OpenAPI    string               `yaml:"openapi" json:"openapi"`
+	Info       OpenAPIInfo          `yaml:"info" json:"info"`
+	Servers    []OpenAPIServer      `yaml:"servers,omitempty" json:"servers,omitempty"`
+	Paths      map[string]*PathItem `yaml:"paths" json:"paths"`
+	Components *Components          `yaml:"components,omitempty" json:"components,omitempty"`
+
+	matchers []pathMatcher
+}
+
+type OpenAPIInfo struct {
+	Title   string `yaml:"title" json:"title"`
+	Version string `yaml:"version" json:"version"`
+}
+
+type OpenAPIServer struct {
+	URL string `yaml:"url" json:"url"`
+}
+
+type Components struct {
+	Schemas       map[string]*Schema      `yaml:"schemas,omitempty" json:"schemas,omitempty"`
+	Parameters    map[string]*Parameter   `yaml:"parameters,omitempty" json:"parameters,omitempty"`
+	RequestBodies map[string]*RequestBody `yaml:"requestBodies,omitempty" json:"requestBodies,omitempty"`
+	Responses     map[string]*Response    `yaml:"responses,omitempty" json:"responses,omitempty"`
+}
+
+// PathItem holds the operations of one path template, e.g. "/users/{id}".
+type PathItem struct {
+	Parameters []*Parameter `yaml:"parameters,omitempty" json:"parameters,omitempty"`
+	Get        *Operation   `yaml:"get,omitempty" json:"get,omitempty"`
+	Put        *Operation   `yaml:"put,omitempty" json:"put,omitempty"`
+	Post       *Operation   `yaml:"post,omitempty" json:"post,omitempty"`
+	Delete     *Operation   `yaml:"delete,omitempty" json:"delete,omitempty"`
+	Options    *Operation   `yaml:"options,omitempty" json:"options,omitempty"`
+	Head       *Operation   `yaml:"head,omitempty" json:"head,omitempty"`
+	Patch      *Operation   `yaml:"patch,omitempty" json:"patch,omitempty"`
+	Trace      *Operation   `yaml:"trace,omitempty" json:"trace,omitempty"`
+}
+
+// Operations returns the item's operations keyed by upper-case HTTP method.
+func (p *PathItem) Operations() map[string]*Operation {
+	ops := make(map[string]*Operation)
+	for method, op := range map[string]*Operation{
+		"GET": p.Get, "PUT": p.Put, "POST": p.Post, "DELETE": p.Delete,
+		"OPTIONS": p.Options, "HEAD": p.Head, "PATCH": p.Patch, "TRACE": p.Trace,
+	} {
+		if op != nil {
+			ops[method] = op
+		}
+	}
+	return ops
+}
+
+// SetOperation sets the operation for an upper-case HTTP method.
+func (p *PathItem) SetOperation(method string, op *Operation) {
+	switch method {
+	case "GET":
+		p.Get = op
+	case "PUT":
+		p.Put = op
+	case "POST":
+		p.Post = op
+	case "DELETE":
+		p.Delete = op
+	case "OPTIONS":
+		p.Options = op
+	case "HEAD":
+		p.Head = op
+	case "PATCH":
+		p.Patch = op
+	case "TRACE":
+		p.Trace = op
+	}
+}
+
+type Operation struct {
+	OperationID string               `yaml:"operationId,omitempty" json:"operationId,omitempty"`
+	Parameters  []*Parameter         `yaml:"parameters,omitempty" json:"parameters,omitempty"`
+	RequestBody *RequestBody         `yaml:"requestBody,omitempty" json:"requestBody,omitempty"`
+	Responses   map[string]*Response `yaml:"responses,omitempty" json:"responses,omitempty"`
+}
+
+type Parameter struct {
+	Ref      string  `yaml:"$ref,omitempty" json:"$ref,omitempty"`
+	Name     string  `yaml:"name,omitempty" json:"name,omitempty"`
+	In       string  `yaml:"in,omitempty" json:"in,omitempty"` // path, query, header or cookie
+	Required bool    `yaml:"required,omitempty" json:"required,omitempty"`
+	Schema   *Schema `yaml:"schema,omitempty" json:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Ref      string                `yaml:"$ref,omitempty" json:"$ref,omitempty"`
+	Required bool                  `yaml:"required,omitempty" json:"required,omitempty"`
+	Content  map[string]*MediaType `yaml:"content,omitempty" json:"content,omitempty"`
+}
+
+type Response struct {
+	Ref         string                `yaml:"$ref,omitempty" json:"$ref,omitempty"`
+	Description string                `yaml:"description,omitempty" json:"description"`
+	Content     map[string]*MediaType `yaml:"content,omitempty" json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `yaml:"schema,omitempty" json:"schema,omitempty"`
+}
+
+// LoadOpenAPI reads an OpenAPI 3 document in YAML or JSON.
+func LoadOpenAPI(path string) (*OpenAPISpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := ParseOpenAPI(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// ParseOpenAPI decodes an OpenAPI 3 document and prepares it for matching.
+// JSON is valid YAML, so one decoder handles both formats.
+func ParseOpenAPI(data []byte) (*OpenAPISpec, error) {
+	var spec OpenAPISpec
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&spec); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported openapi version %q (want 3.x)", spec.OpenAPI)
+	}
+	if len(spec.Paths) == 0 {
+		return nil, fmt.Errorf("no paths")
+	}
+	if err := spec.check(); err != nil {
+		return nil, err
+	}
+	spec.compile()
+	return &spec, nil
+}
+
+// BasePath is the path of the first server URL, e.g. "/api/v1", or "".
+func (s *OpenAPISpec) BasePath() string {
+	if len(s.Servers) == 0 {
+		return ""
+	}
+	u, err := url.Parse(s.Servers[0].URL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// --- Path matching ---
+
+type pathMatcher struct {
+	template string
+	segments []string // "{id}" for parameters
+	literals int
+}
+
+func (s *OpenAPISpec) compile() {
+	s.matchers = s.matchers[:0]
+	for template := range s.Paths {
+		m := pathMatcher{template: template, segments: splitPath(template)}
+		for _, seg := range m.segments {
+			if !isPathParam(seg) {
+				m.literals++
+			}
+		}
+		s.matchers = append(s.matchers, m)
+	}
+	// /users/me must win over /users/{id}.
+	sort.Slice(s.matchers, func(i, j int) bool {
+		a, b := s.matchers[i], s.matchers[j]
+		if a.literals != b.literals {
+			return a.literals > b.literals
+		}
+		return a.template < b.template
+	})
+}
+
+// Match finds the path template for a request path (without the base path)
+// and returns its path parameters.
+func (s *OpenAPISpec) Match(path string) (string, map[string]string, bool) {
+	segments := splitPath(path)
+	for _, m := range s.matchers {
+		if len(m.segments) != len(segments) {
+			continue
+		}
+		params := make(map[string]string)
+		ok := true
+		for i, seg := range m.segments {
+			if isPathParam(seg) {
+				v, err := url.PathUnescape(segments[i])
+				if err != nil || v == "" {
+					ok = false
+					break
+				}
+				params[seg[1:len(seg)-1]] = v
+				continue
+			}
+			if seg != segments[i] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return m.template, params, true
+		}
+	}
+	return "", nil, false
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func isPathParam(seg string) bool {
+	return len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}'
+}
+
+// --- $ref resolution (local references only) ---
+
+// maxRefDepth stops reference chains that loop (A -> B -> A).
+const maxRefDepth = 32
+
+func (s *OpenAPISpec) schema(sc *Schema) *Schema {
+	for i := 0; sc != nil && sc.Ref != "" && i < maxRefDepth; i++ {
+		name, ok := strings.CutPrefix(sc.Ref, "#/components/schemas/")
+		if !ok || s.Components == nil {
+			return nil
+		}
+		sc = s.Components.Schemas[name]
+	}
+	return sc
+}
+
+func (s *OpenAPISpec) parameter(p *Parameter) *Parameter {
+	for i := 0; p != nil && p.Ref != "" && i < maxRefDepth; i++ {
+		name, ok := strings.CutPrefix(p.Ref, "#/components/parameters/")
+		if !ok || s.Components == nil {
+			return nil
+		}
+		p = s.Components.Parameters[name]
+	}
+	return p
+}
+
+func (s *OpenAPISpec) requestBody(b *RequestBody) *RequestBody {
+	for i := 0; b != nil && b.Ref != "" && i < maxRefDepth; i++ {
+		name, ok := strings.CutPrefix(b.Ref, "#/components/requestBodies/")
+		if !ok || s.Components == nil {
+			return nil
+		}
+		b = s.Components.RequestBodies[name]
+	}
+	return b
+}
+
+func (s *OpenAPISpec) response(r *Response) *Response {
+	for i := 0; r != nil && r.Ref != "" && i < maxRefDepth; i++ {
+		name, ok := strings.CutPrefix(r.Ref, "#/components/responses/")
+		if !ok || s.Components == nil {
+			return nil
+		}
+		r = s.Components.Responses[name]
+	}
+	return r
+}
+
+// --- Checking references and patterns ---
+
+// check resolves every $ref and compiles every pattern in the document. One
+// that doesn't resolve would otherwise read as "nothing to check" and turn
+// validation off wherever it is used.
+func (s *OpenAPISpec) check() error {
+	c := &specChecker{spec: s}
+	if s.Components != nil {
+		for name, sc := range s.Components.Schemas {
+			c.schema(sc, "components.schemas."+name)
+		}
+		for name, p := range s.Components.Parameters {
+			c.parameter(p, "components.parameters."+name)
+		}
+		for name, b := range s.Components.RequestBodies {
+			c.requestBody(b, "components.requestBodies."+name)
+		}
+		for name, r := range s.Components.Responses {
+			c.response(r, "components.responses."+name)
+		}
+	}
+	for template, item := range s.Paths {
+		if item == nil {
+			continue
+		}
+		for i, p := range item.Parameters {
+			c.parameter(p, fmt.Sprintf("paths.%s.parameters[%d]", template, i))
+		}
+		for method, op := range item.Operations() {
+			at := "paths." + template + "." + strings.ToLower(method)
+			for i, p := range op.Parameters {
+				c.parameter(p, fmt.Sprintf("%s.parameters[%d]", at, i))
+			}
+			c.requestBody(op.RequestBody, at+".requestBody")
+			for status, r := range op.Responses {
+				c.response(r, at+".responses."+status)
+			}
+		}
+	}
+
+	if len(c.errs) == 0 {
+		return nil
+	}
+	sort.Strings(c.errs)
+	return errors.New(strings.Join(c.errs, "; "))
+}
+
+// specChecker collects what check finds. A $ref's target is checked where
+// it is defined, so references are only resolved, never followed.
+type specChecker struct {
+	spec *OpenAPISpec
+	errs []string
+}
+
+func (c *specChecker) ref(at, ref string, resolved bool) {
+	if !resolved {
+		c.errs = append(c.errs, fmt.Sprintf("%s: $ref %q doesn't resolve (only #/components/... references are supported)", at, ref))
+	}
+}
+
+func (c *specChecker) schema(sc *Schema, at string) {
+	if sc == nil {
+		return
+	}
+	if sc.Ref != "" {
+		r := c.spec.schema(sc)
+		c.ref(at, sc.Ref, r != nil && r.Ref == "")
+		return
+	}
+	if sc.Pattern != "" {
+		if _, err := compilePattern(sc.Pattern); err != nil {
+			c.errs = append(c.errs, fmt.Sprintf("%s.pattern: %v", at, err))
+		}
+	}
+	c.schema(sc.Items, at+".items")
+	for name, p := range sc.Properties {
+		c.schema(p, at+".properties."+name)
+	}
+	if sc.AdditionalProperties != nil {
+		c.schema(sc.AdditionalProperties.Schema, at+".additionalProperties")
+	}
+	for i, sub := range sc.AllOf {
+		c.schema(sub, fmt.Sprintf("%s.allOf[%d]", at, i))
+	}
+	for i, sub := range sc.AnyOf {
+		c.schema(sub, fmt.Sprintf("%s.anyOf[%d]", at, i))
+	}
+	for i, sub := range sc.OneOf {
+		c.schema(sub, fmt.Sprintf("%s.oneOf[%d]", at, i))
+	}
+}
+
+func (c *specChecker) parameter(p *Parameter, at string) {
+	switch {
+	case p == nil:
+	case p.Ref != "":
+		r := c.spec.parameter(p)
+		c.ref(at, p.Ref, r != nil && r.Ref == "")
+	default:
+		c.schema(p.Schema, at+".schema")
+	}
+}
+
+func (c *specChecker) requestBody(b *RequestBody, at string) {
+	switch {
+	case b == nil:
+	case b.Ref != "":
+		r := c.spec.requestBody(b)
+		c.ref(at, b.Ref, r != nil && r.Ref == "")
+	default:
+		c.content(b.Content, at)
+	}
+}
+
+func (c *specChecker) response(r *Response, at string) {
+	switch {
+	case r == nil:
+	case r.Ref != "":
+		resolved := c.spec.response(r)
+		c.ref(at, r.Ref, resolved != nil && resolved.Ref == "")
+	default:
+		c.content(r.Content, at)
+	}
+}
+
+func (c *specChecker) content(content map[string]*MediaType, at string) {
+	for mediaType, mt := range content {
+		if mt != nil {
+			c.schema(mt.Schema, at+".content."+mediaType+".schema")
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const petstore = `
+openapi: 3.0.3
+info: {title: Pets, version: "1"}
+servers:
+  - url: https://api.example.com/api/v1
+paths:
+  /pets:
+    get:
+      parameters:
+        - name: limit
+          in: query
+          schema: {type: integer, minimum: 1, maximum: 100}
+        - name: tag
+          in: query
+          schema: {type: array, items: {type: string, enum: [cat, dog]}}
+      responses:
+        "200":
+          description: ok
+          content:
+            application/json:
+              schema:
+                type: array
+                items: {$ref: "#/components/schemas/Pet"}
+    post:
+      parameters:
+        - name: X-Tenant
+          in: header
+          required: true
+          schema: {type: string, format: uuid}
+      requestBody:
+        $ref: "#/components/requestBodies/NewPet"
+      responses:
+        "201": {description: created}
+  /pets/{id}:
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema: {type: integer}
+    get:
+      responses:
+        "200":
+          description: ok
+          content:
+            application/json:
+              schema: {$ref: "#/components/schemas/Pet"}
+        default: {$ref: "#/components/responses/Error"}
+    delete:
+      responses:
+        "204": {description: deleted}
+  /pets/mine:
+    get:
+      parameters:
+        - {name: session, in: cookie, required: true, schema: {type: string, minLength: 8}}
+      responses:
+        "200": {description: ok}
+components:
+  schemas:
+    Pet:
+      type: object
+      required: [id, name]
+      properties:
+        id: {type: integer}
+        name: {type: string, minLength: 1, maxLength: 40, pattern: "^[A-Za-z ]+$"}
+        kind: {type: string, enum: [cat, dog]}
+        born: {type: string, format: date}
+        tags: {type: array, maxItems: 3, items: {type: string}}
+      additionalProperties: false
+  requestBodies:
+    NewPet:
+      required: true
+      content:
+        application/json:
+          schema:
+            allOf:
+              - {$ref: "#/components/schemas/Pet"}
+  responses:
+    Error:
+      description: error
+      content:
+        application/json:
+          schema:
+            type: object
+            required: [message]
+            properties: {message: {type: string}}
+`
+
+func mustSpec(t *testing.T, doc string) *OpenAPISpec {
+	t.Helper()
+	spec, err := ParseOpenAPI([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestOpenAPIMatch(t *testing.T) {
+	spec := mustSpec(t, petstore)
+
+	tests := []struct {
+		path     string
+		template string
+		params   map[string]string
+	}{
+		{"/pets", "/pets", nil},
+		{"/pets/", "/pets", nil},
+		{"/pets/42", "/pets/{id}", map[string]string{"id": "42"}},
+		{"/pets/mine", "/pets/mine", nil}, // Literal wins over {id}
+		{"/pets/a%20b", "/pets/{id}", map[string]string{"id": "a b"}},
+		{"/pets/42/toys", "", nil},
+		{"/owners", "", nil},
+	}
+	for _, tt := range tests {
+		template, params, ok := spec.Match(tt.path)
+		if ok != (tt.template != "") || template != tt.template {
+			t.Errorf("%s: expected %q, got %q (ok=%v)", tt.path, tt.template, template, ok)
+			continue
+		}
+		for k, v := range tt.params {
+			if params[k] != v {
+				t.Errorf("%s: expected %s=%q, got %q", tt.path, k, v, params[k])
+			}
+		}
+	}
+	if got := spec.BasePath(); got != "/api/v1" {
+		t.Errorf("expected base path /api/v1, got %q", got)
+	}
+}
+
+func TestParseOpenAPIErrors(t *testing.T) {
+	for _, doc := range []string{
+		`swagger: "2.0"`,
+		`openapi: 3.0.0`,
+		`openapi: 3.0.0
+paths: [`,
+	} {
+		if _, err := ParseOpenAPI([]byte(doc)); err == nil {
+			t.Errorf("expected error for %q", doc)
+		}
+	}
+
+	// A reference or pattern that doesn't work must not turn validation off.
+	op := func(get string) string {
+		return "openapi: 3.0.3\npaths:\n  /pets:\n    get:\n" + get + "\n"
+	}
+	if _, err := ParseOpenAPI([]byte(op(`      parameters: [{name: id, in: query, schema: {type: string, pattern: "^[a-z]+$"}}]`))); err != nil {
+		t.Fatalf("valid document rejected: %v", err)
+	}
+	for _, tt := range []struct{ name, get, want string }{
+		{"dangling schema", `      parameters: [{name: id, in: query, schema: {$ref: "#/components/schemas/Pett"}}]`, "paths./pets.get.parameters[0].schema"},
+		{"remote schema", `      requestBody: {content: {application/json: {schema: {$ref: "pets.yaml#/Pet"}}}}`, `"pets.yaml#/Pet"`},
+		{"dangling parameter", `      parameters: [{$ref: "#/components/parameters/Limit"}]`, "paths./pets.get.parameters[0]"},
+		{"dangling request body", `      requestBody: {$ref: "#/components/requestBodies/NewPet"}`, "paths./pets.get.requestBody"},
+		{"dangling response", `      responses: {"200": {$ref: "#/components/responses/Ok"}}`, "paths./pets.get.responses.200"},
+		{"reference loop", `      parameters: [{name: id, in: query, schema: {$ref: "#/components/schemas/A"}}]
+components:
+  schemas:
+    A: {$ref: "#/components/schemas/B"}
+    B: {$ref: "#/components/schemas/A"}`, "components.schemas.A"},
+		{"bad pattern", `      parameters: [{name: id, in: query, schema: {type: string, pattern: "[a-z"}}]`, "parameters[0].schema.pattern"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseOpenAPI([]byte(op(tt.get)))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error about %s, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestSchemaEnforcer(t *testing.T) {
+	enforcer := NewSchemaEnforcer(mustSpec(t, petstore), SchemaOptions{})
+	handler := enforcer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body) // The body must still be there after validation
+	}))
+
+	const tenant = "0b9e8d3c-6f9b-4b0e-9a43-3f1f6c2d8a11"
+	pet := `{"id": 1, "name": "Rex", "kind": "dog", "born": "2020-02-29"}`
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header map[string]string
+		status int
+	}{
+		{"list", "GET", "/api/v1/pets?limit=10&tag=cat&tag=dog", "", nil, 200},
+		{"list comma separated", "GET", "/api/v1/pets?tag=cat,dog", "", nil, 200},
+		{"head falls back to get", "HEAD", "/api/v1/pets", "", nil, 200},
+		{"get by id", "GET", "/api/v1/pets/7", "", nil, 200},
+		{"create", "POST", "/api/v1/pets", pet, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 200},
+		{"cookie param", "GET", "/api/v1/pets/mine", "", map[string]string{"Cookie": "session=abcdefgh1234"}, 200},
+
+		{"outside base path", "GET", "/pets", "", nil, 404},
+		{"unknown path", "GET", "/api/v1/owners", "", nil, 404},
+		{"base path prefix only", "GET", "/api/v1pets", "", nil, 404},
+		{"method not in spec", "PUT", "/api/v1/pets/7", "", nil, 405},
+		{"undeclared query parameter", "GET", "/api/v1/pets?limit=10&debug=1", "", nil, 400},
+		{"limit not an integer", "GET", "/api/v1/pets?limit=ten", "", nil, 400},
+		{"limit out of range", "GET", "/api/v1/pets?limit=1000", "", nil, 400},
+		{"repeated scalar parameter", "GET", "/api/v1/pets?limit=1&limit=abc", "", nil, 400},
+		{"repeated valid scalar parameter", "GET", "/api/v1/pets?limit=1&limit=2", "", nil, 400},
+		{"tag not in enum", "GET", "/api/v1/pets?tag=cat&tag=lion", "", nil, 400},
+		{"id not an integer", "GET", "/api/v1/pets/1%20OR%201=1", "", nil, 400},
+		{"missing cookie", "GET", "/api/v1/pets/mine", "", nil, 400},
+		{"missing header", "POST", "/api/v1/pets", pet, map[string]string{"Content-Type": "application/json"}, 400},
+		{"header not a uuid", "POST", "/api/v1/pets", pet, map[string]string{"X-Tenant": "1'--", "Content-Type": "application/json"}, 400},
+		{"missing body", "POST", "/api/v1/pets", "", map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"wrong content type", "POST", "/api/v1/pets", "id=1", map[string]string{"X-Tenant": tenant, "Content-Type": "application/x-www-form-urlencoded"}, 415},
+		{"invalid JSON", "POST", "/api/v1/pets", `{"id": 1,`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"trailing JSON", "POST", "/api/v1/pets", pet + `{}`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"missing property", "POST", "/api/v1/pets", `{"id": 1}`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"extra property", "POST", "/api/v1/pets", `{"id": 1, "name": "Rex", "isAdmin": true}`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"wrong type", "POST", "/api/v1/pets", `{"id": "1", "name": "Rex"}`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"fractional integer", "POST", "/api/v1/pets", `{"id": 1.5, "name": "Rex"}`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"pattern", "POST", "/api/v1/pets", `{"id": 1, "name": "<script>"}`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"bad date", "POST", "/api/v1/pets", `{"id": 1, "name": "Rex", "born": "2021-02-29"}`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"too many tags", "POST", "/api/v1/pets", `{"id": 1, "name": "Rex", "tags": ["a","b","c","d"]}`, map[string]string{"X-Tenant": tenant, "Content-Type": "application/json"}, 400},
+		{"body not allowed", "DELETE", "/api/v1/pets/7", `{"cascade": true}`, map[string]string{"Content-Type": "application/json"}, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rr.Code, rr.Body.String())
+			}
+			if tt.status == 200 && rr.Body.String() != tt.body && tt.method != "HEAD" {
+				t.Errorf("body was not passed on: %q", rr.Body.String())
+			}
+			if tt.status == 405 && rr.Header().Get("Allow") != "DELETE, GET" {
+				t.Errorf("expected Allow: DELETE, GET, got %q", rr.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestSchemaEnforcerMonitor(t *testing.T) {
+	enforcer := NewSchemaEnforcer(mustSpec(t, petstore), SchemaOptions{Mode: ModeMonitor})
+	handler := enforcer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/admin", nil))
+	if rr.Code != http.StatusTeapot {
+		t.Errorf("monitor mode must let requests through, got %d", rr.Code)
+	}
+}
+
+func TestSchemaEnforcerAllowUndeclaredQuery(t *testing.T) {
+	handler := func(opts SchemaOptions) http.Handler {
+		return NewSchemaEnforcer(mustSpec(t, petstore), opts).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}
+	send := func(h http.Handler, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+
+	strict := handler(SchemaOptions{})
+	if rr := send(strict, "/api/v1/pets?debug=1"); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "query.debug: is not allowed") {
+		t.Errorf("expected query.debug to be rejected, got %d: %s", rr.Code, rr.Body.String())
+	}
+	// Declared on /pets, not on /pets/{id}.
+	if rr := send(strict, "/api/v1/pets/7?limit=1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for another operation's parameter, got %d", rr.Code)
+	}
+
+	lenient := handler(SchemaOptions{AllowUndeclaredQuery: true})
+	if rr := send(lenient, "/api/v1/pets?debug=1"); rr.Code != http.StatusOK {
+		t.Errorf("allow_undeclared_query: expected 200, got %d", rr.Code)
+	}
+	// Declared ones are still validated.
+	if rr := send(lenient, "/api/v1/pets?debug=1&limit=ten"); rr.Code != http.StatusBadRequest {
+		t.Errorf("allow_undeclared_query: expected 400 for a bad limit, got %d", rr.Code)
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	spec := mustSpec(t, petstore)
+	enforcer := NewSchemaEnforcer(spec, SchemaOptions{ValidateResponses: true})
+	op := spec.Paths["/pets/{id}"].Get
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		drift  bool
+	}{
+		{"matches", 200, `{"id": 7, "name": "Rex"}`, false},
+		{"missing field", 200, `{"id": 7}`, true},
+		{"leaked field", 200, `{"id": 7, "name": "Rex", "password_hash": "x"}`, true},
+		{"default response", 500, `{"message": "oops"}`, false},
+		{"default response mismatch", 500, `{"error": "oops"}`, true},
+		{"not JSON", 200, `<html>`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &responseCapture{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+			rec.Header().Set("Content-Type", "application/json")
+			rec.WriteHeader(tt.status)
+			rec.Write([]byte(tt.body))
+
+			drift := enforcer.checkResponse(op, rec)
+			if (len(drift) > 0) != tt.drift {
+				t.Errorf("expected drift=%v, got %v", tt.drift, drift)
+			}
+		})
+	}
+
+	// Undocumented status codes are drift too.
+	rec := &responseCapture{ResponseWriter: httptest.NewRecorder(), status: http.StatusInternalServerError}
+	if drift := enforcer.checkResponse(spec.Paths["/pets/{id}"].Delete, rec); len(drift) == 0 {
+		t.Error("expected drift for an undocumented status")
+	}
+
+	// Responses pass through unchanged.
+	handler := enforcer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id": 7, "secret": true}`)
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/pets/7", nil))
+	if rr.Code != 200 || rr.Body.String() != `{"id": 7, "secret": true}` {
+		t.Errorf("response validation must not change the response, got %d %q", rr.Code, rr.Body.String())
+	}
+}
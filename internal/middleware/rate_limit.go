@@ -1,63 +1,206 @@
 package middleware
 
 import (
+	"fmt"
 	"log"
-	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/princetheprogrammer/apisentinel/internal/logger"
 )
 
-// RateLimiter simple in-memory rate limiter.
-// In a real pro-tier app, you'd use Redis or a Token Bucket library.
+// RateLimit is a token bucket: a client may send Burst requests at once,
+// and tokens come back smoothly at Rate per Period. There are no windows,
+// so nobody can double up across a boundary and nobody gets reset at once.
+type RateLimit struct {
+	Rate   int           // Requests per Period
+	Burst  int           // Bucket size (default Rate)
+	Period time.Duration // Default one minute
+}
+
+// withDefaults fills in Burst and Period.
+func (l RateLimit) withDefaults() RateLimit {
+	if l.Burst <= 0 {
+		l.Burst = l.Rate
+	}
+	if l.Period <= 0 {
+		l.Period = time.Minute
+	}
+	return l
+}
+
+// perToken is the time it takes to earn back one token, in nanoseconds.
+func (l RateLimit) perToken() float64 {
+	return float64(l.Period) / float64(max(l.Rate, 1))
+}
+
+// RateLimiter is one rate limit: a token bucket per key (client IP, API
+// key...), kept in a RateLimitStore.
 type RateLimiter struct {
-	mu      sync.Mutex
-	clients map[string]int
-	limit   int
+	id       string
+	name     string
+	key      RateKey
+	store    RateLimitStore
+	own      *MemoryStore // Closed by Stop
+	failOpen bool
+
+	mu    sync.Mutex
+	limit RateLimit
+	now   func() time.Time
+}
+
+// RateLimiterOptions configures a RateLimiter.
+type RateLimiterOptions struct {
+	ID       string         // Namespaces the buckets in a shared Store (default Name)
+	Name     string         // For logs and audit events
+	Key      RateKey        // nil = client IP
+	Limit    RateLimit      //
+	Store    RateLimitStore // nil = a MemoryStore of its own
+	FailOpen bool           // Let requests through when the Store fails, instead of a 503
+}
+
+// rateDecision is the outcome of taking a token, for the response headers.
+type rateDecision struct {
+	limit      RateLimit
+	allowed    bool
+	remaining  int
+	reset      time.Duration // Until the bucket is full again
+	retryAfter time.Duration // Until the next token, when not allowed
 }
 
-func NewRateLimiter(limit int) *RateLimiter {
+func NewRateLimiter(opts RateLimiterOptions) *RateLimiter {
 	rl := &RateLimiter{
-		clients: make(map[string]int),
-		limit:   limit,
+		id:       opts.ID,
+		name:     opts.Name,
+		key:      opts.Key,
+		store:    opts.Store,
+		failOpen: opts.FailOpen,
+		limit:    opts.Limit.withDefaults(),
+		now:      time.Now,
+	}
+	if rl.id == "" {
+		rl.id = rl.name
+	}
+	if rl.key == nil {
+		rl.key, _ = ParseRateKey(nil, "")
+	}
+	if rl.store == nil {
+		rl.own = NewMemoryStore()
+		rl.store = rl.own
+	}
+	return rl
+}
+
+// Stop releases the limiter's own MemoryStore. A shared Store is left alone.
+func (rl *RateLimiter) Stop() {
+	if rl.own != nil {
+		rl.own.Close()
 	}
+}
 
-	// Reset limits every minute (educational simplification)
-	go func() {
-		for {
-			time.Sleep(1 * time.Minute)
-			rl.mu.Lock()
-			rl.clients = make(map[string]int)
-			rl.mu.Unlock()
-		}
-	}()
+// SetLimit changes the limit without resetting buckets. Tokens above the
+// new burst are dropped.
+func (rl *RateLimiter) SetLimit(limit RateLimit) {
+	rl.mu.Lock()
+	rl.limit = limit.withDefaults()
+	rl.mu.Unlock()
+}
 
-	return rl
+// take spends one of key's tokens if it has one.
+func (rl *RateLimiter) take(key string) (rateDecision, error) {
+	rl.mu.Lock()
+	l := rl.limit
+	rl.mu.Unlock()
+
+	allowed, tokens, err := rl.store.Take(rl.id+":"+key, l, rl.now())
+	if err != nil {
+		return rateDecision{}, err
+	}
+	d := rateDecision{limit: l, allowed: allowed, remaining: int(tokens)}
+	if !allowed {
+		d.retryAfter = time.Duration((1 - tokens) * l.perToken())
+	}
+	d.reset = time.Duration((float64(l.Burst) - tokens) * l.perToken())
+	return d, nil
+}
+
+// headers sets the RateLimit-* headers (IETF draft) and, when the request
+// is refused, Retry-After. Durations are rounded up to whole seconds.
+func (d rateDecision) headers(h http.Header) {
+	l := d.limit
+	h.Set("RateLimit-Limit", strconv.Itoa(l.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", l.Rate, ceilSeconds(l.Period), l.Burst))
+	if !d.allowed {
+		h.Set("Retry-After", strconv.Itoa(max(ceilSeconds(d.retryAfter), 1)))
+	}
+}
+
+// tighter reports whether d is more restrictive than o: refused, or
+// closer to being refused.
+func (d rateDecision) tighter(o rateDecision) bool {
+	if d.allowed != o.allowed {
+		return !d.allowed
+	}
+	if !d.allowed {
+		return d.retryAfter > o.retryAfter
+	}
+	return d.remaining < o.remaining
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
 }
 
+// Middleware applies the limiter on its own.
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			ip = r.RemoteAddr // Fallback
-		}
-
-		rl.mu.Lock()
-		rl.clients[ip]++
-		count := rl.clients[ip]
-		rl.mu.Unlock()
-
-		if count > rl.limit {
-			log.Printf("⚠️ Rate Limit Exceeded for IP: %s", ip)
-			requestID := r.Header.Get("X-Request-ID")
-			logger.LogEvent(requestID, ip, r.Method, r.URL.Path, "Rate Limit Exceeded", "Client exceeded allowed requests per minute")
-			IncrementBlocked()
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
+	return RateLimits("", rl)(next)
+}
+
+// RateLimits applies every limiter to each request; any of them can refuse
+// it. Each one spends a token even when another refuses, so hammering one
+// limit still counts against the others. The headers describe the refusing
+// limit, or the one closest to refusing.
+func RateLimits(route string, limiters ...*RateLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var worst *RateLimiter
+			var d rateDecision
+			for _, rl := range limiters {
+				rd, err := rl.take(rl.key.of(r, route))
+				if err != nil {
+					if rl.failOpen {
+						continue
+					}
+					// The store logs the outage, not every request.
+					IncrementBlocked()
+					http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				if worst == nil || rd.tighter(d) {
+					worst, d = rl, rd
+				}
+			}
+			if worst == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			d.headers(w.Header())
+
+			if !d.allowed {
+				ip := clientIP(r)
+				log.Printf("⚠️ Rate Limit Exceeded (%s) for IP: %s", worst.name, ip)
+				requestID := r.Header.Get("X-Request-ID")
+				logger.LogEvent(requestID, ip, r.Method, r.URL.Path, "Rate Limit Exceeded", fmt.Sprintf("Client exceeded rate limit %q", worst.name))
+				IncrementBlocked()
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
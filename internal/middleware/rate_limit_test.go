@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for time.Now in rate limiter tests.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(t *testing.T, limit RateLimit) (*RateLimiter, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rl := NewRateLimiter(RateLimiterOptions{Name: "test", Limit: limit})
+	rl.now = clock.now
+	t.Cleanup(rl.Stop)
+	return rl, clock
+}
+
+func mustTake(t *testing.T, rl *RateLimiter, key string) rateDecision {
+	t.Helper()
+	d, err := rl.take(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl, clock := newTestLimiter(t, RateLimit{Rate: 60, Burst: 5, Period: time.Minute})
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The burst goes through at once.
+	for i := 0; i < 5; i++ {
+		rr := send("10.0.0.1")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i+1, rr.Code)
+		}
+		if got, want := rr.Header().Get("RateLimit-Remaining"), []string{"4", "3", "2", "1", "0"}[i]; got != want {
+			t.Errorf("request %d: RateLimit-Remaining %s, want %s", i+1, got, want)
+		}
+	}
+
+	rr := send("10.0.0.1")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the burst: got %d", rr.Code)
+	}
+	want := map[string]string{
+		"RateLimit-Limit":     "5",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "5", // One token a second
+		"RateLimit-Policy":    "60;w=60;burst=5",
+		"Retry-After":         "1",
+	}
+	for h, v := range want {
+		if got := rr.Header().Get(h); got != v {
+			t.Errorf("%s: %q, want %q", h, got, v)
+		}
+	}
+
+	// Other clients have their own bucket.
+	if rr := send("10.0.0.2"); rr.Code != http.StatusOK {
+		t.Errorf("another client: got %d", rr.Code)
+	}
+
+	// Tokens come back one at a time, not all at once.
+	clock.advance(time.Second)
+	if rr := send("10.0.0.1"); rr.Code != http.StatusOK {
+		t.Errorf("after one second: got %d", rr.Code)
+	}
+	if rr := send("10.0.0.1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("only one token should have come back, got %d", rr.Code)
+	}
+	clock.advance(500 * time.Millisecond)
+	if rr := send("10.0.0.1"); rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("half a token: got %d, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if rr := send("10.0.0.2"); rr.Header().Get("Retry-After") != "" {
+		t.Error("Retry-After set on an allowed request")
+	}
+}
+
+func TestRateLimiterNoWindowBoundary(t *testing.T) {
+	// A fixed one-minute window let a client send 10 at 0:59 and 10 more at 1:01.
+	rl, clock := newTestLimiter(t, RateLimit{Rate: 10})
+	clock.advance(59 * time.Second)
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if mustTake(t, rl, "c").allowed {
+			allowed++
+		}
+	}
+	clock.advance(2 * time.Second)
+	for i := 0; i < 10; i++ {
+		if mustTake(t, rl, "c").allowed {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("%d requests allowed across the boundary, want 10", allowed)
+	}
+
+	// A full period later the bucket is full again.
+	clock.advance(time.Minute)
+	if d := mustTake(t, rl, "c"); !d.allowed || d.remaining != 9 {
+		t.Errorf("after a minute: %+v", d)
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	rl, clock := newTestLimiter(t, RateLimit{Rate: 2, Burst: 2, Period: time.Second})
+	mustTake(t, rl, "idle")
+	mustTake(t, rl, "busy")
+	mustTake(t, rl, "busy")
+
+	clock.advance(600 * time.Millisecond)
+	rl.own.evict(clock.now())
+	if _, ok := rl.own.buckets["test:idle"]; ok {
+		t.Error("a full bucket should be evicted")
+	}
+	if _, ok := rl.own.buckets["test:busy"]; !ok {
+		t.Error("a bucket still refilling should be kept")
+	}
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	rl, clock := newTestLimiter(t, RateLimit{Rate: 10, Burst: 10, Period: time.Second})
+	for i := 0; i < 10; i++ {
+		mustTake(t, rl, "c")
+	}
+
+	// A reload doesn't hand out a fresh bucket...
+	rl.SetLimit(RateLimit{Rate: 100, Burst: 100, Period: time.Second})
+	if mustTake(t, rl, "c").allowed {
+		t.Error("SetLimit refilled the bucket")
+	}
+	// ...but the new rate applies from now on.
+	clock.advance(100 * time.Millisecond)
+	if d := mustTake(t, rl, "c"); !d.allowed || d.remaining != 9 {
+		t.Errorf("after 100ms at 100/s: %+v", d)
+	}
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RateKey says what a rate limit counts requests by. Its parts are joined
+// into a composite key: [api_key, path] gives every key its own bucket on
+// every path.
+//
+//	ip            client IP
+//	api_key       X-API-Key header, or the api_key query parameter
+//	jwt_sub       sub claim of the Authorization bearer token. Without a
+//	              secret to verify it, sub and client IP together
+//	cookie:NAME   a cookie
+//	header:NAME   a request header
+//	path          request path
+//	method        request method
+//	route         the route the request matched
+//
+// A request without the identity a part asks for (no API key, no token...)
+// is counted by its IP instead, so leaving the header out doesn't escape
+// the limit.
+type RateKey []rateKeyPart
+
+type rateKeyPart struct {
+	name     string // As configured, for the bucket key
+	value    func(r *http.Request, route string) string
+	identity bool // Falls back to the client IP when missing
+	secret   bool // Hashed, so credentials don't end up in bucket keys
+}
+
+// ParseRateKey parses a key from its parts. No parts means the client IP.
+// jwtSecret is the HMAC secret jwt_sub tokens are verified with, "" if
+// they can't be.
+func ParseRateKey(parts []string, jwtSecret string) (RateKey, error) {
+	if len(parts) == 0 {
+		parts = []string{"ip"}
+	}
+	key := make(RateKey, 0, len(parts))
+	for _, p := range parts {
+		kind, arg, _ := strings.Cut(p, ":")
+		part := rateKeyPart{name: p}
+		switch kind {
+		case "ip":
+			part.value = func(r *http.Request, _ string) string { return clientIP(r) }
+		case "api_key":
+			part.value, part.identity, part.secret = apiKey, true, true
+		case "jwt_sub":
+			part.value, part.identity = jwtKey([]byte(jwtSecret)), true
+		case "cookie":
+			part.value, part.identity, part.secret = func(r *http.Request, _ string) string {
+				if c, err := r.Cookie(arg); err == nil {
+					return c.Value
+				}
+				return ""
+			}, true, true
+		case "header":
+			part.value, part.identity, part.secret = func(r *http.Request, _ string) string { return r.Header.Get(arg) }, true, true
+		case "path":
+			part.value = func(r *http.Request, _ string) string { return r.URL.Path }
+		case "method":
+			part.value = func(r *http.Request, _ string) string { return r.Method }
+		case "route":
+			part.value = func(_ *http.Request, route string) string { return route }
+		default:
+			return nil, fmt.Errorf("unknown rate limit key %q", p)
+		}
+		if (kind == "cookie" || kind == "header") == (arg == "") {
+			return nil, fmt.Errorf("invalid rate limit key %q", p)
+		}
+		key = append(key, part)
+	}
+	return key, nil
+}
+
+// of returns the bucket key for r.
+func (k RateKey) of(r *http.Request, route string) string {
+	var b strings.Builder
+	for i, part := range k {
+		if i > 0 {
+			b.WriteByte('|')
+		}
+		v := part.value(r, route)
+		switch {
+		case v == "" && part.identity:
+			b.WriteString("ip=" + clientIP(r))
+			continue
+		case part.secret:
+			sum := sha256.Sum256([]byte(v))
+			v = hex.EncodeToString(sum[:12])
+		}
+		b.WriteString(part.name + "=" + v)
+	}
+	return b.String()
+}
+
+func apiKey(r *http.Request, _ string) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// jwtKey returns the jwt_sub part's value. An unverified sub is anything
+// the client wants it to be: alone, a forged token naming a victim would
+// spend the victim's bucket. So without a secret the IP is part of the key.
+func jwtKey(secret []byte) func(r *http.Request, _ string) string {
+	return func(r *http.Request, _ string) string {
+		sub := jwtSubject(r, secret, time.Now())
+		if sub == "" || len(secret) > 0 {
+			return sub
+		}
+		return sub + "@" + clientIP(r)
+	}
+}
+
+// jwtSubject reads the sub claim of a bearer JWT. With a secret, only an
+// HS256/384/512 token signed with it and not expired counts.
+func jwtSubject(r *http.Request, secret []byte, now time.Time) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	if len(secret) > 0 && !jwtSigned(parts, secret) {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Sub string   `json:"sub"`
+		Exp *float64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+	if len(secret) > 0 && claims.Exp != nil && float64(now.Unix()) >= *claims.Exp {
+		return ""
+	}
+	return claims.Sub
+}
+
+// jwtSigned checks an HMAC-signed token's signature.
+func jwtSigned(parts []string, secret []byte) bool {
+	header, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return false
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(header, &h) != nil {
+		return false
+	}
+	var newHash func() hash.Hash
+	switch h.Alg {
+	case "HS256":
+		newHash = sha256.New
+	case "HS384":
+		newHash = sha512.New384
+	case "HS512":
+		newHash = sha512.New
+	default:
+		return false // "none", RS256... can't be checked with a shared secret
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	return hmac.Equal(sig, mac.Sum(nil))
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateKey(t *testing.T) {
+	jwt := func(payload string) string {
+		return "Bearer eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+	}
+	tests := []struct {
+		name    string
+		key     []string
+		headers map[string]string
+		url     string
+		want    string
+	}{
+		{"default", nil, nil, "/", "ip=192.0.2.1"},
+		{"jwt subject", []string{"jwt_sub"}, map[string]string{"Authorization": jwt(`{"sub":"u-42"}`)}, "/", "jwt_sub=u-42@192.0.2.1"},
+		{"jwt without sub", []string{"jwt_sub"}, map[string]string{"Authorization": jwt(`{"iss":"x"}`)}, "/", "ip=192.0.2.1"},
+		{"not a jwt", []string{"jwt_sub"}, map[string]string{"Authorization": "Basic dXNlcjpwdw=="}, "/", "ip=192.0.2.1"},
+		{"composite", []string{"method", "path", "route"}, nil, "/api/x", "method=GET|path=/api/x|route=/api"},
+		{"missing header", []string{"header:X-Tenant", "path"}, nil, "/a", "ip=192.0.2.1|path=/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseRateKey(tt.key, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := key.of(req, "/api"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Credentials are hashed, and the header and query forms are one key.
+	key, _ := ParseRateKey([]string{"api_key"}, "")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "sk-secret")
+	viaHeader := key.of(req, "")
+	if strings.Contains(viaHeader, "sk-secret") {
+		t.Errorf("API key in bucket key: %q", viaHeader)
+	}
+	if viaQuery := key.of(httptest.NewRequest(http.MethodGet, "/?api_key=sk-secret", nil), ""); viaQuery != viaHeader {
+		t.Errorf("header %q and query %q keys differ", viaHeader, viaQuery)
+	}
+
+	for _, bad := range [][]string{{"user"}, {"cookie"}, {"ip:1"}} {
+		if _, err := ParseRateKey(bad, ""); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
+
+func TestRateLimitsTightest(t *testing.T) {
+	perIP, _ := newTestLimiter(t, RateLimit{Rate: 100})
+	perPath, _ := newTestLimiter(t, RateLimit{Rate: 2})
+	perPath.key, _ = ParseRateKey([]string{"path"}, "")
+
+	handler := RateLimits("", perIP, perPath)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/x", nil))
+		return rr
+	}
+
+	if rr := send(); rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("headers should describe the tightest limit: %v", rr.Header())
+	}
+	send()
+	if rr := send(); rr.Code != http.StatusTooManyRequests || rr.Header().Get("RateLimit-Policy") != "2;w=60;burst=2" {
+		t.Errorf("got %d, %v", rr.Code, rr.Header())
+	}
+}
+
+func TestRateKeyVerifiedJWT(t *testing.T) {
+	secret := "s3cret"
+	sign := func(alg, payload, key string) string {
+		head := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT"}`))
+		body := base64.RawURLEncoding.EncodeToString([]byte(payload))
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(head + "." + body))
+		return "Bearer " + head + "." + body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	future := fmt.Sprintf(`{"sub":"u-42","exp":%d}`, time.Now().Add(time.Hour).Unix())
+	past := fmt.Sprintf(`{"sub":"u-42","exp":%d}`, time.Now().Add(-time.Hour).Unix())
+
+	tests := []struct {
+		name, auth, want string
+	}{
+		{"verified", sign("HS256", future, secret), "jwt_sub=u-42"},
+		{"wrong secret", sign("HS256", future, "guess"), "ip=192.0.2.1"},
+		{"expired", sign("HS256", past, secret), "ip=192.0.2.1"},
+		{"alg none", sign("none", future, secret), "ip=192.0.2.1"},
+	}
+	key, err := ParseRateKey([]string{"jwt_sub"}, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", tt.auth)
+		if got := key.of(req, ""); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Unverified, a token naming the victim doesn't reach their bucket
+	// from another IP.
+	unverified, _ := ParseRateKey([]string{"jwt_sub"}, "")
+	victim := httptest.NewRequest(http.MethodGet, "/", nil)
+	victim.Header.Set("Authorization", sign("HS256", future, secret))
+	forged := httptest.NewRequest(http.MethodGet, "/", nil)
+	forged.RemoteAddr = "198.51.100.7:4000"
+	forged.Header.Set("Authorization", sign("HS256", future, "attacker"))
+	if a, b := unverified.of(victim, ""), unverified.of(forged, ""); a == b {
+		t.Errorf("forged token shares the victim's bucket %q", a)
+	}
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitStore holds token buckets. Take brings key's bucket up to now
+// under limit, spends a token if there is one and returns the tokens left.
+// A bucket that doesn't exist yet is full.
+type RateLimitStore interface {
+	Take(key string, limit RateLimit, now time.Time) (allowed bool, tokens float64, err error)
+}
+
+// evictEvery is how often a MemoryStore drops the buckets that have refilled
+// completely. A full bucket is the same as no bucket.
+const evictEvery = time.Minute
+
+// MemoryStore keeps buckets in this process. Each replica counts on its own.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// bucket is one key's tokens as of last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // When it will have refilled, for eviction
+}
+
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{
+		buckets: make(map[string]*bucket),
+		stop:    make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(evictEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				m.evict(now)
+			}
+		}
+	}()
+
+	return m
+}
+
+// Close ends the background eviction loop.
+func (m *MemoryStore) Close() {
+	m.once.Do(func() { close(m.stop) })
+}
+
+func (m *MemoryStore) Take(key string, limit RateLimit, now time.Time) (bool, float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[key] = b
+	}
+	earned := float64(now.Sub(b.last)) / limit.perToken()
+	b.tokens = math.Min(b.tokens+max(earned, 0), float64(limit.Burst))
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) * limit.perToken()))
+	return allowed, b.tokens, nil
+}
+
+// evict drops the buckets that have refilled completely by now.
+func (m *MemoryStore) evict(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// takeScript refills and spends a token atomically, the same way
+// MemoryStore.Take does. The bucket is a hash (t = tokens, l = last, in
+// ms) that expires once it would be full again.
+//
+// KEYS[1] bucket, ARGV burst, ms per token, now in ms.
+const takeScript = `
+local burst = tonumber(ARGV[1])
+local per = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 't', 'l')
+local tokens = tonumber(b[1]) or burst
+local last = tonumber(b[2]) or now
+if now > last then
+  tokens = math.min(burst, tokens + (now - last) / per)
+  last = now
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 't', tostring(tokens), 'l', tostring(last))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) * per) + 1)
+return {allowed, tostring(tokens)}
+`
+
+var takeScriptSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// redisMaxIdle is how many idle connections a RedisStore keeps.
+const redisMaxIdle = 16
+
+// RedisStore keeps buckets in Redis, or anything speaking its protocol, so
+// every replica shares them. Each take is a single script call.
+type RedisStore struct {
+	Address  string        // host:port, or a unix socket path
+	Password string        // AUTH, "" = none
+	DB       int           // SELECT
+	Prefix   string        // Prepended to every key (default "apisentinel:ratelimit:")
+	Timeout  time.Duration // Per command, dial included (default 250ms)
+
+	// After a failure, requests skip the store for this long (default 1s)
+	// instead of each waiting for its own timeout. Then one probes it.
+	RetryEvery time.Duration
+
+	mu      sync.Mutex
+	idle    []*redisConn
+	down    atomic.Bool  // Logged once per outage
+	retryAt atomic.Int64 // While down: UnixNano of the next probe
+}
+
+// errRedisDown is returned without trying while the store is backing off.
+var errRedisDown = errors.New("redis: unreachable, backing off")
+
+// redisError is an error reply. The connection is still usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (s *RedisStore) Take(key string, limit RateLimit, now time.Time) (bool, float64, error) {
+	if s.backingOff() {
+		return false, 0, errRedisDown
+	}
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = "apisentinel:ratelimit:"
+	}
+	args := []string{
+		"EVALSHA", takeScriptSHA, "1", prefix + key,
+		strconv.Itoa(limit.Burst),
+		strconv.FormatFloat(limit.perToken()/float64(time.Millisecond), 'f', -1, 64),
+		strconv.FormatInt(now.UnixMilli(), 10),
+	}
+	reply, err := s.Do(args...)
+	if rerr := redisError(""); errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		// First call on this server (or after SCRIPT FLUSH): send the script itself.
+		args[0], args[1] = "EVAL", takeScript
+		reply, err = s.Do(args...)
+	}
+	if err != nil {
+		s.failed(err)
+		return false, 0, err
+	}
+	s.recovered()
+
+	r, ok := reply.([]any)
+	if len(r) != 2 || !ok {
+		return false, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	allowed, _ := r[0].(int64)
+	tokens, _ := r[1].(string)
+	t, err := strconv.ParseFloat(tokens, 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	return allowed == 1, t, nil
+}
+
+// Ping checks that the server is reachable and accepts our credentials.
+func (s *RedisStore) Ping() error {
+	_, err := s.Do("PING")
+	if err != nil {
+		s.failed(err)
+		return err
+	}
+	s.recovered()
+	return nil
+}
+
+// backingOff reports whether to skip the store. Once the retry interval
+// has passed, the first caller probes it and the others keep skipping.
+func (s *RedisStore) backingOff() bool {
+	if !s.down.Load() {
+		return false
+	}
+	at, now := s.retryAt.Load(), time.Now().UnixNano()
+	if now < at {
+		return true
+	}
+	return !s.retryAt.CompareAndSwap(at, now+int64(s.retryEvery()))
+}
+
+func (s *RedisStore) retryEvery() time.Duration {
+	if s.RetryEvery <= 0 {
+		return time.Second
+	}
+	return s.RetryEvery
+}
+
+func (s *RedisStore) failed(err error) {
+	s.retryAt.Store(time.Now().Add(s.retryEvery()).UnixNano())
+	if s.down.CompareAndSwap(false, true) {
+		log.Printf("❌ Rate limit store unreachable (%s): %v", s.Address, err)
+	}
+}
+
+func (s *RedisStore) recovered() {
+	if s.down.CompareAndSwap(true, false) {
+		log.Printf("✅ Rate limit store is back (%s)", s.Address)
+	}
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.idle {
+		c.Close()
+	}
+	s.idle = nil
+}
+
+// Do sends one command and returns its reply: string, int64, []any, nil,
+// or a redisError.
+func (s *RedisStore) Do(args ...string) (any, error) {
+	c, pooled, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(s.timeout(), args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.Close() // Broken mid-reply, don't reuse it
+		if !pooled {
+			return nil, err
+		}
+		// An idle connection may have died with a server restart: one
+		// more try on a fresh one.
+		if c, err = s.dial(); err != nil {
+			return nil, err
+		}
+		if reply, err = c.do(s.timeout(), args...); err != nil && !errors.As(err, &rerr) {
+			c.Close()
+			return nil, err
+		}
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (s *RedisStore) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return 250 * time.Millisecond
+	}
+	return s.Timeout
+}
+
+// conn returns an idle connection, or dials a new one.
+func (s *RedisStore) conn() (c *redisConn, pooled bool, err error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, true, nil
+	}
+	s.mu.Unlock()
+	c, err = s.dial()
+	return c, false, err
+}
+
+// dial connects, authenticates and selects the database.
+func (s *RedisStore) dial() (*redisConn, error) {
+	network := "tcp"
+	if strings.HasPrefix(s.Address, "/") {
+		network = "unix"
+	}
+	nc, err := net.DialTimeout(network, s.Address, s.timeout())
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	if s.Password != "" {
+		if _, err := c.do(s.timeout(), "AUTH", s.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if s.DB != 0 {
+		if _, err := c.do(s.timeout(), "SELECT", strconv.Itoa(s.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *RedisStore) put(c *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= redisMaxIdle {
+		c.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+	writeCommand(c.w, args)
+	if err := c.w.Flush(); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	reply, err := readReply(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(redisError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+// writeCommand writes args as a RESP array of bulk strings.
+func writeCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+// readReply reads one RESP value. Error replies are returned as a
+// redisError value, not an error.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed integer %q", body)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
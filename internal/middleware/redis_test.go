@@ -0,0 +1,296 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks enough of the Redis protocol for RedisStore: AUTH,
+// SELECT, PING, and EVAL/EVALSHA of takeScript, which it runs in Go.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	buckets map[string][2]float64 // Key → tokens, last
+	scripts map[string]bool
+	calls   map[string]int
+	conns   []net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:       ln,
+		password: password,
+		buckets:  make(map[string][2]float64),
+		scripts:  make(map[string]bool),
+		calls:    make(map[string]int),
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authed := f.password == ""
+	for {
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := req.([]any)
+		args := make([]string, len(items))
+		for i, it := range items {
+			args[i], _ = it.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		f.mu.Lock()
+		cmd := strings.ToUpper(args[0])
+		f.calls[cmd]++
+		switch {
+		case cmd == "AUTH":
+			if authed = args[1] == f.password; authed {
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		case cmd == "PING":
+			w.WriteString("+PONG\r\n")
+		case cmd == "SELECT":
+			w.WriteString("+OK\r\n")
+		case cmd == "EVAL" || cmd == "EVALSHA":
+			sha := args[1]
+			if cmd == "EVAL" {
+				sum := sha1.Sum([]byte(args[1]))
+				sha = hex.EncodeToString(sum[:])
+				f.scripts[sha] = true
+			}
+			if !f.scripts[sha] {
+				w.WriteString("-NOSCRIPT No matching script. Please use EVAL.\r\n")
+				break
+			}
+			allowed, tokens := f.take(args[3], args[4:])
+			fmt.Fprintf(w, "*2\r\n:%d\r\n$%d\r\n%s\r\n", allowed, len(tokens), tokens)
+		default:
+			fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		f.mu.Unlock()
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// restart drops every connection and forgets the scripts, as a restarted
+// server would. The buckets are kept, as if persisted.
+func (f *fakeRedis) restart() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+	f.scripts = make(map[string]bool)
+}
+
+// take mirrors takeScript. The caller holds mu.
+func (f *fakeRedis) take(key string, argv []string) (int, string) {
+	burst, _ := strconv.ParseFloat(argv[0], 64)
+	per, _ := strconv.ParseFloat(argv[1], 64)
+	now, _ := strconv.ParseFloat(argv[2], 64)
+	tokens, last := burst, now
+	if b, ok := f.buckets[key]; ok {
+		tokens, last = b[0], b[1]
+	}
+	if now > last {
+		tokens = math.Min(burst, tokens+(now-last)/per)
+		last = now
+	}
+	allowed := 0
+	if tokens >= 1 {
+		tokens--
+		allowed = 1
+	}
+	f.buckets[key] = [2]float64{tokens, last}
+	return allowed, strconv.FormatFloat(tokens, 'f', -1, 64)
+}
+
+func TestRedisStoreSharedByReplicas(t *testing.T) {
+	f := newFakeRedis(t, "s3cret")
+
+	// Two replicas, each with its own connection pool.
+	replica := func() *RateLimiter {
+		store := &RedisStore{Address: f.ln.Addr().String(), Password: "s3cret", DB: 2}
+		t.Cleanup(store.Close)
+		return NewRateLimiter(RateLimiterOptions{Name: "per-ip", Limit: RateLimit{Rate: 3}, Store: store})
+	}
+	a, b := replica(), replica()
+
+	allowed := 0
+	for i := 0; i < 3; i++ {
+		for _, rl := range []*RateLimiter{a, b} {
+			if mustTake(t, rl, "ip=192.0.2.1").allowed {
+				allowed++
+			}
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("%d requests allowed across two replicas, want 3", allowed)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.buckets["apisentinel:ratelimit:per-ip:ip=192.0.2.1"]; !ok {
+		t.Errorf("unexpected keys: %v", f.buckets)
+	}
+	// The script is sent once, then called by its SHA.
+	if f.calls["EVAL"] != 1 || f.calls["EVALSHA"] != 6 {
+		t.Errorf("unexpected calls: %v", f.calls)
+	}
+	// One connection per replica, reused.
+	if f.calls["AUTH"] != 2 || f.calls["SELECT"] != 2 {
+		t.Errorf("unexpected calls: %v", f.calls)
+	}
+}
+
+func TestRedisStoreReconnects(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := &RedisStore{Address: f.ln.Addr().String()}
+	defer store.Close()
+	rl := NewRateLimiter(RateLimiterOptions{Name: "per-ip", Limit: RateLimit{Rate: 2}, Store: store})
+
+	mustTake(t, rl, "c")
+	f.restart()
+	// The idle connection is dead: the take is retried on a new one, and the
+	// script sent again.
+	if d := mustTake(t, rl, "c"); !d.allowed || d.remaining != 0 {
+		t.Errorf("after restart: %+v", d)
+	}
+	if d := mustTake(t, rl, "c"); d.allowed {
+		t.Errorf("bucket lost across the restart: %+v", d)
+	}
+}
+
+func TestRedisStoreUnreachable(t *testing.T) {
+	// A port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	send := func(failOpen bool) int {
+		store := &RedisStore{Address: addr, Timeout: 100 * time.Millisecond}
+		rl := NewRateLimiter(RateLimiterOptions{Limit: RateLimit{Rate: 10}, Store: store, FailOpen: failOpen})
+		rr := httptest.NewRecorder()
+		rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+			ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rr.Code
+	}
+	if code := send(false); code != http.StatusServiceUnavailable {
+		t.Errorf("fail closed: got %d", code)
+	}
+	if code := send(true); code != http.StatusOK {
+		t.Errorf("fail open: got %d", code)
+	}
+}
+
+func TestRedisStoreBacksOff(t *testing.T) {
+	// A server that accepts connections but never answers: every command
+	// waits for the timeout.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var mu sync.Mutex
+	accepted := 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+		}
+	}()
+	dials := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+
+	store := &RedisStore{Address: ln.Addr().String(), Timeout: 100 * time.Millisecond, RetryEvery: 300 * time.Millisecond}
+	defer store.Close()
+	if _, _, err := store.Take("k", RateLimit{Rate: 1, Burst: 1, Period: time.Second}, time.Now()); err == nil {
+		t.Fatal("expected a timeout")
+	}
+
+	// Within the retry interval requests fail at once, without dialing.
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if _, _, err := store.Take("k", RateLimit{Rate: 1, Burst: 1, Period: time.Second}, time.Now()); err != errRedisDown {
+			t.Fatalf("expected errRedisDown, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("backing off took %s", elapsed)
+	}
+	if n := dials(); n != 1 {
+		t.Errorf("%d connections during the back-off, want 1", n)
+	}
+
+	// Then one request probes the store again.
+	time.Sleep(300 * time.Millisecond)
+	store.Take("k", RateLimit{Rate: 1, Burst: 1, Period: time.Second}, time.Now())
+	if n := dials(); n != 2 {
+		t.Errorf("%d connections after the interval, want 2", n)
+	}
+}
+
+func TestRedisStoreWrongPassword(t *testing.T) {
+	f := newFakeRedis(t, "s3cret")
+	store := &RedisStore{Address: f.ln.Addr().String(), Password: "guess"}
+	if err := store.Ping(); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected WRONGPASS, got %v", err)
+	}
+}
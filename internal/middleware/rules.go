@@ -0,0 +1,353 @@
+package middleware
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Inspection targets a rule can select.
+const (
+	TargetPath   = "path"   // The URL path
+	TargetQuery  = "query"  // Query parameter values
+	TargetKeys   = "keys"   // Parameter names and JSON keys
+	TargetHeader = "header" // Request header values
+	TargetCookie = "cookie" // Cookie values
+	TargetBody   = "body"   // Body values (JSON strings, form values or the raw body)
+)
+
+var knownTargets = map[string]bool{
+	TargetPath: true, TargetQuery: true, TargetKeys: true,
+	TargetHeader: true, TargetCookie: true, TargetBody: true,
+}
+
+// Rule actions.
+const (
+	ActionBlock = "block" // Reject the request (subject to the inspector mode)
+	ActionLog   = "log"   // Audit the match only
+)
+
+// severityScores is how much each severity adds to a request's anomaly score
+// (the same scale as the OWASP Core Rule Set).
+var severityScores = map[string]int{
+	"critical": 5,
+	"error":    4,
+	"warning":  3,
+	"notice":   2,
+}
+
+// Paranoia levels: 1 is the default, 4 enables the strictest (noisiest) rules.
+const (
+	MinParanoia = 1
+	MaxParanoia = 4
+)
+
+// Rule is a declarative WAF signature, loaded from YAML or JSON.
+type Rule struct {
+	ID         string   `yaml:"id" json:"id"`
+	Name       string   `yaml:"name" json:"name"`
+	Targets    []string `yaml:"targets" json:"targets"`
+	Operator   string   `yaml:"operator" json:"operator"`
+	Value      string   `yaml:"value" json:"value"`
+	Transforms []string `yaml:"transforms" json:"transforms"`
+	Severity   string   `yaml:"severity" json:"severity"`
+	Paranoia   int      `yaml:"paranoia" json:"paranoia"`
+	Action     string   `yaml:"action" json:"action"`
+	Tags       []string `yaml:"tags" json:"tags"`
+	Message    string   `yaml:"message" json:"message"`
+
+	// TargetTransforms replaces Transforms for the listed targets,
+	// e.g. {header: [lowercase]} while the body gets the full pipeline.
+	TargetTransforms map[string][]string `yaml:"target_transforms" json:"target_transforms"`
+
+	match           func(string) bool
+	transform       Transform
+	targetTransform map[string]Transform
+}
+
+// ruleFile is the on-disk format: a top-level "rules" list.
+type ruleFile struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Operators turn a rule's value into a matcher.
+var operators = map[string]func(value string) (func(string) bool, error){
+	"regex": func(value string) (func(string) bool, error) {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	},
+	"contains": func(value string) (func(string) bool, error) {
+		return func(s string) bool { return strings.Contains(s, value) }, nil
+	},
+	"equals": func(value string) (func(string) bool, error) {
+		return func(s string) bool { return s == value }, nil
+	},
+	"begins_with": func(value string) (func(string) bool, error) {
+		return func(s string) bool { return strings.HasPrefix(s, value) }, nil
+	},
+	"ends_with": func(value string) (func(string) bool, error) {
+		return func(s string) bool { return strings.HasSuffix(s, value) }, nil
+	},
+	"detect_sqli": func(string) (func(string) bool, error) {
+		return func(s string) bool {
+			ok, _ := DetectSQLi(s)
+			return ok
+		}, nil
+	},
+	"detect_xss": func(string) (func(string) bool, error) {
+		return func(s string) bool {
+			ok, _ := DetectXSS(s)
+			return ok
+		}, nil
+	},
+	"detect_xxe": func(string) (func(string) bool, error) {
+		return func(s string) bool {
+			ok, _ := DetectXXE(s)
+			return ok
+		}, nil
+	},
+	"detect_traversal": func(string) (func(string) bool, error) {
+		return func(s string) bool {
+			ok, _ := DetectPathTraversal(s)
+			return ok
+		}, nil
+	},
+	"detect_cmdi": func(string) (func(string) bool, error) {
+		return func(s string) bool {
+			ok, _ := DetectCommandInjection(s)
+			return ok
+		}, nil
+	},
+	"detect_ssrf": func(string) (func(string) bool, error) {
+		return func(s string) bool {
+			ok, _ := DetectSSRF(s)
+			return ok
+		}, nil
+	},
+	"detect_ssti": func(string) (func(string) bool, error) {
+		return func(s string) bool {
+			ok, _ := DetectSSTI(s)
+			return ok
+		}, nil
+	},
+	"detect_jndi": func(string) (func(string) bool, error) {
+		return func(s string) bool {
+			ok, _ := DetectJNDI(s)
+			return ok
+		}, nil
+	},
+}
+
+// compile validates the rule, fills in defaults and prepares its matcher.
+func (r *Rule) compile() error {
+	if r.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	if r.Name == "" {
+		r.Name = "Rule " + r.ID
+	}
+	if len(r.Targets) == 0 {
+		return fmt.Errorf("rule %s: at least one target is required", r.ID)
+	}
+	for _, t := range r.Targets {
+		if !knownTargets[t] {
+			return fmt.Errorf("rule %s: unknown target %q", r.ID, t)
+		}
+	}
+
+	if r.Severity == "" {
+		r.Severity = "critical"
+	}
+	if _, ok := severityScores[r.Severity]; !ok {
+		return fmt.Errorf("rule %s: unknown severity %q", r.ID, r.Severity)
+	}
+
+	if r.Paranoia == 0 {
+		r.Paranoia = MinParanoia
+	}
+	if r.Paranoia < MinParanoia || r.Paranoia > MaxParanoia {
+		return fmt.Errorf("rule %s: paranoia must be between %d and %d, got %d", r.ID, MinParanoia, MaxParanoia, r.Paranoia)
+	}
+
+	if r.Action == "" {
+		r.Action = ActionBlock
+	}
+	if r.Action != ActionBlock && r.Action != ActionLog {
+		return fmt.Errorf("rule %s: unknown action %q", r.ID, r.Action)
+	}
+
+	op, ok := operators[r.Operator]
+	if !ok {
+		return fmt.Errorf("rule %s: unknown operator %q", r.ID, r.Operator)
+	}
+	match, err := op(r.Value)
+	if err != nil {
+		return fmt.Errorf("rule %s: invalid value for %s: %v", r.ID, r.Operator, err)
+	}
+	r.match = match
+
+	t, err := compileTransforms(r.Transforms)
+	if err != nil {
+		return fmt.Errorf("rule %s: %v", r.ID, err)
+	}
+	r.transform = t
+
+	r.targetTransform = make(map[string]Transform, len(r.TargetTransforms))
+	for target, names := range r.TargetTransforms {
+		if !r.HasTarget(target) {
+			return fmt.Errorf("rule %s: target_transforms for %q, which is not one of its targets", r.ID, target)
+		}
+		t, err := compileTransforms(names)
+		if err != nil {
+			return fmt.Errorf("rule %s: target_transforms %s: %v", r.ID, target, err)
+		}
+		r.targetTransform[target] = t
+	}
+
+	return nil
+}
+
+// transformFor returns the transform pipeline for inputs from target.
+func (r *Rule) transformFor(target string) Transform {
+	if t, ok := r.targetTransform[target]; ok {
+		return t
+	}
+	return r.transform
+}
+
+// Score is the anomaly score this rule adds when it matches.
+// Rules with action "log" are recorded but never add to the score.
+func (r *Rule) Score() int {
+	if r.Action == ActionLog {
+		return 0
+	}
+	return severityScores[r.Severity]
+}
+
+// HasTarget reports whether the rule inspects the given target.
+func (r *Rule) HasTarget(target string) bool {
+	for _, t := range r.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+//go:embed rules/default.yaml
+var defaultRulesYAML []byte
+
+// DefaultRules returns the built-in ruleset.
+func DefaultRules() []*Rule {
+	rules, err := parseRules(defaultRulesYAML, "rules/default.yaml")
+	if err != nil {
+		panic("invalid built-in ruleset: " + err.Error())
+	}
+	return rules
+}
+
+// LoadRules reads a YAML or JSON rule file.
+func LoadRules(path string) ([]*Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRules(data, path)
+}
+
+// LoadRuleSet returns the built-in rules merged with every rule file matching
+// the given paths (globs allowed). A rule whose id already exists replaces it.
+func LoadRuleSet(paths []string) ([]*Rule, error) {
+	rules := DefaultRules()
+	index := make(map[string]int, len(rules))
+	for i, r := range rules {
+		index[r.ID] = i
+	}
+
+	for _, pattern := range paths {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule files %q: %w", pattern, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("rule files %q: no such file", pattern)
+		}
+
+		for _, file := range files {
+			loaded, err := LoadRules(file)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range loaded {
+				if i, ok := index[r.ID]; ok {
+					rules[i] = r
+					continue
+				}
+				index[r.ID] = len(rules)
+				rules = append(rules, r)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// parseRules strictly decodes and compiles a rule file.
+// JSON is valid YAML, so one decoder handles both formats.
+func parseRules(data []byte, name string) ([]*Rule, error) {
+	var file ruleFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	// A second pass over the node tree gives us line numbers for errors.
+	var doc yaml.Node
+	yaml.Unmarshal(data, &doc)
+
+	seen := make(map[string]bool, len(file.Rules))
+	for i, r := range file.Rules {
+		line := ruleLine(&doc, i)
+		if r == nil {
+			// "- " or "null": compile would dereference it.
+			return nil, fmt.Errorf("%s:%d: rules[%d]: empty rule", name, line, i)
+		}
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("%s:%d: rules[%d]: %w", name, line, i, err)
+		}
+		if seen[r.ID] {
+			return nil, fmt.Errorf("%s:%d: rules[%d]: duplicate rule id %s", name, line, i, r.ID)
+		}
+		seen[r.ID] = true
+	}
+
+	return file.Rules, nil
+}
+
+// ruleLine returns the line where the i-th rule starts, or 0 if unknown.
+func ruleLine(doc *yaml.Node, i int) int {
+	if len(doc.Content) == 0 {
+		return 0
+	}
+	root := doc.Content[0]
+	for k := 0; k+1 < len(root.Content); k += 2 {
+		if root.Content[k].Value == "rules" {
+			list := root.Content[k+1]
+			if i < len(list.Content) {
+				return list.Content[i].Line
+			}
+		}
+	}
+	return 0
+}
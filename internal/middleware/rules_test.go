@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRuleFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRuleSetFromFiles(t *testing.T) {
+	yamlFile := writeRuleFile(t, "custom.yaml", `
+rules:
+  - id: "100001"
+    name: "Scanner User-Agent"
+    targets: [header]
+    operator: contains
+    value: "sqlmap"
+    transforms: [lowercase]
+    severity: critical
+    tags: [scanner]
+`)
+	jsonFile := writeRuleFile(t, "override.json", `{"rules": [
+  {"id": "941100", "name": "Stricter XSS", "targets": ["query", "body"],
+   "operator": "contains", "value": "<svg", "transforms": ["url_decode", "lowercase"]}
+]}`)
+
+	rules, err := LoadRuleSet([]string{yamlFile, jsonFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	byID := make(map[string]*Rule)
+	for _, r := range rules {
+		byID[r.ID] = r
+	}
+	if byID["100001"] == nil {
+		t.Fatal("custom rule was not loaded")
+	}
+	if byID["941100"].Name != "Stricter XSS" {
+		t.Errorf("built-in 941100 should be replaced, got %q", byID["941100"].Name)
+	}
+	if byID["100001"].Action != ActionBlock {
+		t.Errorf("action should default to block, got %q", byID["100001"].Action)
+	}
+
+	si := NewSecurityInspector(InspectorOptions{Rules: rules})
+	handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "SQLMap/1.7")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("header rule should block, got %d", rr.Code)
+	}
+}
+
+func TestLoadRulesReportsLine(t *testing.T) {
+	path := writeRuleFile(t, "bad.yaml", `rules:
+  - id: "1"
+    targets: [query]
+    operator: contains
+    value: "x"
+  - id: "2"
+    targets: [qeury]
+    operator: contains
+    value: "y"
+`)
+	_, err := LoadRules(path)
+	if err == nil || !strings.Contains(err.Error(), ":6:") || !strings.Contains(err.Error(), "qeury") {
+		t.Fatalf("expected error on line 6 about target, got %v", err)
+	}
+}
+
+func TestLoadRulesRejectsEmptyRule(t *testing.T) {
+	for name, data := range map[string]string{
+		"dash": "rules:\n  - id: \"1\"\n    targets: [query]\n    operator: contains\n    value: \"x\"\n  -\n",
+		"null": "rules: [null]\n",
+	} {
+		_, err := LoadRules(writeRuleFile(t, name+".yaml", data))
+		if err == nil || !strings.Contains(err.Error(), "empty rule") {
+			t.Errorf("%s: expected an empty rule error, got %v", name, err)
+		}
+	}
+}
+
+func TestCategoriesDisableTaggedRules(t *testing.T) {
+	si := NewSecurityInspector(InspectorOptions{
+		Rules:      DefaultRules(),
+		Categories: map[string]bool{"xss": false, "sqli": true},
+	})
+	for _, r := range si.rules {
+		for _, tag := range r.Tags {
+			if tag == "xss" {
+				t.Fatalf("rule %s is tagged xss but xss is disabled", r.ID)
+			}
+		}
+	}
+}
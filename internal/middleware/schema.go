@@ -0,0 +1,335 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is the JSON Schema subset used by OpenAPI 3.0.
+type Schema struct {
+	Ref      string        `yaml:"$ref,omitempty" json:"$ref,omitempty"`
+	Type     string        `yaml:"type,omitempty" json:"type,omitempty"`
+	Format   string        `yaml:"format,omitempty" json:"format,omitempty"`
+	Nullable bool          `yaml:"nullable,omitempty" json:"nullable,omitempty"`
+	Enum     []interface{} `yaml:"enum,omitempty" json:"enum,omitempty"`
+
+	Minimum   *float64 `yaml:"minimum,omitempty" json:"minimum,omitempty"`
+	Maximum   *float64 `yaml:"maximum,omitempty" json:"maximum,omitempty"`
+	MinLength *int     `yaml:"minLength,omitempty" json:"minLength,omitempty"`
+	MaxLength *int     `yaml:"maxLength,omitempty" json:"maxLength,omitempty"`
+	Pattern   string   `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+
+	Items    *Schema `yaml:"items,omitempty" json:"items,omitempty"`
+	MinItems *int    `yaml:"minItems,omitempty" json:"minItems,omitempty"`
+	MaxItems *int    `yaml:"maxItems,omitempty" json:"maxItems,omitempty"`
+
+	Properties           map[string]*Schema    `yaml:"properties,omitempty" json:"properties,omitempty"`
+	Required             []string              `yaml:"required,omitempty" json:"required,omitempty"`
+	AdditionalProperties *AdditionalProperties `yaml:"additionalProperties,omitempty" json:"additionalProperties,omitempty"`
+
+	AllOf []*Schema `yaml:"allOf,omitempty" json:"allOf,omitempty"`
+	AnyOf []*Schema `yaml:"anyOf,omitempty" json:"anyOf,omitempty"`
+	OneOf []*Schema `yaml:"oneOf,omitempty" json:"oneOf,omitempty"`
+}
+
+// AdditionalProperties is either a boolean or a schema for extra object keys.
+type AdditionalProperties struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (a *AdditionalProperties) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&a.Allowed)
+	}
+	a.Allowed = true
+	a.Schema = new(Schema)
+	return n.Decode(a.Schema)
+}
+
+func (a AdditionalProperties) MarshalJSON() ([]byte, error) {
+	if a.Schema != nil {
+		return json.Marshal(a.Schema)
+	}
+	return json.Marshal(a.Allowed)
+}
+
+func (a AdditionalProperties) MarshalYAML() (interface{}, error) {
+	if a.Schema != nil {
+		return a.Schema, nil
+	}
+	return a.Allowed, nil
+}
+
+// maxSchemaErrors bounds how many violations we collect for one value.
+const maxSchemaErrors = 10
+
+// schemaValidator checks decoded JSON values (json.Number for numbers)
+// against schemas of one spec.
+type schemaValidator struct {
+	spec *OpenAPISpec
+	errs []string
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	if len(v.errs) < maxSchemaErrors {
+		if path == "" {
+			path = "$"
+		}
+		v.errs = append(v.errs, path+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+// validate checks value against sc. depth guards against recursive schemas.
+func (v *schemaValidator) validate(sc *Schema, value interface{}, path string, depth int) {
+	sc = v.spec.schema(sc)
+	if sc == nil || depth > maxRefDepth || len(v.errs) >= maxSchemaErrors {
+		return
+	}
+
+	for _, sub := range sc.AllOf {
+		v.validate(sub, value, path, depth+1)
+	}
+	if len(sc.AnyOf) > 0 && v.matching(sc.AnyOf, value, depth) == 0 {
+		v.fail(path, "does not match any of the allowed schemas")
+	}
+	if len(sc.OneOf) > 0 {
+		if n := v.matching(sc.OneOf, value, depth); n != 1 {
+			v.fail(path, "must match exactly one schema, matched %d", n)
+		}
+	}
+
+	if value == nil {
+		if sc.Type != "" && !sc.Nullable {
+			v.fail(path, "must not be null")
+		}
+		return
+	}
+
+	if len(sc.Enum) > 0 && !inEnum(sc.Enum, value) {
+		v.fail(path, "must be one of %v", sc.Enum)
+	}
+
+	switch sc.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			v.fail(path, "must be an object")
+			return
+		}
+		v.object(sc, obj, path, depth)
+
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			v.fail(path, "must be an array")
+			return
+		}
+		if sc.MinItems != nil && len(arr) < *sc.MinItems {
+			v.fail(path, "must have at least %d items", *sc.MinItems)
+		}
+		if sc.MaxItems != nil && len(arr) > *sc.MaxItems {
+			v.fail(path, "must have at most %d items", *sc.MaxItems)
+		}
+		if sc.Items != nil {
+			for i, item := range arr {
+				v.validate(sc.Items, item, path+"["+strconv.Itoa(i)+"]", depth+1)
+			}
+		}
+
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			v.fail(path, "must be a string")
+			return
+		}
+		v.str(sc, s, path)
+
+	case "integer", "number":
+		kind := "a number"
+		if sc.Type == "integer" {
+			kind = "an integer"
+		}
+		n, ok := value.(json.Number)
+		if !ok {
+			v.fail(path, "must be %s", kind)
+			return
+		}
+		f, err := n.Float64()
+		if err != nil || sc.Type == "integer" && f != math.Trunc(f) {
+			v.fail(path, "must be %s", kind)
+			return
+		}
+		if sc.Minimum != nil && f < *sc.Minimum {
+			v.fail(path, "must be >= %v", *sc.Minimum)
+		}
+		if sc.Maximum != nil && f > *sc.Maximum {
+			v.fail(path, "must be <= %v", *sc.Maximum)
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.fail(path, "must be a boolean")
+		}
+	}
+}
+
+// matching counts how many of the schemas accept value.
+func (v *schemaValidator) matching(schemas []*Schema, value interface{}, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		trial := &schemaValidator{spec: v.spec}
+		trial.validate(sub, value, "", depth+1)
+		if len(trial.errs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (v *schemaValidator) object(sc *Schema, obj map[string]interface{}, path string, depth int) {
+	for _, name := range sc.Required {
+		if _, ok := obj[name]; !ok {
+			v.fail(joinJSONPath(path, name), "is required")
+		}
+	}
+	for name, val := range obj {
+		child := joinJSONPath(path, name)
+		if prop, ok := sc.Properties[name]; ok {
+			v.validate(prop, val, child, depth+1)
+			continue
+		}
+		if ap := sc.AdditionalProperties; ap != nil {
+			switch {
+			case ap.Schema != nil:
+				v.validate(ap.Schema, val, child, depth+1)
+			case !ap.Allowed:
+				v.fail(child, "is not allowed")
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) str(sc *Schema, s, path string) {
+	n := utf8.RuneCountInString(s)
+	if sc.MinLength != nil && n < *sc.MinLength {
+		v.fail(path, "must be at least %d characters", *sc.MinLength)
+	}
+	if sc.MaxLength != nil && n > *sc.MaxLength {
+		v.fail(path, "must be at most %d characters", *sc.MaxLength)
+	}
+	if sc.Pattern != "" {
+		if re, err := compilePattern(sc.Pattern); err == nil && !re.MatchString(s) {
+			v.fail(path, "must match %s", sc.Pattern)
+		}
+	}
+	if sc.Format != "" && !validFormat(sc.Format, s) {
+		v.fail(path, "must be a valid %s", sc.Format)
+	}
+}
+
+func joinJSONPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(e, value) || fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// validFormat checks the common string formats. Unknown formats pass.
+func validFormat(format, s string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "email":
+		a, err := mail.ParseAddress(s)
+		return err == nil && a.Address == s
+	case "uuid":
+		return uuidPattern.MatchString(s)
+	case "ipv4":
+		a, err := netip.ParseAddr(s)
+		return err == nil && a.Is4()
+	case "ipv6":
+		a, err := netip.ParseAddr(s)
+		return err == nil && a.Is6()
+	}
+	return true
+}
+
+// patterns caches compiled schema patterns across requests.
+var patterns sync.Map // string -> *regexp.Regexp
+
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(p); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(p, re)
+	return re, nil
+}
+
+// coerceParam turns raw parameter strings into the JSON value the schema
+// expects, so they can be validated like a body. Values that don't convert
+// are left as strings and fail the type check.
+func (s *OpenAPISpec) coerceParam(sc *Schema, raw []string) interface{} {
+	sc = s.schema(sc)
+	if sc == nil || len(raw) == 0 {
+		return nil
+	}
+	if sc.Type == "array" {
+		// form style: ?id=1&id=2, or ?id=1,2
+		if len(raw) == 1 && strings.Contains(raw[0], ",") {
+			raw = strings.Split(raw[0], ",")
+		}
+		items := make([]interface{}, len(raw))
+		for i, r := range raw {
+			items[i] = s.coerceParam(sc.Items, []string{r})
+			if sc.Items == nil {
+				items[i] = r
+			}
+		}
+		return items
+	}
+
+	v := raw[0]
+	switch sc.Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return json.Number(v)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return v
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAnomalyScoring(t *testing.T) {
+	path := writeRuleFile(t, "scoring.yaml", `
+rules:
+  - id: "1"
+    targets: [query]
+    operator: contains
+    value: "foo"
+    severity: warning
+  - id: "2"
+    targets: [query]
+    operator: contains
+    value: "bar"
+    severity: warning
+  - id: "3"
+    targets: [query]
+    operator: contains
+    value: "baz"
+    severity: critical
+    paranoia: 2
+`)
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		paranoia int
+		query    string
+		want     int
+	}{
+		{"single warning stays below threshold", 1, "?q=foo", http.StatusOK},
+		{"two warnings cross threshold", 1, "?q=foo+bar", http.StatusForbidden},
+		{"paranoia 2 rule ignored at level 1", 1, "?q=baz", http.StatusOK},
+		{"paranoia 2 rule active at level 2", 2, "?q=baz", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			si := NewSecurityInspector(InspectorOptions{Rules: rules, AnomalyThreshold: 5, ParanoiaLevel: tt.paranoia})
+			handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+tt.query, nil))
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
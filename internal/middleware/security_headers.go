@@ -2,22 +2,48 @@ package middleware
 
 import "net/http"
 
-// SecurityHeaders adds common security headers to all outgoing responses.
-func SecurityHeaders(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Prevent browsers from MIME-sniffing the response
-		w.Header().Set("X-Content-Type-Options", "nosniff")
+// defaultSecurityHeaders are added to all outgoing responses.
+var defaultSecurityHeaders = []struct{ Name, Value string }{
+	// Prevent browsers from MIME-sniffing the response
+	{"X-Content-Type-Options", "nosniff"},
+
+	// Prevent Clickjacking attacks
+	{"X-Frame-Options", "DENY"},
+
+	// Enable XSS filtering in browsers
+	{"X-XSS-Protection", "1; mode=block"},
 
-		// Prevent Clickjacking attacks
-		w.Header().Set("X-Frame-Options", "DENY")
+	// Content Security Policy (Basic)
+	{"Content-Security-Policy", "default-src 'self'"},
+}
+
+// SecurityHeaders adds common security headers to all outgoing responses.
+var SecurityHeaders = NewSecurityHeaders(nil)
 
-		// Enable XSS filtering in browsers
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
+// NewSecurityHeaders returns a SecurityHeaders middleware with per-route overrides.
+// An override replaces (or adds) a header; an empty value removes a default header.
+func NewSecurityHeaders(overrides map[string]string) Middleware {
+	headers := make(map[string]string)
+	for _, h := range defaultSecurityHeaders {
+		headers[http.CanonicalHeaderKey(h.Name)] = h.Value
+	}
+	for name, value := range overrides {
+		name = http.CanonicalHeaderKey(name)
+		if value == "" {
+			delete(headers, name)
+			continue
+		}
+		headers[name] = value
+	}
 
-		// Content Security Policy (Basic)
-		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				w.Header().Set(name, value)
+			}
 
-		// Pass to the next handler
-		next.ServeHTTP(w, r)
-	})
+			// Pass to the next handler
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,431 @@
+package middleware
+
+import (
+	"strings"
+)
+
+// SQL injection detection by lexical fingerprinting, in the style of libinjection.
+//
+// Instead of regexes over raw text, the input is split into SQL tokens and each
+// token is reduced to a one-character type. The first few types form a
+// "fingerprint" such as "s&1o1" (string, logic operator, number, operator,
+// number: the shape of `' OR 1=1`). Injections have a small set of shapes that
+// normal text almost never produces, so "C# developer" ("nc") and "O'Reilly"
+// are fine while `admin' OR 1=1 --` is not.
+//
+// Because we don't know where the input lands in the backend's query, it is
+// fingerprinted three times: as-is (numeric context), and as if it were
+// appended after a single or a double quote (string contexts).
+
+// SQL token types.
+const (
+	sqlString   = 's'
+	sqlNumber   = '1'
+	sqlVariable = 'v'
+	sqlBareword = 'n'
+	sqlKeyword  = 'k'
+	sqlGroupBy  = 'B' // ORDER BY / GROUP BY
+	sqlSelect   = 'E'
+	sqlModify   = 'X' // INSERT, UPDATE, DELETE, DROP, ...
+	sqlExec     = 'x' // EXEC, SHUTDOWN, DECLARE, WAITFOR
+	sqlUnion    = 'U'
+	sqlFunction = 'f'
+	sqlOperator = 'o'
+	sqlLogic    = '&'
+	sqlComment  = 'c'
+	sqlLParen   = '('
+	sqlRParen   = ')'
+	sqlComma    = ','
+	sqlSemi     = ';'
+)
+
+// fingerprintLen is how many tokens make up a fingerprint. Fragments are
+// searched for in a longer window so a payload can't hide behind filler words.
+const (
+	fingerprintLen = 6
+	fragmentLen    = 32
+)
+
+var sqlWords = map[string]byte{
+	"and": sqlLogic, "or": sqlLogic, "xor": sqlLogic,
+
+	"like": sqlOperator, "rlike": sqlOperator, "regexp": sqlOperator, "is": sqlOperator,
+	"not": sqlOperator, "in": sqlOperator, "div": sqlOperator, "mod": sqlOperator,
+	"sounds": sqlOperator, "collate": sqlOperator,
+
+	"null": sqlNumber,
+
+	"union": sqlUnion, "intersect": sqlUnion, "except": sqlUnion,
+
+	"select": sqlSelect,
+
+	"insert": sqlModify, "update": sqlModify, "delete": sqlModify, "drop": sqlModify,
+	"create": sqlModify, "alter": sqlModify, "truncate": sqlModify, "rename": sqlModify,
+	"grant": sqlModify, "revoke": sqlModify,
+
+	"exec": sqlExec, "execute": sqlExec, "shutdown": sqlExec, "declare": sqlExec,
+	"waitfor": sqlExec,
+
+	"from": sqlKeyword, "where": sqlKeyword, "table": sqlKeyword, "into": sqlKeyword,
+	"values": sqlKeyword, "set": sqlKeyword, "database": sqlKeyword, "having": sqlKeyword,
+	"limit": sqlKeyword, "offset": sqlKeyword, "top": sqlKeyword, "distinct": sqlKeyword,
+	"case": sqlKeyword, "when": sqlKeyword, "then": sqlKeyword, "procedure": sqlKeyword,
+	"delay": sqlKeyword, "outfile": sqlKeyword, "dumpfile": sqlKeyword, "join": sqlKeyword,
+	"order": sqlKeyword, "group": sqlKeyword, "by": sqlKeyword, "all": sqlKeyword,
+}
+
+// sqliFingerprints are injection shapes. A fingerprint is malicious if it starts
+// with one of these; a trailing "$" means the whole fingerprint must match.
+var sqliFingerprints = []string{
+	// Breaking out of a string: ' OR 1=1, ' OR 'a'='a, ' AND sleep(5)
+	"s&1", "s&s", "s&f", "s&(", "s&v", "s&no", "s&nc",
+	"so1", "sos", "sof", "so(", "sov",
+	"s)&", "s)U", "s);", "s)c", "s)o",
+	"sU", "s;E", "s;X", "s;x", "s;k", "s;c", "s;1", "sc", "sB", "sE", "sXk", "sx", "sk1", "skk", "sks",
+
+	// Numeric context: 1 OR 1=1, 1) OR (1=1, 1 AND sleep(5)
+	"1&1o", "1&1c", "1&1$", "1&so", "1&f(", "1&(", "1&v", "1&no",
+	"1)&", "1)U", "1);", "1)c",
+	"1U", "1;X", "1;x", "1;E", "1;k", "1B1",
+
+	// Bare statements: SELECT * FROM, SELECT sleep(5), (SELECT 1)
+	"Eok", "Ef(", "E1,", "E1$", "Ev", "(Eo", "(E1", "(Ef", "(Ev",
+}
+
+// sqliFragments are malicious wherever they appear in a fingerprint.
+var sqliFragments = []string{
+	"UE",               // UNION SELECT
+	";Xk", ";Xn", ";x", // Stacked queries: ; DROP TABLE, ; UPDATE t, ; EXEC
+	";E1", ";Ef", ";Eo", ";Ev", // ; SELECT 1, ; SELECT sleep(5), ; SELECT *
+	"o(E", "&(E", "((E", // Sub-selects: + (SELECT, OR (SELECT
+}
+
+// sqliStatements are keyword pairs that only make sense as a SQL statement.
+var sqliStatements = [][2]string{
+	{"drop", "table"}, {"drop", "database"}, {"truncate", "table"},
+	{"alter", "table"}, {"create", "table"}, {"delete", "from"}, {"insert", "into"},
+}
+
+type sqlToken struct {
+	kind byte
+	text string // Lower-cased for words, raw otherwise
+}
+
+// DetectSQLi reports whether input looks like SQL injection, and the fingerprint
+// that matched.
+func DetectSQLi(input string) (bool, string) {
+	if input == "" {
+		return false, ""
+	}
+
+	for _, quote := range []byte{0, '\'', '"'} {
+		if quote != 0 && strings.IndexByte(input, quote) < 0 {
+			continue // Can't break out of a string without the quote
+		}
+		tokens := foldSQLTokens(tokenizeSQL(input, quote))
+		if fp := sqlFingerprint(tokens, fingerprintLen); isSQLiFingerprint(fp) {
+			return true, fp
+		}
+		if fp := sqlFingerprint(tokens, fragmentLen); hasSQLiFragment(fp) || hasSQLStatement(tokens) {
+			return true, fp
+		}
+	}
+	return false, ""
+}
+
+func isSQLiFingerprint(fp string) bool {
+	for _, p := range sqliFingerprints {
+		if strings.HasSuffix(p, "$") {
+			if fp == p[:len(p)-1] {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(fp, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSQLiFragment(fp string) bool {
+	for _, f := range sqliFragments {
+		if strings.Contains(fp, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSQLStatement(tokens []sqlToken) bool {
+	for i := 0; i+1 < len(tokens); i++ {
+		for _, st := range sqliStatements {
+			if tokens[i].text == st[0] && tokens[i+1].text == st[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sqlFingerprint(tokens []sqlToken, n int) string {
+	if len(tokens) > n {
+		tokens = tokens[:n]
+	}
+	b := make([]byte, len(tokens))
+	for i, t := range tokens {
+		b[i] = t.kind
+	}
+	return string(b)
+}
+
+// tokenizeSQL splits input into SQL tokens. If quote is set, the input is
+// treated as if it started inside a string delimited by that quote.
+func tokenizeSQL(input string, quote byte) []sqlToken {
+	var tokens []sqlToken
+	i := 0
+
+	if quote != 0 {
+		end, _ := scanSQLString(input, 0, quote)
+		tokens = append(tokens, sqlToken{kind: sqlString, text: input[:end]})
+		i = end + 1
+	}
+
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case isSQLSpace(c):
+			i++
+
+		case c == '\'' || c == '"':
+			end, _ := scanSQLString(input, i+1, c)
+			tokens = append(tokens, sqlToken{kind: sqlString, text: input[i+1 : min(end, len(input))]})
+			i = end + 1
+
+		case c == '`':
+			end := strings.IndexByte(input[i+1:], '`')
+			if end < 0 {
+				end = len(input) - i - 1
+			}
+			tokens = append(tokens, sqlToken{kind: sqlBareword, text: input[i+1 : i+1+end]})
+			i += end + 2
+
+		case c == '#':
+			i = appendSQLComment(&tokens, input, i, lineEnd(input, i))
+
+		case c == '-' && i+1 < len(input) && input[i+1] == '-':
+			i = appendSQLComment(&tokens, input, i, lineEnd(input, i))
+
+		case c == '/' && i+1 < len(input) && input[i+1] == '*':
+			if i+2 < len(input) && input[i+2] == '!' {
+				// MySQL executable comment: /*!50000 UNION */ runs its content.
+				i += 3
+				for i < len(input) && isDigit(input[i]) {
+					i++
+				}
+				continue
+			}
+			end := strings.Index(input[i+2:], "*/")
+			if end < 0 {
+				i = appendSQLComment(&tokens, input, i, len(input))
+				continue
+			}
+			i = appendSQLComment(&tokens, input, i, i+2+end+2)
+
+		case c == '*' && i+1 < len(input) && input[i+1] == '/':
+			i += 2 // End of an executable comment
+
+		case c == '@':
+			j := i + 1
+			for j < len(input) && input[j] == '@' {
+				j++
+			}
+			k := scanWord(input, j)
+			tokens = append(tokens, sqlToken{kind: sqlVariable, text: input[i:k]})
+			i = max(k, i+1)
+
+		case c == '(' || c == ')' || c == ',' || c == ';':
+			tokens = append(tokens, sqlToken{kind: c, text: string(c)})
+			i++
+
+		case isDigit(c) || (c == '.' && i+1 < len(input) && isDigit(input[i+1])):
+			j := scanWord(input, i)
+			text := input[i:j]
+			kind := byte(sqlBareword)
+			if isSQLNumber(text) {
+				kind = sqlNumber
+			}
+			tokens = append(tokens, sqlToken{kind: kind, text: text})
+			i = j
+
+		case isWordStart(c):
+			j := scanWord(input, i)
+			word := strings.ToLower(input[i:j])
+			tokens = append(tokens, sqlToken{kind: classifySQLWord(word, input, j), text: word})
+			i = j
+
+		case strings.IndexByte("=<>!+-*/%|&^~:", c) >= 0:
+			j := i + 1
+			for j < len(input) && j-i < 3 && strings.IndexByte("=<>!|&:", input[j]) >= 0 {
+				j++
+			}
+			op := input[i:j]
+			kind := byte(sqlOperator)
+			if op == "&&" || op == "||" {
+				kind = sqlLogic
+			}
+			tokens = append(tokens, sqlToken{kind: kind, text: op})
+			i = j
+
+		default:
+			i++ // Punctuation with no meaning in SQL
+		}
+	}
+
+	return tokens
+}
+
+// scanSQLString returns the index of the closing quote (or len(input)) for a
+// string whose content starts at i. Doubled quotes and backslashes escape.
+func scanSQLString(input string, i int, quote byte) (int, bool) {
+	for i < len(input) {
+		switch input[i] {
+		case '\\':
+			i += 2
+			continue
+		case quote:
+			if i+1 < len(input) && input[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i, true
+		}
+		i++
+	}
+	return len(input), false
+}
+
+func appendSQLComment(tokens *[]sqlToken, input string, start, end int) int {
+	*tokens = append(*tokens, sqlToken{kind: sqlComment, text: input[start:end]})
+	return end
+}
+
+func lineEnd(input string, i int) int {
+	if nl := strings.IndexByte(input[i:], '\n'); nl >= 0 {
+		return i + nl
+	}
+	return len(input)
+}
+
+// classifySQLWord decides the type of a word. Unknown words followed by
+// "(" are function calls, anything else is a bareword (column, table, text).
+func classifySQLWord(word, input string, next int) byte {
+	if kind, ok := sqlWords[word]; ok {
+		return kind
+	}
+	for next < len(input) && isSQLSpace(input[next]) {
+		next++
+	}
+	if next < len(input) && input[next] == '(' {
+		return sqlFunction
+	}
+	return sqlBareword
+}
+
+// foldSQLTokens simplifies the token stream so equivalent injections share a
+// fingerprint.
+func foldSQLTokens(tokens []sqlToken) []sqlToken {
+	out := make([]sqlToken, 0, len(tokens))
+	for i, t := range tokens {
+		// Inline comments (UNION/**/SELECT) are just whitespace; only a
+		// trailing comment is meaningful (it cuts off the rest of the query).
+		if t.kind == sqlComment && i < len(tokens)-1 {
+			continue
+		}
+
+		// A function name is also a keyword in "EXISTS(" or "IF(", but
+		// otherwise keywords keep their own type.
+		if t.kind == sqlFunction {
+			out = append(out, t)
+			continue
+		}
+
+		var prev *sqlToken
+		if len(out) > 0 {
+			prev = &out[len(out)-1]
+		}
+
+		switch {
+		// ORDER BY / GROUP BY
+		case prev != nil && t.text == "by" && (prev.text == "order" || prev.text == "group"):
+			prev.kind = sqlGroupBy
+			continue
+
+		// UNION ALL / UNION DISTINCT
+		case prev != nil && prev.kind == sqlUnion && (t.text == "all" || t.text == "distinct"):
+			continue
+
+		// Adjacent strings are concatenated: 'a' 'b'
+		case prev != nil && prev.kind == sqlString && t.kind == sqlString:
+			continue
+
+		// Unary operators: -1, +1, !1, ~1
+		case t.kind == sqlNumber && prev != nil && prev.kind == sqlOperator &&
+			(prev.text == "-" || prev.text == "+" || prev.text == "!" || prev.text == "~") &&
+			(len(out) == 1 || strings.IndexByte("o&(,", out[len(out)-2].kind) >= 0):
+			*prev = t
+			continue
+		}
+
+		out = append(out, t)
+	}
+	return out
+}
+
+func isSQLNumber(s string) bool {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X' || s[1] == 'b' || s[1] == 'B') {
+		for _, c := range s[2:] {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+		return true
+	}
+
+	seenDot, seenExp := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case isDigit(c):
+		case c == '.' && !seenDot && !seenExp:
+			seenDot = true
+		case (c == 'e' || c == 'E') && !seenExp && i > 0 && i+1 < len(s):
+			seenExp = true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isSQLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f' || c == 0xa0
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isWordStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func scanWord(input string, i int) int {
+	for i < len(input) {
+		c := input[i]
+		if isWordStart(c) || isDigit(c) || c == '.' {
+			i++
+			continue
+		}
+		break
+	}
+	return i
+}
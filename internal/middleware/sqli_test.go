@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readCorpus returns the lines of a testdata corpus. The first line is a
+// description and is skipped; every other non-empty line is a sample (so
+// samples may themselves start with "#").
+func readCorpus(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Corpus-driven quality gates. Tighten these as the detector improves;
+// never loosen them to make a change pass.
+const (
+	maxSQLiFalseNegativeRate = 0.02
+	maxSQLiFalsePositiveRate = 0.0
+)
+
+func TestDetectSQLiCorpus(t *testing.T) {
+	payloads := readCorpus(t, "testdata/sqli/payloads.txt")
+	benign := readCorpus(t, "testdata/sqli/benign.txt")
+
+	missed := 0
+	for _, p := range payloads {
+		if ok, _ := DetectSQLi(p); !ok {
+			missed++
+			t.Logf("false negative: %q (fingerprints: %s)", p, debugFingerprints(p))
+		}
+	}
+
+	flagged := 0
+	for _, b := range benign {
+		if ok, fp := DetectSQLi(b); ok {
+			flagged++
+			t.Logf("false positive: %q (fingerprint %s)", b, fp)
+		}
+	}
+
+	fnRate := float64(missed) / float64(len(payloads))
+	fpRate := float64(flagged) / float64(len(benign))
+	t.Logf("SQLi corpus: %d payloads, %d benign, FN rate %.1f%%, FP rate %.1f%%",
+		len(payloads), len(benign), fnRate*100, fpRate*100)
+
+	if fnRate > maxSQLiFalseNegativeRate {
+		t.Errorf("false negative rate %.1f%% exceeds %.1f%%", fnRate*100, maxSQLiFalseNegativeRate*100)
+	}
+	if fpRate > maxSQLiFalsePositiveRate {
+		t.Errorf("false positive rate %.1f%% exceeds %.1f%%", fpRate*100, maxSQLiFalsePositiveRate*100)
+	}
+}
+
+func debugFingerprints(input string) string {
+	var fps []string
+	for _, q := range []byte{0, '\'', '"'} {
+		fps = append(fps, sqlFingerprint(foldSQLTokens(tokenizeSQL(input, q)), fragmentLen))
+	}
+	return strings.Join(fps, " | ")
+}
@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Server-side request forgery.
+//
+// Every URL in the input is checked for where it points. Schemes that only
+// make sense against internal services (gopher://, dict://, file://...) are
+// flagged outright; for the rest, the host must not be loopback, private,
+// link-local (which includes the 169.254.169.254 cloud metadata service) or
+// a known metadata or DNS-rebinding name.
+//
+// Hosts are parsed the way inet_aton does, since that is what the backend's
+// HTTP client will do: 2130706433, 0x7f000001, 0177.0.0.1 and 127.1 are all
+// 127.0.0.1.
+//
+// The name is not resolved: the WAF must not make DNS requests on behalf of
+// clients, and an attacker controlling DNS can rebind after our check anyway.
+
+// urlPattern finds URLs, including scheme-relative ones ("//10.0.0.1/").
+var urlPattern = regexp.MustCompile(`(?i)(?:\b([a-z][a-z0-9+.-]*):)?//([^\s/?#"'<>\\]*)`)
+
+// ssrfSchemes talk to internal services and are never a legitimate link.
+var ssrfSchemes = map[string]bool{
+	"gopher": true, "dict": true, "file": true, "ldap": true, "ldaps": true,
+	"tftp": true, "jar": true, "netdoc": true, "sftp": true,
+}
+
+// ssrfHosts are internal names; suffix matches apply to the ones starting
+// with a dot.
+var ssrfHosts = []string{
+	"localhost", ".localhost", "metadata", "metadata.google.internal",
+	"instance-data", ".internal", "kubernetes.default", ".svc",
+	".cluster.local", "localtest.me", ".localtest.me", "lvh.me", ".lvh.me",
+	".nip.io", ".sslip.io", ".xip.io",
+}
+
+// internalPrefixes are IPv4 ranges with no place in a user-supplied URL,
+// on top of what netip already classifies.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "This" network
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT, Alibaba metadata
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments, Oracle metadata
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+}
+
+// DetectSSRF reports whether the input holds a URL pointing at an internal
+// address, and why.
+func DetectSSRF(input string) (bool, string) {
+	if !strings.Contains(input, "//") {
+		return false, ""
+	}
+	for _, m := range urlPattern.FindAllStringSubmatch(input, -1) {
+		scheme := strings.ToLower(m[1])
+		if ssrfSchemes[scheme] {
+			return true, scheme + ":// URL"
+		}
+		if m[1] == "" && !strings.HasPrefix(strings.TrimSpace(input), "//") {
+			continue // A comment or a path, not a scheme-relative URL
+		}
+		if reason := internalHost(m[2]); reason != "" {
+			return true, reason
+		}
+	}
+	return false, ""
+}
+
+// internalHost checks the authority of a URL and describes what it points at.
+func internalHost(authority string) string {
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		authority = authority[i+1:] // Userinfo: http://trusted.example@10.0.0.1/
+	}
+	host := authority
+	if strings.HasPrefix(host, "[") {
+		if i := strings.IndexByte(host, ']'); i > 0 {
+			host = host[1:i]
+		}
+	} else if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if ip, ok := parseHostIP(host); ok {
+		ip = ip.Unmap()
+		switch {
+		case ip.IsLoopback():
+			return "loopback address " + ip.String()
+		case ip.IsLinkLocalUnicast():
+			return "link-local address " + ip.String()
+		case ip.IsPrivate():
+			return "private address " + ip.String()
+		case ip.IsUnspecified():
+			return "unspecified address " + ip.String()
+		}
+		for _, p := range internalPrefixes {
+			if p.Contains(ip) {
+				return "internal address " + ip.String()
+			}
+		}
+		return ""
+	}
+
+	for _, h := range ssrfHosts {
+		if host == h || strings.HasPrefix(h, ".") && strings.HasSuffix(host, h) {
+			return "internal host " + host
+		}
+	}
+	return ""
+}
+
+// parseHostIP parses IPv6 literals and IPv4 in any form inet_aton accepts:
+// one to four parts, each decimal, octal (leading 0) or hex (0x).
+func parseHostIP(host string) (netip.Addr, bool) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip, true
+	}
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return netip.Addr{}, false
+	}
+	nums := make([]uint64, len(parts))
+	for i, p := range parts {
+		if p == "" || strings.Contains(p, "_") || len(p) > 1 && p[0] == '0' && strings.ContainsRune("oObB", rune(p[1])) {
+			return netip.Addr{}, false // Go literal syntax, not inet_aton's
+		}
+		n, err := strconv.ParseUint(p, 0, 32)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		nums[i] = n
+	}
+
+	// The last part fills all the remaining bytes: 127.1 is 127.0.0.1.
+	var v uint64
+	for i, n := range nums[:len(nums)-1] {
+		if n > 0xff {
+			return netip.Addr{}, false
+		}
+		v |= n << (24 - 8*uint(i))
+	}
+	last := nums[len(nums)-1]
+	if last >= 1<<(32-8*uint(len(nums)-1)) {
+		return netip.Addr{}, false
+	}
+	v |= last
+	return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}), true
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import "testing"
+
+func TestDetectSSRF(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"public URL", "https://example.com/hook", false},
+		{"public IP", "http://93.184.216.34/", false},
+		{"no URL", "10.0.0.1", false},
+		{"comment", "a // note about 127.0.0.1", false},
+		{"host with digits", "https://web1.example.com:8443/", false},
+		{"public IPv6", "http://[2606:4700::1111]/", false},
+
+		{"loopback", "http://127.0.0.1/admin", true},
+		{"localhost", "http://localhost:8080/", true},
+		{"metadata", "http://169.254.169.254/latest/meta-data/", true},
+		{"gcp metadata", "http://metadata.google.internal/computeMetadata/v1/", true},
+		{"private", "https://10.1.2.3/", true},
+		{"private 172", "http://172.16.0.5:9200/_cat", true},
+		{"private 192", "http://192.168.1.1/", true},
+		{"alibaba metadata", "http://100.100.100.200/latest/meta-data/", true},
+		{"unspecified", "http://0.0.0.0:6379/", true},
+		{"decimal", "http://2130706433/", true},
+		{"hex", "http://0x7f000001/", true},
+		{"octal", "http://0177.0.0.1/", true},
+		{"short form", "http://127.1/", true},
+		{"IPv6 loopback", "http://[::1]/", true},
+		{"IPv4-mapped", "http://[::ffff:169.254.169.254]/", true},
+		{"userinfo", "http://trusted.example.com@10.0.0.1/", true},
+		{"trailing dot", "http://localhost./", true},
+		{"rebinding", "http://10.0.0.1.nip.io/", true},
+		{"scheme-relative", "//192.168.0.1/x", true},
+		{"embedded in text", "fetch this: http://127.0.0.1:2375/containers/json please", true},
+		{"gopher", "gopher://example.com:6379/_FLUSHALL", true},
+		{"file", "file:///etc/passwd", true},
+		{"dict", "dict://example.com:11211/stats", true},
+	}
+	for _, tt := range tests {
+		if got, reason := DetectSSRF(tt.input); got != tt.want {
+			t.Errorf("%s: expected %v, got %v (%s)", tt.name, tt.want, got, reason)
+		}
+	}
+}
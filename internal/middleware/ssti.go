@@ -0,0 +1,38 @@
+package middleware
+
+import "regexp"
+
+// Server-side template injection.
+//
+// Template delimiters alone are everywhere ("{{ name }}" in a help text,
+// "${price}" in a config snippet), so an expression only counts when it
+// does something a legitimate value never does: arithmetic probes like
+// {{7*7}}, which is how every SSTI scan starts, or reaching for the
+// language runtime (__class__, T(java.lang.Runtime), system()).
+
+// sstiPatterns cover the common engines, one per delimiter style.
+var sstiPatterns = []struct {
+	engine string
+	re     *regexp.Regexp
+}{
+	// Jinja2, Twig, Nunjucks, Handlebars, Go templates
+	{"{{ }}", regexp.MustCompile(`\{\{[^}]*?(?:\d+\s*[*+/-]\s*\d+|__\w+__|\bconfig\b|\bself\b|\brequest\b|\blipsum\b|\bcycler\b|\bjoiner\b|\bnamespace\b|\b_self\b|\bconstructor\b|\bprocess\b|\bcall\b)[^}]*\}\}`)},
+	// Freemarker, Velocity, Spring EL, JSP EL, Thymeleaf
+	{"${ }", regexp.MustCompile(`[$*#]\{[^}]*?(?:\d+\s*[*+/-]\s*\d+|\bT\s*\(|\bnew\s+java\.|getClass\b|\bRuntime\b|ProcessBuilder|\bexec\s*\(|freemarker\.)[^}]*\}`)},
+	// ERB, JSP scriptlets, Mako
+	{"<% %>", regexp.MustCompile(`<%=?[^%]*?(?:\d+\s*[*+/-]\s*\d+|\bsystem\b|` + "`" + `|\bexec\b|\beval\b|\bFile\.|\bIO\.|Runtime)[^%]*%>`)},
+	// Freemarker directives and Velocity statements. Directive and class
+	// names are case-sensitive in both engines.
+	{"directive", regexp.MustCompile(`<#assign\b|freemarker\.template\.utility\.Execute|#set\s*\(\s*\$\w+\s*=|\$class\.inspect|#evaluate\s*\(`)},
+}
+
+// DetectSSTI reports whether the input is a template expression probing or
+// escaping the engine, and for which syntax.
+func DetectSSTI(input string) (bool, string) {
+	for _, p := range sstiPatterns {
+		if m := p.re.FindString(input); m != "" {
+			return true, p.engine + " expression: " + truncate(m, 64)
+		}
+	}
+	return false, ""
+}
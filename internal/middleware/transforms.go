@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Transform normalizes an input before a rule matches against it.
+type Transform func(string) string
+
+// transforms is the registry of transforms rules can reference by name.
+// A rule applies them in the order listed, e.g.
+//
+//	transforms: [url_decode_uni, html_entity_decode, normalize_nfkc, remove_nulls, lowercase]
+var transforms = map[string]Transform{
+	"none":                func(s string) string { return s },
+	"url_decode":          urlDecode,
+	"url_decode_uni":      urlDecodeUni,
+	"html_entity_decode":  html.UnescapeString,
+	"normalize_nfkc":      norm.NFKC.String,
+	"remove_nulls":        removeNulls,
+	"compress_whitespace": compressWhitespace,
+	"remove_comments":     removeComments,
+	"base64_decode":       base64DecodeExt,
+	"lowercase":           strings.ToLower,
+	"trim":                strings.TrimSpace,
+}
+
+func urlDecode(s string) string {
+	decoded, err := url.QueryUnescape(s)
+	if err != nil {
+		return s // Fallback to original
+	}
+	return decoded
+}
+
+// maxDecodePasses bounds url_decode_uni so "%2525...25" can't loop forever.
+const maxDecodePasses = 4
+
+// urlDecodeUni decodes %XX and IIS-style %uXXXX escapes and "+", repeating
+// until the value stops changing so double-encoding (%253C) can't hide a
+// payload. Invalid escapes are left as they are instead of failing the whole value.
+func urlDecodeUni(s string) string {
+	for i := 0; i < maxDecodePasses && strings.ContainsAny(s, "%+"); i++ {
+		decoded := decodePercent(s)
+		if decoded == s {
+			break
+		}
+		s = decoded
+	}
+	return s
+}
+
+func decodePercent(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && i+5 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U') && isHex(s[i+2:i+6]):
+			r, _ := strconv.ParseUint(s[i+2:i+6], 16, 32)
+			b.WriteRune(rune(r))
+			i += 5
+		case c == '%' && i+2 < len(s) && isHex(s[i+1:i+3]):
+			v, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(v))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isDigit(c) && (c < 'a' || c > 'f') && (c < 'A' || c > 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func removeNulls(s string) string {
+	return strings.ReplaceAll(s, "\x00", "")
+}
+
+// compressWhitespace turns every run of whitespace (tabs, newlines, NBSP...)
+// into a single space.
+func compressWhitespace(s string) string {
+	return strings.Join(strings.FieldsFunc(s, unicode.IsSpace), " ")
+}
+
+// removeComments strips SQL/C and HTML comments, so keywords split with a
+// comment (UN/**/ION) are joined back together. An unterminated comment is
+// removed up to the end of the input.
+func removeComments(s string) string {
+	for _, c := range [][2]string{{"/*", "*/"}, {"<!--", "-->"}} {
+		for {
+			start := strings.Index(s, c[0])
+			if start < 0 {
+				break
+			}
+			end := strings.Index(s[start+len(c[0]):], c[1])
+			if end < 0 {
+				s = s[:start]
+				break
+			}
+			s = s[:start] + s[start+len(c[0])+end+len(c[1]):]
+		}
+	}
+	return s
+}
+
+// minBase64Len keeps short words that happen to be valid base64 ("admin") as text.
+const minBase64Len = 8
+
+// base64DecodeExt decodes the value if it looks like base64 and decodes to
+// text; anything else is returned unchanged.
+func base64DecodeExt(s string) string {
+	trimmed := strings.TrimSpace(s)
+	if len(trimmed) < minBase64Len {
+		return s
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		decoded, err := enc.DecodeString(trimmed)
+		if err == nil && isText(decoded) {
+			return string(decoded)
+		}
+	}
+	return s
+}
+
+// isText reports whether b is valid UTF-8 without control characters
+// other than whitespace, i.e. not binary data that just happened to decode.
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// compileTransforms resolves transform names into a single pipeline.
+func compileTransforms(names []string) (Transform, error) {
+	var chain []Transform
+	for _, name := range names {
+		t, ok := transforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		chain = append(chain, t)
+	}
+
+	return func(s string) string {
+		for _, t := range chain {
+			s = t(s)
+		}
+		return s
+	}, nil
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		transform string
+		in, want  string
+	}{
+		{"url_decode_uni", "%253Cscript%253E", "<script>"},
+		{"url_decode_uni", "%u003Cscript%u003E", "<script>"},
+		{"url_decode_uni", "100% sure+%zz", "100% sure %zz"},
+		{"html_entity_decode", "&lt;img&#x20;src&#61;x&gt;", "<img src=x>"},
+		{"normalize_nfkc", "＜script＞", "<script>"},
+		{"remove_nulls", "<scr\x00ipt>", "<script>"},
+		{"compress_whitespace", "union \t\n  select", "union select"},
+		{"remove_comments", "UN/**/ION SEL/*x*/ECT", "UNION SELECT"},
+		{"remove_comments", "a<!-- b -->c/* unterminated", "ac"},
+		{"base64_decode", "PHNjcmlwdD4=", "<script>"},
+		{"base64_decode", "admin", "admin"},
+		{"base64_decode", "not base64!", "not base64!"},
+	}
+
+	for _, tt := range tests {
+		if got := transforms[tt.transform](tt.in); got != tt.want {
+			t.Errorf("%s(%q) = %q, want %q", tt.transform, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestInspectorNormalizesEvasions(t *testing.T) {
+	evasions := []struct {
+		name     string
+		paranoia int
+		query    string
+	}{
+		{"double URL encoding", 1, "q=%25253Cscript%25253Ealert(1)"},
+		{"IIS %u encoding", 1, "q=%25u003Cscript%25u003Ealert(1)"},
+		{"full-width characters", 1, "q=" + "%EF%BC%9Cscript%EF%BC%9Ealert(1)"},
+		{"null byte in tag", 1, "q=%3Cscr%00ipt%3Ealert(1)"},
+		{"comment inside keywords", 2, "id=1+UN/**/ION+SEL/**/ECT+password+FROM+users"},
+		{"base64 payload", 2, "token=JyBPUiAxPTEgLS0="}, // ' OR 1=1 --
+	}
+
+	for _, tt := range evasions {
+		t.Run(tt.name, func(t *testing.T) {
+			si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules(), ParanoiaLevel: tt.paranoia})
+			handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil))
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("expected 403, got %d", rr.Code)
+			}
+		})
+	}
+}
+
+func TestTargetTransforms(t *testing.T) {
+	path := writeRuleFile(t, "target.yaml", `
+rules:
+  - id: "1"
+    targets: [query, header]
+    operator: contains
+    value: "evil"
+    transforms: [base64_decode]
+    target_transforms:
+      header: [lowercase]
+`)
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := NewSecurityInspector(InspectorOptions{Rules: rules})
+	handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(query, header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		if header != "" {
+			req.Header.Set("X-Test", header)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := send("q=ZXZpbCB0aGluZ3M=", ""); code != http.StatusForbidden { // "evil things"
+		t.Errorf("query should be base64-decoded, got %d", code)
+	}
+	if code := send("", "EVIL"); code != http.StatusForbidden {
+		t.Errorf("header should be lowercased, got %d", code)
+	}
+	if code := send("", "ZXZpbCB0aGluZ3M="); code != http.StatusOK {
+		t.Errorf("header should not be base64-decoded, got %d", code)
+	}
+
+	bad := writeRuleFile(t, "bad.yaml", `
+rules:
+  - id: "2"
+    targets: [query]
+    operator: contains
+    value: "x"
+    target_transforms:
+      body: [lowercase]
+`)
+	if _, err := LoadRules(bad); err == nil || !strings.Contains(err.Error(), "not one of its targets") {
+		t.Errorf("expected target_transforms error, got %v", err)
+	}
+}
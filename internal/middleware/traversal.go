@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Path traversal and local file inclusion.
+//
+// Inputs arrive URL-decoded by the rule's transforms, so %2e%2e%2f and
+// ..%255c are already "../" and "..\" here. What is left are the overlong
+// UTF-8 forms (%c0%ae, %c0%af) some Java and IIS stacks still accept; they
+// are folded back to "." and "/" first.
+//
+// A single "../" is common in relative links and is left to paranoia level
+// 2. Two steps up, or any step up toward a well-known file, is an attack.
+
+// overlongUTF8 maps overlong encodings of '.', '/' and '\' to the character.
+var overlongUTF8 = strings.NewReplacer(
+	"\xc0\xae", ".", "\xe0\x80\xae", ".",
+	"\xc0\xaf", "/", "\xe0\x80\xaf", "/",
+	"\xc1\x9c", `\`, "\xc1\x1c", `\`,
+)
+
+// sensitiveFiles are files and wrappers only an attacker asks for.
+var sensitiveFiles = regexp.MustCompile(`(?i)` +
+	`/etc/(?:passwd|shadow|group|hosts|issue|sudoers|crontab)\b` +
+	`|/proc/(?:self|\d+)/(?:environ|cmdline|maps|mem|fd/)` +
+	`|(?:^|[\\/])windows[\\/](?:win\.ini|system\.ini|system32[\\/])` +
+	`|(?:^|[\\/])boot\.ini\b` +
+	`|web-inf[\\/](?:web\.xml|classes[\\/])` +
+	`|\.ssh[\\/](?:id_rsa|id_dsa|id_ecdsa|id_ed25519|authorized_keys)` +
+	`|(?:^|[\\/])\.(?:htpasswd|htaccess|git[\\/]config|aws[\\/]credentials)\b` +
+	`|\b(?:php|phar|zip|expect|glob)://`)
+
+// DetectPathTraversal reports whether the input walks out of a directory or
+// names a file outside the application, and why.
+func DetectPathTraversal(input string) (bool, string) {
+	s := overlongUTF8.Replace(input)
+
+	if f := sensitiveFiles.FindString(s); f != "" {
+		return true, "sensitive file: " + f
+	}
+	if traversalSteps(s) >= 2 {
+		return true, "directory traversal"
+	}
+	return false, ""
+}
+
+// traversalSteps counts ".." path segments, including Tomcat's "..;".
+func traversalSteps(s string) int {
+	n := 0
+	for _, seg := range strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if seg == ".." || seg == "..;" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import "testing"
+
+func TestDetectPathTraversal(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"file name", "report-2024.pdf", false},
+		{"relative link", "../index.html", false},
+		{"ellipsis", "wait... what../", false},
+		{"version range", "1.2..1.4", false},
+		{"etc in prose", "see /etc for config, etc.", false},
+
+		{"two levels", "../../secret.txt", true},
+		{"deep", "images/../../../../etc/shadow", true},
+		{"windows", `..\..\boot.ini`, true},
+		{"tomcat", "..;/..;/manager/html", true},
+		{"passwd", "/etc/passwd", true},
+		{"one level to passwd", "../etc/passwd", true},
+		{"proc environ", "/proc/self/environ", true},
+		{"win.ini", `C:\Windows\win.ini`, true},
+		{"web.xml", "WEB-INF/web.xml", true},
+		{"ssh key", "/home/app/.ssh/id_rsa", true},
+		{"php filter", "php://filter/convert.base64-encode/resource=index.php", true},
+		{"overlong", "\xc0\xae\xc0\xae/\xc0\xae\xc0\xae/app.cfg", true},
+		{"overlong slash", "..\xc0\xaf..\xc0\xafapp.cfg", true},
+	}
+	for _, tt := range tests {
+		if got, reason := DetectPathTraversal(tt.input); got != tt.want {
+			t.Errorf("%s: expected %v, got %v (%s)", tt.name, tt.want, got, reason)
+		}
+	}
+}
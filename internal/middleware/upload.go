@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/princetheprogrammer/apisentinel/internal/logger"
+)
+
+// UploadPolicy restricts files uploaded with multipart/form-data.
+type UploadPolicy struct {
+	MaxFileSize       int64    // Bytes per file, 0 = unlimited
+	AllowedExtensions []string // e.g. ".jpg", ".pdf". Empty = any
+	VerifyContentType bool     // Reject files whose content doesn't match their declared type
+
+	// Scanner, if set, checks every file for malware (see ClamAVScanner).
+	Scanner Scanner
+	// ScanFailOpen lets uploads through when the scanner is unreachable.
+	ScanFailOpen bool
+}
+
+// Scanner checks file contents for malware.
+type Scanner interface {
+	// Scan returns the signature name if data is infected, "" if clean.
+	Scan(data []byte) (string, error)
+}
+
+// UploadGuard enforces an UploadPolicy on multipart requests.
+// File name path traversal is always rejected.
+type UploadGuard struct {
+	policy     UploadPolicy
+	extensions map[string]bool
+}
+
+func NewUploadGuard(policy UploadPolicy) *UploadGuard {
+	g := &UploadGuard{policy: policy}
+	if len(policy.AllowedExtensions) > 0 {
+		g.extensions = make(map[string]bool, len(policy.AllowedExtensions))
+		for _, ext := range policy.AllowedExtensions {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			g.extensions[ext] = true
+		}
+	}
+	return g
+}
+
+// uploadError is a rejected upload and the status to reject it with.
+type uploadError struct {
+	status    int
+	violation string
+	details   string
+}
+
+func (e *uploadError) Error() string { return e.violation + ": " + e.details }
+
+func (g *UploadGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Checked part by part as it streams to the next handler. Only what
+		// the checks need of each file is kept (see readFile).
+		serveChecked(w, r, next, func(body io.Reader) error {
+			return g.check(body, params["boundary"])
+		}, func(err error) int {
+			var ue *uploadError
+			if !errors.As(err, &ue) {
+				ue = &uploadError{status: http.StatusBadRequest, violation: "Malformed Multipart Body", details: err.Error()}
+			}
+			log.Printf("📎 Upload rejected on %s: %v", r.URL.Path, ue)
+			logger.LogEvent(r.Header.Get("X-Request-ID"), clientIP(r), r.Method, r.URL.Path, ue.violation, ue.details)
+			IncrementBlocked()
+			return ue.status
+		})
+	})
+}
+
+// check walks every file part of a multipart body.
+func (g *UploadGuard) check(body io.Reader, boundary string) error {
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		filename, err := rawFileName(part)
+		if err != nil {
+			return &uploadError{http.StatusBadRequest, "Malformed Upload Header", err.Error()}
+		}
+		if filename == "" {
+			continue // A regular form field
+		}
+
+		// The name is checked before any of the file is passed on.
+		if err := g.checkName(filename); err != nil {
+			return err
+		}
+		data, size, err := g.readFile(part)
+		if err != nil {
+			return err
+		}
+		if err := g.checkFile(filename, part.Header.Get("Content-Type"), data, size); err != nil {
+			return err
+		}
+	}
+}
+
+// readFile reads a file part and returns its size and as much of it as the
+// checks need: the start for content sniffing, or all of it for the
+// scanner, up to one byte past MaxFileSize.
+func (g *UploadGuard) readFile(part io.Reader) (data []byte, size int64, err error) {
+	keep := int64(sniffLen)
+	if g.policy.Scanner != nil {
+		keep = math.MaxInt64
+		if g.policy.MaxFileSize > 0 {
+			keep = g.policy.MaxFileSize + 1
+		}
+	}
+	if data, err = io.ReadAll(io.LimitReader(part, keep)); err != nil {
+		return nil, 0, err
+	}
+	rest, err := io.Copy(io.Discard, part)
+	return data, int64(len(data)) + rest, err
+}
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+func (g *UploadGuard) checkName(filename string) error {
+	if unsafeFileName(filename) {
+		return &uploadError{http.StatusForbidden, "Upload Path Traversal", fmt.Sprintf("file name %q", filename)}
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if g.extensions != nil && !g.extensions[ext] {
+		return &uploadError{http.StatusForbidden, "Upload Extension Not Allowed", fmt.Sprintf("%q", filename)}
+	}
+	return nil
+}
+
+// checkFile checks a file's size and contents. data is what readFile kept.
+func (g *UploadGuard) checkFile(filename, declared string, data []byte, size int64) error {
+	if g.policy.MaxFileSize > 0 && size > g.policy.MaxFileSize {
+		return &uploadError{http.StatusRequestEntityTooLarge, "Upload Too Large",
+			fmt.Sprintf("%q is %d bytes, limit %d", filename, size, g.policy.MaxFileSize)}
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if g.policy.VerifyContentType {
+		if declared == "" {
+			declared = mime.TypeByExtension(ext)
+		}
+		sniffed := http.DetectContentType(data)
+		if !contentMatches(declared, sniffed) {
+			return &uploadError{http.StatusForbidden, "Upload Content Mismatch",
+				fmt.Sprintf("%q declared %s but looks like %s", filename, declared, sniffed)}
+		}
+	}
+
+	if g.policy.Scanner != nil {
+		signature, err := g.policy.Scanner.Scan(data)
+		switch {
+		case err != nil && g.policy.ScanFailOpen:
+			log.Printf("⚠️ Malware scan failed for %q, letting it through: %v", filename, err)
+		case err != nil:
+			return &uploadError{http.StatusServiceUnavailable, "Upload Scan Failed", err.Error()}
+		case signature != "":
+			return &uploadError{http.StatusForbidden, "Malware Upload", fmt.Sprintf("%q: %s", filename, signature)}
+		}
+	}
+
+	return nil
+}
+
+// unsafeFileName reports whether a client-supplied file name could escape
+// the directory a backend saves it to.
+func unsafeFileName(name string) bool {
+	if strings.ContainsAny(name, "/\\\x00") {
+		return true
+	}
+	return name == "." || name == ".." || len(name) >= 2 && name[1] == ':' // C:evil.exe
+}
+
+// sniffedFamilies are media types http.DetectContentType recognizes reliably.
+// A file declared as one of them must really be it.
+var sniffedFamilies = []string{"image/", "audio/", "video/", "font/", "application/pdf", "application/zip", "application/x-gzip"}
+
+// contentMatches reports whether sniffed content agrees with the declared type.
+func contentMatches(declared, sniffed string) bool {
+	declared, _, _ = mime.ParseMediaType(declared)
+	sniffed, _, _ = mime.ParseMediaType(sniffed)
+	switch declared {
+	case "image/jpg":
+		declared = "image/jpeg"
+	case "image/svg+xml":
+		// SVG is XML; it sniffs as text/xml or text/plain.
+		return sniffed == "text/xml" || sniffed == "text/plain"
+	}
+
+	// Markup can run script if served back, so it must be declared as such.
+	if sniffed == "text/html" || sniffed == "text/xml" {
+		return declared == sniffed || declared == "application/xml" && sniffed == "text/xml"
+	}
+
+	for _, family := range sniffedFamilies {
+		if strings.HasPrefix(declared, family) {
+			return declared == sniffed
+		}
+	}
+	return true
+}
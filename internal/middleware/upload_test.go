@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// pngHeader is enough of a PNG for content sniffing.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+type upload struct {
+	field, filename, contentType string
+	data                         []byte
+}
+
+// multipartRequest builds a POST with form values and file uploads.
+func multipartRequest(t *testing.T, values map[string]string, files ...upload) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range values {
+		mw.WriteField(k, v)
+	}
+	for _, f := range files {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="`+f.field+`"; filename="`+f.filename+`"`)
+		if f.contentType != "" {
+			h.Set("Content-Type", f.contentType)
+		}
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(f.data)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// fakeClamd answers INSTREAM requests, reporting EICAR as infected.
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				cmd := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(conn, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				if bytes.Contains(data, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUploadGuard(t *testing.T) {
+	eicar := []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	policy := UploadPolicy{
+		MaxFileSize:       1024,
+		AllowedExtensions: []string{".png", "jpg", ".txt"},
+		VerifyContentType: true,
+		Scanner:           &ClamAVScanner{Address: fakeClamd(t)},
+	}
+
+	tests := []struct {
+		name   string
+		policy UploadPolicy
+		file   upload
+		want   int
+	}{
+		{"clean image", policy, upload{"avatar", "me.png", "image/png", pngHeader}, http.StatusOK},
+		{"too large", policy, upload{"avatar", "big.png", "image/png", append(pngHeader, make([]byte, 2048)...)}, http.StatusRequestEntityTooLarge},
+		{"extension not allowed", policy, upload{"avatar", "shell.php", "image/png", pngHeader}, http.StatusForbidden},
+		{"path traversal", policy, upload{"avatar", "../../etc/cron.d/evil.png", "image/png", pngHeader}, http.StatusForbidden},
+		{"windows path", policy, upload{"avatar", `..\..\evil.png`, "image/png", pngHeader}, http.StatusForbidden},
+		{"HTML disguised as JPEG", policy, upload{"avatar", "cat.jpg", "image/jpeg", []byte("<html><script>alert(1)</script>")}, http.StatusForbidden},
+		{"PNG declared as JPEG", policy, upload{"avatar", "cat.jpg", "", pngHeader}, http.StatusForbidden},
+		{"malware", policy, upload{"doc", "notes.txt", "text/plain", eicar}, http.StatusForbidden},
+		{
+			"scanner down fails closed",
+			UploadPolicy{Scanner: &ClamAVScanner{Address: "127.0.0.1:1"}},
+			upload{"doc", "notes.txt", "text/plain", []byte("hi")}, http.StatusServiceUnavailable,
+		},
+		{
+			"scanner down fails open",
+			UploadPolicy{Scanner: &ClamAVScanner{Address: "127.0.0.1:1"}, ScanFailOpen: true},
+			upload{"doc", "notes.txt", "text/plain", []byte("hi")}, http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			handler := NewUploadGuard(tt.policy).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = io.ReadAll(r.Body)
+			}))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, multipartRequest(t, map[string]string{"title": "hello"}, tt.file))
+			if rr.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, rr.Code, strings.TrimSpace(rr.Body.String()))
+			}
+			if tt.want == http.StatusOK && !bytes.Contains(got, tt.file.data) {
+				t.Error("body was not passed on to the next handler")
+			}
+		})
+	}
+}
+
+func TestUploadGuardMalformedDisposition(t *testing.T) {
+	handler := NewUploadGuard(UploadPolicy{AllowedExtensions: []string{".jpg"}}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, disposition := range []string{
+		`form-data; name="f"; filename="evil.php"; filename="x"`,
+		`form-data; name="f"; filename="evil.php`,
+		`form-data; name="f"; filename=evil .php`,
+		`form-data; name="f"; filename="cat.jpg"; evil.php`,
+	} {
+		t.Run(disposition, func(t *testing.T) {
+			body := "--b\r\nContent-Disposition: " + disposition + "\r\n\r\n<?php system($_GET['c']); ?>\r\n--b--\r\n"
+			req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+			req.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", rr.Code)
+			}
+		})
+	}
+}
+
+func TestUploadGuardStreamed(t *testing.T) {
+	var got []byte
+	var readErr error
+	handler := NewUploadGuard(UploadPolicy{AllowedExtensions: []string{".png"}, VerifyContentType: true}).
+		Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, readErr = io.ReadAll(r.Body)
+		}))
+
+	// Larger than guardAhead: the second file is checked while the first
+	// is already on its way.
+	big := append(pngHeader, make([]byte, 2*guardAhead)...)
+	tests := []struct {
+		name  string
+		files []upload
+		want  int
+	}{
+		{"large clean image", []upload{{"a", "big.png", "image/png", big}}, http.StatusOK},
+		{"traversal after a large file", []upload{{"a", "big.png", "image/png", big}, {"b", "../evil.png", "image/png", pngHeader}}, http.StatusForbidden},
+		{"HTML after a large file", []upload{{"a", "big.png", "image/png", big}, {"b", "x.png", "image/png", []byte("<html><script>")}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		got, readErr = nil, nil
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, multipartRequest(t, nil, tt.files...))
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rr.Code)
+			continue
+		}
+		if tt.want == http.StatusOK && (readErr != nil || !bytes.Contains(got, big)) {
+			t.Errorf("%s: body was not passed on whole (%v)", tt.name, readErr)
+		}
+		if tt.want != http.StatusOK && readErr == nil {
+			t.Errorf("%s: the body was delivered whole", tt.name)
+		}
+	}
+}
+
+func TestInspectMultipartFields(t *testing.T) {
+	si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules()})
+	handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		values map[string]string
+		file   upload
+		want   int
+	}{
+		// The raw body is full of "--boundary" lines, which must not count as SQL comments.
+		{"benign form", map[string]string{"title": "Quarterly report", "notes": "see attached"}, upload{"file", "report.pdf", "application/pdf", []byte("%PDF-1.7")}, http.StatusOK},
+		{"XSS in field", map[string]string{"bio": "<img src=x onerror=alert(1)>"}, upload{"file", "a.txt", "text/plain", []byte("x")}, http.StatusForbidden},
+		{"SQLi in field", map[string]string{"id": "1' OR '1'='1"}, upload{"file", "a.txt", "text/plain", []byte("x")}, http.StatusForbidden},
+		{"XSS in file name", nil, upload{"file", "<svg onload=alert(1)>.png", "image/png", pngHeader}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, multipartRequest(t, tt.values, tt.file))
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/princetheprogrammer/apisentinel/internal/logger"
+)
+
+// Virtual patching.
+//
+// When a CVE lands on a backend, the real fix can take days to ship. A
+// virtual patch blocks the exploit at the proxy in the meantime: a set of
+// conditions on the request, added through the admin API, that applies to
+// every route as soon as it's added. Every condition a patch sets must
+// match. There is no anomaly scoring and no monitor mode: a matching patch
+// blocks the request, or only audits it with action "log".
+
+var (
+	// ErrNoSuchPatch is returned for a virtual patch ID that doesn't exist.
+	ErrNoSuchPatch = errors.New("no such virtual patch")
+
+	// ErrInvalidPatch wraps the reason a new patch was refused.
+	ErrInvalidPatch = errors.New("invalid virtual patch")
+)
+
+// VirtualPatch is an emergency rule added at runtime.
+type VirtualPatch struct {
+	ID          string            `json:"id"` // Generated if empty
+	Description string            `json:"description,omitempty"`
+	Path        string            `json:"path,omitempty"` // Regex on the URL path
+	Methods     []string          `json:"methods,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"` // Header name -> regex on its value
+	Params      map[string]string `json:"params,omitempty"`  // Query, form or JSON parameter -> regex; names take "*" like exclusions
+	Body        string            `json:"body,omitempty"`    // Regex on the raw body; a streamed one window at a time
+	Action      string            `json:"action,omitempty"`  // ActionBlock (default) or ActionLog
+	CreatedAt   time.Time         `json:"created_at"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"` // nil = until deleted
+	Hits        int64             `json:"hits"`
+}
+
+// Expired reports whether the patch has stopped applying.
+func (p *VirtualPatch) Expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !now.Before(*p.ExpiresAt)
+}
+
+// virtualPatch is a VirtualPatch ready to match.
+type virtualPatch struct {
+	VirtualPatch
+	path    *regexp.Regexp
+	headers map[string]*regexp.Regexp
+	params  map[string]*regexp.Regexp
+	body    *regexp.Regexp
+	hits    atomic.Int64
+}
+
+// compilePatch validates a patch and compiles its regexes.
+func compilePatch(p VirtualPatch) (*virtualPatch, error) {
+	if strings.ContainsAny(p.ID, " \t\r\n/?&") {
+		return nil, fmt.Errorf("invalid id %q", p.ID)
+	}
+	if p.Path == "" && len(p.Headers) == 0 && len(p.Params) == 0 && p.Body == "" {
+		return nil, errors.New("at least one of path, headers, params or body is required")
+	}
+	for _, m := range p.Methods {
+		if m == "" || strings.ToUpper(m) != m {
+			return nil, fmt.Errorf("invalid method %q (methods are upper-case)", m)
+		}
+	}
+	if p.Action == "" {
+		p.Action = ActionBlock
+	}
+	if p.Action != ActionBlock && p.Action != ActionLog {
+		return nil, fmt.Errorf("unknown action %q", p.Action)
+	}
+
+	vp := &virtualPatch{VirtualPatch: p}
+	vp.hits.Store(p.Hits)
+	compile := func(what, expr string) (*regexp.Regexp, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", what, err)
+		}
+		return re, nil
+	}
+
+	var err error
+	if p.Path != "" {
+		if vp.path, err = compile("path", p.Path); err != nil {
+			return nil, err
+		}
+	}
+	vp.headers = make(map[string]*regexp.Regexp, len(p.Headers))
+	for name, expr := range p.Headers {
+		if vp.headers[http.CanonicalHeaderKey(name)], err = compile("header "+name, expr); err != nil {
+			return nil, err
+		}
+	}
+	vp.params = make(map[string]*regexp.Regexp, len(p.Params))
+	for name, expr := range p.Params {
+		if vp.params[name], err = compile("param "+name, expr); err != nil {
+			return nil, err
+		}
+	}
+	if p.Body != "" {
+		if vp.body, err = compile("body", p.Body); err != nil {
+			return nil, err
+		}
+	}
+	return vp, nil
+}
+
+// matches reports whether every condition of the patch holds for the
+// request. fields are the request's parameters, body the buffered body.
+func (vp *virtualPatch) matches(r *http.Request, fields []field, body []byte) bool {
+	if !vp.matchesRequest(r) {
+		return false
+	}
+	for name, re := range vp.params {
+		if !paramMatches(fields, name, re) {
+			return false
+		}
+	}
+	return vp.body == nil || vp.body.Match(body)
+}
+
+// matchesRequest checks the conditions that don't depend on the body:
+// method, path and headers.
+func (vp *virtualPatch) matchesRequest(r *http.Request) bool {
+	if len(vp.Methods) > 0 && !slices.Contains(vp.Methods, r.Method) {
+		return false
+	}
+	if vp.path != nil && !vp.path.MatchString(r.URL.Path) {
+		return false
+	}
+	for name, re := range vp.headers {
+		if !slices.ContainsFunc(r.Header.Values(name), re.MatchString) {
+			return false
+		}
+	}
+	return true
+}
+
+// paramMatches reports whether a query or body parameter called name has a
+// value matching re.
+func paramMatches(fields []field, name string, re *regexp.Regexp) bool {
+	return slices.ContainsFunc(fields, func(f field) bool {
+		return (f.target == TargetQuery || f.target == TargetBody) && wildcardMatch(name, f.name) && re.MatchString(f.value)
+	})
+}
+
+// snapshot returns the patch with its current hit count.
+func (vp *virtualPatch) snapshot() VirtualPatch {
+	p := vp.VirtualPatch
+	p.Hits = vp.hits.Load()
+	return p
+}
+
+// VirtualPatches is the set of virtual patches, persisted to a JSON file so
+// they survive restarts. It is shared by every route and generation.
+type VirtualPatches struct {
+	file    string
+	mu      sync.Mutex // Serialises changes and writes to file
+	patches atomic.Pointer[[]*virtualPatch]
+}
+
+// LoadVirtualPatches reads the patches saved in file. A missing file is an
+// empty set.
+func LoadVirtualPatches(file string) (*VirtualPatches, error) {
+	vps := &VirtualPatches{file: file}
+	var list []*virtualPatch
+
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var saved []VirtualPatch
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, p := range saved {
+			vp, err := compilePatch(p)
+			if err != nil {
+				return nil, fmt.Errorf("%s: virtual patch %s: %v", file, p.ID, err)
+			}
+			list = append(list, vp)
+		}
+		log.Printf("🩹 Loaded %d virtual patch(es) from %s", len(list), file)
+	}
+	vps.patches.Store(&list)
+	return vps, nil
+}
+
+// List returns every patch, expired ones included, with hit counts.
+func (vps *VirtualPatches) List() []VirtualPatch {
+	list := *vps.patches.Load()
+	out := make([]VirtualPatch, len(list))
+	for i, vp := range list {
+		out[i] = vp.snapshot()
+	}
+	return out
+}
+
+// Add validates a patch, saves it and applies it at once. Nothing changes
+// if it can't be saved.
+func (vps *VirtualPatches) Add(p VirtualPatch) (VirtualPatch, error) {
+	vps.mu.Lock()
+	defer vps.mu.Unlock()
+
+	now := time.Now().UTC()
+	if p.ID == "" {
+		p.ID = "vp-" + generateRequestID()
+	}
+	if p.Expired(now) {
+		return VirtualPatch{}, fmt.Errorf("%w: expires_at is in the past", ErrInvalidPatch)
+	}
+	p.CreatedAt, p.Hits = now, 0
+
+	list := *vps.patches.Load()
+	if slices.ContainsFunc(list, func(vp *virtualPatch) bool { return vp.ID == p.ID }) {
+		return VirtualPatch{}, fmt.Errorf("%w: %s already exists", ErrInvalidPatch, p.ID)
+	}
+	vp, err := compilePatch(p)
+	if err != nil {
+		return VirtualPatch{}, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	updated := append(slices.Clip(list), vp)
+	if err := vps.save(updated); err != nil {
+		return VirtualPatch{}, err
+	}
+	vps.patches.Store(&updated)
+	log.Printf("🩹 Virtual patch %s added: %s", vp.ID, vp.Description)
+	return vp.snapshot(), nil
+}
+
+// Expire stops a patch from applying now. It stays listed, with its hits,
+// until deleted.
+func (vps *VirtualPatches) Expire(id string) (VirtualPatch, error) {
+	vps.mu.Lock()
+	defer vps.mu.Unlock()
+
+	list := *vps.patches.Load()
+	i := slices.IndexFunc(list, func(vp *virtualPatch) bool { return vp.ID == id })
+	if i < 0 {
+		return VirtualPatch{}, ErrNoSuchPatch
+	}
+
+	// Patches are immutable once published: replace it with an expired copy.
+	p := list[i].snapshot()
+	now := time.Now().UTC()
+	if !p.Expired(now) {
+		p.ExpiresAt = &now
+	}
+	vp, err := compilePatch(p)
+	if err != nil {
+		return VirtualPatch{}, err
+	}
+	updated := slices.Clone(list)
+	updated[i] = vp
+	if err := vps.save(updated); err != nil {
+		return VirtualPatch{}, err
+	}
+	vps.patches.Store(&updated)
+	log.Printf("⏹️  Virtual patch %s expired", id)
+	return vp.snapshot(), nil
+}
+
+// Delete removes a patch.
+func (vps *VirtualPatches) Delete(id string) error {
+	vps.mu.Lock()
+	defer vps.mu.Unlock()
+
+	list := *vps.patches.Load()
+	i := slices.IndexFunc(list, func(vp *virtualPatch) bool { return vp.ID == id })
+	if i < 0 {
+		return ErrNoSuchPatch
+	}
+	updated := slices.Delete(slices.Clone(list), i, i+1)
+	if err := vps.save(updated); err != nil {
+		return err
+	}
+	vps.patches.Store(&updated)
+	log.Printf("🗑️  Virtual patch %s deleted", id)
+	return nil
+}
+
+// Save writes the patches and their current hit counts to file.
+func (vps *VirtualPatches) Save() error {
+	vps.mu.Lock()
+	defer vps.mu.Unlock()
+	return vps.save(*vps.patches.Load())
+}
+
+// save replaces the file atomically, so a crash never leaves half a list.
+// Changes are saved before they are applied. The caller holds mu.
+func (vps *VirtualPatches) save(list []*virtualPatch) error {
+	out := make([]VirtualPatch, len(list))
+	for i, vp := range list {
+		out[i] = vp.snapshot()
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(vps.file), filepath.Base(vps.file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), vps.file)
+}
+
+// matching returns the active patches that match the request.
+func (vps *VirtualPatches) matching(r *http.Request, fields []field, body []byte) []*virtualPatch {
+	var matched []*virtualPatch
+	now := time.Now()
+	for _, vp := range *vps.patches.Load() {
+		if !vp.Expired(now) && vp.matches(r, fields, body) {
+			matched = append(matched, vp)
+		}
+	}
+	return matched
+}
+
+// patchStream matches the virtual patches against a body too large to
+// buffer, one window at a time as it streams. A condition met stays met:
+// a patch fires once all of its conditions have been, wherever in the body
+// each was. Streamed JSON values carry no path, so params conditions only
+// see form and multipart fields there; body conditions see everything.
+type patchStream struct {
+	pending []*patchProgress
+	text    []byte // The end of the previous window, then this one
+}
+
+// patchProgress is a patch waiting for the rest of its conditions.
+type patchProgress struct {
+	vp     *virtualPatch
+	params map[string]bool // params conditions met so far
+	body   bool
+}
+
+// stream starts matching the active patches whose method, path and header
+// conditions hold for r.
+func (vps *VirtualPatches) stream(r *http.Request) *patchStream {
+	ps := &patchStream{}
+	now := time.Now()
+	for _, vp := range *vps.patches.Load() {
+		if !vp.Expired(now) && vp.matchesRequest(r) {
+			ps.pending = append(ps.pending, &patchProgress{vp: vp, params: make(map[string]bool), body: vp.body == nil})
+		}
+	}
+	return ps
+}
+
+// feed matches the next window and the fields it completed, and returns
+// the patches they completed. The body regex also sees the last
+// streamOverlap bytes of the previous window, for a match across the two.
+func (ps *patchStream) feed(window []byte, fields []field) []*virtualPatch {
+	if len(window) > 0 {
+		keep := max(len(ps.text)-streamOverlap, 0)
+		ps.text = append(ps.text[:copy(ps.text, ps.text[keep:])], window...)
+	}
+
+	var done []*virtualPatch
+	kept := ps.pending[:0]
+	for _, p := range ps.pending {
+		for name, re := range p.vp.params {
+			if !p.params[name] && paramMatches(fields, name, re) {
+				p.params[name] = true
+			}
+		}
+		if !p.body && len(window) > 0 && p.vp.body.Match(ps.text) {
+			p.body = true
+		}
+		if p.body && len(p.params) == len(p.vp.params) {
+			done = append(done, p.vp)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	ps.pending = kept
+	return done
+}
+
+// streamPatches applies the virtual patches to a request whose body will
+// be streamed. Patches the rest of the request completes apply at once;
+// the returned stream, nil if no patch is left waiting, is fed the body.
+func (si *SecurityInspector) streamPatches(w http.ResponseWriter, r *http.Request, fields []field) (*patchStream, bool) {
+	if si.patches == nil {
+		return nil, false
+	}
+	ps := si.patches.stream(r)
+	if si.applyPatches(r, ps.feed(nil, fields)) {
+		IncrementBlocked()
+		http.Error(w, "Forbidden: Malicious activity detected", http.StatusForbidden)
+		return nil, true
+	}
+	if len(ps.pending) == 0 {
+		return nil, false
+	}
+	return ps, false
+}
+
+// patched applies the virtual patches to a request before the WAF rules
+// run. It returns true if one blocked the request.
+func (si *SecurityInspector) patched(w http.ResponseWriter, r *http.Request, fields []field, body []byte) bool {
+	if si.patches == nil || !si.applyPatches(r, si.patches.matching(r, fields, body)) {
+		return false
+	}
+	IncrementBlocked()
+	http.Error(w, "Forbidden: Malicious activity detected", http.StatusForbidden)
+	return true
+}
+
+// applyPatches counts and audits the patches a request matched, and
+// reports whether one of them blocks it.
+func (si *SecurityInspector) applyPatches(r *http.Request, matched []*virtualPatch) bool {
+	blocked := false
+	for _, vp := range matched {
+		vp.hits.Add(1)
+		block := vp.Action == ActionBlock
+		details := "Blocked by virtual patch " + vp.ID
+		if !block {
+			details = "Matched virtual patch " + vp.ID
+		}
+		if vp.Description != "" {
+			details += ": " + vp.Description
+		}
+		log.Printf("🩹 %s (%s %s)", details, r.Method, r.URL.Path)
+		logger.Log(logger.AuditEvent{
+			RequestID:     r.Header.Get("X-Request-ID"),
+			SourceIP:      sourceIP(r),
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			ViolationType: "Virtual Patch",
+			Details:       details,
+		})
+		blocked = blocked || block
+	}
+	return blocked
+}
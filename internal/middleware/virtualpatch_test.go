@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVirtualPatches(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "patches.json")
+	vps, err := LoadVirtualPatches(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patches := []VirtualPatch{
+		{ID: "cve-1", Description: "Struts OGNL in Content-Type", Headers: map[string]string{"content-type": `%\{`}},
+		{ID: "cve-2", Path: `^/api/import$`, Methods: []string{"POST"}, Body: `(?i)<!ENTITY`},
+		{ID: "cve-3", Params: map[string]string{"items[*].template": `\$\{.*\}`}},
+		{ID: "watch", Path: `^/admin/`, Action: ActionLog},
+	}
+	for _, p := range patches {
+		if _, err := vps.Add(p); err != nil {
+			t.Fatalf("%s: %v", p.ID, err)
+		}
+	}
+
+	// No WAF rules: only the patches can block.
+	si := NewSecurityInspector(InspectorOptions{Patches: vps})
+	handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(method, url, contentType, body string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	tests := []struct {
+		name, method, url, contentType, body string
+		want                                 int
+	}{
+		{"header", "POST", "/upload", "%{(#_='multipart/form-data')}", "", http.StatusForbidden},
+		{"header, benign", "POST", "/upload", "text/plain", "hello", http.StatusOK},
+		{"body", "POST", "/api/import", "application/xml", `<!DOCTYPE x [<!entity e SYSTEM "file:///">]>`, http.StatusForbidden},
+		{"body, other method", "PUT", "/api/import", "application/xml", `<!ENTITY e SYSTEM "x">`, http.StatusOK},
+		{"body, other path", "POST", "/api/import/v2", "application/xml", `<!ENTITY e SYSTEM "x">`, http.StatusOK},
+		{"JSON param", "POST", "/render", "application/json", `{"items": [{"template": "hi"}, {"template": "${7*7}"}]}`, http.StatusForbidden},
+		{"JSON param, other field", "POST", "/render", "application/json", `{"items": [{"title": "${7*7}"}]}`, http.StatusOK},
+		{"log action", "GET", "/admin/users", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := send(tt.method, tt.url, tt.contentType, tt.body); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	hits := func(vps *VirtualPatches) map[string]int64 {
+		m := make(map[string]int64)
+		for _, p := range vps.List() {
+			m[p.ID] = p.Hits
+		}
+		return m
+	}
+	want := map[string]int64{"cve-1": 1, "cve-2": 1, "cve-3": 1, "watch": 1}
+	for id, n := range want {
+		if got := hits(vps)[id]; got != n {
+			t.Errorf("%s: %d hits, want %d", id, got, n)
+		}
+	}
+
+	// Expired patches stay listed but stop matching.
+	if _, err := vps.Expire("cve-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := send("POST", "/upload", "%{(#_='multipart/form-data')}", ""); got != http.StatusOK {
+		t.Errorf("expired patch still blocks: %d", got)
+	}
+	if err := vps.Delete("cve-3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vps.Delete("cve-3"); !errors.Is(err, ErrNoSuchPatch) {
+		t.Errorf("deleting twice: got %v", err)
+	}
+
+	// Everything survives a restart, hit counts included.
+	if err := vps.Save(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadVirtualPatches(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := reloaded.List()
+	if len(list) != 3 || list[0].ID != "cve-1" || !list[0].Expired(time.Now()) {
+		t.Fatalf("unexpected patches after reload: %+v", list)
+	}
+	if got := hits(reloaded)["cve-2"]; got != 1 {
+		t.Errorf("cve-2: %d hits after reload, want 1", got)
+	}
+}
+
+func TestVirtualPatchValidation(t *testing.T) {
+	vps, err := LoadVirtualPatches(filepath.Join(t.TempDir(), "patches.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+
+	invalid := map[string]VirtualPatch{
+		"no condition":    {Methods: []string{"POST"}},
+		"bad regex":       {Path: `^/api/(`},
+		"bad action":      {Path: `^/`, Action: "drop"},
+		"bad method":      {Path: `^/`, Methods: []string{"post"}},
+		"bad id":          {ID: "a b", Path: `^/`},
+		"already expired": {Path: `^/`, ExpiresAt: &past},
+	}
+	for name, p := range invalid {
+		if _, err := vps.Add(p); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("%s: expected ErrInvalidPatch, got %v", name, err)
+		}
+	}
+
+	p, err := vps.Add(VirtualPatch{Path: `^/`})
+	if err != nil || !strings.HasPrefix(p.ID, "vp-") || p.Action != ActionBlock {
+		t.Fatalf("expected a generated ID and the block action, got %+v (%v)", p, err)
+	}
+	if _, err := vps.Add(VirtualPatch{ID: p.ID, Path: `^/x`}); !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("duplicate ID: expected ErrInvalidPatch, got %v", err)
+	}
+}
+
+func TestVirtualPatchesStreamedBody(t *testing.T) {
+	vps, err := LoadVirtualPatches(filepath.Join(t.TempDir(), "patches.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []VirtualPatch{
+		{ID: "marker", Body: `exploit-marker`},
+		{ID: "cmd", Params: map[string]string{"cmd": `^rm$`}},
+		{ID: "both", Params: map[string]string{"a": `^1$`, "b": `^2$`}},
+	} {
+		if _, err := vps.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The backend reads the whole body, as a proxy would.
+	var delivered int
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		delivered++
+	})
+	handler := NewSecurityInspector(InspectorOptions{Patches: vps}).Middleware(backend)
+	send := func(body string) int {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Past inspect_body_size (1 MiB by default), the body is streamed.
+	pad := "pad=" + strings.Repeat("x", 2<<20)
+	tests := []struct {
+		name, body string
+		want       int
+	}{
+		{"body, small", "exploit-marker&pad=x", http.StatusForbidden},
+		{"body, padded", "exploit-marker&" + pad, http.StatusForbidden},
+		{"body, after the padding", pad + "&exploit-marker", http.StatusForbidden},
+		{"param, small", "cmd=rm&pad=x", http.StatusForbidden},
+		{"param, padded", "cmd=rm&" + pad, http.StatusForbidden},
+		{"param, after the padding", pad + "&cmd=rm", http.StatusForbidden},
+		{"params across the padding", "a=1&" + pad + "&b=2", http.StatusForbidden},
+		{"half a patch", "a=1&" + pad, http.StatusOK},
+		{"benign, padded", "cmd=ls&" + pad, http.StatusOK},
+	}
+	for _, tt := range tests {
+		delivered = 0
+		if got := send(tt.body); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+		if ok := tt.want == http.StatusOK; (delivered == 1) != ok {
+			t.Errorf("%s: delivered=%v", tt.name, delivered == 1)
+		}
+	}
+}
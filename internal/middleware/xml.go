@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// XML and SOAP bodies are walked element by element: every attribute value
+// and every piece of element text becomes a field, named by its path
+// ("Envelope/Body/Login/username", "Login/@type"). The DOCTYPE, if any,
+// becomes a field of its own so DetectXXE can look at it.
+//
+// encoding/xml never expands custom entities or fetches DTDs, so parsing
+// the body here is safe; the danger is the backend's parser.
+
+// maxXMLEntities is how many internal entities a DOCTYPE may declare before
+// it is treated as an expansion attack.
+const maxXMLEntities = 16
+
+// isXML reports whether a Content-Type is XML (including SOAP and "+xml" types).
+func isXML(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	ct = strings.TrimSpace(ct)
+	return ct == "application/xml" || ct == "text/xml" || strings.HasSuffix(ct, "+xml")
+}
+
+// xmlFields parses an XML document into fields.
+func xmlFields(body []byte) ([]field, error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false // Leave unknown entities as text instead of failing
+	d.Entity = xml.HTMLEntity
+
+	var fields []field
+	var path []string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			name := strings.Join(path, "/")
+			fields = append(fields, field{target: TargetKeys, source: "XML Body", name: name, value: t.Name.Local})
+			for _, a := range t.Attr {
+				fields = append(fields, field{target: TargetBody, source: "XML Body", name: name + "/@" + a.Name.Local, value: a.Value})
+			}
+
+		case xml.EndElement:
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+
+		case xml.CharData:
+			if text := strings.TrimSpace(string(t)); text != "" {
+				fields = append(fields, field{target: TargetBody, source: "XML Body", name: strings.Join(path, "/"), value: text})
+			}
+
+		case xml.Directive:
+			fields = append(fields, field{target: TargetBody, source: "XML DOCTYPE", name: "!DOCTYPE", value: "<!" + string(t) + ">"})
+		}
+	}
+}
+
+// DetectXXE reports whether input declares a DOCTYPE that can make an XML
+// parser read local files or make requests (external DTDs and entities,
+// parameter entities) or blow up in memory (nested or excessive entities).
+func DetectXXE(input string) (bool, string) {
+	upper := strings.ToUpper(input)
+	start := strings.Index(upper, "<!DOCTYPE")
+	if start < 0 {
+		return false, ""
+	}
+	doctype := upper[start+len("<!DOCTYPE"):]
+
+	// External DTD: <!DOCTYPE foo SYSTEM "http://evil/x.dtd">
+	header := doctype
+	if i := strings.IndexAny(header, "[>"); i >= 0 {
+		header = header[:i]
+	}
+	if hasXMLWord(header, "SYSTEM") || hasXMLWord(header, "PUBLIC") {
+		return true, "external DTD"
+	}
+
+	entities := 0
+	for {
+		i := strings.Index(doctype, "<!ENTITY")
+		if i < 0 {
+			break
+		}
+		doctype = doctype[i+len("<!ENTITY"):]
+		decl := doctype
+		if end := strings.IndexByte(decl, '>'); end >= 0 {
+			decl = decl[:end]
+		}
+		entities++
+
+		switch {
+		case strings.HasPrefix(strings.TrimLeft(decl, " \t\r\n"), "%"):
+			return true, "parameter entity"
+		case hasXMLWord(decl, "SYSTEM") || hasXMLWord(decl, "PUBLIC"):
+			return true, "external entity"
+		case strings.Contains(strings.ReplaceAll(decl, "&#", ""), "&"): // Character references are fine
+			return true, "nested entity expansion"
+		}
+	}
+	if entities > maxXMLEntities {
+		return true, "too many entities"
+	}
+	return false, ""
+}
+
+// hasXMLWord reports whether word appears in s as a separate token.
+func hasXMLWord(s, word string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == word {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDetectXXE(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"plain document", `<?xml version="1.0"?><order><id>1</id></order>`, false},
+		{"html doctype", `<!DOCTYPE html><html></html>`, false},
+		{"internal entity", `<!DOCTYPE d [<!ENTITY company "ACME &#169; Corp">]><d>&company;</d>`, false},
+		{"external entity", `<!DOCTYPE d [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><d>&xxe;</d>`, true},
+		{"public entity", `<!DOCTYPE d [<!ENTITY xxe PUBLIC "x" "http://evil.example/x">]><d>&xxe;</d>`, true},
+		{"external DTD", `<!DOCTYPE d SYSTEM "http://evil.example/evil.dtd"><d/>`, true},
+		{"parameter entity", `<!DOCTYPE d [<!ENTITY % p "<!ENTITY x 'y'>"> %p;]><d/>`, true},
+		{"billion laughs", `<!DOCTYPE lolz [<!ENTITY lol "lol"><!ENTITY lol2 "&lol;&lol;&lol;">]><lolz>&lol2;</lolz>`, true},
+		{"lowercase keywords", `<!doctype d [<!entity xxe system "file:///etc/passwd">]><d/>`, true},
+	}
+	for _, tt := range tests {
+		if got, reason := DetectXXE(tt.input); got != tt.want {
+			t.Errorf("%s: expected %v, got %v (%s)", tt.name, tt.want, got, reason)
+		}
+	}
+
+	var many strings.Builder
+	many.WriteString("<!DOCTYPE d [")
+	for i := 0; i <= maxXMLEntities; i++ {
+		many.WriteString(`<!ENTITY e` + strings.Repeat("x", i) + ` "v">`)
+	}
+	many.WriteString("]><d/>")
+	if ok, _ := DetectXXE(many.String()); !ok {
+		t.Error("expected too many entities to be flagged")
+	}
+}
+
+func TestInspectXMLBody(t *testing.T) {
+	si := NewSecurityInspector(InspectorOptions{Rules: DefaultRules()})
+	handler := si.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	soap := func(body string) string {
+		return `<?xml version="1.0"?><soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope"><soap:Body>` + body + `</soap:Body></soap:Envelope>`
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"benign SOAP", "application/soap+xml; charset=utf-8", soap(`<Login><user>alice</user><note>--see ticket #42--</note></Login>`), http.StatusOK},
+		{"SQLi in element text", "text/xml", soap(`<Login><user>admin' OR '1'='1</user></Login>`), http.StatusForbidden},
+		{"XSS in attribute", "application/xml", `<profile name="&lt;img src=x onerror=alert(1)&gt;"/>`, http.StatusForbidden},
+		{"XXE", "application/xml", `<?xml version="1.0"?><!DOCTYPE d [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><d>&xxe;</d>`, http.StatusForbidden},
+		{"XXE sent as text/plain", "text/plain", `<!DOCTYPE d SYSTEM "http://evil.example/x.dtd"><d/>`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/soap", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
+
+func TestXMLFields(t *testing.T) {
+	fields, err := xmlFields([]byte(`<a><b type="x">text</b></a>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	for _, f := range fields {
+		if f.target == TargetBody {
+			names[f.name] = f.value
+		}
+	}
+	if names["a/b"] != "text" || names["a/b/@type"] != "x" {
+		t.Errorf("unexpected fields: %v", names)
+	}
+}
@@ -0,0 +1,264 @@
+package middleware
+
+import (
+	"html"
+	"strings"
+)
+
+// XSS detection with a small HTML tokenizer.
+//
+// Regexes like `<script` miss most real payloads: `<img src=x onerror=...>`,
+// `<svg onload=...>`, `<a href="&#106;avascript:...">`. Instead, the input is
+// tokenized the way a browser would read it: tags, their attributes and
+// attribute values (entity-decoded, as the browser does). A tag is flagged if
+// it is dangerous on its own, has an event handler, or points a URI attribute
+// at a scriptable scheme.
+//
+// The tokenizer is deliberately lax: an unterminated tag still counts, since
+// the rest of the page may well close it.
+
+// xssTags can run script or change how the page loads it.
+var xssTags = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "embed": true, "applet": true, "base": true, "meta": true,
+}
+
+// xssURIAttrs are attributes whose value the browser loads or navigates to.
+var xssURIAttrs = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "data": true,
+	"xlink:href": true, "background": true, "poster": true, "lowsrc": true,
+	"dynsrc": true, "codebase": true, "cite": true, "to": true, "from": true, "values": true,
+}
+
+// xssSchemes run script when navigated to.
+var xssSchemes = []string{"javascript:", "vbscript:", "livescript:"}
+
+// safeDataURIs are data: URIs that can't carry script. Only data: URIs with a
+// media type are considered at all, so "data: 5 rows" is just text.
+var safeDataURIs = []string{
+	"data:image/png", "data:image/gif", "data:image/jpeg", "data:image/jpg",
+	"data:image/webp", "data:image/bmp",
+}
+
+// DetectXSS reports whether input contains HTML that would run script, and why.
+func DetectXSS(input string) (bool, string) {
+	if input == "" {
+		return false, ""
+	}
+
+	// A bare URI, e.g. ?next=javascript:alert(1), is dangerous wherever it
+	// ends up in an href.
+	if scheme, ok := dangerousURI(input); ok {
+		return true, scheme + " URI"
+	}
+
+	if reason := htmlDanger(input); reason != "" {
+		return true, reason
+	}
+
+	// &lt;img src=x onerror=...&gt; turns into markup if the backend (or a
+	// template) decodes entities before rendering.
+	if strings.IndexByte(input, '&') >= 0 {
+		if decoded := html.UnescapeString(input); decoded != input {
+			if reason := htmlDanger(decoded); reason != "" {
+				return true, reason + " (entity-encoded)"
+			}
+		}
+	}
+	return false, ""
+}
+
+// htmlDanger returns why the markup in input would run script, or "".
+func htmlDanger(input string) string {
+	if strings.IndexByte(input, '<') < 0 {
+		return ""
+	}
+	for _, tag := range tokenizeHTML(input) {
+		if reason := tag.danger(); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+type htmlAttr struct {
+	name  string // Lower-cased
+	value string // Entity-decoded
+}
+
+type htmlTag struct {
+	name  string // Lower-cased
+	attrs []htmlAttr
+}
+
+// danger explains why the tag would run script, or returns "".
+func (t htmlTag) danger() string {
+	if xssTags[t.name] {
+		return "<" + t.name + "> tag"
+	}
+
+	for _, a := range t.attrs {
+		switch {
+		case len(a.name) > 2 && strings.HasPrefix(a.name, "on"):
+			return "event handler " + a.name + " on <" + t.name + ">"
+
+		case xssURIAttrs[a.name]:
+			if scheme, ok := dangerousURI(a.value); ok {
+				return scheme + " URI in " + a.name + " on <" + t.name + ">"
+			}
+
+		case a.name == "srcdoc":
+			if ok, reason := DetectXSS(a.value); ok {
+				return reason + " in srcdoc"
+			}
+
+		case a.name == "style":
+			css := strings.ToLower(stripURIJunk(a.value))
+			if strings.Contains(css, "expression(") || strings.Contains(css, "javascript:") {
+				return "script in style on <" + t.name + ">"
+			}
+		}
+	}
+	return ""
+}
+
+// dangerousURI reports whether a URI uses a scheme that runs script, and which.
+// Browsers ignore whitespace and control characters inside the scheme, and
+// entity-decode attribute values, so "&#106;ava\tscript:" still counts.
+func dangerousURI(uri string) (string, bool) {
+	u := strings.ToLower(stripURIJunk(html.UnescapeString(uri)))
+
+	for _, s := range xssSchemes {
+		if strings.HasPrefix(u, s) {
+			return s, true
+		}
+	}
+	if mime, ok := strings.CutPrefix(u, "data:"); ok && strings.Contains(strings.SplitN(mime, ",", 2)[0], "/") {
+		for _, safe := range safeDataURIs {
+			if strings.HasPrefix(u, safe) {
+				return "", false
+			}
+		}
+		return "data:", true
+	}
+	return "", false
+}
+
+// stripURIJunk drops the characters a browser skips while reading a URL scheme.
+func stripURIJunk(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// tokenizeHTML returns the start tags found in input.
+func tokenizeHTML(input string) []htmlTag {
+	var tags []htmlTag
+	i := 0
+	for i < len(input) {
+		lt := strings.IndexByte(input[i:], '<')
+		if lt < 0 {
+			break
+		}
+		i += lt + 1
+		if i >= len(input) {
+			break
+		}
+
+		switch c := input[i]; {
+		case strings.HasPrefix(input[i:], "!--"):
+			end := strings.Index(input[i+3:], "-->")
+			if end < 0 {
+				return tags
+			}
+			i += 3 + end + 3
+
+		case c == '/' || c == '!' || c == '?':
+			// End tags, doctypes and processing instructions can't carry script.
+			i++
+
+		case isASCIILetter(c):
+			var tag htmlTag
+			tag, i = scanHTMLTag(input, i)
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// scanHTMLTag reads a start tag beginning at its name and returns it along
+// with the offset just past it.
+func scanHTMLTag(input string, i int) (htmlTag, int) {
+	start := i
+	for i < len(input) && !isHTMLSpace(input[i]) && input[i] != '/' && input[i] != '>' {
+		i++
+	}
+	tag := htmlTag{name: strings.ToLower(input[start:i])}
+
+	for i < len(input) {
+		// Whitespace and stray slashes separate attributes: <svg/onload=...>
+		for i < len(input) && (isHTMLSpace(input[i]) || input[i] == '/') {
+			i++
+		}
+		if i >= len(input) {
+			break
+		}
+		if input[i] == '>' {
+			return tag, i + 1
+		}
+
+		start = i
+		i++ // A name may start with any character, even "="
+		for i < len(input) && !isHTMLSpace(input[i]) && input[i] != '/' && input[i] != '>' && input[i] != '=' {
+			i++
+		}
+		attr := htmlAttr{name: strings.ToLower(input[start:i])}
+
+		j := i
+		for j < len(input) && isHTMLSpace(input[j]) {
+			j++
+		}
+		if j < len(input) && input[j] == '=' {
+			j++
+			for j < len(input) && isHTMLSpace(input[j]) {
+				j++
+			}
+			var raw string
+			raw, i = scanHTMLValue(input, j)
+			attr.value = html.UnescapeString(raw)
+		}
+
+		tag.attrs = append(tag.attrs, attr)
+	}
+	return tag, i
+}
+
+// scanHTMLValue reads a quoted or unquoted attribute value.
+func scanHTMLValue(input string, i int) (string, int) {
+	if i >= len(input) {
+		return "", i
+	}
+	if q := input[i]; q == '"' || q == '\'' || q == '`' {
+		end := strings.IndexByte(input[i+1:], q)
+		if end < 0 {
+			return input[i+1:], len(input)
+		}
+		return input[i+1 : i+1+end], i + 1 + end + 1
+	}
+	start := i
+	for i < len(input) && !isHTMLSpace(input[i]) && input[i] != '>' {
+		i++
+	}
+	return input[start:i], i
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import "testing"
+
+func TestDetectXSS(t *testing.T) {
+	malicious := []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`<svg onmouseover="alert(1)">`,
+		`<svg/onload=alert(1)>`,
+		`<IMG SRC=x OnError=alert(1)>`,
+		`<body onload=alert(1)`, // Unterminated
+		`<a href="javascript:alert(1)">x</a>`,
+		`<a href="&#106;avascript:alert(1)">x</a>`,
+		`<a href="&#x6A;ava&#x73;cript&colon;alert(1)">x</a>`,
+		"<a href=\"java\tscript:alert(1)\">x</a>",
+		`<a href=" JaVaScRiPt:alert(1)">x</a>`,
+		`<iframe src="https://evil.example"></iframe>`,
+		`<object data="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">`,
+		`<embed src="data:image/svg+xml,<svg onload=alert(1)>">`,
+		`<form><button formaction=javascript:alert(1)>x</button></form>`,
+		`<div style="width: expression(alert(1))">`,
+		`<iframe srcdoc="&lt;img src=x onerror=alert(1)&gt;">`,
+		`&lt;img src=x onerror=alert(1)&gt;`,
+		`javascript:alert(document.cookie)`,
+		`data:text/html,<script>alert(1)</script>`,
+		`<math><a xlink:href="javascript:alert(1)">x</a></math>`,
+		`<details open ontoggle=alert(1)>`,
+	}
+	for _, input := range malicious {
+		if ok, _ := DetectXSS(input); !ok {
+			t.Errorf("expected XSS: %q", input)
+		}
+	}
+
+	benign := []string{
+		"",
+		"hello world",
+		"a < b and c > d",
+		"I <3 APIs",
+		"x<y",
+		`<b>bold</b> and <i>italic</i>`,
+		`<a href="https://example.com/page?x=1">link</a>`,
+		`<img src="data:image/png;base64,iVBORw0KGgo=" alt="dot">`,
+		`<p class="note">Call me on 555-0100</p>`,
+		"Tom &amp; Jerry",
+		"data: 5 rows returned",
+		"the online editor",
+		"<!-- comment onload=x -->",
+	}
+	for _, input := range benign {
+		if ok, reason := DetectXSS(input); ok {
+			t.Errorf("false positive (%s): %q", reason, input)
+		}
+	}
+}
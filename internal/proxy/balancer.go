@@ -36,11 +36,14 @@ type LoadBalancer struct {
 	targets []*Target
 	current uint64
 	mu      sync.RWMutex
+	stop    chan struct{}
+	once    sync.Once
 }
 
 func NewLoadBalancer(urls []string) (*LoadBalancer, error) {
 	lb := &LoadBalancer{
 		targets: make([]*Target, 0),
+		stop:    make(chan struct{}),
 	}
 
 	for _, u := range urls {
@@ -74,8 +77,11 @@ func NewLoadBalancer(urls []string) (*LoadBalancer, error) {
 
 func (lb *LoadBalancer) healthCheck() {
 	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-lb.stop:
+			return
 		case <-ticker.C:
 			lb.mu.RLock()
 			for _, t := range lb.targets {
@@ -90,6 +96,12 @@ func (lb *LoadBalancer) healthCheck() {
 	}
 }
 
+// Close stops the background health checker.
+// Targets keep serving with their last known health state.
+func (lb *LoadBalancer) Close() {
+	lb.once.Do(func() { close(lb.stop) })
+}
+
 func isAlive(u *url.URL) bool {
 	timeout := 2 * time.Second
 	conn, err := net.DialTimeout("tcp", u.Host, timeout)
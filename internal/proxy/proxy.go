@@ -30,7 +30,15 @@ func (m *MultiTargetProxy) AddRoute(prefix string, targets []string) error {
 	return nil
 }
 
-func (m *MultiTargetProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Close stops the health checkers of every route's LoadBalancer.
+func (m *MultiTargetProxy) Close() {
+	for _, lb := range m.Routes {
+		lb.Close()
+	}
+}
+
+// Match returns the longest route prefix that matches path.
+func (m *MultiTargetProxy) Match(path string) (string, bool) {
 	// Get prefixes and sort them by length descending
 	prefixes := make([]string, 0, len(m.Routes))
 	for k := range m.Routes {
@@ -41,11 +49,18 @@ func (m *MultiTargetProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	})
 
 	for _, prefix := range prefixes {
-		if strings.HasPrefix(r.URL.Path, prefix) {
-			m.Routes[prefix].ServeHTTP(w, r)
-			return
+		if strings.HasPrefix(path, prefix) {
+			return prefix, true
 		}
 	}
+	return "", false
+}
+
+func (m *MultiTargetProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if prefix, ok := m.Match(r.URL.Path); ok {
+		m.Routes[prefix].ServeHTTP(w, r)
+		return
+	}
 
 	// Default fallback if no route matches (could be handled in main)
 	http.Error(w, "Not Found: No route matches this path", http.StatusNotFound)